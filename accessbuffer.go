@@ -0,0 +1,176 @@
+package probecache
+
+import (
+	"context"
+	"fmt"
+	"runtime/pprof"
+	"sync"
+	"sync/atomic"
+)
+
+// AccessDropPolicy decides what happens to a full batch of recorded Gets
+// when the drain queue has no room for it
+type AccessDropPolicy int
+
+const (
+	// DropNewest discards the batch that didn't fit
+	DropNewest AccessDropPolicy = iota
+	// DropOldest discards the oldest queued batch to make room
+	DropOldest
+	// DropNone waits for the drainer, so Get may block
+	DropNone
+)
+
+func (p AccessDropPolicy) String() string {
+	switch p {
+	case DropNewest:
+		return "newest"
+	case DropOldest:
+		return "oldest"
+	case DropNone:
+		return "none"
+	}
+	return "unknown"
+}
+
+// accessStripe collects key hashes of Gets to one shard. Stripes are taken from
+// a per-shard sync.Pool, so concurrent readers mostly append to different ones
+type accessStripe struct {
+	shard *PolicyShard
+	keys  []uint64
+}
+
+// accessBuffer is the lossy Get access buffer of a storage: full stripes are queued
+// for the drainer, a worker task which applies them to entry worth under shard locks.
+// Stripes dropped by sync.Pool on GC and batches dropped by the policy are lost
+type accessBuffer struct {
+	size     int
+	drop     AccessDropPolicy
+	queue    chan *accessStripe
+	stop     chan struct{}
+	workers  *workerPool
+	draining int32 // a drain task is submitted or running
+	// drainer runs under pprof label probecache=access
+	profile bool
+}
+
+func newAccessBuffer(size int, batches int, drop AccessDropPolicy, workers *workerPool, stop chan struct{}) *accessBuffer {
+	return &accessBuffer{
+		size:    size,
+		drop:    drop,
+		queue:   make(chan *accessStripe, batches),
+		stop:    stop,
+		workers: workers,
+	}
+}
+
+func newStripePool(s *PolicyShard, size int) *sync.Pool {
+	return &sync.Pool{New: func() interface{} {
+		return &accessStripe{shard: s, keys: make([]uint64, 0, size)}
+	}}
+}
+
+// record is called out of the shard lock, DropNone push waits for the drainer,
+// which takes the lock
+func (b *accessBuffer) record(s *PolicyShard, key uint64) {
+	st := s.stripes.Get().(*accessStripe)
+	st.keys = append(st.keys, key)
+	if len(st.keys) < b.size {
+		s.stripes.Put(st)
+		return
+	}
+	b.push(st)
+}
+
+func (b *accessBuffer) push(st *accessStripe) {
+	defer b.schedule()
+	switch b.drop {
+	case DropNone:
+		select {
+		case b.queue <- st:
+			return
+		default:
+		}
+		// the queue is full, so a drainer is due and frees room
+		b.schedule()
+		select {
+		case b.queue <- st:
+		case <-b.stop:
+			b.recycle(st)
+		}
+		return
+	case DropOldest:
+		for {
+			select {
+			case b.queue <- st:
+				return
+			default:
+			}
+			select {
+			case old := <-b.queue:
+				b.recycle(old)
+			default:
+			}
+		}
+	}
+	select {
+	case b.queue <- st:
+	default:
+		b.recycle(st)
+	}
+}
+
+func (b *accessBuffer) recycle(st *accessStripe) {
+	st.keys = st.keys[:0]
+	st.shard.stripes.Put(st)
+}
+
+// schedule submits a drainer unless one is pending already
+func (b *accessBuffer) schedule() {
+	if len(b.queue) == 0 || !atomic.CompareAndSwapInt32(&b.draining, 0, 1) {
+		return
+	}
+	if !b.workers.submit(priorityHigh, b.run) {
+		atomic.StoreInt32(&b.draining, 0)
+	}
+}
+
+// run drains queued batches until the queue is empty or stop is closed
+func (b *accessBuffer) run(ctx context.Context) {
+	if b.profile {
+		pprof.Do(ctx, pprof.Labels("probecache", "access"), b.drainQueue)
+		return
+	}
+	b.drainQueue(ctx)
+}
+
+func (b *accessBuffer) drainQueue(context.Context) {
+	for {
+		select {
+		case <-b.stop:
+			return
+		case st := <-b.queue:
+			st.shard.drain(st.keys)
+			b.recycle(st)
+			continue
+		default:
+		}
+		atomic.StoreInt32(&b.draining, 0)
+		// a batch pushed before the store found draining set and left it to us
+		if len(b.queue) == 0 || !atomic.CompareAndSwapInt32(&b.draining, 0, 1) {
+			return
+		}
+	}
+}
+
+func (c Config) validateAccessBuffer() error {
+	if c.AccessBufferSize < 0 || c.AccessBufferBatches < 0 {
+		return fmt.Errorf("%w: negative access buffer parameters", ErrInvalidConfig)
+	}
+	switch c.AccessDropPolicy {
+	case DropNewest, DropOldest, DropNone:
+	default:
+		return fmt.Errorf("%w: unknown AccessDropPolicy %d", ErrInvalidConfig, c.AccessDropPolicy)
+	}
+	return nil
+}
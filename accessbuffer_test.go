@@ -0,0 +1,47 @@
+package probecache
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAccessBuffer(t *testing.T) {
+	s, _ := NewLFUStorage(WithShards(1), WithAccessBuffer(10, 4, DropNone))
+	defer s.Close()
+	shard := s.shards[0]
+	worth := func() float64 {
+		shard.Lock()
+		defer shard.Unlock()
+		e := shard.data[s.KeyHash("a")]
+		shard.fold(e)
+		return e.worth
+	}
+	s.Set("a", []byte("1"), 0)
+	// a stripe reaches worth only once full
+	for i := 0; i < 9; i++ {
+		s.Get("a")
+	}
+	if w := worth(); w != 0 {
+		t.Fatalf("worth %f before the stripe is full", w)
+	}
+	for i := 0; i < 9991; i++ {
+		s.Get("a")
+	}
+	// stripes dropped by sync.Pool are lost, the race detector drops them on purpose
+	for i := 0; worth() < 500; i++ {
+		if i == 1000 {
+			t.Fatalf("worth %f after 10000 buffered Gets", worth())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if w := worth(); w > 10000 || s.Stats().Hits != 10000 {
+		t.Fatalf("worth %f, %d hits", w, s.Stats().Hits)
+	}
+
+	for _, opt := range []Option{WithAccessBuffer(-1, 0, DropNone), WithAccessBuffer(10, 0, AccessDropPolicy(7))} {
+		if _, err := NewLFUStorage(opt); !errors.Is(err, ErrInvalidConfig) {
+			t.Fatalf("invalid access buffer accepted: %v", err)
+		}
+	}
+}
@@ -0,0 +1,369 @@
+package probecache
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io/fs"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// log record ops
+const (
+	logSet byte = iota + 1
+	logDel
+	logClear
+)
+
+// SnapshotStorage is a storage AppendLog can compact into snapshots
+type SnapshotStorage interface {
+	IStorage
+	Snapshotter
+}
+
+// AppendLog is a storage writing Set, Del and Clear to an append-only log, so a crashed
+// process is rebuilt up to the last logged operation rather than the last snapshot. Other
+// writes, e.g. SetWithDuration or Incr of the wrapped storage, are not logged.
+//
+// Files: path is the log, path.snap the snapshot it's compacted into and path.old the
+// log being compacted. Records are checksummed, a torn tail is dropped on open
+type AppendLog struct {
+	SnapshotStorage
+	path        string
+	compactSize int64
+	stripes     [64]sync.Mutex // apply and append of a key go in the same order
+	hash        keyHasher
+
+	mu    sync.Mutex // file
+	f     *os.File
+	flags int // of log files, O_SYNC if every write is synced
+	size  int64
+	buf   []byte
+	err   error // first write error, the log is unusable after it
+
+	compactMu      sync.Mutex
+	compactTimeout time.Duration // of background compactions, in compactMu
+	workers        *workerPool
+	janitor        *janitor // syncs and compacts
+	closed         int32
+}
+
+// OpenAppendLog loads s from path.snap and the logs at path, then logs its writes there.
+// The log is synced every syncPeriod (0 means every write) and compacted into the snapshot
+// in background once it grows past compactSize bytes (0 means 64mb). TTL 0 is logged as is,
+// so replayed entries get a fresh DefaultTTL
+func OpenAppendLog(s SnapshotStorage, path string, syncPeriod time.Duration, compactSize int64) (*AppendLog, error) {
+	if compactSize <= 0 {
+		compactSize = 64 << 20
+	}
+	l := &AppendLog{
+		SnapshotStorage: s,
+		path:            path,
+		compactSize:     compactSize,
+		hash:            newKeyHasher(HashFNV, nil),
+		flags:           os.O_CREATE | os.O_WRONLY,
+		compactTimeout:  time.Minute,
+	}
+	if syncPeriod <= 0 {
+		l.flags |= os.O_SYNC
+	}
+	if err := LoadFromFile(s, path+".snap"); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if _, err := l.replay(path + ".old"); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	n, err := l.replay(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, l.flags, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	// appends go after the last whole record
+	if err := f.Truncate(n); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(n, 0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	l.f, l.size = f, n
+	if _, err := os.Stat(path + ".old"); err == nil {
+		// a compaction was interrupted
+		if err := l.Compact(); err != nil {
+			l.f.Close()
+			return nil, err
+		}
+	}
+	l.run(syncPeriod)
+	return l, nil
+}
+
+// replay applies records of the log at path, returns length of its whole records
+func (l *AppendLog) replay(path string) (int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	off := 0
+	for off < len(data) {
+		n, k := binary.Uvarint(data[off:])
+		if k <= 0 || uint64(len(data)-off-k) < n+4 {
+			break
+		}
+		rec := data[off+k : off+k+int(n)]
+		if crc32.ChecksumIEEE(rec) != binary.LittleEndian.Uint32(data[off+k+int(n):]) {
+			break
+		}
+		if !l.apply(rec) {
+			break
+		}
+		off += k + int(n) + 4
+	}
+	return int64(off), nil
+}
+
+// apply replays a record, false if it's malformed
+func (l *AppendLog) apply(rec []byte) bool {
+	s := l.SnapshotStorage
+	if len(rec) == 0 {
+		return false
+	}
+	if rec[0] == logClear {
+		s.Clear()
+		return true
+	}
+	key, rest, ok := logBytes(rec[1:])
+	if !ok {
+		return false
+	}
+	if rec[0] == logDel {
+		s.Del(string(key))
+		return true
+	}
+	expire, k := binary.Uvarint(rest)
+	if k <= 0 || rec[0] != logSet {
+		return false
+	}
+	data, _, ok := logBytes(rest[k:])
+	if !ok {
+		return false
+	}
+	ttl := uint64(0)
+	if expire != noExpire {
+		now := nowMs()
+		if expire <= now {
+			s.Del(string(key))
+			return true
+		}
+		ttl = ttlToSeconds(expire - now)
+	}
+	// data points into the whole file read, a storage taking ownership would keep it alive
+	s.Set(string(key), append([]byte(nil), data...), ttl)
+	return true
+}
+
+func logBytes(b []byte) ([]byte, []byte, bool) {
+	n, k := binary.Uvarint(b)
+	if k <= 0 || uint64(len(b)-k) < n {
+		return nil, nil, false
+	}
+	return b[k : k+int(n)], b[k+int(n):], true
+}
+
+// run syncs the log every syncPeriod and compacts it once over compactSize in a worker task
+func (l *AppendLog) run(syncPeriod time.Duration) {
+	period := syncPeriod
+	if period <= 0 {
+		period = time.Second
+	}
+	l.workers = newWorkerPool(0)
+	l.janitor = startJanitor(l.workers, period, priorityNormal, func(ctx context.Context) {
+		l.mu.Lock()
+		if syncPeriod > 0 && l.err == nil {
+			l.err = l.f.Sync()
+		}
+		over := l.size > l.compactSize
+		l.mu.Unlock()
+		if over {
+			l.compactMu.Lock()
+			ctx, cancel := withTimeout(ctx, l.compactTimeout)
+			l.compact(ctx)
+			cancel()
+			l.compactMu.Unlock()
+		}
+	})
+}
+
+func (l *AppendLog) stripe(key string) *sync.Mutex {
+	return &l.stripes[l.hash.sum(key)%uint64(len(l.stripes))]
+}
+
+// append writes a record, op is followed by length prefixed key, expire and data for Set
+func (l *AppendLog) append(op byte, key string, expire uint64, data []byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err != nil {
+		return l.err
+	}
+	rec := []byte{op}
+	if op != logClear {
+		rec = binary.AppendUvarint(rec, uint64(len(key)))
+		rec = append(rec, key...)
+	}
+	if op == logSet {
+		rec = binary.AppendUvarint(rec, expire)
+		rec = binary.AppendUvarint(rec, uint64(len(data)))
+		rec = append(rec, data...)
+	}
+	l.buf = binary.AppendUvarint(l.buf[:0], uint64(len(rec)))
+	l.buf = append(l.buf, rec...)
+	l.buf = binary.LittleEndian.AppendUint32(l.buf, crc32.ChecksumIEEE(rec))
+	n, err := l.f.Write(l.buf)
+	l.size += int64(n)
+	l.err = err
+	return err
+}
+
+// logged fails writes once the log is broken, the storage then stays as logged
+func (l *AppendLog) logged() error {
+	if atomic.LoadInt32(&l.closed) == 1 {
+		return ErrClosed
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err
+}
+
+func (l *AppendLog) Set(key string, data []byte, ttl uint64) error {
+	if err := l.logged(); err != nil {
+		return err
+	}
+	mu := l.stripe(key)
+	mu.Lock()
+	defer mu.Unlock()
+	if err := l.SnapshotStorage.Set(key, data, ttl); err != nil {
+		return err
+	}
+	expire := uint64(noExpire)
+	if ttl > 0 {
+		expire = expireAt(secondsToTTL(ttl))
+	}
+	return l.append(logSet, key, expire, data)
+}
+
+func (l *AppendLog) Del(key string) error {
+	if err := l.logged(); err != nil {
+		return err
+	}
+	mu := l.stripe(key)
+	mu.Lock()
+	defer mu.Unlock()
+	if err := l.SnapshotStorage.Del(key); err != nil {
+		return err
+	}
+	return l.append(logDel, key, 0, nil)
+}
+
+func (l *AppendLog) Clear() {
+	if l.logged() != nil {
+		return
+	}
+	for i := range l.stripes {
+		l.stripes[i].Lock()
+	}
+	defer func() {
+		for i := range l.stripes {
+			l.stripes[i].Unlock()
+		}
+	}()
+	l.SnapshotStorage.Clear()
+	l.append(logClear, "", 0, nil)
+}
+
+// Compact snapshots the storage into path.snap and drops the log written before. Writes
+// go on meanwhile to a fresh log, which is replayed over the snapshot on open
+func (l *AppendLog) Compact() error {
+	return l.CompactContext(context.Background())
+}
+
+// CompactContext is Compact which gives up with ctx.Err() once ctx is done,
+// the log written before stays at path.old for the next compaction
+func (l *AppendLog) CompactContext(ctx context.Context) error {
+	l.compactMu.Lock()
+	defer l.compactMu.Unlock()
+	return l.compact(ctx)
+}
+
+// SetCompactTimeout bounds background compactions, 1 minute by default, 0 means no limit.
+// They are cancelled by Close either way
+func (l *AppendLog) SetCompactTimeout(d time.Duration) {
+	l.compactMu.Lock()
+	l.compactTimeout = d
+	l.compactMu.Unlock()
+}
+
+// Run in compactMu only
+func (l *AppendLog) compact(ctx context.Context) error {
+	old := l.path + ".old"
+	// path.old left by a failed compaction is not covered by a snapshot yet, keep it
+	if _, err := os.Stat(old); errors.Is(err, fs.ErrNotExist) {
+		if err := l.rotate(old); err != nil {
+			return err
+		}
+	}
+	if err := SaveToFileContext(ctx, l.SnapshotStorage, l.path+".snap"); err != nil {
+		return err
+	}
+	return os.Remove(old)
+}
+
+// rotate renames the log to old and starts a new one
+func (l *AppendLog) rotate(old string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err != nil {
+		return l.err
+	}
+	if err := l.f.Sync(); err != nil {
+		return err
+	}
+	if err := os.Rename(l.path, old); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(l.path, l.flags|os.O_TRUNC, 0o644)
+	if err != nil {
+		l.err = err
+		return err
+	}
+	l.f.Close()
+	l.f, l.size = f, 0
+	return nil
+}
+
+// Close syncs and closes the log, then the storage
+func (l *AppendLog) Close() {
+	if !atomic.CompareAndSwapInt32(&l.closed, 0, 1) {
+		return
+	}
+	// cancels a compaction in progress
+	l.workers.close()
+	l.janitor.stop()
+	l.compactMu.Lock()
+	l.mu.Lock()
+	l.f.Sync()
+	l.f.Close()
+	if l.err == nil {
+		l.err = ErrClosed
+	}
+	l.mu.Unlock()
+	l.compactMu.Unlock()
+	l.SnapshotStorage.Close()
+}
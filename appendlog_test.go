@@ -0,0 +1,92 @@
+package probecache
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestAppendLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.aof")
+	open := func() *AppendLog {
+		s, _ := NewLRUStorage(WithShards(2))
+		l, err := OpenAppendLog(s, path, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l
+	}
+	l := open()
+	for i := 0; i < 10; i++ {
+		l.Set(strconv.Itoa(i), []byte("v"+strconv.Itoa(i)), 0)
+	}
+	l.Del("3")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// the log stays at path.old for the next compaction
+	if err := l.CompactContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled compaction: %v", err)
+	}
+	l.Set("4", []byte("new"), 60)
+	if err := l.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	l.Set("10", []byte("after"), 0)
+	l.Del("5")
+	l.Close()
+
+	// a record torn by a crash
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	f.Write([]byte{20, 1, 2, 3})
+	f.Close()
+
+	l = open()
+	l.Set("11", []byte("x"), 0)
+	l.Close()
+	l = open()
+	defer l.Close()
+	if l.Len() != 10 {
+		t.Fatalf("len %d", l.Len())
+	}
+	for key, want := range map[string]string{"0": "v0", "4": "new", "10": "after", "11": "x"} {
+		if data, err := l.Get(key); string(data) != want {
+			t.Errorf("%s = %q, %v", key, data, err)
+		}
+	}
+	for _, key := range []string{"3", "5"} {
+		if _, err := l.Get(key); err == nil {
+			t.Errorf("deleted %s restored", key)
+		}
+	}
+	if _, ttl, _ := l.GetWithTTL("4"); ttl == 0 || ttl > 60 {
+		t.Errorf("ttl of 4: %d", ttl)
+	}
+}
+
+func TestAppendLogReplayCopies(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.aof")
+	open := func() *AppendLog {
+		s, _ := NewLRUStorage(WithShards(1), WithZeroCopy())
+		l, err := OpenAppendLog(s, path, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l
+	}
+	l := open()
+	for i := 0; i < 100; i++ {
+		l.Set(strconv.Itoa(i), []byte("v"), 0)
+	}
+	l.Close()
+	l = open()
+	defer l.Close()
+	s := l.SnapshotStorage.(*LRUStorage)
+	e := s.shards[0].data[s.KeyHash("0")]
+	// a value sharing the file buffer has its capacity up to the file end
+	if e == nil || string(e.data) != "v" || cap(e.data) > 8 {
+		t.Fatalf("got %+v", e)
+	}
+}
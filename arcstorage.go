@@ -0,0 +1,267 @@
+package probecache
+
+import (
+	"container/list"
+	"sync"
+)
+
+// ARC (Adaptive Replacement Cache): resident lists T1 (seen once) and T2 (seen
+// at least twice), ghost lists B1/B2 remember keys recently evicted from them.
+// A hit in B1 grows target size p of T1, a hit in B2 shrinks it, so the shard
+// adapts between recency and frequency. Sizes are counted in bytes when
+// MaxMemSize is set, in entries otherwise.
+
+type arcEntry struct {
+	key    uint64
+	data   []byte // nil for ghosts
+	expire uint64
+	cost   int
+	list   *list.List
+}
+
+type ARCShard struct {
+	sync.Mutex
+	listBase
+	items          map[uint64]*list.Element
+	t1, t2, b1, b2 *list.List
+	t1Size, t2Size int
+	b1Size, b2Size int
+	p              int
+}
+
+func NewARCShard(capacity int, byBytes bool) *ARCShard {
+	s := &ARCShard{}
+	s.init(s, capacity, byBytes)
+	s.reset()
+	return s
+}
+
+func (s *ARCShard) reset() {
+	s.items = make(map[uint64]*list.Element)
+	s.t1, s.t2, s.b1, s.b2 = list.New(), list.New(), list.New(), list.New()
+	s.t1Size, s.t2Size, s.b1Size, s.b2Size = 0, 0, 0, 0
+	s.p = 0
+	s.size = 0
+}
+
+func (s *ARCShard) listSize(l *list.List) *int {
+	switch l {
+	case s.t1:
+		return &s.t1Size
+	case s.t2:
+		return &s.t2Size
+	case s.b1:
+		return &s.b1Size
+	}
+	return &s.b2Size
+}
+
+func (s *ARCShard) resident(e *arcEntry) bool {
+	return e.list == s.t1 || e.list == s.t2
+}
+
+// Run in lock only
+func (s *ARCShard) push(l *list.List, e *arcEntry) {
+	e.list = l
+	*s.listSize(l) += e.cost
+	if s.resident(e) {
+		s.size += len(e.data) + entryOverhead
+	}
+	s.items[e.key] = l.PushFront(e)
+}
+
+// Run in lock only
+func (s *ARCShard) unlink(el *list.Element) *arcEntry {
+	e := el.Value.(*arcEntry)
+	e.list.Remove(el)
+	*s.listSize(e.list) -= e.cost
+	if s.resident(e) {
+		s.size -= len(e.data) + entryOverhead
+	}
+	delete(s.items, e.key)
+	return e
+}
+
+// Run in lock only. Moves LRU entry of T1 or T2 to its ghost list
+func (s *ARCShard) replace(inB2 bool) {
+	from, ghost := s.t2, s.b2
+	if s.t1.Len() > 0 && (s.t1Size > s.p || (inB2 && s.t1Size == s.p) || s.t2.Len() == 0) {
+		from, ghost = s.t1, s.b1
+	}
+	e := s.unlink(from.Back())
+	s.evicted(e.key, e.data, e.expire)
+	e.data = nil
+	s.push(ghost, e)
+}
+
+// Run in lock only. Frees room for an entry of given cost
+func (s *ARCShard) fit(cost int, inB2 bool) {
+	for s.t1.Len()+s.t2.Len() > 0 {
+		overSize := s.capacity > 0 && s.t1Size+s.t2Size+cost > s.capacity
+		overLen := s.maxLen > 0 && s.t1.Len()+s.t2.Len() >= s.maxLen
+		if !overSize && !overLen {
+			return
+		}
+		s.replace(inB2)
+	}
+}
+
+// Run in lock only. Keeps T1+B1 within capacity and all lists within 2*capacity
+func (s *ARCShard) trimGhosts(cost int) {
+	if s.capacity == 0 {
+		return
+	}
+	for s.b1.Len() > 0 && s.t1Size+s.b1Size+cost > s.capacity {
+		s.unlink(s.b1.Back())
+	}
+	for s.b2.Len() > 0 && s.t1Size+s.t2Size+s.b1Size+s.b2Size+cost > 2*s.capacity {
+		s.unlink(s.b2.Back())
+	}
+}
+
+func (s *ARCShard) Set(key uint64, data []byte, ttl uint64) {
+	if s.copyOnSet {
+		data = append([]byte(nil), data...)
+	}
+	s.Lock()
+	defer s.Unlock()
+	e := &arcEntry{key: key, data: data, expire: expireAt(ttl), cost: s.cost(data)}
+	el, ok := s.items[key]
+	s.written(key, len(data))
+	if !ok {
+		s.trimGhosts(e.cost)
+		s.fit(e.cost, false)
+		s.push(s.t1, e)
+		return
+	}
+	old := s.unlink(el)
+	if s.resident(old) {
+		s.removed(key, old.data, EvictReplaced)
+	}
+	inB2 := false
+	switch old.list {
+	case s.b1:
+		s.p += e.cost * maxInt(s.b2Size/maxInt(s.b1Size, 1), 1)
+		if s.capacity > 0 && s.p > s.capacity {
+			s.p = s.capacity
+		}
+	case s.b2:
+		inB2 = true
+		s.p -= e.cost * maxInt(s.b1Size/maxInt(s.b2Size, 1), 1)
+		if s.p < 0 {
+			s.p = 0
+		}
+	}
+	s.fit(e.cost, inB2)
+	s.push(s.t2, e)
+}
+
+func (s *ARCShard) put(key uint64, data []byte, ttl uint64) error {
+	if s.tooLarge(data) {
+		return ErrTooLarge
+	}
+	s.Set(key, data, ttl)
+	return nil
+}
+
+func (s *ARCShard) get(key uint64) ([]byte, uint64, error) {
+	s.Lock()
+	defer s.Unlock()
+	el, ok := s.items[key]
+	if !ok || !s.resident(el.Value.(*arcEntry)) {
+		s.miss()
+		return nil, 0, ErrMissing
+	}
+	if s.isExpired(el.Value.(*arcEntry).expire) {
+		if !s.keepExpired {
+			s.expire(key)
+		}
+		s.miss()
+		return nil, 0, ErrExpired
+	}
+	e := s.unlink(el)
+	s.push(s.t2, e)
+	s.hit()
+	return e.data, ttlLeft(e.expire), nil
+}
+
+func (s *ARCShard) Get(key uint64) ([]byte, error) {
+	d, _, err := s.get(key)
+	return d, err
+}
+
+func (s *ARCShard) GetWithTTL(key uint64) ([]byte, uint64, error) {
+	return s.get(key)
+}
+
+// Del removes resident entry or ghost, reports whether a live entry was removed
+func (s *ARCShard) Del(key uint64) bool {
+	s.Lock()
+	defer s.Unlock()
+	el, ok := s.items[key]
+	if !ok {
+		return false
+	}
+	e := s.unlink(el)
+	if !s.resident(e) {
+		return false
+	}
+	s.removed(key, e.data, EvictDeleted)
+	return !s.isExpired(e.expire)
+}
+
+func (s *ARCShard) Clear() {
+	s.Lock()
+	defer s.Unlock()
+	s.reset()
+}
+
+// each skips ghosts
+func (s *ARCShard) each(fn func(key uint64, expire uint64, data []byte)) {
+	for _, el := range s.items {
+		if e := el.Value.(*arcEntry); s.resident(e) {
+			fn(e.key, e.expire, e.data)
+		}
+	}
+}
+
+// Run in lock only
+func (s *ARCShard) expire(key uint64) {
+	e := s.unlink(s.items[key])
+	s.expired(e.key, e.data)
+}
+
+func (s *ARCShard) count() int {
+	return s.t1.Len() + s.t2.Len()
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// ----------------------------------------------
+
+// ARCStorage supports the IStorage subset of Config: NumShards, MaxMemSize,
+// MaxEntries, MaxEntrySize, DefaultTTL, CopyOnGet/CopyOnSet, OnEvict, OnExpire, OnRemove, EventBuffer,
+// ExpirationMode, CleanPeriod
+type ARCStorage struct {
+	listStorage[*ARCShard]
+}
+
+func NewARCStorage(opts ...Option) (*ARCStorage, error) {
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	capacity, byBytes, _ := listLimits(cfg)
+	shards := make([]*ARCShard, cfg.NumShards)
+	for i := range shards {
+		shards[i] = NewARCShard(capacity, byBytes)
+	}
+	s := &ARCStorage{}
+	s.init(cfg, newKeyHasher(cfg.KeyHash, cfg.Hasher), shards)
+	return s, nil
+}
@@ -0,0 +1,225 @@
+package probecache
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// CLOCK (second chance): entries sit in a ring of slots with a reference bit.
+// Get only sets the bit, so it takes a read lock. On eviction the hand sweeps
+// the ring, clearing set bits and evicting the first entry found without one.
+
+type clockSlot struct {
+	key    uint64
+	data   []byte
+	expire uint64
+	ref    uint32
+	used   bool
+}
+
+type ClockShard struct {
+	sync.RWMutex
+	listBase
+	items map[uint64]int
+	slots []clockSlot
+	free  []int
+	hand  int
+	used  int
+}
+
+func NewClockShard(capacity int, byBytes bool) *ClockShard {
+	s := &ClockShard{}
+	s.init(s, capacity, byBytes)
+	s.reset()
+	return s
+}
+
+func (s *ClockShard) reset() {
+	s.items = make(map[uint64]int)
+	s.slots = nil
+	s.free = nil
+	s.hand = 0
+	s.used = 0
+	s.size = 0
+}
+
+// overLimit reports whether one more entry of given cost doesn't fit
+func (s *ClockShard) overLimit(cost int) bool {
+	if s.capacity > 0 && s.used+cost > s.capacity {
+		return true
+	}
+	return s.maxLen > 0 && len(s.items)+1 > s.maxLen
+}
+
+// Run in lock only
+func (s *ClockShard) remove(i int) {
+	slot := &s.slots[i]
+	s.used -= s.cost(slot.data)
+	s.size -= len(slot.data) + entryOverhead
+	delete(s.items, slot.key)
+	*slot = clockSlot{}
+	s.free = append(s.free, i)
+}
+
+// Run in lock only
+func (s *ClockShard) evictOne() {
+	for len(s.items) > 0 {
+		i := s.hand
+		s.hand++
+		if s.hand >= len(s.slots) {
+			s.hand = 0
+		}
+		slot := &s.slots[i]
+		if !slot.used {
+			continue
+		}
+		if !s.isExpired(slot.expire) && atomic.LoadUint32(&slot.ref) == 1 {
+			atomic.StoreUint32(&slot.ref, 0)
+			continue
+		}
+		s.evicted(slot.key, slot.data, slot.expire)
+		s.remove(i)
+		return
+	}
+}
+
+func (s *ClockShard) Set(key uint64, data []byte, ttl uint64) {
+	if s.copyOnSet {
+		data = append([]byte(nil), data...)
+	}
+	s.Lock()
+	defer s.Unlock()
+	if i, ok := s.items[key]; ok {
+		s.removed(key, s.slots[i].data, EvictReplaced)
+		s.remove(i)
+	}
+	cost := s.cost(data)
+	for len(s.items) > 0 && s.overLimit(cost) {
+		s.evictOne()
+	}
+	var i int
+	if n := len(s.free); n > 0 {
+		i = s.free[n-1]
+		s.free = s.free[:n-1]
+	} else {
+		i = len(s.slots)
+		s.slots = append(s.slots, clockSlot{})
+	}
+	// new entries start without reference bit, so they go first unless reused
+	s.slots[i] = clockSlot{key: key, data: data, expire: expireAt(ttl), used: true}
+	s.items[key] = i
+	s.used += cost
+	s.size += len(data) + entryOverhead
+	s.written(key, len(data))
+}
+
+func (s *ClockShard) put(key uint64, data []byte, ttl uint64) error {
+	if s.tooLarge(data) {
+		return ErrTooLarge
+	}
+	s.Set(key, data, ttl)
+	return nil
+}
+
+func (s *ClockShard) get(key uint64) ([]byte, uint64, error) {
+	s.RLock()
+	i, ok := s.items[key]
+	if !ok {
+		s.RUnlock()
+		s.miss()
+		return nil, 0, ErrMissing
+	}
+	slot := &s.slots[i]
+	if !s.isExpired(slot.expire) {
+		atomic.StoreUint32(&slot.ref, 1)
+		data, expire := slot.data, slot.expire
+		s.RUnlock()
+		s.hit()
+		return data, ttlLeft(expire), nil
+	}
+	s.RUnlock()
+
+	s.miss()
+	if s.keepExpired {
+		return nil, 0, ErrExpired
+	}
+	s.Lock()
+	defer s.Unlock()
+	// may have been replaced while unlocked
+	if i, ok := s.items[key]; ok && s.isExpired(s.slots[i].expire) {
+		s.expire(key)
+	}
+	return nil, 0, ErrExpired
+}
+
+func (s *ClockShard) Get(key uint64) ([]byte, error) {
+	d, _, err := s.get(key)
+	return d, err
+}
+
+func (s *ClockShard) GetWithTTL(key uint64) ([]byte, uint64, error) {
+	return s.get(key)
+}
+
+// Del removes entry, reports whether a live entry was removed
+func (s *ClockShard) Del(key uint64) bool {
+	s.Lock()
+	defer s.Unlock()
+	i, ok := s.items[key]
+	if !ok {
+		return false
+	}
+	expired := s.isExpired(s.slots[i].expire)
+	s.removed(key, s.slots[i].data, EvictDeleted)
+	s.remove(i)
+	return !expired
+}
+
+func (s *ClockShard) Clear() {
+	s.Lock()
+	defer s.Unlock()
+	s.reset()
+}
+
+func (s *ClockShard) each(fn func(key uint64, expire uint64, data []byte)) {
+	for _, i := range s.items {
+		e := &s.slots[i]
+		fn(e.key, e.expire, e.data)
+	}
+}
+
+// Run in lock only
+func (s *ClockShard) expire(key uint64) {
+	i := s.items[key]
+	data := s.slots[i].data
+	s.remove(i)
+	s.expired(key, data)
+}
+
+func (s *ClockShard) count() int {
+	return len(s.items)
+}
+
+// ----------------------------------------------
+
+// ClockStorage supports the IStorage subset of Config: NumShards, MaxMemSize,
+// MaxEntries, MaxEntrySize, DefaultTTL, CopyOnGet/CopyOnSet, OnEvict, OnExpire, OnRemove, EventBuffer,
+// ExpirationMode, CleanPeriod
+type ClockStorage struct {
+	listStorage[*ClockShard]
+}
+
+func NewClockStorage(opts ...Option) (*ClockStorage, error) {
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	capacity, byBytes, _ := listLimits(cfg)
+	shards := make([]*ClockShard, cfg.NumShards)
+	for i := range shards {
+		shards[i] = NewClockShard(capacity, byBytes)
+	}
+	s := &ClockStorage{}
+	s.init(cfg, newKeyHasher(cfg.KeyHash, cfg.Hasher), shards)
+	return s, nil
+}
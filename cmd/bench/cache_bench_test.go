@@ -359,6 +359,60 @@ func BenchmarkProbeTTLGetParallel(b *testing.B) {
 	})
 }
 
+// ------------------------------------------------------------------------------------------------
+
+const hitRateEntries = 10000
+
+// BenchmarkHitRate replays the same zipfian key stream against every eviction policy
+// with equal entry budget, misses are filled with Set. RandomStorage is the baseline
+func BenchmarkHitRate(b *testing.B) {
+	noMem := probecache.WithMaxBytes(1 << 30)
+	limit := probecache.WithMaxEntries(hitRateEntries)
+	storages := []struct {
+		name string
+		init func() (probecache.IStorage, error)
+	}{
+		{"Random", func() (probecache.IStorage, error) { return probecache.NewRandomStorage(limit) }},
+		{"FIFO", func() (probecache.IStorage, error) { return probecache.NewFIFOStorage(limit) }},
+		{"Ring", func() (probecache.IStorage, error) { return probecache.NewRingStorage(limit, noMem) }},
+		{"OffHeap", func() (probecache.IStorage, error) { return probecache.NewOffHeapStorage(limit, noMem) }},
+		{"S3FIFO", func() (probecache.IStorage, error) { return probecache.NewS3FIFOStorage(limit) }},
+		{"LRU", func() (probecache.IStorage, error) { return probecache.NewLRUStorage(limit, noMem) }},
+		{"ExactLRU", func() (probecache.IStorage, error) { return probecache.NewExactLRUStorage(limit) }},
+		{"LFU", func() (probecache.IStorage, error) { return probecache.NewLFUStorage(limit, noMem) }},
+		{"ExactLFU", func() (probecache.IStorage, error) { return probecache.NewExactLFUStorage(limit) }},
+		{"Clock", func() (probecache.IStorage, error) { return probecache.NewClockStorage(limit) }},
+		{"SLRU", func() (probecache.IStorage, error) { return probecache.NewSLRUStorage(limit) }},
+		{"GDSF", func() (probecache.IStorage, error) { return probecache.NewGDSFStorage(limit) }},
+		{"LRFU", func() (probecache.IStorage, error) {
+			return probecache.NewLRFUStorage(limit, probecache.WithLRFULambda(0.0001))
+		}},
+		{"2Q", func() (probecache.IStorage, error) { return probecache.NewTwoQStorage(limit) }},
+		{"ARC", func() (probecache.IStorage, error) { return probecache.NewARCStorage(limit) }},
+		{"LIRS", func() (probecache.IStorage, error) { return probecache.NewLIRSStorage(limit) }},
+		{"WTinyLFU", func() (probecache.IStorage, error) { return probecache.NewWTinyLFUStorage(limit) }},
+	}
+	for _, st := range storages {
+		b.Run(st.name, func(b *testing.B) {
+			cache, err := st.init()
+			if err != nil {
+				b.Fatal(err)
+			}
+			zipf := rand.NewZipf(rand.New(rand.NewSource(1)), 1.1, 1, 100*hitRateEntries)
+			hits := 0
+			for i := 0; i < b.N; i++ {
+				k := key(int(zipf.Uint64()))
+				if _, err := cache.Get(k); err == nil {
+					hits++
+				} else {
+					cache.Set(k, value(), 120)
+				}
+			}
+			b.ReportMetric(100*float64(hits)/float64(b.N), "hit%")
+		})
+	}
+}
+
 func key(i int) string {
 	return fmt.Sprintf("key-%010d", i)
 }
@@ -386,18 +440,31 @@ func initBigCache(entriesInWindow int) *bigcache.BigCache {
 func initProbeLru(maxEntries int) *probecache.LRUStorage {
 	mem := maxEntries * maxEntrySize
 	crit := int(float64(mem) * 1.2)
-	cache, _ := probecache.NewLRUStorage(numShards, mem, crit, 7)
+	cache, _ := probecache.NewLRUStorage(
+		probecache.WithShards(numShards),
+		probecache.WithMaxBytes(mem),
+		probecache.WithCritBytes(crit),
+		probecache.WithCleanDepth(7),
+	)
 	return cache
 }
 
 func initProbeLfu(maxEntries int) *probecache.LFUStorage {
 	mem := maxEntries * maxEntrySize
 	crit := int(float64(mem) * 1.2)
-	cache, _ := probecache.NewLFUStorage(numShards, mem, crit, 7)
+	cache, _ := probecache.NewLFUStorage(
+		probecache.WithShards(numShards),
+		probecache.WithMaxBytes(mem),
+		probecache.WithCritBytes(crit),
+		probecache.WithCleanDepth(7),
+	)
 	return cache
 }
 
 func initProbeTTL(maxEntries int) *probecache.TTLStorage {
-	cache, _ := probecache.NewTTLStorage(numShards, 0)
+	cache, _ := probecache.NewTTLStorage(
+		probecache.WithShards(numShards),
+		probecache.WithCleanPeriod(0),
+	)
 	return cache
 }
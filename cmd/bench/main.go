@@ -0,0 +1,142 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/n1ord/probecache"
+)
+
+// Shard scaling sweep: go run ./cmd/bench -mem 268435456
+// Runs a mixed 80% get / 20% set load on LRU storage for every combination of
+// shard count, goroutine count and value size, then recommends the smallest
+// shard count that stays within 10% of the best throughput under full parallelism.
+
+var (
+	memFlag      = flag.Int("mem", 64*1024*1024, "cache memory budget, bytes")
+	durationFlag = flag.Duration("duration", 300*time.Millisecond, "duration of every run")
+	keysFlag     = flag.Int("keys", 200000, "key space size")
+)
+
+var (
+	sweepShards = []int{1, 4, 16, 64, 256}
+	sweepValues = []int{64, 1024}
+)
+
+type sweepResult struct {
+	shards     int
+	goroutines int
+	valueSize  int
+	opsPerSec  float64
+}
+
+func main() {
+	flag.Parse()
+	procs := runtime.GOMAXPROCS(0)
+	goroutines := []int{1, procs, 4 * procs}
+
+	fmt.Printf("GOMAXPROCS=%d, mem=%dkb, run=%s\n\n", procs, *memFlag/1024, *durationFlag)
+	fmt.Printf("%8s %11s %6s %14s\n", "shards", "goroutines", "value", "ops/sec")
+	var results []sweepResult
+	for _, size := range sweepValues {
+		for _, g := range goroutines {
+			for _, shards := range sweepShards {
+				r := sweepRun(shards, g, size)
+				results = append(results, r)
+				fmt.Printf("%8d %11d %6d %14.0f\n", r.shards, r.goroutines, r.valueSize, r.opsPerSec)
+			}
+		}
+	}
+
+	fmt.Println()
+	maxG := goroutines[len(goroutines)-1]
+	recommended := 0
+	for _, size := range sweepValues {
+		shards, best := recommend(results, maxG, size)
+		fmt.Printf("value %4db: %d shards is within 10%% of best (%.0f ops/sec)\n", size, shards, best)
+		if shards > recommended {
+			recommended = shards
+		}
+	}
+
+	maxMem := *memFlag
+	critMem := int(float64(maxMem) * 1.2)
+	fmt.Printf("\nRecommended: NumShards=%d, MaxMemSize=%d, MaxCritSize=%d (max * 1.2)\n", recommended, maxMem, critMem)
+	fmt.Printf("storage, err := probecache.NewLRUStorage(probecache.WithConfig(probecache.Config{\n")
+	fmt.Printf("\tNumShards:     %d,\n\tMaxMemSize:    %d,\n\tMaxCritSize:   %d,\n\tMaxCleanDepth: 5,\n}))\n", recommended, maxMem, critMem)
+}
+
+// recommend returns the smallest shard count within 10% of the best throughput
+// for goroutines and valueSize, results are ordered by shard count
+func recommend(results []sweepResult, goroutines int, valueSize int) (int, float64) {
+	best := 0.
+	for _, r := range results {
+		if r.goroutines == goroutines && r.valueSize == valueSize && r.opsPerSec > best {
+			best = r.opsPerSec
+		}
+	}
+	for _, r := range results {
+		if r.goroutines == goroutines && r.valueSize == valueSize && r.opsPerSec >= 0.9*best {
+			return r.shards, best
+		}
+	}
+	return 0, best
+}
+
+func sweepRun(shards int, goroutines int, valueSize int) sweepResult {
+	storage, err := probecache.NewLRUStorage(
+		probecache.WithShards(shards),
+		probecache.WithMaxBytes(*memFlag),
+		probecache.WithCritBytes(int(float64(*memFlag)*1.2)),
+	)
+	if err != nil {
+		panic(err)
+	}
+	keys := make([]string, *keysFlag)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("sweep-%010d", i)
+	}
+	payload := make([]byte, valueSize)
+	for i := 0; i < len(keys); i += 2 {
+		storage.Set(keys[i], payload, 600)
+	}
+
+	var ops int64
+	var wg sync.WaitGroup
+	deadline := time.Now().Add(*durationFlag)
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			n := int64(0)
+			for {
+				for i := 0; i < 256; i++ {
+					key := keys[rnd.Intn(len(keys))]
+					if rnd.Intn(5) == 0 {
+						storage.Set(key, payload, 600)
+					} else {
+						storage.Get(key)
+					}
+				}
+				n += 256
+				if time.Now().After(deadline) {
+					break
+				}
+			}
+			atomic.AddInt64(&ops, n)
+		}(int64(g))
+	}
+	wg.Wait()
+	return sweepResult{
+		shards:     shards,
+		goroutines: goroutines,
+		valueSize:  valueSize,
+		opsPerSec:  float64(ops) / durationFlag.Seconds(),
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRecommend(t *testing.T) {
+	results := []sweepResult{
+		{shards: 1, goroutines: 8, valueSize: 64, opsPerSec: 100},
+		{shards: 4, goroutines: 8, valueSize: 64, opsPerSec: 920},
+		{shards: 16, goroutines: 8, valueSize: 64, opsPerSec: 1000},
+		{shards: 64, goroutines: 8, valueSize: 64, opsPerSec: 990},
+		{shards: 64, goroutines: 1, valueSize: 64, opsPerSec: 5000},
+		{shards: 1, goroutines: 8, valueSize: 1024, opsPerSec: 50},
+		{shards: 4, goroutines: 8, valueSize: 1024, opsPerSec: 80},
+		{shards: 16, goroutines: 8, valueSize: 1024, opsPerSec: 200},
+	}
+	if shards, best := recommend(results, 8, 64); shards != 4 || best != 1000 {
+		t.Fatalf("64b values: %d shards, best %f", shards, best)
+	}
+	if shards, best := recommend(results, 8, 1024); shards != 16 || best != 200 {
+		t.Fatalf("1kb values: %d shards, best %f", shards, best)
+	}
+}
+
+func TestSweepRun(t *testing.T) {
+	*durationFlag = 10 * time.Millisecond
+	*keysFlag = 1000
+	r := sweepRun(4, 2, 64)
+	if r.shards != 4 || r.goroutines != 2 || r.valueSize != 64 || r.opsPerSec <= 0 {
+		t.Fatalf("got %+v", r)
+	}
+}
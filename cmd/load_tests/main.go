@@ -40,30 +40,20 @@ func BenchNormalLoad(storage pcache.IStorage, N int, maxValueSize int, warmDurat
 	}
 	// GO Probabilistic-Negation Invalidation Cache
 	// os.Exit(1)
-	hits := 0.
-	misses := 0.
-	writes := 0
-	reads := 0
+	storage.ResetStats()
 	writeProb := 1.
 	started = time.Now()
 	for {
 		// r := int64(rand.Float64() * float64(N))
 		r := int64(rand.NormFloat64()*float64(N)/6. + float64(N)/2)
 		key := fmt.Sprintf("%d", r)
-		_, err := storage.Get(key)
-		reads++
-		if err != nil {
-			writes++
+		if _, err := storage.Get(key); err != nil {
 			storage.Set(key, []byte("somevalue"), 120)
-			misses++
-		} else {
-			hits++
 		}
 
 		if rand.Float32() < float32(writeProb) {
 			key = fmt.Sprintf("randkey%f", rand.Float32())
 			value := RandStringRunes(rand.Intn(maxValueSize-1) + 1)
-			writes++
 			storage.Set(key, []byte(value), 120)
 		}
 
@@ -74,10 +64,11 @@ func BenchNormalLoad(storage pcache.IStorage, N int, maxValueSize int, warmDurat
 		// 	fmt.Printf("Size: %d bytes\n", storage.GetSize())
 		// }
 	}
-	fmt.Printf("Size: %d bytes\n", storage.GetSize())
-	fmt.Printf("Writes: %d \n", writes)
-	fmt.Printf("Reads: %d \n", reads)
-	fmt.Printf("Hitrate: %d%%\n", int32(100.*hits/(hits+misses)))
+	st := storage.Stats()
+	fmt.Printf("Size: %d bytes\n", st.Size)
+	fmt.Printf("Writes: %d \n", st.Sets)
+	fmt.Printf("Reads: %d \n", st.Hits+st.Misses)
+	fmt.Printf("Hitrate: %d%%\n", int32(100*st.HitRate()))
 	storage.PrintInfo()
 }
 
@@ -89,7 +80,12 @@ func main() {
 	critMemSize := int(float64(maxMemSize) * 1.2)
 	{
 		fmt.Println("LFUStorage testing")
-		storage, err := pcache.NewLFUStorage(10, maxMemSize, critMemSize, cleanDepth)
+		storage, err := pcache.NewLFUStorage(
+			pcache.WithShards(10),
+			pcache.WithMaxBytes(maxMemSize),
+			pcache.WithCritBytes(critMemSize),
+			pcache.WithCleanDepth(cleanDepth),
+		)
 		if err != nil {
 			panic(err)
 		}
@@ -98,7 +94,12 @@ func main() {
 	fmt.Println("")
 	{
 		fmt.Println("LRUStorage testing")
-		storage, err := pcache.NewLRUStorage(10, maxMemSize, critMemSize, cleanDepth)
+		storage, err := pcache.NewLRUStorage(
+			pcache.WithShards(10),
+			pcache.WithMaxBytes(maxMemSize),
+			pcache.WithCritBytes(critMemSize),
+			pcache.WithCleanDepth(cleanDepth),
+		)
 		if err != nil {
 			panic(err)
 		}
@@ -107,7 +108,12 @@ func main() {
 	fmt.Println("")
 	{
 		fmt.Println("LFUStorage testing with warming")
-		storage, err := pcache.NewLFUStorage(10, maxMemSize, critMemSize, cleanDepth)
+		storage, err := pcache.NewLFUStorage(
+			pcache.WithShards(10),
+			pcache.WithMaxBytes(maxMemSize),
+			pcache.WithCritBytes(critMemSize),
+			pcache.WithCleanDepth(cleanDepth),
+		)
 		if err != nil {
 			panic(err)
 		}
@@ -116,7 +122,12 @@ func main() {
 	fmt.Println("")
 	{
 		fmt.Println("LRUStorage testing with warming")
-		storage, err := pcache.NewLRUStorage(10, maxMemSize, critMemSize, cleanDepth)
+		storage, err := pcache.NewLRUStorage(
+			pcache.WithShards(10),
+			pcache.WithMaxBytes(maxMemSize),
+			pcache.WithCritBytes(critMemSize),
+			pcache.WithCleanDepth(cleanDepth),
+		)
 		if err != nil {
 			panic(err)
 		}
@@ -0,0 +1,628 @@
+package probecache
+
+import (
+	"fmt"
+	"log/slog"
+	"math/bits"
+	"runtime"
+	"time"
+)
+
+type Config struct {
+	// Rounded up to a power of two
+	NumShards int
+	// Optimal (threshold #1) and maximum (threshold #2) memory size in bytes, LRU/LFU only.
+	// MaxMemSize 0 means unbounded, MaxCritSize 0 means equal to MaxMemSize
+	MaxMemSize  int
+	MaxCritSize int
+	// Max number of entries, LRU/LFU only. Eviction starts on whichever
+	// of MaxMemSize and MaxEntries is hit first. 0 means unbounded
+	MaxEntries int
+	// Counters per row of TinyLFU admission sketch per shard, LRU/LFU only. When a Set of
+	// a new key needs eviction, the key is admitted only if it was requested more often
+	// than a random resident one, otherwise the Set is silently dropped. 0 disables
+	TinyLFUWidth int
+	// LRFUStorage balance between recency and frequency, [0, 1]:
+	// 0 is pure LFU, 1 is pure LRU
+	LRFULambda float64
+	// Max number of probe iterations per eviction, LRU/LFU only
+	MaxCleanDepth int
+	// Redis-style eviction, LRU/LFU only: every eviction samples EvictionSamples random
+	// entries and removes the one with the lowest worth. 0 uses MaxCleanDepth probing
+	// under the mean worth threshold
+	EvictionSamples int
+	// Incremental clean, LRU/LFU only: every Set of a new key (and Get with CleanOnGet) probes
+	// CleanSteps entries at a per-shard cursor instead of up to MaxCleanDepth at once. Eviction
+	// is forced only over MaxCritSize or MaxEntries. 0 disables, EvictionSamples is ignored if set
+	CleanSteps int
+	CleanOnGet bool
+	// Eviction hysteresis, LRU/LFU only: a Set that finds a shard over HighWatermark fraction of
+	// its MaxMemSize/MaxEntries share evicts it down to LowWatermark fraction, or with AsyncEviction
+	// hands it to a background goroutine. Limits are still enforced by Set. 0 disables
+	HighWatermark float64
+	LowWatermark  float64
+	AsyncEviction bool
+	// Background cleaner period of TTLStorage, and of all storages with ExpireActive or
+	// ExpireHybrid ExpirationMode. 0 disables the TTL cleaner
+	CleanPeriod    time.Duration
+	ExpirationMode ExpirationMode
+	// LRU/LFU janitor period: a background goroutine removes due expired entries and evicts
+	// shards left over their limits, since eviction otherwise happens only on Set. 0 disables
+	JanitorPeriod time.Duration
+	// CleanTimeout bounds a background pass of the janitor and the TTL cleaner, shards left
+	// are cleaned by the next one. 0 means no limit
+	CleanTimeout time.Duration
+	// Index of expire times, TTL and LRU/LFU only. With it the TTL cleaner, DeleteExpired and
+	// LRU/LFU eviction remove expired entries in O(expired), at 16 bytes per entry with TTL.
+	// ExpiryTick is the timing wheel resolution, 0 disables the wheel. See ExpiryIndex
+	ExpiryIndex ExpiryIndex
+	ExpiryTick  time.Duration
+	// LFU and PolicyStorage aging: worth of all entries is halved every AgingPeriod (background
+	// goroutine, stopped by Close) and/or in a shard after AgingHits hits to it. 0 disables
+	AgingPeriod time.Duration
+	AgingHits   int
+	// Buffered access recording, LRU/LFU only: Gets append key hashes to per-shard stripes of
+	// AccessBufferSize keys, full stripes are queued (AccessBufferBatches of them, NumShards if 0)
+	// for a background goroutine that updates worth, TinyLFU and AgingHits. Lossy, what happens
+	// to a stripe that finds the queue full is AccessDropPolicy. 0 disables
+	AccessBufferSize    int
+	AccessBufferBatches int
+	AccessDropPolicy    AccessDropPolicy
+	// Max payload size of a single entry, bigger Sets fail with ErrTooLarge. 0 means unlimited
+	MaxEntrySize int
+	// TTL used by Set with ttl 0. 0 or NoExpiration makes such entries permanent
+	DefaultTTL time.Duration
+	// Every written ttl is randomized by ±TTLJitter fraction of it, [0, 1)
+	TTLJitter float64
+	// Probabilistic early expiration (XFetch): a live entry is reported missing when
+	// -XFetchDelta*XFetchBeta*ln(rand) >= ttl left, so refreshes spread out before
+	// hard expiry. XFetchDelta is expected recompute time, 1s if 0. Beta 0 disables
+	XFetchBeta  float64
+	XFetchDelta time.Duration
+	// How long expired entries are still served by GetStale. TTL storage cleaner keeps them
+	// that long too, LRU/LFU may evict them as usual
+	StaleWindow time.Duration
+	// Called in background on stale hits of GetStale, result is Set. At most MaxRefreshes
+	// (16 if 0) calls run at once, more stale hits are served without one. RefreshTimeout
+	// bounds a call, 0 leaves it to Close
+	Refresher      RefreshFunc
+	MaxRefreshes   int
+	RefreshTimeout time.Duration
+	// CopyOnGet returns copies of stored values, CopyOnSet copies values on Set.
+	// Both are on in DefaultConfig, a Config literal without them is zero-copy, see WithZeroCopy
+	CopyOnGet bool
+	CopyOnSet bool
+	// Bytes of freed entry buffers kept for reuse by Set, LRU/LFU only, split between shards.
+	// Steady Set traffic then stops allocating. Needs CopyOnGet: values always leave shards
+	// as copies, OnEvict/OnExpire data is valid only during the call. 0 disables
+	BufferPoolSize int
+	// Keep original keys for DeleteByPrefix/DeleteMatch, costs a map entry per key
+	TrackKeys bool
+	// KeyFingerprints is the cheaper alternative to TrackKeys, LRU/LFU only: keys are tracked by
+	// 4-byte fingerprints of their first 4 prefixes ending with one of FingerprintDelims (":/"
+	// if empty), 16 bytes per key plus each distinct prefix once. DeleteByPrefix then takes
+	// such prefixes only, DeleteMatch, wildcard TTL overrides, keyed snapshots and Key of
+	// debug entries still need TrackKeys. Keys whose prefix fingerprint collides with another
+	// prefix keep their prefix as a string, so a collision never deletes a wrong key
+	KeyFingerprints   bool
+	FingerprintDelims string
+	// Keep a second 64-bit key hash in entries, LRU/LFU only: a key whose hash collides
+	// with a stored one is reported missing instead of getting the other key's value
+	CollisionSafe bool
+
+	// Seed of per-shard random sources, 0 means seeded from time
+	Seed int64
+	// Hash of string keys, HashFNV by default. See KeyHash. Hasher, if set, is used instead
+	KeyHash KeyHash
+	Hasher  Hasher
+	// Bytes an LRU/LFU/TTL entry costs beyond its payload without Weigher. 0 means 24, the entry
+	// header alone: with map slots and allocation rounding the heap takes more, see CalibrateEntryOverhead
+	EntryOverhead int
+	// Entry cost used for size limits and eviction, LRU/LFU only. nil means wrapped byte length
+	Weigher  Weigher
+	OnEvict  EvictFunc
+	OnExpire ExpireFunc
+	// EventBuffer events of entries are buffered for Events(), more are dropped.
+	// EventSample > 1 sends every EventSample-th event only. 0 disables the stream
+	EventBuffer int
+	EventSample int
+	// Called for every entry leaving a storage with the reason: evicted, expired,
+	// deleted or replaced by Set. Clear reports nothing. Same rules as OnEvict
+	OnRemove EvictFunc
+	// Logger gets noteworthy events of LRU/LFU storages: emergency cleans of shards over
+	// critSize (Warn, logged in shard lock), failed Restore, resharding and janitor start/stop.
+	// nil logs nothing
+	Logger *slog.Logger
+	// SnapshotPath, if set, gets a snapshot of the storage every SnapshotInterval and on Close,
+	// see SaveToFile. Interval 0 saves on Close only. Not loaded on creation, see LoadFromFile
+	SnapshotPath     string
+	SnapshotInterval time.Duration
+	// SnapshotTimeout bounds an auto snapshot, SnapshotPath keeps the previous one on timeout.
+	// 0 means no limit
+	SnapshotTimeout time.Duration
+	// MmapPath makes OffHeapStorage keep entries in this file mapped into memory instead of
+	// anonymous memory, so they outlive the process: a storage opened on the file later starts
+	// with them. Ignored by other storages
+	MmapPath string
+	// Profile times cleaning per shard (ShardStats.CleanTime) and runs background maintenance
+	// of LRU/LFU storages under pprof label "probecache" (janitor, lowering, aging, access)
+	Profile bool
+	// MaxWorkers caps goroutines of background work of the storage: janitor, async eviction,
+	// aging, access buffer drains, refreshes and auto snapshots. Tasks over it are queued,
+	// eviction first. 0 leaves only the process budget of SetMaxWorkers
+	MaxWorkers int
+}
+
+// NoExpiration as DefaultTTL makes entries set with ttl 0 never expire,
+// same as no DefaultTTL at all
+const NoExpiration time.Duration = -1
+
+type Option func(*Config)
+
+func DefaultConfig() Config {
+	return Config{
+		NumShards:       16,
+		MaxCleanDepth:   5,
+		CleanPeriod:     time.Minute,
+		ExpiryTick:      time.Second,
+		CleanTimeout:    10 * time.Second,
+		RefreshTimeout:  10 * time.Second,
+		SnapshotTimeout: time.Minute,
+		CopyOnGet:       true,
+		CopyOnSet:       true,
+	}
+}
+
+func WithConfig(cfg Config) Option {
+	return func(c *Config) {
+		*c = cfg
+	}
+}
+
+func WithShards(n int) Option {
+	return func(c *Config) {
+		c.NumShards = n
+	}
+}
+
+func WithMaxBytes(n int) Option {
+	return func(c *Config) {
+		c.MaxMemSize = n
+	}
+}
+
+const (
+	// shards per P: goroutines running on all Ps rarely meet on one shard lock
+	autoShardsPerProc = 4
+	// smaller shards evict by too few entries, the mean worth of a shard gets noisy
+	autoMinShardBytes = 256 << 10
+)
+
+// WithAutoSize picks NumShards and thresholds for a byte budget. Shards: 4 per GOMAXPROCS,
+// but no smaller than 256kb each, rounded down to a power of two. maxBytes is the hard
+// limit (MaxCritSize), eviction starts 1/16 below it (MaxMemSize), that is about as much
+// as shards overshoot between clean rounds. Options after it override the choice
+func WithAutoSize(maxBytes int) Option {
+	return func(c *Config) {
+		c.NumShards = autoShards(maxBytes, runtime.GOMAXPROCS(0))
+		c.MaxCritSize = maxBytes
+		c.MaxMemSize = maxBytes - maxBytes/16
+	}
+}
+
+func autoShards(maxBytes int, procs int) int {
+	n := procs * autoShardsPerProc
+	if maxBytes > 0 && n > maxBytes/autoMinShardBytes {
+		n = maxBytes / autoMinShardBytes
+	}
+	if n < 1 {
+		return 1
+	}
+	return 1 << uint(bits.Len(uint(n))-1)
+}
+
+func WithCritBytes(n int) Option {
+	return func(c *Config) {
+		c.MaxCritSize = n
+	}
+}
+
+func WithMaxEntries(n int) Option {
+	return func(c *Config) {
+		c.MaxEntries = n
+	}
+}
+
+func WithTinyLFU(width int) Option {
+	return func(c *Config) {
+		c.TinyLFUWidth = width
+	}
+}
+
+func WithCleanDepth(n int) Option {
+	return func(c *Config) {
+		c.MaxCleanDepth = n
+	}
+}
+
+func WithSampledEviction(samples int) Option {
+	return func(c *Config) {
+		c.EvictionSamples = samples
+	}
+}
+
+func WithIncrementalClean(steps int, onGet bool) Option {
+	return func(c *Config) {
+		c.CleanSteps = steps
+		c.CleanOnGet = onGet
+	}
+}
+
+func WithWatermarks(high float64, low float64, async bool) Option {
+	return func(c *Config) {
+		c.HighWatermark = high
+		c.LowWatermark = low
+		c.AsyncEviction = async
+	}
+}
+
+func WithLRFULambda(lambda float64) Option {
+	return func(c *Config) {
+		c.LRFULambda = lambda
+	}
+}
+
+func WithCleanPeriod(d time.Duration) Option {
+	return func(c *Config) {
+		c.CleanPeriod = d
+	}
+}
+
+func WithExpirationMode(mode ExpirationMode) Option {
+	return func(c *Config) {
+		c.ExpirationMode = mode
+	}
+}
+
+func WithJanitor(period time.Duration) Option {
+	return func(c *Config) {
+		c.JanitorPeriod = period
+	}
+}
+
+func WithCleanTimeout(d time.Duration) Option {
+	return func(c *Config) {
+		c.CleanTimeout = d
+	}
+}
+
+func WithExpiryTick(d time.Duration) Option {
+	return func(c *Config) {
+		c.ExpiryTick = d
+	}
+}
+
+func WithExpiryIndex(index ExpiryIndex) Option {
+	return func(c *Config) {
+		c.ExpiryIndex = index
+	}
+}
+
+func WithAgingPeriod(d time.Duration) Option {
+	return func(c *Config) {
+		c.AgingPeriod = d
+	}
+}
+
+func WithAgingHits(n int) Option {
+	return func(c *Config) {
+		c.AgingHits = n
+	}
+}
+
+func WithAccessBuffer(size int, batches int, drop AccessDropPolicy) Option {
+	return func(c *Config) {
+		c.AccessBufferSize = size
+		c.AccessBufferBatches = batches
+		c.AccessDropPolicy = drop
+	}
+}
+
+func WithDefaultTTL(d time.Duration) Option {
+	return func(c *Config) {
+		c.DefaultTTL = d
+	}
+}
+
+func WithTTLJitter(fraction float64) Option {
+	return func(c *Config) {
+		c.TTLJitter = fraction
+	}
+}
+
+func WithXFetch(beta float64, delta time.Duration) Option {
+	return func(c *Config) {
+		c.XFetchBeta = beta
+		c.XFetchDelta = delta
+	}
+}
+
+func WithStaleWindow(d time.Duration) Option {
+	return func(c *Config) {
+		c.StaleWindow = d
+	}
+}
+
+func WithRefresher(fn RefreshFunc) Option {
+	return func(c *Config) {
+		c.Refresher = fn
+	}
+}
+
+func WithRefreshLimits(max int, timeout time.Duration) Option {
+	return func(c *Config) {
+		c.MaxRefreshes = max
+		c.RefreshTimeout = timeout
+	}
+}
+
+func WithMaxWorkers(n int) Option {
+	return func(c *Config) {
+		c.MaxWorkers = n
+	}
+}
+
+func WithMaxEntrySize(n int) Option {
+	return func(c *Config) {
+		c.MaxEntrySize = n
+	}
+}
+
+func WithCopyOnGet(on bool) Option {
+	return func(c *Config) {
+		c.CopyOnGet = on
+	}
+}
+
+func WithCopyOnSet(on bool) Option {
+	return func(c *Config) {
+		c.CopyOnSet = on
+	}
+}
+
+// WithZeroCopy is for experts: Get returns slices of storage memory which must not
+// be modified, Set takes ownership of data and may reuse its spare capacity
+func WithZeroCopy() Option {
+	return func(c *Config) {
+		c.CopyOnGet = false
+		c.CopyOnSet = false
+	}
+}
+
+func WithBufferPool(bytes int) Option {
+	return func(c *Config) {
+		c.BufferPoolSize = bytes
+	}
+}
+
+func WithKeyFingerprints(delims string) Option {
+	return func(c *Config) {
+		c.KeyFingerprints = true
+		c.FingerprintDelims = delims
+	}
+}
+
+func WithTrackKeys() Option {
+	return func(c *Config) {
+		c.TrackKeys = true
+	}
+}
+
+func WithCollisionSafe() Option {
+	return func(c *Config) {
+		c.CollisionSafe = true
+	}
+}
+
+func WithSeed(seed int64) Option {
+	return func(c *Config) {
+		c.Seed = seed
+	}
+}
+
+func WithKeyHash(h KeyHash) Option {
+	return func(c *Config) {
+		c.KeyHash = h
+	}
+}
+
+func WithHasher(h Hasher) Option {
+	return func(c *Config) {
+		c.Hasher = h
+	}
+}
+
+func WithWeigher(fn Weigher) Option {
+	return func(c *Config) {
+		c.Weigher = fn
+	}
+}
+
+func WithEntryOverhead(n int) Option {
+	return func(c *Config) {
+		c.EntryOverhead = n
+	}
+}
+
+func WithOnEvict(fn EvictFunc) Option {
+	return func(c *Config) {
+		c.OnEvict = fn
+	}
+}
+
+// WithEvents enables PolicyStorage.Events with buffer events, sending every sample-th one
+func WithEvents(buffer int, sample int) Option {
+	return func(c *Config) {
+		c.EventBuffer = buffer
+		c.EventSample = sample
+	}
+}
+
+func WithLogger(l *slog.Logger) Option {
+	return func(c *Config) {
+		c.Logger = l
+	}
+}
+
+func WithAutoSnapshot(interval time.Duration, path string) Option {
+	return func(c *Config) {
+		c.SnapshotInterval = interval
+		c.SnapshotPath = path
+	}
+}
+
+func WithSnapshotTimeout(d time.Duration) Option {
+	return func(c *Config) {
+		c.SnapshotTimeout = d
+	}
+}
+
+func WithMmapFile(path string) Option {
+	return func(c *Config) {
+		c.MmapPath = path
+	}
+}
+
+func WithProfiling() Option {
+	return func(c *Config) {
+		c.Profile = true
+	}
+}
+
+func WithOnRemove(fn EvictFunc) Option {
+	return func(c *Config) {
+		c.OnRemove = fn
+	}
+}
+
+func WithOnExpire(fn ExpireFunc) Option {
+	return func(c *Config) {
+		c.OnExpire = fn
+	}
+}
+
+func newConfig(opts []Option) (Config, error) {
+	cfg := DefaultConfig()
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.NumShards <= 0 {
+		return cfg, fmt.Errorf("%w: NumShards must be positive, got %d", ErrInvalidConfig, cfg.NumShards)
+	}
+	// shards are picked by a mask, see shardOf
+	cfg.NumShards = 1 << uint(bits.Len(uint(cfg.NumShards-1)))
+	if cfg.MaxMemSize < 0 || cfg.MaxCritSize < 0 {
+		return cfg, fmt.Errorf("%w: negative memory size", ErrInvalidConfig)
+	}
+	if cfg.MaxCritSize != 0 && cfg.MaxCritSize < cfg.MaxMemSize {
+		return cfg, fmt.Errorf("%w: MaxCritSize %d is less than MaxMemSize %d", ErrInvalidConfig, cfg.MaxCritSize, cfg.MaxMemSize)
+	}
+	if cfg.MaxEntries < 0 {
+		return cfg, fmt.Errorf("%w: negative MaxEntries", ErrInvalidConfig)
+	}
+	if cfg.MaxEntrySize < 0 {
+		return cfg, fmt.Errorf("%w: negative MaxEntrySize", ErrInvalidConfig)
+	}
+	if cfg.TTLJitter < 0 || cfg.TTLJitter >= 1 {
+		return cfg, fmt.Errorf("%w: TTLJitter must be in [0, 1), got %f", ErrInvalidConfig, cfg.TTLJitter)
+	}
+	if cfg.XFetchBeta < 0 || cfg.XFetchDelta < 0 {
+		return cfg, fmt.Errorf("%w: negative XFetch parameters", ErrInvalidConfig)
+	}
+	if cfg.StaleWindow < 0 {
+		return cfg, fmt.Errorf("%w: negative StaleWindow", ErrInvalidConfig)
+	}
+	if cfg.MaxRefreshes < 0 || cfg.RefreshTimeout < 0 {
+		return cfg, fmt.Errorf("%w: negative refresh limits", ErrInvalidConfig)
+	}
+	if cfg.KeyFingerprints && cfg.TrackKeys {
+		return cfg, fmt.Errorf("%w: KeyFingerprints and TrackKeys are alternatives", ErrInvalidConfig)
+	}
+	if cfg.CleanTimeout < 0 || cfg.SnapshotTimeout < 0 {
+		return cfg, fmt.Errorf("%w: negative CleanTimeout or SnapshotTimeout", ErrInvalidConfig)
+	}
+	if cfg.MaxWorkers < 0 {
+		return cfg, fmt.Errorf("%w: negative MaxWorkers", ErrInvalidConfig)
+	}
+	if cfg.BufferPoolSize < 0 {
+		return cfg, fmt.Errorf("%w: negative BufferPoolSize", ErrInvalidConfig)
+	}
+	if cfg.BufferPoolSize > 0 && !cfg.CopyOnGet {
+		return cfg, fmt.Errorf("%w: BufferPoolSize needs CopyOnGet, recycled buffers can't be shared", ErrInvalidConfig)
+	}
+	if cfg.EntryOverhead < 0 {
+		return cfg, fmt.Errorf("%w: negative EntryOverhead", ErrInvalidConfig)
+	}
+	if cfg.TinyLFUWidth < 0 {
+		return cfg, fmt.Errorf("%w: negative TinyLFUWidth", ErrInvalidConfig)
+	}
+	if err := cfg.validateExpiry(); err != nil {
+		return cfg, err
+	}
+	if err := cfg.validateExpirationMode(); err != nil {
+		return cfg, err
+	}
+	if cfg.JanitorPeriod < 0 {
+		return cfg, fmt.Errorf("%w: negative JanitorPeriod", ErrInvalidConfig)
+	}
+	if cfg.AgingPeriod < 0 || cfg.AgingHits < 0 {
+		return cfg, fmt.Errorf("%w: negative aging parameters", ErrInvalidConfig)
+	}
+	if err := cfg.validateAccessBuffer(); err != nil {
+		return cfg, err
+	}
+	if err := cfg.validateKeyHash(); err != nil {
+		return cfg, err
+	}
+	if err := cfg.validateEvents(); err != nil {
+		return cfg, err
+	}
+	if cfg.SnapshotInterval < 0 || (cfg.SnapshotInterval > 0 && cfg.SnapshotPath == "") {
+		return cfg, fmt.Errorf("%w: SnapshotInterval needs SnapshotPath and must not be negative", ErrInvalidConfig)
+	}
+	if cfg.LRFULambda < 0 || cfg.LRFULambda > 1 {
+		return cfg, fmt.Errorf("%w: LRFULambda must be in [0, 1], got %f", ErrInvalidConfig, cfg.LRFULambda)
+	}
+	if (cfg.HighWatermark != 0 || cfg.LowWatermark != 0) &&
+		!(0 < cfg.LowWatermark && cfg.LowWatermark < cfg.HighWatermark && cfg.HighWatermark <= 1) {
+		return cfg, fmt.Errorf("%w: watermarks must be 0 < low < high <= 1, got %f and %f", ErrInvalidConfig, cfg.LowWatermark, cfg.HighWatermark)
+	}
+	if cfg.CleanSteps < 0 {
+		return cfg, fmt.Errorf("%w: negative CleanSteps", ErrInvalidConfig)
+	}
+	if cfg.EvictionSamples < 0 {
+		return cfg, fmt.Errorf("%w: negative EvictionSamples", ErrInvalidConfig)
+	}
+	if cfg.MaxCleanDepth < 0 {
+		return cfg, fmt.Errorf("%w: negative MaxCleanDepth", ErrInvalidConfig)
+	}
+	if cfg.Seed == 0 {
+		cfg.Seed = time.Now().UnixNano()
+	}
+	return cfg, nil
+}
+
+func (c Config) defaultTTL() uint64 {
+	if c.DefaultTTL <= 0 {
+		return ttlForever
+	}
+	return durationToTTL(c.DefaultTTL)
+}
+
+func (c Config) xfetchScale() float64 {
+	delta := c.XFetchDelta
+	if delta == 0 {
+		delta = time.Second
+	}
+	return c.XFetchBeta * float64(delta) / float64(time.Millisecond)
+}
@@ -0,0 +1,129 @@
+package probecache
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// EntryInfo describes an entry found by Largest
+type EntryInfo struct {
+	KeyHash uint64
+	Key     string `json:",omitempty"` // TrackKeys only
+	Size    int    // value bytes
+	TTL     uint64 // ms left, 0 for persistent entries
+}
+
+// pushLargest inserts e into top sorted by size descending, dropping the smallest past n
+func pushLargest(top []EntryInfo, e EntryInfo, n int) []EntryInfo {
+	i := sort.Search(len(top), func(i int) bool { return top[i].Size < e.Size })
+	if i == n {
+		return top
+	}
+	if len(top) < n {
+		top = append(top, EntryInfo{})
+	}
+	copy(top[i+1:], top[i:])
+	top[i] = e
+	return top
+}
+
+type shardInfo struct {
+	ShardStats
+	HitRate         float64
+	CleanEfficiency float64
+	AvgCleanDepth   float64
+}
+
+var debugIndex = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<title>probecache</title>
+<pre>{{.}}</pre>
+<p><a href="stats">stats</a> <a href="shards">shards</a> <a href="top?n=20">top</a> <a href="memory">memory</a></p>
+<form method="post" action="delete-expired?back=1"><button>Delete expired</button></form>
+<form method="post" action="clear?back=1" onsubmit="return confirm('Clear the cache?')"><button>Clear</button></form>
+`))
+
+// DebugHandler serves an admin page of s, mount it with a trailing slash, e.g.
+// mux.Handle("/admin/cache/", DebugHandler(s)). GET stats, shards, memory and top?n=
+// return JSON, POST clear and delete-expired act on s. top and memory need LRU/LFU
+func DebugHandler(s IStorage) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/") {
+			var b strings.Builder
+			s.WriteInfo(&b)
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			debugIndex.Execute(w, b.String())
+			return
+		}
+		switch name := path.Base(r.URL.Path); name {
+		case "stats":
+			st := s.Stats()
+			st.Shards = nil
+			writeJSON(w, struct {
+				Stats
+				HitRate float64
+			}{st, st.HitRate()})
+		case "shards":
+			shards := s.Stats().Shards
+			out := make([]shardInfo, len(shards))
+			for i, sh := range shards {
+				out[i] = shardInfo{sh, sh.HitRate(), sh.CleanEfficiency(), sh.AvgCleanDepth()}
+			}
+			writeJSON(w, out)
+		case "memory":
+			m, ok := s.(interface{ MemoryStats() MemoryStats })
+			if !ok {
+				http.Error(w, "not supported by the storage", http.StatusNotImplemented)
+				return
+			}
+			writeJSON(w, m.MemoryStats())
+		case "top":
+			l, ok := s.(interface{ Largest(n int) []EntryInfo })
+			if !ok {
+				http.Error(w, "not supported by the storage", http.StatusNotImplemented)
+				return
+			}
+			n := 20
+			if q := r.URL.Query().Get("n"); q != "" {
+				var err error
+				if n, err = strconv.Atoi(q); err != nil || n < 0 {
+					http.Error(w, "bad n", http.StatusBadRequest)
+					return
+				}
+			}
+			writeJSON(w, l.Largest(n))
+		case "clear", "delete-expired":
+			if r.Method != http.MethodPost {
+				w.Header().Set("Allow", http.MethodPost)
+				http.Error(w, "POST only", http.StatusMethodNotAllowed)
+				return
+			}
+			deleted := 0
+			if name == "clear" {
+				deleted = s.Len()
+				s.Clear()
+			} else if d, ok := s.(interface{ DeleteExpired() int }); ok {
+				deleted = d.DeleteExpired()
+			} else {
+				http.Error(w, "not supported by the storage", http.StatusNotImplemented)
+				return
+			}
+			if r.URL.Query().Get("back") != "" {
+				http.Redirect(w, r, "./", http.StatusSeeOther)
+				return
+			}
+			writeJSON(w, struct{ Deleted int }{deleted})
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,48 @@
+package probecache
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestDebugHandler(t *testing.T) {
+	s, err := NewLRUStorage(WithShards(4), WithTrackKeys())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for i := 1; i <= 50; i++ {
+		s.Set(strconv.Itoa(i), make([]byte, i), 0)
+	}
+	h := DebugHandler(s)
+	do := func(method, target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+		return rec
+	}
+
+	var top []EntryInfo
+	if err := json.NewDecoder(do("GET", "/admin/cache/top?n=3").Body).Decode(&top); err != nil {
+		t.Fatal(err)
+	}
+	if len(top) != 3 || top[0].Key != "50" || top[1].Size != 49 || top[2].Size != 48 {
+		t.Fatalf("top %+v", top)
+	}
+	var shards []ShardStats
+	if err := json.NewDecoder(do("GET", "/admin/cache/shards").Body).Decode(&shards); err != nil || len(shards) != 4 {
+		t.Fatalf("shards %+v, %v", shards, err)
+	}
+	if rec := do("GET", "/admin/cache/"); !strings.Contains(rec.Body.String(), "Clear") {
+		t.Fatalf("index %s", rec.Body)
+	}
+	if rec := do("GET", "/admin/cache/clear"); rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("GET clear: %d", rec.Code)
+	}
+	if rec := do("POST", "/admin/cache/clear?back=1"); rec.Code != http.StatusSeeOther || s.Len() != 0 {
+		t.Fatalf("POST clear: %d, len %d", rec.Code, s.Len())
+	}
+}
@@ -0,0 +1,84 @@
+package probecache
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+type EventType int
+
+const (
+	EventSet EventType = iota
+	EventDelete
+	EventEvict
+	EventExpire
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventSet:
+		return "set"
+	case EventDelete:
+		return "delete"
+	case EventEvict:
+		return "evict"
+	case EventExpire:
+		return "expire"
+	}
+	return "unknown"
+}
+
+// CacheEvent is a change of an entry. Shards know keys by hash only, match
+// them against KeyHash of the storage for keys of interest
+type CacheEvent struct {
+	Type    EventType
+	KeyHash uint64
+	Size    int // value bytes
+}
+
+var removalEvents = [...]EventType{
+	EvictCapacity: EventEvict,
+	EvictExpired:  EventExpire,
+	EvictDeleted:  EventDelete,
+}
+
+// eventStream hands events over to a buffered channel without blocking shards:
+// events that find the buffer full are dropped and counted
+type eventStream struct {
+	ch      chan CacheEvent
+	sample  uint64 // every sample-th event is sent, 1 sends all
+	seen    uint64
+	dropped uint64
+}
+
+func newEventStream(buffer int, sample int) *eventStream {
+	if sample < 1 {
+		sample = 1
+	}
+	return &eventStream{ch: make(chan CacheEvent, buffer), sample: uint64(sample)}
+}
+
+func (es *eventStream) emit(ev CacheEvent) {
+	if es.sample > 1 && atomic.AddUint64(&es.seen, 1)%es.sample != 0 {
+		return
+	}
+	select {
+	case es.ch <- ev:
+	default:
+		atomic.AddUint64(&es.dropped, 1)
+	}
+}
+
+func (es *eventStream) droppedCount() uint64 {
+	if es == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&es.dropped)
+}
+
+func (c Config) validateEvents() error {
+	if c.EventBuffer < 0 || c.EventSample < 0 {
+		return fmt.Errorf("%w: negative event stream parameters", ErrInvalidConfig)
+	}
+	return nil
+}
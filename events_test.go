@@ -0,0 +1,115 @@
+package probecache
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestEvents(t *testing.T) {
+	s, err := NewLRUStorage(WithShards(1), WithMaxEntries(2), WithEvents(4, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.Set("a", []byte("12"), 0)
+	s.Del("a")
+	want := []CacheEvent{
+		{Type: EventSet, KeyHash: s.KeyHash("a"), Size: 2},
+		{Type: EventDelete, KeyHash: s.KeyHash("a"), Size: 2},
+	}
+	for _, w := range want {
+		if got := <-s.Events(); got != w {
+			t.Fatalf("got %+v, want %+v", got, w)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		s.Set(string(rune('b'+i)), []byte("x"), 0)
+	}
+	evicted := 0
+	for i := 0; i < 4; i++ {
+		if ev := <-s.Events(); ev.Type == EventEvict {
+			evicted++
+		}
+	}
+	if evicted == 0 || s.DroppedEvents() == 0 {
+		t.Fatalf("evict events %d, dropped %d", evicted, s.DroppedEvents())
+	}
+}
+
+func TestOnEvict(t *testing.T) {
+	s, _ := NewLRUStorage(WithShards(1), WithMaxEntries(4), WithExpiryIndex(ExpiryHeap))
+	defer s.Close()
+	evicted := map[uint64]string{}
+	reasons := map[EvictReason]int{}
+	s.SetOnEvict(func(key uint64, value []byte, reason EvictReason) {
+		evicted[key] = string(value)
+		reasons[reason]++
+	})
+	s.Set("a", []byte("1"), 0)
+	s.Set("a", []byte("2"), 0)
+	s.Del("a")
+	if len(evicted) != 0 {
+		t.Fatalf("overwrite and Del reported: %v", evicted)
+	}
+	for i := 0; i < 10; i++ {
+		s.Set(strconv.Itoa(i), []byte("v"+strconv.Itoa(i)), 0)
+	}
+	if reasons[EvictCapacity] != 6 || s.Len() != 4 {
+		t.Fatalf("%v evicted, %d left", reasons, s.Len())
+	}
+	for i := 0; i < 10; i++ {
+		if v, ok := evicted[s.KeyHash(strconv.Itoa(i))]; ok && v != "v"+strconv.Itoa(i) {
+			t.Fatalf("key %d evicted with value %q", i, v)
+		}
+	}
+
+	s.Clear()
+	s.SetWithDuration("x", []byte("x"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	s.DeleteExpired()
+	if reasons[EvictExpired] != 0 {
+		t.Fatalf("DeleteExpired reported to OnEvict: %v", reasons)
+	}
+}
+
+func TestOnExpire(t *testing.T) {
+	for _, mode := range []ExpiryIndex{ExpiryScan, ExpiryHeap} {
+		expired := map[uint64]string{}
+		s, _ := NewLRUStorage(WithShards(1), WithMaxEntries(2), WithExpiryIndex(mode), WithOnExpire(func(key uint64, value []byte) {
+			expired[key] = string(value)
+		}))
+		s.SetWithDuration("lazy", []byte("1"), time.Millisecond)
+		s.SetWithDuration("purged", []byte("2"), time.Millisecond)
+		time.Sleep(5 * time.Millisecond)
+		s.Get("lazy")
+		s.DeleteExpired()
+		s.Set("a", []byte("3"), 0)
+		s.Del("a")
+		for i := 0; i < 4; i++ {
+			s.Set(strconv.Itoa(i), []byte("live"), 0)
+		}
+		want := map[uint64]string{s.KeyHash("lazy"): "1", s.KeyHash("purged"): "2"}
+		if len(expired) != len(want) || expired[s.KeyHash("lazy")] != "1" || expired[s.KeyHash("purged")] != "2" {
+			t.Errorf("%v: expired %v, want %v", mode, expired, want)
+		}
+		s.Close()
+	}
+}
+
+func TestOnExpireCleaner(t *testing.T) {
+	expired := make(chan uint64, 1)
+	s, _ := NewTTLStorage(WithShards(1), WithCleanPeriod(5*time.Millisecond), WithOnExpire(func(key uint64, value []byte) {
+		expired <- key
+	}))
+	defer s.Close()
+	s.SetWithDuration("a", []byte("1"), time.Millisecond)
+	select {
+	case key := <-expired:
+		if key != s.KeyHash("a") || s.Len() != 0 {
+			t.Fatalf("expired %d, %d entries left", key, s.Len())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("cleaner didn't expire the entry")
+	}
+}
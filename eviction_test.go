@@ -0,0 +1,279 @@
+package probecache
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMaxEntries(t *testing.T) {
+	lru, _ := NewLRUStorage(WithShards(2), WithMaxEntries(100))
+	defer lru.Close()
+	lfu, _ := NewLFUStorage(WithShards(2), WithMaxEntries(100))
+	defer lfu.Close()
+	for name, s := range map[string]IStorage{"LRU": lru, "LFU": lfu} {
+		for i := 0; i < 1000; i++ {
+			s.Set(strconv.Itoa(i), make([]byte, 64), 0)
+		}
+		if n := s.Len(); n > 100 || n < 50 {
+			t.Errorf("%s: %d entries under a limit of 100", name, n)
+		}
+		if st := s.Stats(); st.Evictions != uint64(1000-st.Len) {
+			t.Errorf("%s: %d evicted, %d left", name, st.Evictions, st.Len)
+		}
+	}
+
+	// whichever limit is hit first evicts
+	s, _ := NewLRUStorage(WithShards(2), WithMaxEntries(1000), WithMaxBytes(4096))
+	defer s.Close()
+	for i := 0; i < 1000; i++ {
+		s.Set(strconv.Itoa(i), make([]byte, 64), 0)
+	}
+	// shards evict before a Set, so each may hold one entry over its share
+	if size := s.GetSize(); size > 4096+2*(64+entryOverhead) || s.Len() >= 1000 {
+		t.Fatalf("size %d, len %d under MaxMemSize 4096", size, s.Len())
+	}
+}
+
+func TestWeigher(t *testing.T) {
+	// value is its cost in decimal
+	s, _ := NewLRUStorage(WithShards(1), WithMaxBytes(100), WithWeigher(func(key uint64, value []byte) int {
+		n, _ := strconv.Atoi(string(value))
+		return n
+	}))
+	defer s.Close()
+	s.Set("a", []byte("10"), 0)
+	s.Set("b", []byte("0"), 0)
+	if size := s.GetSize(); size != 11 {
+		t.Fatalf("size %d, want 10 + 1 for a zero cost", size)
+	}
+	s.Set("a", []byte("30"), 0)
+	if size := s.GetSize(); size != 31 {
+		t.Fatalf("size %d after overwrite", size)
+	}
+	for i := 0; i < 100; i++ {
+		s.Set(strconv.Itoa(i), []byte("5"), 0)
+	}
+	// evicted by cost, not by bytes
+	if size := s.GetSize(); size > 100+5 || s.Len() < 15 {
+		t.Fatalf("size %d, len %d under a cost limit of 100", size, s.Len())
+	}
+}
+
+func TestTinyLFU(t *testing.T) {
+	// share of hot keys surviving a scan of one-time keys
+	hot := func(opts ...Option) float64 {
+		s, _ := NewLRUStorage(append([]Option{WithShards(1), WithMaxEntries(1000)}, opts...)...)
+		defer s.Close()
+		for i := 0; i < 500; i++ {
+			s.Set("hot"+strconv.Itoa(i), []byte("1"), 0)
+		}
+		for j := 0; j < 10; j++ {
+			for i := 0; i < 500; i++ {
+				s.Get("hot" + strconv.Itoa(i))
+			}
+		}
+		for i := 0; i < 10000; i++ {
+			s.Set("cold"+strconv.Itoa(i), []byte("1"), 0)
+		}
+		n := 0
+		for i := 0; i < 500; i++ {
+			if _, err := s.Get("hot" + strconv.Itoa(i)); err == nil {
+				n++
+			}
+		}
+		return float64(n) / 500
+	}
+	plain, admitted := hot(), hot(WithTinyLFU(4096))
+	if admitted < 0.8 || admitted < plain+0.2 {
+		t.Fatalf("%.2f of hot keys kept with TinyLFU, %.2f without", admitted, plain)
+	}
+}
+
+func TestAging(t *testing.T) {
+	worth := func(s *LFUStorage, key string) float64 {
+		shard := s.shards[0]
+		shard.Lock()
+		defer shard.Unlock()
+		e := shard.data[s.KeyHash(key)]
+		shard.fold(e)
+		return e.worth
+	}
+	s, _ := NewLFUStorage(WithShards(1))
+	defer s.Close()
+	s.Set("a", []byte("1"), 0)
+	for i := 0; i < 8; i++ {
+		s.Get("a")
+	}
+	if w := worth(s, "a"); w != 8 {
+		t.Fatalf("worth %f after 8 hits", w)
+	}
+	s.Age()
+	if w := worth(s, "a"); w != 4 {
+		t.Fatalf("worth %f after aging", w)
+	}
+
+	// every 10 hits to a shard halve it
+	byHits, _ := NewLFUStorage(WithShards(1), WithAgingHits(10))
+	defer byHits.Close()
+	byHits.Set("a", []byte("1"), 0)
+	for i := 0; i < 10; i++ {
+		byHits.Get("a")
+	}
+	if w := worth(byHits, "a"); w != 5 {
+		t.Fatalf("worth %f after 10 hits with AgingHits 10", w)
+	}
+	if total := byHits.shards[0].GetTotalWorth(); total != 5 {
+		t.Fatalf("total worth %f", total)
+	}
+
+	byPeriod, _ := NewLFUStorage(WithShards(1), WithAgingPeriod(time.Millisecond))
+	defer byPeriod.Close()
+	byPeriod.Set("a", []byte("1"), 0)
+	for i := 0; i < 1000; i++ {
+		byPeriod.Get("a")
+	}
+	for i := 0; worth(byPeriod, "a") > 500; i++ {
+		if i == 1000 {
+			t.Fatal("worth not aged in background")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSampledEviction(t *testing.T) {
+	s, _ := NewLFUStorage(WithShards(1), WithMaxEntries(100), WithSampledEviction(10))
+	defer s.Close()
+	for i := 0; i < 50; i++ {
+		s.Set("hot"+strconv.Itoa(i), []byte("1"), 0)
+		for j := 0; j < 10; j++ {
+			s.Get("hot" + strconv.Itoa(i))
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		s.Set("cold"+strconv.Itoa(i), []byte("1"), 0)
+	}
+	// one victim per Set, not a cut down to the mean
+	if n := s.Len(); n < 100 || n > 101 {
+		t.Fatalf("%d entries under a limit of 100", n)
+	}
+	// the lowest worth of a sample leaves, a random victim would have taken them all
+	n := 0
+	for i := 0; i < 50; i++ {
+		if _, err := s.Get("hot" + strconv.Itoa(i)); err == nil {
+			n++
+		}
+	}
+	if n < 20 {
+		t.Fatalf("%d of 50 hot keys kept", n)
+	}
+}
+
+// keepTouched evicts only entries never hit nor overwritten
+type keepTouched struct{}
+
+func (keepTouched) OnInsert(old float64, existed bool) float64 {
+	if existed {
+		return 1
+	}
+	return 0
+}
+
+func (keepTouched) OnHit(worth float64) float64 {
+	return 1
+}
+
+func (keepTouched) Victim(worth float64, mean float64) bool {
+	return worth == 0
+}
+
+func TestPolicyShard(t *testing.T) {
+	cost := 1 + entryOverhead
+	s := NewPolicyShard(keepTouched{}, 10*cost, 20*cost, 100)
+	for k := uint64(0); k < 10; k++ {
+		s.Set(k, []byte("1"), ttlForever)
+	}
+	s.Set(0, []byte("2"), ttlForever)
+	s.Get(1)
+	for k := uint64(10); k < 100; k++ {
+		s.Set(k, []byte("1"), ttlForever)
+	}
+	for k := uint64(0); k < 2; k++ {
+		if _, err := s.Get(k); err != nil {
+			t.Fatalf("key %d evicted against the policy: %v", k, err)
+		}
+	}
+	if size := s.GetSize(); size > 11*cost {
+		t.Fatalf("size %d over a limit of %d", size, 10*cost)
+	}
+	if total := s.GetTotalWorth(); total != 2 {
+		t.Fatalf("total worth %f, want 2 kept entries", total)
+	}
+}
+
+func TestIncrementalClean(t *testing.T) {
+	cost := 1 + entryOverhead
+	s, _ := NewLRUStorage(WithShards(1), WithMaxBytes(100*cost), WithCritBytes(150*cost), WithIncrementalClean(2, false))
+	defer s.Close()
+	for i := 0; i < 1000; i++ {
+		s.Set(strconv.Itoa(i), []byte("1"), 0)
+	}
+	// a couple of probes per Set, never over the critical size
+	if size := s.GetSize(); size > 150*cost || s.Stats().Evictions == 0 {
+		t.Fatalf("size %d, critical size %d", size, 150*cost)
+	}
+
+	onGet, _ := NewLRUStorage(WithShards(1), WithMaxBytes(100*cost), WithCritBytes(200*cost), WithIncrementalClean(2, true))
+	defer onGet.Close()
+	for i := 0; i < 100; i++ {
+		onGet.Set(strconv.Itoa(i), []byte("1"), 0)
+	}
+	// overwrites grow the shard over its limit without a clean
+	for i := 0; i < 100; i++ {
+		onGet.Set(strconv.Itoa(i), []byte("12"), 0)
+	}
+	if size := onGet.GetSize(); size <= 100*cost {
+		t.Fatalf("size %d after overwrites", size)
+	}
+	for i := 0; i < 1000 && onGet.GetSize() > 100*cost; i++ {
+		onGet.Get(strconv.Itoa(i % 100))
+	}
+	if size := onGet.GetSize(); size > 100*cost {
+		t.Fatalf("size %d left over %d by Gets", size, 100*cost)
+	}
+}
+
+func TestWatermarks(t *testing.T) {
+	s, _ := NewLRUStorage(WithShards(1), WithMaxEntries(100), WithWatermarks(0.9, 0.5, false))
+	defer s.Close()
+	for i := 0; i < 90; i++ {
+		s.Set(strconv.Itoa(i), []byte("1"), 0)
+	}
+	if n := s.Len(); n != 90 {
+		t.Fatalf("%d entries under the high watermark", n)
+	}
+	// the Set finding the shard at 90 evicts it down to 50 at once
+	s.Set("90", []byte("1"), 0)
+	if n := s.Len(); n != 51 {
+		t.Fatalf("%d entries after the high watermark, want 50 + 1", n)
+	}
+
+	async, _ := NewLRUStorage(WithShards(1), WithMaxEntries(100), WithWatermarks(0.9, 0.5, true))
+	defer async.Close()
+	for i := 0; i < 91; i++ {
+		async.Set(strconv.Itoa(i), []byte("1"), 0)
+	}
+	for i := 0; async.Len() > 51; i++ {
+		if i == 1000 {
+			t.Fatalf("%d entries left by async eviction", async.Len())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	for _, marks := range [][2]float64{{0.5, 0.9}, {1.5, 0.5}, {0.9, 0}} {
+		if _, err := NewLRUStorage(WithWatermarks(marks[0], marks[1], false)); !errors.Is(err, ErrInvalidConfig) {
+			t.Fatalf("watermarks %v accepted: %v", marks, err)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package probecache
+
+import (
+	"sync"
+)
+
+// Exact LFU with O(1) operations: entries with the same hit count share a
+// frequency bucket, buckets are linked in ascending order. A hit moves the entry
+// to the next bucket, eviction takes the least recently used entry of the lowest
+// bucket. Overwrite keeps the count.
+
+type lfuNode struct {
+	key        uint64
+	data       []byte
+	expire     uint64
+	bucket     *freqBucket
+	prev, next *lfuNode
+}
+
+type freqBucket struct {
+	freq       uint64
+	root       lfuNode // sentinel, root.next is the most recent
+	len        int
+	prev, next *freqBucket
+}
+
+type ExactLFUShard struct {
+	sync.Mutex
+	listBase
+	items   map[uint64]*lfuNode
+	buckets freqBucket // sentinel, buckets.next has the lowest freq
+	used    int
+}
+
+func NewExactLFUShard(capacity int, byBytes bool) *ExactLFUShard {
+	s := &ExactLFUShard{}
+	s.init(s, capacity, byBytes)
+	s.reset()
+	return s
+}
+
+func (s *ExactLFUShard) reset() {
+	s.items = make(map[uint64]*lfuNode)
+	s.buckets.next = &s.buckets
+	s.buckets.prev = &s.buckets
+	s.used = 0
+	s.size = 0
+}
+
+// overLimit reports whether one more entry of given cost doesn't fit
+func (s *ExactLFUShard) overLimit(cost int) bool {
+	if s.capacity > 0 && s.used+cost > s.capacity {
+		return true
+	}
+	return s.maxLen > 0 && len(s.items)+1 > s.maxLen
+}
+
+// Run in lock only. Returns bucket of freq right after prev, creating it if needed
+func (s *ExactLFUShard) bucketAfter(prev *freqBucket, freq uint64) *freqBucket {
+	if b := prev.next; b != &s.buckets && b.freq == freq {
+		return b
+	}
+	b := &freqBucket{freq: freq, prev: prev, next: prev.next}
+	b.root.next = &b.root
+	b.root.prev = &b.root
+	prev.next.prev = b
+	prev.next = b
+	return b
+}
+
+// Run in lock only
+func (s *ExactLFUShard) link(b *freqBucket, n *lfuNode) {
+	n.bucket = b
+	n.prev = &b.root
+	n.next = b.root.next
+	b.root.next.prev = n
+	b.root.next = n
+	b.len++
+}
+
+// Run in lock only. Takes node out of its bucket, empty buckets are dropped.
+// Returns bucket preceding the node's position
+func (s *ExactLFUShard) unlink(n *lfuNode) *freqBucket {
+	b := n.bucket
+	n.prev.next = n.next
+	n.next.prev = n.prev
+	n.prev, n.next, n.bucket = nil, nil, nil
+	b.len--
+	if b.len > 0 {
+		return b
+	}
+	b.prev.next = b.next
+	b.next.prev = b.prev
+	return b.prev
+}
+
+// Run in lock only
+func (s *ExactLFUShard) remove(n *lfuNode) {
+	s.unlink(n)
+	s.used -= s.cost(n.data)
+	s.size -= len(n.data) + entryOverhead
+	delete(s.items, n.key)
+}
+
+// Run in lock only
+func (s *ExactLFUShard) evictOne() {
+	n := s.buckets.next.root.prev
+	s.remove(n)
+	s.evicted(n.key, n.data, n.expire)
+}
+
+func (s *ExactLFUShard) Set(key uint64, data []byte, ttl uint64) {
+	if s.copyOnSet {
+		data = append([]byte(nil), data...)
+	}
+	s.Lock()
+	defer s.Unlock()
+	cost := s.cost(data)
+	if n, ok := s.items[key]; ok {
+		s.used += cost - s.cost(n.data)
+		s.size += len(data) - len(n.data)
+		s.removed(key, n.data, EvictReplaced)
+		n.data, n.expire = data, expireAt(ttl)
+		s.written(key, len(data))
+		b := n.bucket
+		s.unlink(n)
+		s.link(s.bucketAfter(b.prev, b.freq), n)
+		// grown entry may push others, itself included, out
+		for len(s.items) > 0 && s.capacity > 0 && s.used > s.capacity {
+			s.evictOne()
+		}
+		return
+	}
+	for len(s.items) > 0 && s.overLimit(cost) {
+		s.evictOne()
+	}
+	n := &lfuNode{key: key, data: data, expire: expireAt(ttl)}
+	s.link(s.bucketAfter(&s.buckets, 1), n)
+	s.items[key] = n
+	s.used += cost
+	s.size += len(data) + entryOverhead
+	s.written(key, len(data))
+}
+
+func (s *ExactLFUShard) put(key uint64, data []byte, ttl uint64) error {
+	if s.tooLarge(data) {
+		return ErrTooLarge
+	}
+	s.Set(key, data, ttl)
+	return nil
+}
+
+func (s *ExactLFUShard) get(key uint64) ([]byte, uint64, error) {
+	s.Lock()
+	defer s.Unlock()
+	n, ok := s.items[key]
+	if !ok {
+		s.miss()
+		return nil, 0, ErrMissing
+	}
+	if s.isExpired(n.expire) {
+		if !s.keepExpired {
+			s.expire(key)
+		}
+		s.miss()
+		return nil, 0, ErrExpired
+	}
+	freq := n.bucket.freq + 1
+	s.link(s.bucketAfter(s.unlink(n), freq), n)
+	s.hit()
+	return n.data, ttlLeft(n.expire), nil
+}
+
+func (s *ExactLFUShard) Get(key uint64) ([]byte, error) {
+	d, _, err := s.get(key)
+	return d, err
+}
+
+func (s *ExactLFUShard) GetWithTTL(key uint64) ([]byte, uint64, error) {
+	return s.get(key)
+}
+
+// Del removes entry, reports whether a live entry was removed
+func (s *ExactLFUShard) Del(key uint64) bool {
+	s.Lock()
+	defer s.Unlock()
+	n, ok := s.items[key]
+	if !ok {
+		return false
+	}
+	s.remove(n)
+	s.removed(key, n.data, EvictDeleted)
+	return !s.isExpired(n.expire)
+}
+
+func (s *ExactLFUShard) Clear() {
+	s.Lock()
+	defer s.Unlock()
+	s.reset()
+}
+
+func (s *ExactLFUShard) each(fn func(key uint64, expire uint64, data []byte)) {
+	for _, n := range s.items {
+		fn(n.key, n.expire, n.data)
+	}
+}
+
+// Run in lock only
+func (s *ExactLFUShard) expire(key uint64) {
+	n := s.items[key]
+	s.remove(n)
+	s.expired(n.key, n.data)
+}
+
+func (s *ExactLFUShard) count() int {
+	return len(s.items)
+}
+
+// ----------------------------------------------
+
+// ExactLFUStorage supports the IStorage subset of Config: NumShards, MaxMemSize,
+// MaxEntries, MaxEntrySize, DefaultTTL, CopyOnGet/CopyOnSet, OnEvict, OnExpire, OnRemove, EventBuffer,
+// ExpirationMode, CleanPeriod
+type ExactLFUStorage struct {
+	listStorage[*ExactLFUShard]
+}
+
+func NewExactLFUStorage(opts ...Option) (*ExactLFUStorage, error) {
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	capacity, byBytes, _ := listLimits(cfg)
+	shards := make([]*ExactLFUShard, cfg.NumShards)
+	for i := range shards {
+		shards[i] = NewExactLFUShard(capacity, byBytes)
+	}
+	s := &ExactLFUStorage{}
+	s.init(cfg, newKeyHasher(cfg.KeyHash, cfg.Hasher), shards)
+	return s, nil
+}
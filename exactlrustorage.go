@@ -0,0 +1,201 @@
+package probecache
+
+import (
+	"sync"
+)
+
+// Exact LRU: entries are linked into an intrusive doubly-linked list, every hit
+// moves the entry to the front and eviction always takes the least recently
+// used one from the back. Costs two pointers per entry and a write lock on Get,
+// in exchange eviction order is deterministic.
+
+type lruNode struct {
+	key        uint64
+	data       []byte
+	expire     uint64
+	prev, next *lruNode
+}
+
+type ExactLRUShard struct {
+	sync.Mutex
+	listBase
+	items map[uint64]*lruNode
+	root  lruNode // sentinel, root.next is the most recent, root.prev the least
+	used  int
+}
+
+func NewExactLRUShard(capacity int, byBytes bool) *ExactLRUShard {
+	s := &ExactLRUShard{}
+	s.init(s, capacity, byBytes)
+	s.reset()
+	return s
+}
+
+func (s *ExactLRUShard) reset() {
+	s.items = make(map[uint64]*lruNode)
+	s.root.next = &s.root
+	s.root.prev = &s.root
+	s.used = 0
+	s.size = 0
+}
+
+// overLimit reports whether one more entry of given cost doesn't fit
+func (s *ExactLRUShard) overLimit(cost int) bool {
+	if s.capacity > 0 && s.used+cost > s.capacity {
+		return true
+	}
+	return s.maxLen > 0 && len(s.items)+1 > s.maxLen
+}
+
+// Run in lock only
+func (s *ExactLRUShard) pushFront(n *lruNode) {
+	n.prev = &s.root
+	n.next = s.root.next
+	s.root.next.prev = n
+	s.root.next = n
+}
+
+// Run in lock only
+func (s *ExactLRUShard) unlink(n *lruNode) {
+	n.prev.next = n.next
+	n.next.prev = n.prev
+	n.prev, n.next = nil, nil
+}
+
+// Run in lock only
+func (s *ExactLRUShard) remove(n *lruNode) {
+	s.unlink(n)
+	s.used -= s.cost(n.data)
+	s.size -= len(n.data) + entryOverhead
+	delete(s.items, n.key)
+}
+
+// Run in lock only
+func (s *ExactLRUShard) evictOne() {
+	n := s.root.prev
+	s.remove(n)
+	s.evicted(n.key, n.data, n.expire)
+}
+
+func (s *ExactLRUShard) Set(key uint64, data []byte, ttl uint64) {
+	if s.copyOnSet {
+		data = append([]byte(nil), data...)
+	}
+	s.Lock()
+	defer s.Unlock()
+	if n, ok := s.items[key]; ok {
+		s.remove(n)
+		s.removed(key, n.data, EvictReplaced)
+	}
+	cost := s.cost(data)
+	for len(s.items) > 0 && s.overLimit(cost) {
+		s.evictOne()
+	}
+	n := &lruNode{key: key, data: data, expire: expireAt(ttl)}
+	s.pushFront(n)
+	s.items[key] = n
+	s.used += cost
+	s.size += len(data) + entryOverhead
+	s.written(key, len(data))
+}
+
+func (s *ExactLRUShard) put(key uint64, data []byte, ttl uint64) error {
+	if s.tooLarge(data) {
+		return ErrTooLarge
+	}
+	s.Set(key, data, ttl)
+	return nil
+}
+
+func (s *ExactLRUShard) get(key uint64) ([]byte, uint64, error) {
+	s.Lock()
+	defer s.Unlock()
+	n, ok := s.items[key]
+	if !ok {
+		s.miss()
+		return nil, 0, ErrMissing
+	}
+	if s.isExpired(n.expire) {
+		if !s.keepExpired {
+			s.expire(key)
+		}
+		s.miss()
+		return nil, 0, ErrExpired
+	}
+	if s.root.next != n {
+		s.unlink(n)
+		s.pushFront(n)
+	}
+	s.hit()
+	return n.data, ttlLeft(n.expire), nil
+}
+
+func (s *ExactLRUShard) Get(key uint64) ([]byte, error) {
+	d, _, err := s.get(key)
+	return d, err
+}
+
+func (s *ExactLRUShard) GetWithTTL(key uint64) ([]byte, uint64, error) {
+	return s.get(key)
+}
+
+// Del removes entry, reports whether a live entry was removed
+func (s *ExactLRUShard) Del(key uint64) bool {
+	s.Lock()
+	defer s.Unlock()
+	n, ok := s.items[key]
+	if !ok {
+		return false
+	}
+	s.remove(n)
+	s.removed(key, n.data, EvictDeleted)
+	return !s.isExpired(n.expire)
+}
+
+func (s *ExactLRUShard) Clear() {
+	s.Lock()
+	defer s.Unlock()
+	s.reset()
+}
+
+// each walks the list least recent first, so Restore keeps the order
+func (s *ExactLRUShard) each(fn func(key uint64, expire uint64, data []byte)) {
+	for n := s.root.prev; n != &s.root; n = n.prev {
+		fn(n.key, n.expire, n.data)
+	}
+}
+
+// Run in lock only
+func (s *ExactLRUShard) expire(key uint64) {
+	n := s.items[key]
+	s.remove(n)
+	s.expired(n.key, n.data)
+}
+
+func (s *ExactLRUShard) count() int {
+	return len(s.items)
+}
+
+// ----------------------------------------------
+
+// ExactLRUStorage supports the IStorage subset of Config: NumShards, MaxMemSize,
+// MaxEntries, MaxEntrySize, DefaultTTL, CopyOnGet/CopyOnSet, OnEvict, OnExpire, OnRemove, EventBuffer,
+// ExpirationMode, CleanPeriod
+type ExactLRUStorage struct {
+	listStorage[*ExactLRUShard]
+}
+
+func NewExactLRUStorage(opts ...Option) (*ExactLRUStorage, error) {
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	capacity, byBytes, _ := listLimits(cfg)
+	shards := make([]*ExactLRUShard, cfg.NumShards)
+	for i := range shards {
+		shards[i] = NewExactLRUShard(capacity, byBytes)
+	}
+	s := &ExactLRUStorage{}
+	s.init(cfg, newKeyHasher(cfg.KeyHash, cfg.Hasher), shards)
+	return s, nil
+}
@@ -0,0 +1,123 @@
+package probecache
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ExpirationMode selects how expired entries are removed, same for all storages
+type ExpirationMode int
+
+const (
+	// ExpireDefault keeps storage specific behavior: TTLStorage is hybrid with its
+	// CleanPeriod cleaner, LRU/LFU run the janitor only with JanitorPeriod, others are lazy
+	ExpireDefault ExpirationMode = iota
+	// ExpireLazy removes expired entries on access only, no background cleaning
+	ExpireLazy
+	// ExpireActive removes them by a background cleaner every CleanPeriod only,
+	// reads report expired entries missing but leave them in place
+	ExpireActive
+	// ExpireHybrid does both
+	ExpireHybrid
+)
+
+func (m ExpirationMode) String() string {
+	switch m {
+	case ExpireDefault:
+		return "default"
+	case ExpireLazy:
+		return "lazy"
+	case ExpireActive:
+		return "active"
+	case ExpireHybrid:
+		return "hybrid"
+	}
+	return "unknown"
+}
+
+// expirePeriod is the period of background expiration, 0 if the mode has none.
+// legacy is the storage specific period for ExpireDefault
+func (c Config) expirePeriod(legacy time.Duration) time.Duration {
+	switch c.ExpirationMode {
+	case ExpireLazy:
+		return 0
+	case ExpireActive, ExpireHybrid:
+		return c.CleanPeriod
+	}
+	return legacy
+}
+
+func (c Config) validateExpirationMode() error {
+	switch c.ExpirationMode {
+	case ExpireDefault, ExpireLazy:
+	case ExpireActive, ExpireHybrid:
+		if c.CleanPeriod <= 0 {
+			return fmt.Errorf("%w: %s expiration needs CleanPeriod", ErrInvalidConfig, c.ExpirationMode)
+		}
+	default:
+		return fmt.Errorf("%w: unknown ExpirationMode %d", ErrInvalidConfig, c.ExpirationMode)
+	}
+	return nil
+}
+
+// janitor calls fn every period in the background until stopped, runs don't overlap:
+// the next period starts when fn returns
+type janitor struct {
+	pool   *workerPool
+	period time.Duration
+	prio   priority
+	fn     func(ctx context.Context)
+	timer  *time.Timer
+
+	mu      sync.Mutex
+	stopped bool
+	running sync.WaitGroup
+}
+
+// startJanitor returns nil for period 0, which is safe to stop
+func startJanitor(pool *workerPool, period time.Duration, prio priority, fn func(ctx context.Context)) *janitor {
+	if period <= 0 {
+		return nil
+	}
+	j := &janitor{pool: pool, period: period, prio: prio, fn: fn}
+	j.timer = time.AfterFunc(period, j.due)
+	return j
+}
+
+func (j *janitor) due() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.stopped {
+		return
+	}
+	j.running.Add(1)
+	ok := j.pool.submit(j.prio, func(ctx context.Context) {
+		defer j.running.Done()
+		if ctx.Err() != nil {
+			return
+		}
+		j.fn(ctx)
+		j.mu.Lock()
+		if !j.stopped {
+			j.timer.Reset(j.period)
+		}
+		j.mu.Unlock()
+	})
+	if !ok {
+		j.running.Done()
+	}
+}
+
+// stop waits for a run in progress
+func (j *janitor) stop() {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	j.stopped = true
+	j.timer.Stop()
+	j.mu.Unlock()
+	j.running.Wait()
+}
@@ -0,0 +1,125 @@
+package probecache
+
+import (
+	"container/heap"
+	"fmt"
+)
+
+// ExpiryIndex selects how TTL and LRU/LFU shards find expired entries
+type ExpiryIndex int
+
+const (
+	// ExpiryWheel is a timing wheel of ExpiryTick resolution: O(1) per Set, expired
+	// entries are removed up to one tick late. Same as ExpiryScan if ExpiryTick is 0
+	ExpiryWheel ExpiryIndex = iota
+	// ExpiryHeap is a min-heap of expire times: O(log n) per Set, no delay
+	ExpiryHeap
+	// ExpiryScan keeps no index, expired entries are found by full shard scans
+	ExpiryScan
+)
+
+func (i ExpiryIndex) String() string {
+	switch i {
+	case ExpiryWheel:
+		return "wheel"
+	case ExpiryHeap:
+		return "heap"
+	case ExpiryScan:
+		return "scan"
+	}
+	return "unknown"
+}
+
+// records beyond twice the shard length that trigger an index rebuild
+const expiryRebuildSlack = 64
+
+type expiryRecord struct {
+	key    uint64
+	expire uint64
+}
+
+// expiryIndex keeps expire times of shard entries. Records are never removed:
+// overwritten, prolonged or deleted entries leave stale ones, which the shard
+// recognizes by expire mismatch. Not thread safe, shards use it in lock.
+type expiryIndex interface {
+	add(key uint64, expire uint64)
+	// advance hands records due by now to fn, which reports whether it removed an entry.
+	// Returns the number of removed entries
+	advance(now uint64, fn func(key uint64, expire uint64) bool) int
+	len() int
+	reset()
+}
+
+var (
+	_ expiryIndex = (*timingWheel)(nil)
+	_ expiryIndex = (*expiryHeap)(nil)
+)
+
+// newExpiryIndex returns nil for ExpiryScan. Records are due delay ms after expire
+func (c Config) newExpiryIndex(delay uint64) expiryIndex {
+	switch {
+	case c.ExpiryIndex == ExpiryHeap:
+		return &expiryHeap{delay: delay}
+	case c.ExpiryIndex == ExpiryWheel && c.ExpiryTick > 0:
+		return newTimingWheel(c.ExpiryTick, delay)
+	}
+	return nil
+}
+
+func (c Config) validateExpiry() error {
+	if c.ExpiryTick < 0 {
+		return fmt.Errorf("%w: negative ExpiryTick", ErrInvalidConfig)
+	}
+	if c.ExpiryIndex < ExpiryWheel || c.ExpiryIndex > ExpiryScan {
+		return fmt.Errorf("%w: unknown ExpiryIndex %d", ErrInvalidConfig, c.ExpiryIndex)
+	}
+	return nil
+}
+
+// ----------------------------------------------
+
+type expiryRecords []expiryRecord
+
+func (h expiryRecords) Len() int           { return len(h) }
+func (h expiryRecords) Less(i, j int) bool { return h[i].expire < h[j].expire }
+func (h expiryRecords) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *expiryRecords) Push(x interface{}) {
+	*h = append(*h, x.(expiryRecord))
+}
+
+func (h *expiryRecords) Pop() interface{} {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	*h = old[:n-1]
+	return e
+}
+
+type expiryHeap struct {
+	records expiryRecords
+	delay   uint64
+}
+
+func (h *expiryHeap) add(key uint64, expire uint64) {
+	heap.Push(&h.records, expiryRecord{key, expire})
+}
+
+func (h *expiryHeap) advance(now uint64, fn func(key uint64, expire uint64) bool) int {
+	n := 0
+	for len(h.records) > 0 && h.records[0].expire+h.delay <= now {
+		e := heap.Pop(&h.records).(expiryRecord)
+		if fn(e.key, e.expire) {
+			n++
+		}
+	}
+	return n
+}
+
+func (h *expiryHeap) len() int {
+	return len(h.records)
+}
+
+func (h *expiryHeap) reset() {
+	h.records = nil
+}
@@ -0,0 +1,511 @@
+package probecache
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestOverrideTTL(t *testing.T) {
+	s, _ := NewLRUStorage(WithShards(1), WithTrackKeys())
+	defer s.Close()
+	s.SetWithDuration("pin:1", []byte("1"), 10*time.Millisecond)
+	s.SetWithDuration("other", []byte("2"), 10*time.Millisecond)
+	if err := s.OverrideTTL("pin:*", time.Minute, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if n := s.DeleteExpired(); n != 1 {
+		t.Fatalf("deleted %d expired entries, want the one not matching", n)
+	}
+	if data, err := s.Get("pin:1"); string(data) != "1" {
+		t.Fatalf("pinned entry %q, %v", data, err)
+	}
+	if st := s.OverrideStats(); len(st) != 1 || st[0].Saved != 1 {
+		t.Fatalf("override stats %+v", st)
+	}
+
+	untracked, _ := NewTTLStorage(WithShards(1), WithExpiryIndex(ExpiryHeap))
+	defer untracked.Close()
+	if err := untracked.OverrideTTL("pin:*", time.Minute, time.Now().Add(time.Hour)); !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("wildcard without TrackKeys: %v", err)
+	}
+	untracked.SetWithDuration("pin:1", []byte("1"), 10*time.Millisecond)
+	untracked.SetWithDuration("other", []byte("2"), 10*time.Millisecond)
+	if err := untracked.OverrideTTL("pin:1", time.Minute, time.Now().Add(30*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	untracked.DeleteExpired()
+	if untracked.Len() != 1 {
+		t.Fatalf("%d entries left, want the literal match", untracked.Len())
+	}
+	time.Sleep(20 * time.Millisecond)
+	if st := untracked.OverrideStats(); len(st) != 0 {
+		t.Fatalf("expired rule kept: %+v", st)
+	}
+	untracked.DeleteExpired()
+	if untracked.Len() != 0 {
+		t.Fatalf("%d entries left after the rule expired", untracked.Len())
+	}
+}
+
+func TestDurationTTL(t *testing.T) {
+	lru, _ := NewLRUStorage(WithShards(1))
+	defer lru.Close()
+	ttl, _ := NewTTLStorage(WithShards(1))
+	defer ttl.Close()
+	fifo, _ := NewFIFOStorage(WithShards(1))
+	defer fifo.Close()
+	for name, s := range map[string]interface {
+		IStorage
+		SetWithDuration(key string, data []byte, ttl time.Duration) error
+		GetWithDuration(key string) ([]byte, time.Duration, error)
+	}{"LRU": lru, "TTL": ttl, "FIFO": fifo} {
+		s.SetWithDuration("a", []byte("1"), 1500*time.Millisecond)
+		if _, left, _ := s.GetWithDuration("a"); left <= time.Second || left > 1500*time.Millisecond {
+			t.Fatalf("%s: %v left of 1.5s", name, left)
+		}
+		// seconds are rounded up, the entry isn't reported persistent
+		if _, left, _ := s.GetWithTTL("a"); left != 2 {
+			t.Fatalf("%s: %ds left of 1.5s", name, left)
+		}
+		s.SetWithDuration("b", []byte("2"), 0)
+		if _, left, err := s.GetWithDuration("b"); left != 0 || err != nil {
+			t.Fatalf("%s: persistent entry %v left, %v", name, left, err)
+		}
+	}
+}
+
+func TestDeleteExpired(t *testing.T) {
+	lru, _ := NewLRUStorage(WithShards(2), WithExpiryIndex(ExpiryScan))
+	defer lru.Close()
+	lfu, _ := NewLFUStorage(WithShards(2), WithExpiryIndex(ExpiryScan))
+	defer lfu.Close()
+	for name, s := range map[string]interface {
+		IStorage
+		SetWithDuration(key string, data []byte, ttl time.Duration) error
+		DeleteExpired() int
+	}{"LRU": lru, "LFU": lfu} {
+		for i := 0; i < 10; i++ {
+			s.SetWithDuration("e"+strconv.Itoa(i), []byte("1"), time.Millisecond)
+			s.Set("p"+strconv.Itoa(i), []byte("1"), 0)
+		}
+		size := s.GetSize()
+		time.Sleep(5 * time.Millisecond)
+		if n := s.DeleteExpired(); n != 10 {
+			t.Fatalf("%s: %d expired entries removed", name, n)
+		}
+		if n := s.DeleteExpired(); n != 0 {
+			t.Fatalf("%s: %d removed again", name, n)
+		}
+		st := s.Stats()
+		if st.Len != 10 || st.Size != size/2 || st.Expirations != 10 {
+			t.Fatalf("%s: %+v", name, st)
+		}
+	}
+}
+
+func TestDefaultTTL(t *testing.T) {
+	for name, make := range map[string]func(opts ...Option) (IStorage, error){
+		"LRU":  func(o ...Option) (IStorage, error) { return NewLRUStorage(o...) },
+		"TTL":  func(o ...Option) (IStorage, error) { return NewTTLStorage(o...) },
+		"FIFO": func(o ...Option) (IStorage, error) { return NewFIFOStorage(o...) },
+	} {
+		s, _ := make(WithShards(1), WithDefaultTTL(time.Minute))
+		s.Set("default", []byte("1"), 0)
+		s.Set("own", []byte("1"), 5)
+		if _, left, _ := s.GetWithTTL("default"); left != 60 {
+			t.Errorf("%s: default ttl %d", name, left)
+		}
+		if _, left, _ := s.GetWithTTL("own"); left != 5 {
+			t.Errorf("%s: own ttl %d", name, left)
+		}
+		s.Close()
+
+		s, _ = make(WithShards(1), WithDefaultTTL(NoExpiration))
+		s.Set("a", []byte("1"), 0)
+		if _, left, err := s.GetWithTTL("a"); left != 0 || err != nil {
+			t.Errorf("%s: NoExpiration ttl %d, %v", name, left, err)
+		}
+		s.Close()
+	}
+}
+
+func TestSubSecondTTL(t *testing.T) {
+	lru, _ := NewLRUStorage(WithShards(1))
+	defer lru.Close()
+	ttl, _ := NewTTLStorage(WithShards(1))
+	defer ttl.Close()
+	fifo, _ := NewFIFOStorage(WithShards(1))
+	defer fifo.Close()
+	for name, s := range map[string]interface {
+		IStorage
+		SetWithDuration(key string, data []byte, ttl time.Duration) error
+	}{"LRU": lru, "TTL": ttl, "FIFO": fifo} {
+		s.SetWithDuration("a", []byte("1"), 200*time.Millisecond)
+		s.SetWithDuration("b", []byte("1"), 20*time.Millisecond)
+		time.Sleep(50 * time.Millisecond)
+		if _, err := s.Get("a"); err != nil {
+			t.Errorf("%s: 200ms entry gone after 50ms: %v", name, err)
+		}
+		if _, err := s.Get("b"); !errors.Is(err, ErrExpired) {
+			t.Errorf("%s: 20ms entry after 50ms: %v", name, err)
+		}
+	}
+}
+
+func TestZeroTTL(t *testing.T) {
+	makers := map[string]func(opts ...Option) (IStorage, error){
+		"LRU":  func(o ...Option) (IStorage, error) { return NewLRUStorage(o...) },
+		"TTL":  func(o ...Option) (IStorage, error) { return NewTTLStorage(o...) },
+		"Ring": func(o ...Option) (IStorage, error) { return NewRingStorage(o...) },
+	}
+	for name, make := range listStorages {
+		makers[name] = make
+	}
+	for name, make := range makers {
+		s, _ := make(WithShards(1), WithMaxBytes(1<<20))
+		s.Set("a", []byte("1"), 0)
+		time.Sleep(2 * time.Millisecond)
+		s.(interface{ DeleteExpired() int }).DeleteExpired()
+		if _, left, err := s.GetWithTTL("a"); left != 0 || err != nil {
+			t.Errorf("%s: ttl 0 entry: %d left, %v", name, left, err)
+		}
+		s.Close()
+	}
+}
+
+func TestTTLJitter(t *testing.T) {
+	lru, _ := NewLRUStorage(WithShards(1), WithTTLJitter(0.5))
+	defer lru.Close()
+	ttl, _ := NewTTLStorage(WithShards(1), WithTTLJitter(0.5))
+	defer ttl.Close()
+	for name, s := range map[string]IStorage{"LRU": lru, "TTL": ttl} {
+		seen := map[uint64]bool{}
+		for i := 0; i < 100; i++ {
+			key := strconv.Itoa(i)
+			s.Set(key, []byte("1"), 100)
+			_, left, _ := s.GetWithTTL(key)
+			if left < 50 || left > 150 {
+				t.Fatalf("%s: ttl %d out of 100±50%%", name, left)
+			}
+			seen[left] = true
+		}
+		if len(seen) < 10 {
+			t.Fatalf("%s: %d distinct ttls of 100 entries", name, len(seen))
+		}
+		s.Set("p", []byte("1"), 0)
+		if _, left, _ := s.GetWithTTL("p"); left != 0 {
+			t.Fatalf("%s: persistent entry jittered to %d", name, left)
+		}
+	}
+}
+
+func TestXFetch(t *testing.T) {
+	s, _ := NewLRUStorage(WithShards(1), WithSeed(1), WithXFetch(1, 10*time.Second))
+	defer s.Close()
+	s.Set("soon", []byte("1"), 1)
+	s.Set("late", []byte("1"), 3600)
+	s.Set("never", []byte("1"), 0)
+	early := map[string]int{}
+	for i := 0; i < 100; i++ {
+		for _, key := range []string{"soon", "late", "never"} {
+			if _, err := s.Get(key); errors.Is(err, ErrMissing) {
+				early[key]++
+			}
+		}
+	}
+	// with 1s of 10s recompute time left about 90% of reads refresh
+	if early["soon"] < 50 || early["late"] != 0 || early["never"] != 0 {
+		t.Fatalf("early expirations %v", early)
+	}
+	if s.Len() != 3 {
+		t.Fatalf("early expiration removed entries, %d left", s.Len())
+	}
+}
+
+func TestGetStale(t *testing.T) {
+	calls := make(chan string, 10)
+	release := make(chan struct{})
+	s, _ := NewLRUStorage(WithShards(1), WithStaleWindow(time.Minute), WithRefresher(func(ctx context.Context, key string) ([]byte, uint64, error) {
+		calls <- key
+		<-release
+		return []byte("fresh"), 60, nil
+	}))
+	defer s.Close()
+	s.SetWithDuration("a", []byte("old"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		data, stale, err := s.GetStale("a")
+		if string(data) != "old" || !stale || err != nil {
+			t.Fatalf("stale hit %q, %v, %v", data, stale, err)
+		}
+	}
+	close(release)
+	if key := <-calls; key != "a" {
+		t.Fatalf("refreshed %q", key)
+	}
+	for i := 0; ; i++ {
+		data, stale, _ := s.GetStale("a")
+		if string(data) == "fresh" && !stale {
+			break
+		}
+		if i == 100 {
+			t.Fatal("refreshed value not set")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if len(calls) != 0 {
+		t.Fatalf("%d more refreshes of one stale entry", len(calls))
+	}
+
+	short, _ := NewLRUStorage(WithShards(1), WithStaleWindow(10*time.Millisecond))
+	defer short.Close()
+	short.SetWithDuration("a", []byte("old"), time.Millisecond)
+	time.Sleep(30 * time.Millisecond)
+	if _, _, err := short.GetStale("a"); !errors.Is(err, ErrMissing) {
+		t.Fatalf("entry past the stale window: %v", err)
+	}
+}
+
+func TestRefreshLimits(t *testing.T) {
+	started := make(chan string, 10)
+	s, _ := NewLRUStorage(WithShards(1), WithStaleWindow(time.Minute), WithRefreshLimits(2, 0),
+		WithRefresher(func(ctx context.Context, key string) ([]byte, uint64, error) {
+			started <- key
+			<-ctx.Done()
+			return []byte("late"), 60, nil
+		}))
+	for i := 0; i < 5; i++ {
+		s.SetWithDuration(strconv.Itoa(i), []byte("old"), time.Millisecond)
+	}
+	time.Sleep(5 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		s.GetStale(strconv.Itoa(i))
+	}
+	<-started
+	<-started
+	// Close cancels the hung refreshes and waits for them
+	s.Close()
+	if len(started) != 0 {
+		t.Fatalf("%d refreshes over the limit of 2", 2+len(started))
+	}
+	if s.refresher.wg.Wait(); len(s.refresher.inflight) != 0 {
+		t.Fatal("refreshes left in flight after Close")
+	}
+
+	timedOut := make(chan error, 1)
+	short, _ := NewLRUStorage(WithShards(1), WithStaleWindow(time.Minute), WithRefreshLimits(0, time.Millisecond),
+		WithRefresher(func(ctx context.Context, key string) ([]byte, uint64, error) {
+			<-ctx.Done()
+			timedOut <- ctx.Err()
+			return []byte("late"), 60, nil
+		}))
+	defer short.Close()
+	short.SetWithDuration("a", []byte("old"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	short.GetStale("a")
+	if err := <-timedOut; !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("refresh ended by %v", err)
+	}
+	// a value loaded past the deadline is dropped
+	if _, stale, _ := short.GetStale("a"); !stale {
+		t.Fatal("late refresh was set")
+	}
+}
+
+func TestTimingWheel(t *testing.T) {
+	w := &timingWheel{tick: 10}
+	// ticks of every level and the overflow
+	expires := []uint64{0, 5, 10, 639, 640, 655, 40959, 40960, 2621439, 2621440, 167772159, 167772160, 200000000}
+	for i, expire := range expires {
+		w.add(uint64(i), expire)
+	}
+	due := map[uint64]bool{}
+	fired := func(key uint64, expire uint64) bool {
+		if expire != expires[key] || due[key] {
+			t.Fatalf("record %d handed out twice or broken", key)
+		}
+		due[key] = true
+		return true
+	}
+	for now := uint64(0); now < 201000000; now = now*3/2 + 7 {
+		w.advance(now, fired)
+		// a tick is due once fully passed
+		for i, expire := range expires {
+			if want := expire/10 < now/10; due[uint64(i)] != want {
+				t.Fatalf("now %d: record of expire %d due %v", now, expire, due[uint64(i)])
+			}
+		}
+	}
+	w.advance(201000000, fired)
+	if len(due) != len(expires) {
+		t.Fatalf("%d records of %d due at the end", len(due), len(expires))
+	}
+	if w.len() != 0 {
+		t.Fatalf("%d records left", w.len())
+	}
+}
+
+func TestExpiryIndex(t *testing.T) {
+	for _, index := range []ExpiryIndex{ExpiryWheel, ExpiryHeap, ExpiryScan} {
+		s, _ := NewLRUStorage(WithShards(2), WithExpiryIndex(index), WithExpiryTick(time.Millisecond))
+		for i := 0; i < 10; i++ {
+			s.SetWithDuration("e"+strconv.Itoa(i), []byte("1"), time.Millisecond)
+			s.Set("p"+strconv.Itoa(i), []byte("1"), 0)
+		}
+		// overwritten entries leave stale records behind
+		for i := 0; i < 5; i++ {
+			s.Set("e"+strconv.Itoa(i), []byte("1"), 0)
+		}
+		time.Sleep(5 * time.Millisecond)
+		if n := s.DeleteExpired(); n != 5 || s.Len() != 15 {
+			t.Fatalf("%s: %d expired entries removed, %d left", index, n, s.Len())
+		}
+		s.Close()
+	}
+
+	h := &expiryHeap{delay: 10}
+	for _, expire := range []uint64{30, 10, 20} {
+		h.add(expire, expire)
+	}
+	var due []uint64
+	n := h.advance(30, func(key uint64, expire uint64) bool {
+		due = append(due, key)
+		return key != 20
+	})
+	if n != 1 || len(due) != 2 || due[0] != 10 || due[1] != 20 || h.len() != 1 {
+		t.Fatalf("heap handed out %v by 30 with delay 10, %d removed", due, n)
+	}
+
+	for _, opt := range []Option{WithExpiryIndex(ExpiryIndex(7)), WithExpiryTick(-time.Second)} {
+		if _, err := NewLRUStorage(opt); !errors.Is(err, ErrInvalidConfig) {
+			t.Fatalf("invalid expiry config accepted: %v", err)
+		}
+	}
+}
+
+func TestJanitor(t *testing.T) {
+	s, _ := NewLRUStorage(WithShards(2), WithExpiryIndex(ExpiryHeap), WithJanitor(time.Millisecond))
+	defer s.Close()
+	for i := 0; i < 10; i++ {
+		s.SetWithDuration("e"+strconv.Itoa(i), []byte("1"), time.Millisecond)
+		s.Set("p"+strconv.Itoa(i), []byte("1"), 0)
+	}
+	// removed in background, without a read or a write
+	for i := 0; s.Len() != 10; i++ {
+		if i == 1000 {
+			t.Fatalf("%d entries left by the janitor", s.Len())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if st := s.Stats(); st.Expirations != 10 {
+		t.Fatalf("%d expirations", st.Expirations)
+	}
+
+	manual, _ := NewLRUStorage(WithShards(2), WithExpiryIndex(ExpiryHeap))
+	defer manual.Close()
+	manual.SetWithDuration("e", []byte("1"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if n := manual.Shrink(); n != 1 || manual.Len() != 0 {
+		t.Fatalf("Shrink removed %d", n)
+	}
+}
+
+// passCtx is done after n checks
+type passCtx struct {
+	context.Context
+	n int
+}
+
+func (c *passCtx) Err() error {
+	if c.n == 0 {
+		return context.DeadlineExceeded
+	}
+	c.n--
+	return nil
+}
+
+func TestJanitorTimeout(t *testing.T) {
+	if _, err := NewLRUStorage(WithCleanTimeout(-1)); !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("negative CleanTimeout accepted: %v", err)
+	}
+	s, _ := NewLRUStorage(WithShards(4), WithExpiryIndex(ExpiryHeap))
+	defer s.Close()
+	for i := 0; i < 100; i++ {
+		s.SetWithDuration(strconv.Itoa(i), []byte("1"), time.Millisecond)
+	}
+	time.Sleep(5 * time.Millisecond)
+	// a pass out of time after a shard leaves the rest to the next ones
+	for pass := 1; pass <= 4; pass++ {
+		s.shrink(&passCtx{Context: context.Background(), n: 1})
+		left := 0
+		for _, shard := range s.shards[pass:] {
+			left += len(shard.data)
+		}
+		if left != s.Len() {
+			t.Fatalf("pass %d: %d entries left, %d in later shards", pass, s.Len(), left)
+		}
+	}
+	if s.Len() != 0 {
+		t.Fatalf("%d entries left after a pass per shard", s.Len())
+	}
+}
+
+func TestExpirationMode(t *testing.T) {
+	makers := map[string]func(opts ...Option) (IStorage, error){
+		"LRU": func(o ...Option) (IStorage, error) { return NewLRUStorage(o...) },
+		"LFU": func(o ...Option) (IStorage, error) { return NewLFUStorage(o...) },
+		"TTL": func(o ...Option) (IStorage, error) { return NewTTLStorage(o...) },
+	}
+	for name, make := range listStorages {
+		makers[name] = make
+	}
+	type expiring interface {
+		IStorage
+		SetWithDuration(key string, data []byte, ttl time.Duration) error
+		DeleteExpired() int
+	}
+	open := func(name string, opts ...Option) expiring {
+		s, err := makers[name](append([]Option{WithShards(1), WithExpiryIndex(ExpiryHeap)}, opts...)...)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		s.(expiring).SetWithDuration("a", []byte("1"), time.Millisecond)
+		time.Sleep(5 * time.Millisecond)
+		return s.(expiring)
+	}
+	for name := range makers {
+		lazy := open(name, WithExpirationMode(ExpireLazy))
+		if _, err := lazy.Get("a"); err == nil || lazy.Len() != 0 {
+			t.Fatalf("%s: lazy read left an expired entry, %v", name, err)
+		}
+		lazy.Close()
+
+		// reads leave expired entries to the cleaner
+		active := open(name, WithExpirationMode(ExpireActive), WithCleanPeriod(time.Hour))
+		if _, err := active.Get("a"); err == nil || active.Len() != 1 {
+			t.Fatalf("%s: active read removed an expired entry, %v", name, err)
+		}
+		if n := active.DeleteExpired(); n != 1 {
+			t.Fatalf("%s: %d removed", name, n)
+		}
+		active.Close()
+
+		hybrid := open(name, WithExpirationMode(ExpireHybrid), WithCleanPeriod(time.Millisecond))
+		for i := 0; hybrid.Len() != 0; i++ {
+			if i == 1000 {
+				t.Fatalf("%s: expired entry not cleaned in background", name)
+			}
+			time.Sleep(time.Millisecond)
+		}
+		hybrid.Close()
+
+		if _, err := makers[name](WithExpirationMode(ExpireActive), WithCleanPeriod(0)); !errors.Is(err, ErrInvalidConfig) {
+			t.Fatalf("%s: active expiration without a cleaner accepted: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,15 @@
+package probecache
+
+import "expvar"
+
+// PublishExpvar exports live Stats of s under name in /debug/vars, computed on every
+// read of the variable. Like expvar.Publish it panics if name is already taken
+func PublishExpvar(name string, s IStorage) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		st := s.Stats()
+		return struct {
+			Stats
+			HitRate float64
+		}{st, st.HitRate()}
+	}))
+}
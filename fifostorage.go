@@ -0,0 +1,197 @@
+package probecache
+
+import (
+	"container/list"
+	"sync"
+)
+
+// FIFO: entries are evicted in insertion order, reads don't touch the queue
+// and take a read lock. Overwriting a key keeps its place in the queue.
+
+type fifoEntry struct {
+	key    uint64
+	data   []byte
+	expire uint64
+}
+
+type FIFOShard struct {
+	sync.RWMutex
+	listBase
+	items map[uint64]*list.Element
+	queue *list.List
+	used  int
+}
+
+func NewFIFOShard(capacity int, byBytes bool) *FIFOShard {
+	s := &FIFOShard{}
+	s.init(s, capacity, byBytes)
+	s.reset()
+	return s
+}
+
+func (s *FIFOShard) reset() {
+	s.items = make(map[uint64]*list.Element)
+	s.queue = list.New()
+	s.used = 0
+	s.size = 0
+}
+
+// overLimit reports whether one more entry of given cost doesn't fit
+func (s *FIFOShard) overLimit(cost int) bool {
+	if s.capacity > 0 && s.used+cost > s.capacity {
+		return true
+	}
+	return s.maxLen > 0 && len(s.items)+1 > s.maxLen
+}
+
+// Run in lock only
+func (s *FIFOShard) remove(el *list.Element) *fifoEntry {
+	e := s.queue.Remove(el).(*fifoEntry)
+	s.used -= s.cost(e.data)
+	s.size -= len(e.data) + entryOverhead
+	delete(s.items, e.key)
+	return e
+}
+
+// Run in lock only
+func (s *FIFOShard) evictOne() {
+	e := s.remove(s.queue.Back())
+	s.evicted(e.key, e.data, e.expire)
+}
+
+func (s *FIFOShard) Set(key uint64, data []byte, ttl uint64) {
+	if s.copyOnSet {
+		data = append([]byte(nil), data...)
+	}
+	s.Lock()
+	defer s.Unlock()
+	cost := s.cost(data)
+	if el, ok := s.items[key]; ok {
+		e := el.Value.(*fifoEntry)
+		s.used += cost - s.cost(e.data)
+		s.size += len(data) - len(e.data)
+		s.removed(key, e.data, EvictReplaced)
+		e.data, e.expire = data, expireAt(ttl)
+		s.written(key, len(data))
+		// grown entry may push others, itself included, out
+		for s.queue.Len() > 0 && s.capacity > 0 && s.used > s.capacity {
+			s.evictOne()
+		}
+		return
+	}
+	for s.queue.Len() > 0 && s.overLimit(cost) {
+		s.evictOne()
+	}
+	e := &fifoEntry{key: key, data: data, expire: expireAt(ttl)}
+	s.items[key] = s.queue.PushFront(e)
+	s.used += cost
+	s.size += len(data) + entryOverhead
+	s.written(key, len(data))
+}
+
+func (s *FIFOShard) put(key uint64, data []byte, ttl uint64) error {
+	if s.tooLarge(data) {
+		return ErrTooLarge
+	}
+	s.Set(key, data, ttl)
+	return nil
+}
+
+func (s *FIFOShard) get(key uint64) ([]byte, uint64, error) {
+	s.RLock()
+	el, ok := s.items[key]
+	if !ok {
+		s.RUnlock()
+		s.miss()
+		return nil, 0, ErrMissing
+	}
+	e := el.Value.(*fifoEntry)
+	data, expire := e.data, e.expire
+	s.RUnlock()
+	if !s.isExpired(expire) {
+		s.hit()
+		return data, ttlLeft(expire), nil
+	}
+
+	s.miss()
+	if s.keepExpired {
+		return nil, 0, ErrExpired
+	}
+	s.Lock()
+	defer s.Unlock()
+	// may have been replaced while unlocked
+	if el, ok := s.items[key]; ok && s.isExpired(el.Value.(*fifoEntry).expire) {
+		s.expire(key)
+	}
+	return nil, 0, ErrExpired
+}
+
+func (s *FIFOShard) Get(key uint64) ([]byte, error) {
+	d, _, err := s.get(key)
+	return d, err
+}
+
+func (s *FIFOShard) GetWithTTL(key uint64) ([]byte, uint64, error) {
+	return s.get(key)
+}
+
+// Del removes entry, reports whether a live entry was removed
+func (s *FIFOShard) Del(key uint64) bool {
+	s.Lock()
+	defer s.Unlock()
+	el, ok := s.items[key]
+	if !ok {
+		return false
+	}
+	e := s.remove(el)
+	s.removed(key, e.data, EvictDeleted)
+	return !s.isExpired(e.expire)
+}
+
+func (s *FIFOShard) Clear() {
+	s.Lock()
+	defer s.Unlock()
+	s.reset()
+}
+
+// each walks the queue oldest first, so Restore keeps the order
+func (s *FIFOShard) each(fn func(key uint64, expire uint64, data []byte)) {
+	for el := s.queue.Back(); el != nil; el = el.Prev() {
+		e := el.Value.(*fifoEntry)
+		fn(e.key, e.expire, e.data)
+	}
+}
+
+// Run in lock only
+func (s *FIFOShard) expire(key uint64) {
+	e := s.remove(s.items[key])
+	s.expired(e.key, e.data)
+}
+
+func (s *FIFOShard) count() int {
+	return len(s.items)
+}
+
+// ----------------------------------------------
+
+// FIFOStorage supports the IStorage subset of Config: NumShards, MaxMemSize,
+// MaxEntries, MaxEntrySize, DefaultTTL, CopyOnGet/CopyOnSet, OnEvict, OnExpire, OnRemove, EventBuffer,
+// ExpirationMode, CleanPeriod
+type FIFOStorage struct {
+	listStorage[*FIFOShard]
+}
+
+func NewFIFOStorage(opts ...Option) (*FIFOStorage, error) {
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	capacity, byBytes, _ := listLimits(cfg)
+	shards := make([]*FIFOShard, cfg.NumShards)
+	for i := range shards {
+		shards[i] = NewFIFOShard(capacity, byBytes)
+	}
+	s := &FIFOStorage{}
+	s.init(cfg, newKeyHasher(cfg.KeyHash, cfg.Hasher), shards)
+	return s, nil
+}
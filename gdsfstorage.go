@@ -0,0 +1,222 @@
+package probecache
+
+import (
+	"container/heap"
+	"sync"
+)
+
+// GDSF (Greedy-Dual-Size-Frequency): entry priority is L + hits/size, the one
+// with the lowest priority goes first. L is raised to the priority of every
+// evicted entry, so long unused entries age out. Large rarely hit entries are
+// evicted before small ones with the same hit count.
+
+type gdsfEntry struct {
+	key      uint64
+	data     []byte
+	expire   uint64
+	hits     uint64
+	priority float64
+	index    int
+}
+
+type gdsfHeap []*gdsfEntry
+
+func (h gdsfHeap) Len() int           { return len(h) }
+func (h gdsfHeap) Less(i, j int) bool { return h[i].priority < h[j].priority }
+func (h gdsfHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *gdsfHeap) Push(x interface{}) {
+	e := x.(*gdsfEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *gdsfHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return e
+}
+
+type GDSFShard struct {
+	sync.Mutex
+	listBase
+	items     map[uint64]*gdsfEntry
+	queue     gdsfHeap
+	inflation float64 // L
+	used      int
+}
+
+func NewGDSFShard(capacity int, byBytes bool) *GDSFShard {
+	s := &GDSFShard{}
+	s.init(s, capacity, byBytes)
+	s.reset()
+	return s
+}
+
+func (s *GDSFShard) reset() {
+	s.items = make(map[uint64]*gdsfEntry)
+	s.queue = nil
+	s.inflation = 0
+	s.used = 0
+	s.size = 0
+}
+
+// priority is size-aware even when capacity counts entries
+func (s *GDSFShard) priority(e *gdsfEntry) float64 {
+	return s.inflation + float64(e.hits)/float64(len(e.data)+entryOverhead)
+}
+
+// overLimit reports whether one more entry of given cost doesn't fit
+func (s *GDSFShard) overLimit(cost int) bool {
+	if s.capacity > 0 && s.used+cost > s.capacity {
+		return true
+	}
+	return s.maxLen > 0 && len(s.items)+1 > s.maxLen
+}
+
+// Run in lock only
+func (s *GDSFShard) remove(e *gdsfEntry) {
+	heap.Remove(&s.queue, e.index)
+	s.used -= s.cost(e.data)
+	s.size -= len(e.data) + entryOverhead
+	delete(s.items, e.key)
+}
+
+// Run in lock only
+func (s *GDSFShard) evictOne() {
+	e := s.queue[0]
+	s.remove(e)
+	s.inflation = e.priority
+	s.evicted(e.key, e.data, e.expire)
+}
+
+func (s *GDSFShard) Set(key uint64, data []byte, ttl uint64) {
+	if s.copyOnSet {
+		data = append([]byte(nil), data...)
+	}
+	s.Lock()
+	defer s.Unlock()
+	e := &gdsfEntry{key: key, data: data, expire: expireAt(ttl), hits: 1}
+	// overwrite counts as a hit
+	if old, ok := s.items[key]; ok {
+		e.hits = old.hits + 1
+		s.remove(old)
+		s.removed(key, old.data, EvictReplaced)
+	}
+	cost := s.cost(data)
+	for len(s.items) > 0 && s.overLimit(cost) {
+		s.evictOne()
+	}
+	e.priority = s.priority(e)
+	heap.Push(&s.queue, e)
+	s.items[key] = e
+	s.used += cost
+	s.size += len(data) + entryOverhead
+	s.written(key, len(data))
+}
+
+func (s *GDSFShard) put(key uint64, data []byte, ttl uint64) error {
+	if s.tooLarge(data) {
+		return ErrTooLarge
+	}
+	s.Set(key, data, ttl)
+	return nil
+}
+
+func (s *GDSFShard) get(key uint64) ([]byte, uint64, error) {
+	s.Lock()
+	defer s.Unlock()
+	e, ok := s.items[key]
+	if !ok {
+		s.miss()
+		return nil, 0, ErrMissing
+	}
+	if s.isExpired(e.expire) {
+		if !s.keepExpired {
+			s.expire(key)
+		}
+		s.miss()
+		return nil, 0, ErrExpired
+	}
+	e.hits++
+	e.priority = s.priority(e)
+	heap.Fix(&s.queue, e.index)
+	s.hit()
+	return e.data, ttlLeft(e.expire), nil
+}
+
+func (s *GDSFShard) Get(key uint64) ([]byte, error) {
+	d, _, err := s.get(key)
+	return d, err
+}
+
+func (s *GDSFShard) GetWithTTL(key uint64) ([]byte, uint64, error) {
+	return s.get(key)
+}
+
+// Del removes entry, reports whether a live entry was removed
+func (s *GDSFShard) Del(key uint64) bool {
+	s.Lock()
+	defer s.Unlock()
+	e, ok := s.items[key]
+	if !ok {
+		return false
+	}
+	s.remove(e)
+	s.removed(key, e.data, EvictDeleted)
+	return !s.isExpired(e.expire)
+}
+
+func (s *GDSFShard) Clear() {
+	s.Lock()
+	defer s.Unlock()
+	s.reset()
+}
+
+func (s *GDSFShard) each(fn func(key uint64, expire uint64, data []byte)) {
+	for _, e := range s.items {
+		fn(e.key, e.expire, e.data)
+	}
+}
+
+// Run in lock only
+func (s *GDSFShard) expire(key uint64) {
+	e := s.items[key]
+	s.remove(e)
+	s.expired(e.key, e.data)
+}
+
+func (s *GDSFShard) count() int {
+	return len(s.items)
+}
+
+// ----------------------------------------------
+
+// GDSFStorage supports the IStorage subset of Config: NumShards, MaxMemSize,
+// MaxEntries, MaxEntrySize, DefaultTTL, CopyOnGet/CopyOnSet, OnEvict, OnExpire, OnRemove, EventBuffer,
+// ExpirationMode, CleanPeriod
+type GDSFStorage struct {
+	listStorage[*GDSFShard]
+}
+
+func NewGDSFStorage(opts ...Option) (*GDSFStorage, error) {
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	capacity, byBytes, _ := listLimits(cfg)
+	shards := make([]*GDSFShard, cfg.NumShards)
+	for i := range shards {
+		shards[i] = NewGDSFShard(capacity, byBytes)
+	}
+	s := &GDSFStorage{}
+	s.init(cfg, newKeyHasher(cfg.KeyHash, cfg.Hasher), shards)
+	return s, nil
+}
@@ -0,0 +1,150 @@
+package probecache
+
+import (
+	"fmt"
+	"hash/maphash"
+
+	"github.com/cespare/xxhash"
+)
+
+// KeyHash selects the hash string keys are turned into, it picks shards and is
+// the key of shard maps
+type KeyHash int
+
+const (
+	// HashFNV is FNV-1a, byte at a time: fast for short keys
+	HashFNV KeyHash = iota
+	// HashXXHash is xxHash64, much faster for long keys (URLs and such)
+	HashXXHash
+	// HashMaphash is the runtime hash of Go maps, seeded randomly per storage,
+	// so hashes differ between storages and process runs
+	HashMaphash
+	// HashMurmur3 is 128-bit MurmurHash3: one half is the key hash, LRU/LFU keep the
+	// other in entries and verify it on access, as with CollisionSafe
+	HashMurmur3
+)
+
+func (h KeyHash) String() string {
+	switch h {
+	case HashFNV:
+		return "fnv"
+	case HashXXHash:
+		return "xxhash"
+	case HashMaphash:
+		return "maphash"
+	case HashMurmur3:
+		return "murmur3"
+	}
+	return "unknown"
+}
+
+// Hasher is a user supplied key hash, e.g. keyed SipHash against hash flooding
+// by untrusted keys. It must be safe for concurrent use
+type Hasher interface {
+	Hash(key string) uint64
+}
+
+// HasherFunc adapts a function to Hasher
+type HasherFunc func(key string) uint64
+
+func (f HasherFunc) Hash(key string) uint64 {
+	return f(key)
+}
+
+type keyHasher struct {
+	kind   KeyHash
+	seed   maphash.Seed
+	custom Hasher // overrides kind if set
+}
+
+func newKeyHasher(kind KeyHash, custom Hasher) keyHasher {
+	h := keyHasher{kind: kind, custom: custom}
+	if kind == HashMaphash {
+		h.seed = maphash.MakeSeed()
+	}
+	return h
+}
+
+func (h keyHasher) sum(key string) uint64 {
+	if h.custom != nil {
+		return h.custom.Hash(key)
+	}
+	switch h.kind {
+	case HashXXHash:
+		return xxhash.Sum64String(key)
+	case HashMaphash:
+		var mh maphash.Hash
+		mh.SetSeed(h.seed)
+		mh.WriteString(key)
+		return mh.Sum64()
+	case HashMurmur3:
+		h, _ := murmur3(key)
+		return h
+	}
+	var hash uint64 = offset64
+	for i := 0; i < len(key); i++ {
+		hash ^= uint64(key[i])
+		hash *= prime64
+	}
+	return hash
+}
+
+// sumB hashes []byte key the same way as sum, without string conversion
+// unless the hash is custom
+func (h keyHasher) sumB(key []byte) uint64 {
+	if h.custom != nil {
+		return h.custom.Hash(string(key))
+	}
+	switch h.kind {
+	case HashXXHash:
+		return xxhash.Sum64(key)
+	case HashMaphash:
+		var mh maphash.Hash
+		mh.SetSeed(h.seed)
+		mh.Write(key)
+		return mh.Sum64()
+	case HashMurmur3:
+		h, _ := murmur3(string(key))
+		return h
+	}
+	var hash uint64 = offset64
+	for i := 0; i < len(key); i++ {
+		hash ^= uint64(key[i])
+		hash *= prime64
+	}
+	return hash
+}
+
+// wide reports whether the hash has a second half to keep in entries
+func (h keyHasher) wide() bool {
+	return h.custom == nil && h.kind == HashMurmur3
+}
+
+// sum128 is both halves of a wide hash, the second is never 0 (see keyCheck)
+func (h keyHasher) sum128(key string) (uint64, uint64) {
+	lo, hi := murmur3(key)
+	return lo, hi | 1
+}
+
+// keyCheck is the second key hash CollisionSafe storages keep in entries, never 0:
+// that marks entries stored without it. Seeded independently of the key hash
+func keyCheck(seed maphash.Seed, key string) uint64 {
+	var mh maphash.Hash
+	mh.SetSeed(seed)
+	mh.WriteString(key)
+	return mh.Sum64() | 1
+}
+
+func keyCheckB(seed maphash.Seed, key []byte) uint64 {
+	var mh maphash.Hash
+	mh.SetSeed(seed)
+	mh.Write(key)
+	return mh.Sum64() | 1
+}
+
+func (c Config) validateKeyHash() error {
+	if c.KeyHash < HashFNV || c.KeyHash > HashMurmur3 {
+		return fmt.Errorf("%w: unknown KeyHash %d", ErrInvalidConfig, c.KeyHash)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package probecache
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCollisionSafe(t *testing.T) {
+	same := HasherFunc(func(key string) uint64 { return 42 })
+	s, err := NewLRUStorage(WithHasher(same), WithCollisionSafe())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.Set("a", []byte("1"), 0)
+	if _, err := s.Get("b"); err != ErrMissing {
+		t.Fatalf("colliding key: got %v, want ErrMissing", err)
+	}
+	if ok, _ := s.SetIfPresent("b", []byte("2"), 0); ok {
+		t.Fatal("SetIfPresent wrote over a colliding key")
+	}
+	s.Del("b")
+	if v, err := s.Get("a"); err != nil || string(v) != "1" {
+		t.Fatalf("got %q %v after Del of a colliding key", v, err)
+	}
+	s.Set("b", []byte("2"), 0)
+	if _, err := s.Get("a"); err != ErrMissing {
+		t.Fatalf("replaced key: got %v, want ErrMissing", err)
+	}
+	if v, err := s.Get("b"); err != nil || string(v) != "2" {
+		t.Fatalf("got %q %v", v, err)
+	}
+}
+
+func TestMurmur3(t *testing.T) {
+	for key, want := range map[string][2]uint64{
+		"hello": {0xcbd8a7b341bd9b02, 0x5b1e906a48ae1d19},
+		"The quick brown fox jumps over the lazy dog": {0xe34bbc7bbc071b6c, 0x7a433ca9c49a9347},
+	} {
+		if h1, h2 := murmur3(key); h1 != want[0] || h2 != want[1] {
+			t.Errorf("murmur3(%q) = %016x%016x, want %016x%016x", key, h1, h2, want[0], want[1])
+		}
+	}
+}
+
+func TestKeyHash(t *testing.T) {
+	for kind, want := range map[KeyHash]uint64{HashFNV: 0xaf63dc4c8601ec8c, HashXXHash: 0xd24ec4f1a98c6e5b} {
+		if h := newKeyHasher(kind, nil).sum("a"); h != want {
+			t.Errorf("%s(a) = %016x, want %016x", kind, h, want)
+		}
+	}
+	for _, kind := range []KeyHash{HashFNV, HashXXHash, HashMaphash, HashMurmur3} {
+		h := newKeyHasher(kind, nil)
+		if h.sum("key") != h.sumB([]byte("key")) {
+			t.Errorf("%s: string and []byte keys hash apart", kind)
+		}
+		s, err := NewLRUStorage(WithKeyHash(kind))
+		if err != nil {
+			t.Fatal(kind, err)
+		}
+		s.Set("a", []byte("1"), 0)
+		if v, err := s.Get("a"); err != nil || string(v) != "1" {
+			t.Errorf("%s: got %q %v", kind, v, err)
+		}
+		s.Close()
+	}
+	// seeded per storage
+	if newKeyHasher(HashMaphash, nil).sum("a") == newKeyHasher(HashMaphash, nil).sum("a") {
+		t.Error("maphash storages share a seed")
+	}
+	if _, err := NewLRUStorage(WithKeyHash(KeyHash(9))); !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("unknown KeyHash accepted: %v", err)
+	}
+}
@@ -0,0 +1,121 @@
+package importer
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+type Options struct {
+	// Glob pattern of keys to import, "*" by default
+	Pattern string
+	// Keys fetched per round trip
+	BatchSize int
+	// TTL in seconds for keys without expiration on the source side,
+	// 0 leaves them to the storage DefaultTTL (no expiration by default)
+	DefaultTTL uint64
+	// Dial and per batch IO timeout, the import as a whole is bounded by its ctx
+	Timeout time.Duration
+	// Called after every batch
+	Progress func(p Progress)
+
+	// Redis only
+	Password string
+	DB       int
+}
+
+type Progress struct {
+	Scanned  int
+	Imported int
+	Skipped  int
+}
+
+func (o *Options) setDefaults() {
+	if o.Pattern == "" {
+		o.Pattern = "*"
+	}
+	if o.BatchSize <= 0 {
+		o.BatchSize = 100
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = 10 * time.Second
+	}
+}
+
+type conn struct {
+	net.Conn
+	r       *bufio.Reader
+	w       *bufio.Writer
+	timeout time.Duration
+	ctx     context.Context
+	stop    func() bool
+}
+
+// dial connects to addr, IO in progress fails once ctx is done
+func dial(ctx context.Context, addr string, timeout time.Duration) (*conn, error) {
+	d := net.Dialer{Timeout: timeout}
+	nc, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &conn{
+		Conn:    nc,
+		r:       bufio.NewReader(nc),
+		w:       bufio.NewWriter(nc),
+		timeout: timeout,
+		ctx:     ctx,
+	}
+	c.stop = context.AfterFunc(ctx, c.interrupt)
+	return c, nil
+}
+
+func (c *conn) Close() error {
+	c.stop()
+	return c.Conn.Close()
+}
+
+func (c *conn) interrupt() {
+	c.SetDeadline(time.Unix(1, 0))
+}
+
+func (c *conn) deadline() {
+	c.SetDeadline(time.Now().Add(c.timeout))
+	// ctx done before the deadline was set
+	if c.ctx.Err() != nil {
+		c.interrupt()
+	}
+}
+
+// fail reports err of IO interrupted by ctx as ctx.Err()
+func (c *conn) fail(err error) error {
+	if ctxErr := c.ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+func (c *conn) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("importer: malformed line %q", line)
+	}
+	return line[:len(line)-2], nil
+}
+
+func (p *Progress) report(opts *Options) {
+	if opts.Progress != nil {
+		opts.Progress(*p)
+	}
+}
+
+func ttlFromDuration(d time.Duration, opts *Options) uint64 {
+	if d < 0 {
+		return opts.DefaultTTL
+	}
+	return uint64((d + time.Second - 1) / time.Second)
+}
@@ -0,0 +1,164 @@
+package importer
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	pcache "github.com/n1ord/probecache"
+)
+
+// serve runs a fake server for one connection, handle gets request lines
+// (memcached) or command arguments joined by spaces (redis) and returns the reply
+func serve(t *testing.T, resp bool, handle func(req string) string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		r := bufio.NewReader(c)
+		for {
+			req, err := readRequest(r, resp)
+			if err != nil {
+				return
+			}
+			if _, err := c.Write([]byte(handle(req))); err != nil {
+				return
+			}
+		}
+	}()
+	return l.Addr().String()
+}
+
+func readRequest(r *bufio.Reader, resp bool) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil || !resp {
+		return strings.TrimSuffix(line, "\r\n"), err
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+	args := make([]string, n)
+	for i := range args {
+		if _, err := r.ReadString('\n'); err != nil {
+			return "", err
+		}
+		arg, err := r.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		args[i] = strings.TrimSuffix(arg, "\r\n")
+	}
+	return strings.Join(args, " "), nil
+}
+
+func TestFromMemcached(t *testing.T) {
+	future := time.Now().Add(100 * time.Second).Unix()
+	addr := serve(t, false, func(req string) string {
+		switch req {
+		case "lru_crawler metadump all":
+			return "key=a1 exp=-1 la=0\r\n" +
+				fmt.Sprintf("key=a%%3A2 exp=%d la=0\r\n", future) +
+				"key=a3 exp=1 la=0\r\n" +
+				"key=a4 exp=-1 la=0\r\n" +
+				"key=b1 exp=-1 la=0\r\n" +
+				"END\r\n"
+		case "get a1 a:2 a3 a4":
+			// a3 expired and a4 is gone since the dump
+			return "VALUE a1 0 2\r\nv1\r\nVALUE a:2 0 2\r\nv2\r\nVALUE a3 0 2\r\nv3\r\nEND\r\n"
+		}
+		return "ERROR\r\n"
+	})
+	s, _ := pcache.NewLRUStorage(pcache.WithShards(1))
+	defer s.Close()
+	p, err := FromMemcached(context.Background(), addr, s, Options{Pattern: "a*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p != (Progress{Scanned: 4, Imported: 2, Skipped: 2}) {
+		t.Fatalf("progress %+v", p)
+	}
+	if data, ttl, _ := s.GetWithTTL("a1"); string(data) != "v1" || ttl != 0 {
+		t.Fatalf("a1 imported %q with ttl %d", data, ttl)
+	}
+	if data, ttl, _ := s.GetWithTTL("a:2"); string(data) != "v2" || ttl < 99 || ttl > 100 {
+		t.Fatalf("a:2 imported %q with ttl %d", data, ttl)
+	}
+}
+
+func TestFromRedis(t *testing.T) {
+	authed := false
+	addr := serve(t, true, func(req string) string {
+		if !authed && req != "AUTH secret" {
+			return "-NOAUTH Authentication required\r\n"
+		}
+		switch req {
+		case "AUTH secret":
+			authed = true
+			return "+OK\r\n"
+		case "SCAN 0 MATCH * COUNT 2":
+			return "*2\r\n$1\r\n7\r\n*2\r\n$2\r\nk1\r\n$4\r\nlist\r\n"
+		case "SCAN 7 MATCH * COUNT 2":
+			return "*2\r\n$1\r\n0\r\n*2\r\n$2\r\nk2\r\n$4\r\ngone\r\n"
+		case "GET k1":
+			return "$2\r\nv1\r\n"
+		case "GET k2":
+			return "$2\r\nv2\r\n"
+		case "GET list":
+			return "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"
+		case "GET gone":
+			return "$-1\r\n"
+		case "PTTL k2":
+			return ":4500\r\n"
+		case "PTTL gone":
+			return ":-2\r\n"
+		case "PTTL k1", "PTTL list":
+			return ":-1\r\n"
+		}
+		return "-ERR unknown " + req + "\r\n"
+	})
+	s, _ := pcache.NewLRUStorage(pcache.WithShards(1))
+	defer s.Close()
+	batches := 0
+	p, err := FromRedis(context.Background(), addr, s, Options{BatchSize: 2, DefaultTTL: 60, Password: "secret", Progress: func(Progress) { batches++ }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if batches != 2 || p != (Progress{Scanned: 4, Imported: 2, Skipped: 2}) {
+		t.Fatalf("%d batches, progress %+v", batches, p)
+	}
+	if data, ttl, _ := s.GetWithTTL("k1"); string(data) != "v1" || ttl != 60 {
+		t.Fatalf("k1 imported %q with ttl %d", data, ttl)
+	}
+	if data, ttl, _ := s.GetWithTTL("k2"); string(data) != "v2" || ttl != 5 {
+		t.Fatalf("k2 imported %q with ttl %d", data, ttl)
+	}
+}
+
+func TestImportCancel(t *testing.T) {
+	stall := make(chan struct{})
+	defer close(stall)
+	addr := serve(t, true, func(req string) string {
+		<-stall
+		return ""
+	})
+	s, _ := pcache.NewLRUStorage(pcache.WithShards(1))
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := FromRedis(ctx, addr, s, Options{Timeout: time.Minute})
+	if !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > 10*time.Second {
+		t.Fatalf("stalled import returned %v after %v", err, time.Since(start))
+	}
+}
@@ -0,0 +1,152 @@
+package importer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	pcache "github.com/n1ord/probecache"
+)
+
+type mcKey struct {
+	key    string
+	expire int64
+}
+
+// FromMemcached lists keys with "lru_crawler metadump all" (memcached 1.4.31+),
+// filters them by opts.Pattern (path.Match syntax) and fetches values with
+// multi-key get. Keys evicted between dump and get are skipped. Once ctx is done
+// the import stops with ctx.Err(), keys imported so far stay in storage.
+func FromMemcached(ctx context.Context, addr string, storage pcache.IStorage, opts Options) (Progress, error) {
+	opts.setDefaults()
+	var p Progress
+	c, err := dial(ctx, addr, opts.Timeout)
+	if err != nil {
+		return p, err
+	}
+	defer c.Close()
+
+	keys, err := c.mcMetadump(&opts)
+	if err != nil {
+		return p, c.fail(err)
+	}
+	for len(keys) > 0 {
+		n := opts.BatchSize
+		if n > len(keys) {
+			n = len(keys)
+		}
+		if err := c.mcImportBatch(storage, keys[:n], &opts, &p); err != nil {
+			return p, c.fail(err)
+		}
+		keys = keys[n:]
+		p.report(&opts)
+	}
+	return p, nil
+}
+
+func (c *conn) mcMetadump(opts *Options) ([]mcKey, error) {
+	c.deadline()
+	if _, err := c.w.WriteString("lru_crawler metadump all\r\n"); err != nil {
+		return nil, err
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	var keys []mcKey
+	for {
+		// the dump of a big instance may take longer than one timeout
+		c.deadline()
+		line, err := c.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if line == "END" {
+			return keys, nil
+		}
+		if strings.HasPrefix(line, "ERROR") || strings.HasPrefix(line, "BUSY") || strings.HasPrefix(line, "CLIENT_ERROR") {
+			return nil, fmt.Errorf("importer: memcached: metadump: %s", line)
+		}
+		k := mcKey{expire: -1}
+		for _, field := range strings.Fields(line) {
+			i := strings.IndexByte(field, '=')
+			if i < 0 {
+				continue
+			}
+			switch field[:i] {
+			case "key":
+				k.key, err = url.QueryUnescape(field[i+1:])
+				if err != nil {
+					return nil, err
+				}
+			case "exp":
+				k.expire, _ = strconv.ParseInt(field[i+1:], 10, 64)
+			}
+		}
+		if k.key == "" {
+			continue
+		}
+		if ok, _ := path.Match(opts.Pattern, k.key); ok {
+			keys = append(keys, k)
+		}
+	}
+}
+
+func (c *conn) mcImportBatch(storage pcache.IStorage, keys []mcKey, opts *Options, p *Progress) error {
+	c.deadline()
+	c.w.WriteString("get")
+	expires := make(map[string]int64, len(keys))
+	for _, k := range keys {
+		c.w.WriteString(" " + k.key)
+		expires[k.key] = k.expire
+	}
+	c.w.WriteString("\r\n")
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+	p.Scanned += len(keys)
+	found := 0
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return err
+		}
+		if line == "END" {
+			break
+		}
+		// VALUE <key> <flags> <bytes>
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[0] != "VALUE" {
+			return fmt.Errorf("importer: memcached: unexpected reply %q", line)
+		}
+		n, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return err
+		}
+		found++
+
+		ttl := opts.DefaultTTL
+		if expire := expires[fields[1]]; expire > 0 {
+			left := time.Until(time.Unix(expire, 0))
+			if left <= 0 {
+				p.Skipped++
+				continue
+			}
+			ttl = ttlFromDuration(left, opts)
+		}
+		if err := storage.Set(fields[1], buf[:n], ttl); err != nil {
+			return err
+		}
+		p.Imported++
+	}
+	p.Skipped += len(keys) - found
+	return nil
+}
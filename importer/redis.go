@@ -0,0 +1,176 @@
+package importer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	pcache "github.com/n1ord/probecache"
+)
+
+type redisError string
+
+func (e redisError) Error() string {
+	return "importer: redis: " + string(e)
+}
+
+// FromRedis walks keys matching opts.Pattern with SCAN and copies string values
+// with their TTLs into storage. Non-string keys and keys gone during the scan are skipped.
+// Once ctx is done the import stops with ctx.Err(), keys imported so far stay in storage.
+func FromRedis(ctx context.Context, addr string, storage pcache.IStorage, opts Options) (Progress, error) {
+	opts.setDefaults()
+	var p Progress
+	c, err := dial(ctx, addr, opts.Timeout)
+	if err != nil {
+		return p, err
+	}
+	defer c.Close()
+
+	if opts.Password != "" {
+		if _, err := c.redisDo("AUTH", opts.Password); err != nil {
+			return p, c.fail(err)
+		}
+	}
+	if opts.DB != 0 {
+		if _, err := c.redisDo("SELECT", strconv.Itoa(opts.DB)); err != nil {
+			return p, c.fail(err)
+		}
+	}
+
+	cursor := "0"
+	for {
+		reply, err := c.redisDo("SCAN", cursor, "MATCH", opts.Pattern, "COUNT", strconv.Itoa(opts.BatchSize))
+		if err != nil {
+			return p, c.fail(err)
+		}
+		scan, ok := reply.([]interface{})
+		if !ok || len(scan) != 2 {
+			return p, fmt.Errorf("importer: redis: unexpected SCAN reply %v", reply)
+		}
+		cursor, _ = scan[0].(string)
+		keys, _ := scan[1].([]interface{})
+		if err := c.redisImportBatch(storage, keys, &opts, &p); err != nil {
+			return p, c.fail(err)
+		}
+		p.report(&opts)
+		if cursor == "0" {
+			return p, nil
+		}
+	}
+}
+
+func (c *conn) redisImportBatch(storage pcache.IStorage, keys []interface{}, opts *Options, p *Progress) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	// pipeline GET+PTTL for the whole batch
+	c.deadline()
+	for _, k := range keys {
+		key, _ := k.(string)
+		c.redisWrite("GET", key)
+		c.redisWrite("PTTL", key)
+	}
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		key, _ := k.(string)
+		p.Scanned++
+		// WRONGTYPE and friends only skip the key
+		value, err := c.redisRead()
+		if _, ok := err.(redisError); err != nil && !ok {
+			return err
+		}
+		pttl, err := c.redisRead()
+		if _, ok := err.(redisError); err != nil && !ok {
+			return err
+		}
+		data, isString := value.(string)
+		ms, _ := pttl.(int64)
+		if !isString || ms == -2 {
+			p.Skipped++
+			continue
+		}
+		ttl := ttlFromDuration(time.Duration(ms)*time.Millisecond, opts)
+		if err := storage.Set(key, []byte(data), ttl); err != nil {
+			return err
+		}
+		p.Imported++
+	}
+	return nil
+}
+
+func (c *conn) redisDo(args ...string) (interface{}, error) {
+	c.deadline()
+	c.redisWrite(args...)
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	return c.redisRead()
+}
+
+func (c *conn) redisWrite(args ...string) {
+	fmt.Fprintf(c.w, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(c.w, "$%d\r\n%s\r\n", len(a), a)
+	}
+}
+
+// redisRead parses one RESP2 reply: strings and bulk strings as string,
+// integers as int64, arrays as []interface{}, nil bulk as nil.
+// Error replies are returned as redisError.
+func (c *conn) redisRead() (interface{}, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if line == "" {
+		return nil, fmt.Errorf("importer: redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		out := make([]interface{}, n)
+		for i := range out {
+			// nested errors are kept as values
+			v, err := c.redisRead()
+			if err != nil {
+				if re, ok := err.(redisError); ok {
+					v = re
+				} else {
+					return nil, err
+				}
+			}
+			out[i] = v
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("importer: redis: unknown reply %q", line)
+}
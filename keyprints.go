@@ -0,0 +1,191 @@
+package probecache
+
+import (
+	"fmt"
+	"strings"
+	"unsafe"
+)
+
+// prefixes of a key tracked by KeyFingerprints, deeper ones are left out
+const maxKeyPrints = 4
+
+// keyPrint holds fingerprints of the delimited prefixes of a key, shortest first, 0 ends them
+type keyPrint [maxKeyPrints]uint32
+
+// printedPrefix is the prefix that took a fingerprint first and number of keys under the fingerprint
+type printedPrefix struct {
+	name string
+	refs int
+}
+
+// keyPrints tracks keys of a shard by fingerprints of their prefixes ending with a delimiter,
+// KeyFingerprints only. A prefix string is kept once per fingerprint, not per key. Keys with
+// a prefix whose fingerprint another prefix took first spill over: their deepest tracked
+// prefix is kept as a string, so a fingerprint collision never deletes a key by mistake.
+// Run in the shard lock only
+type keyPrints struct {
+	delims   string
+	byKey    map[uint64]keyPrint
+	prefixes map[uint32]*printedPrefix
+	spill    map[uint64]string
+}
+
+func newKeyPrints(delims string) *keyPrints {
+	return &keyPrints{
+		delims:   delims,
+		byKey:    make(map[uint64]keyPrint),
+		prefixes: make(map[uint32]*printedPrefix),
+		spill:    make(map[uint64]string),
+	}
+}
+
+// fingerprint is never 0, that ends a keyPrint
+func fingerprint(prefix string) uint32 {
+	var hash uint32 = 2166136261
+	for i := 0; i < len(prefix); i++ {
+		hash ^= uint32(prefix[i])
+		hash *= 16777619
+	}
+	if hash == 0 {
+		return 1
+	}
+	return hash
+}
+
+// deepest is the longest prefix of key tracked, "" if key has no delimiter
+func (p *keyPrints) deepest(key string) string {
+	end, n := 0, 0
+	for i := 0; i < len(key) && n < maxKeyPrints; i++ {
+		if strings.IndexByte(p.delims, key[i]) >= 0 {
+			end, n = i+1, n+1
+		}
+	}
+	return key[:end]
+}
+
+// track fingerprints prefixes of deepest, the deepest tracked prefix of the key with hash h
+func (p *keyPrints) track(h uint64, deepest string) {
+	p.forget(h)
+	if deepest == "" {
+		return
+	}
+	var kp keyPrint
+	spilled := false
+	n := 0
+	for i := 0; i < len(deepest); i++ {
+		if strings.IndexByte(p.delims, deepest[i]) < 0 {
+			continue
+		}
+		prefix := deepest[:i+1]
+		f := fingerprint(prefix)
+		kp[n] = f
+		n++
+		pp, ok := p.prefixes[f]
+		if !ok {
+			// a substring of the key would pin the whole key in memory
+			pp = &printedPrefix{name: strings.Clone(prefix)}
+			p.prefixes[f] = pp
+		} else if pp.name != prefix {
+			spilled = true
+		}
+		pp.refs++
+	}
+	p.byKey[h] = kp
+	if spilled {
+		p.spill[h] = strings.Clone(deepest)
+	}
+}
+
+func (p *keyPrints) forget(h uint64) {
+	kp, ok := p.byKey[h]
+	if !ok {
+		return
+	}
+	for _, f := range kp {
+		if f == 0 {
+			break
+		}
+		pp := p.prefixes[f]
+		pp.refs--
+		if pp.refs == 0 {
+			delete(p.prefixes, f)
+		}
+	}
+	delete(p.byKey, h)
+	delete(p.spill, h)
+}
+
+// deepestOf is the deepest tracked prefix of the key with hash h
+func (p *keyPrints) deepestOf(h uint64) (string, bool) {
+	if name, ok := p.spill[h]; ok {
+		return name, true
+	}
+	kp, ok := p.byKey[h]
+	if !ok {
+		return "", false
+	}
+	last := kp[0]
+	for _, f := range kp {
+		if f != 0 {
+			last = f
+		}
+	}
+	return p.prefixes[last].name, true
+}
+
+// match returns hashes of keys starting with prefix, which ends with a delimiter
+func (p *keyPrints) match(prefix string) []uint64 {
+	f := fingerprint(prefix)
+	pp, ok := p.prefixes[f]
+	if !ok {
+		return nil
+	}
+	var keys []uint64
+	for h, kp := range p.byKey {
+		for _, pf := range kp {
+			if pf != f {
+				continue
+			}
+			// keys which didn't spill have the prefix that took the fingerprint
+			if name, spilled := p.spill[h]; spilled && strings.HasPrefix(name, prefix) || !spilled && pp.name == prefix {
+				keys = append(keys, h)
+			}
+			break
+		}
+	}
+	return keys
+}
+
+func (p *keyPrints) reset() {
+	p.byKey = make(map[uint64]keyPrint)
+	p.prefixes = make(map[uint32]*printedPrefix)
+	p.spill = make(map[uint64]string)
+}
+
+// memory is the map and string bytes the prints take
+func (p *keyPrints) memory() (maps int, strs int) {
+	maps = mapBytes(len(p.byKey), 8+int(unsafe.Sizeof(keyPrint{}))) +
+		mapBytes(len(p.prefixes), 4+8) + len(p.prefixes)*int(unsafe.Sizeof(printedPrefix{})) +
+		mapBytes(len(p.spill), 8+int(unsafe.Sizeof("")))
+	for _, pp := range p.prefixes {
+		strs += len(pp.name)
+	}
+	for _, name := range p.spill {
+		strs += len(name)
+	}
+	return maps, strs
+}
+
+// printedPrefixOf reports whether DeleteByPrefix can find keys by prefix with KeyFingerprints
+func printedPrefixOf(delims string, prefix string) error {
+	n := 0
+	for i := 0; i < len(prefix); i++ {
+		if strings.IndexByte(delims, prefix[i]) >= 0 {
+			n++
+		}
+	}
+	if n == 0 || n > maxKeyPrints || strings.IndexByte(delims, prefix[len(prefix)-1]) < 0 {
+		return fmt.Errorf("%w: prefix %q must end with one of the first %d delimiters %q", ErrKeysNotTracked, prefix, maxKeyPrints, delims)
+	}
+	return nil
+}
@@ -0,0 +1,335 @@
+package probecache
+
+import (
+	"container/list"
+	"sync"
+)
+
+// LIRS (Low Inter-reference Recency Set): entries re-referenced within a short
+// distance are LIR and take 99% of capacity, the rest are HIR and sit in queue Q
+// waiting for eviction. Stack S orders entries by recency, an HIR entry hit
+// while still in S has shorter reuse distance than the bottom LIR one and
+// swaps status with it. Evicted HIR entries stay in S as non-resident
+// ("ghosts"), up to the number of resident entries, to catch their next reuse.
+
+type lirsEntry struct {
+	key      uint64
+	data     []byte
+	expire   uint64
+	cost     int
+	lir      bool
+	resident bool
+	s        *list.Element // position in stack S, nil if pruned
+	q        *list.Element // position in Q for resident HIR, in ghosts for non-resident
+}
+
+type LIRSShard struct {
+	sync.Mutex
+	listBase
+	items       map[uint64]*lirsEntry
+	stack       *list.List // front is the most recent
+	queue       *list.List // resident HIR, front goes first
+	ghosts      *list.List // non-resident HIR, front is the oldest
+	lirSize     int
+	hirSize     int
+	residentLen int
+	lirCap      int
+}
+
+func NewLIRSShard(capacity int, byBytes bool) *LIRSShard {
+	s := &LIRSShard{}
+	s.init(s, capacity, byBytes)
+	if capacity > 0 {
+		s.lirCap = capacity - maxInt(capacity/100, 1)
+	}
+	s.reset()
+	return s
+}
+
+func (s *LIRSShard) reset() {
+	s.items = make(map[uint64]*lirsEntry)
+	s.stack, s.queue, s.ghosts = list.New(), list.New(), list.New()
+	s.lirSize, s.hirSize = 0, 0
+	s.residentLen = 0
+	s.size = 0
+}
+
+// over reports whether n more entries of given total cost don't fit
+func (s *LIRSShard) over(cost int, n int) bool {
+	if s.capacity > 0 && s.lirSize+s.hirSize+cost > s.capacity {
+		return true
+	}
+	return s.maxLen > 0 && s.residentLen+n > s.maxLen
+}
+
+// Run in lock only. Bottom of S must be LIR, HIR entries below it can't
+// become LIR anymore and are dropped from S
+func (s *LIRSShard) prune() {
+	for el := s.stack.Back(); el != nil; el = s.stack.Back() {
+		e := el.Value.(*lirsEntry)
+		if e.lir {
+			return
+		}
+		s.stack.Remove(el)
+		e.s = nil
+		if !e.resident {
+			s.ghosts.Remove(e.q)
+			delete(s.items, e.key)
+		}
+	}
+}
+
+// Run in lock only. Turns bottom LIR entry into resident HIR
+func (s *LIRSShard) demote() {
+	s.prune()
+	el := s.stack.Back()
+	e := el.Value.(*lirsEntry)
+	s.stack.Remove(el)
+	e.s = nil
+	e.lir = false
+	s.lirSize -= e.cost
+	s.hirSize += e.cost
+	e.q = s.queue.PushBack(e)
+	s.prune()
+}
+
+// Run in lock only. Evicts the oldest resident HIR entry
+func (s *LIRSShard) evictOne() {
+	if s.queue.Len() == 0 {
+		if s.lirSize == 0 {
+			return
+		}
+		s.demote()
+	}
+	e := s.queue.Remove(s.queue.Front()).(*lirsEntry)
+	s.hirSize -= e.cost
+	s.size -= len(e.data) + entryOverhead
+	s.residentLen--
+	s.evicted(e.key, e.data, e.expire)
+	if e.s == nil {
+		delete(s.items, e.key)
+		return
+	}
+	e.resident = false
+	e.data = nil
+	e.q = s.ghosts.PushBack(e)
+	for s.ghosts.Len() > maxInt(s.residentLen, 1) {
+		g := s.ghosts.Remove(s.ghosts.Front()).(*lirsEntry)
+		s.stack.Remove(g.s)
+		delete(s.items, g.key)
+	}
+	s.prune()
+}
+
+// Run in lock only. Removes entry with its history
+func (s *LIRSShard) remove(e *lirsEntry) {
+	if e.s != nil {
+		s.stack.Remove(e.s)
+	}
+	switch {
+	case !e.resident:
+		s.ghosts.Remove(e.q)
+	case e.lir:
+		s.lirSize -= e.cost
+	default:
+		s.queue.Remove(e.q)
+		s.hirSize -= e.cost
+	}
+	if e.resident {
+		s.size -= len(e.data) + entryOverhead
+		s.residentLen--
+	}
+	delete(s.items, e.key)
+	s.prune()
+}
+
+// Run in lock only. Reference to a resident entry
+func (s *LIRSShard) access(e *lirsEntry) {
+	if e.lir {
+		bottom := s.stack.Back() == e.s
+		s.stack.MoveToFront(e.s)
+		if bottom {
+			s.prune()
+		}
+		return
+	}
+	if e.s == nil {
+		// reuse distance is too long, stays HIR
+		e.s = s.stack.PushFront(e)
+		s.queue.MoveToBack(e.q)
+		return
+	}
+	s.stack.MoveToFront(e.s)
+	s.queue.Remove(e.q)
+	e.q = nil
+	e.lir = true
+	s.hirSize -= e.cost
+	s.lirSize += e.cost
+	for s.lirSize > s.lirCap && s.stack.Back() != e.s {
+		s.demote()
+	}
+}
+
+func (s *LIRSShard) Set(key uint64, data []byte, ttl uint64) {
+	if s.copyOnSet {
+		data = append([]byte(nil), data...)
+	}
+	s.Lock()
+	defer s.Unlock()
+	cost := s.cost(data)
+	e, ok := s.items[key]
+	if ok && e.resident {
+		if e.lir {
+			s.lirSize += cost - e.cost
+		} else {
+			s.hirSize += cost - e.cost
+		}
+		s.size += len(data) - len(e.data)
+		s.removed(key, e.data, EvictReplaced)
+		e.data, e.expire, e.cost = data, expireAt(ttl), cost
+		s.written(key, len(data))
+		s.access(e)
+		for s.residentLen > 0 && s.over(0, 0) {
+			s.evictOne()
+		}
+		return
+	}
+	for s.residentLen > 0 && s.over(cost, 1) {
+		s.evictOne()
+	}
+	// eviction may have pruned the ghost
+	e, ok = s.items[key]
+	if ok {
+		s.ghosts.Remove(e.q)
+		e.q = nil
+	} else {
+		e = &lirsEntry{key: key}
+		s.items[key] = e
+	}
+	e.data, e.expire, e.cost = data, expireAt(ttl), cost
+	e.resident = true
+	s.written(key, len(data))
+	s.residentLen++
+	s.size += len(data) + entryOverhead
+	switch {
+	case s.lirSize+cost <= s.lirCap || ok:
+		// warm-up, or reuse of a ghost, which is shorter than the bottom LIR one
+		e.lir = true
+		s.lirSize += cost
+		if e.s == nil {
+			e.s = s.stack.PushFront(e)
+		} else {
+			s.stack.MoveToFront(e.s)
+		}
+		for s.lirSize > s.lirCap && s.stack.Back() != e.s {
+			s.demote()
+		}
+	default:
+		s.hirSize += cost
+		e.s = s.stack.PushFront(e)
+		e.q = s.queue.PushBack(e)
+	}
+}
+
+func (s *LIRSShard) put(key uint64, data []byte, ttl uint64) error {
+	if s.tooLarge(data) {
+		return ErrTooLarge
+	}
+	s.Set(key, data, ttl)
+	return nil
+}
+
+func (s *LIRSShard) get(key uint64) ([]byte, uint64, error) {
+	s.Lock()
+	defer s.Unlock()
+	e, ok := s.items[key]
+	if !ok || !e.resident {
+		s.miss()
+		return nil, 0, ErrMissing
+	}
+	if s.isExpired(e.expire) {
+		if !s.keepExpired {
+			s.expire(key)
+		}
+		s.miss()
+		return nil, 0, ErrExpired
+	}
+	s.access(e)
+	s.hit()
+	return e.data, ttlLeft(e.expire), nil
+}
+
+func (s *LIRSShard) Get(key uint64) ([]byte, error) {
+	d, _, err := s.get(key)
+	return d, err
+}
+
+func (s *LIRSShard) GetWithTTL(key uint64) ([]byte, uint64, error) {
+	return s.get(key)
+}
+
+// Del removes entry or ghost, reports whether a live entry was removed
+func (s *LIRSShard) Del(key uint64) bool {
+	s.Lock()
+	defer s.Unlock()
+	e, ok := s.items[key]
+	if !ok {
+		return false
+	}
+	s.remove(e)
+	if !e.resident {
+		return false
+	}
+	s.removed(key, e.data, EvictDeleted)
+	return !s.isExpired(e.expire)
+}
+
+func (s *LIRSShard) Clear() {
+	s.Lock()
+	defer s.Unlock()
+	s.reset()
+}
+
+// each skips ghosts
+func (s *LIRSShard) each(fn func(key uint64, expire uint64, data []byte)) {
+	for _, e := range s.items {
+		if e.resident {
+			fn(e.key, e.expire, e.data)
+		}
+	}
+}
+
+// Run in lock only
+func (s *LIRSShard) expire(key uint64) {
+	e := s.items[key]
+	s.remove(e)
+	s.expired(e.key, e.data)
+}
+
+func (s *LIRSShard) count() int {
+	return s.residentLen
+}
+
+// ----------------------------------------------
+
+// LIRSStorage supports the IStorage subset of Config: NumShards, MaxMemSize,
+// MaxEntries, MaxEntrySize, DefaultTTL, CopyOnGet/CopyOnSet, OnEvict, OnExpire, OnRemove, EventBuffer,
+// ExpirationMode, CleanPeriod
+type LIRSStorage struct {
+	listStorage[*LIRSShard]
+}
+
+func NewLIRSStorage(opts ...Option) (*LIRSStorage, error) {
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	capacity, byBytes, _ := listLimits(cfg)
+	shards := make([]*LIRSShard, cfg.NumShards)
+	for i := range shards {
+		shards[i] = NewLIRSShard(capacity, byBytes)
+	}
+	s := &LIRSStorage{}
+	s.init(cfg, newKeyHasher(cfg.KeyHash, cfg.Hasher), shards)
+	return s, nil
+}
@@ -0,0 +1,485 @@
+package probecache
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// listShard is a shard of a storage with its own eviction engine, FIFO, ARC and the like.
+// Shards embed listBase, which implements the rest of the interface over their listEntries
+type listShard interface {
+	// put is Set, ErrTooLarge if data doesn't fit the shard at all
+	put(key uint64, data []byte, ttl uint64) error
+	GetWithTTL(key uint64) ([]byte, uint64, error)
+	// Del reports whether a live entry was removed
+	Del(key uint64) bool
+	DeleteExpired() int
+	Clear()
+	Stats() ShardStats
+	snapshot(enc *snapshotEncoder)
+	base() *listBase
+}
+
+// listEntries is the part of a list shard listBase works on: its lock and resident entries.
+// each, expire and count run in the lock only
+type listEntries interface {
+	sync.Locker
+	// each calls fn for every resident entry, oldest first if Restore should keep the order
+	each(fn func(key uint64, expire uint64, data []byte))
+	// expire removes the resident entry of key and reports it expired
+	expire(key uint64)
+	// count is number of resident entries
+	count() int
+}
+
+// listBase is embedded by list shards: limits, callbacks and counters of the shard, reporting
+// of entries leaving it, and DeleteExpired, snapshot and Stats over its listEntries. A shard
+// only keeps its lists and picks victims. Run in the shard lock only, hits and misses may be
+// counted under a read lock
+type listBase struct {
+	entries     listEntries
+	capacity    int // 0 means unbounded
+	byBytes     bool
+	maxLen      int
+	size        int // bytes taken by resident entries
+	copyOnSet   bool
+	copyOut     bool // data points into shard memory, callbacks get copies
+	keepExpired bool // ExpireActive: reads leave expired entries to DeleteExpired
+	onEvict     EvictFunc
+	onExpire    ExpireFunc
+	onRemove    EvictFunc
+	events      *eventStream // nil if disabled
+
+	hits        uint64 // atomic
+	misses      uint64 // atomic
+	evictions   uint64
+	expirations uint64
+	deleted     uint64
+	replaced    uint64
+}
+
+func (b *listBase) init(entries listEntries, capacity int, byBytes bool) {
+	b.entries = entries
+	b.capacity = capacity
+	b.byBytes = byBytes
+}
+
+func (b *listBase) base() *listBase {
+	return b
+}
+
+// cost is what an entry takes of capacity
+func (b *listBase) cost(data []byte) int {
+	if !b.byBytes {
+		return 1
+	}
+	return len(data) + entryOverhead
+}
+
+// tooLarge reports whether data doesn't fit the shard even with everything else evicted
+func (b *listBase) tooLarge(data []byte) bool {
+	return b.capacity > 0 && b.cost(data) > b.capacity
+}
+
+func (b *listBase) isExpired(ts uint64) bool {
+	if ts == noExpire {
+		return false
+	}
+	return ts <= nowMs()
+}
+
+func (b *listBase) hit() {
+	atomic.AddUint64(&b.hits, 1)
+}
+
+func (b *listBase) miss() {
+	atomic.AddUint64(&b.misses, 1)
+}
+
+// out is data for callbacks, a copy if it points into shard memory and is used
+func (b *listBase) out(data []byte, used bool) []byte {
+	if b.copyOut && used {
+		return append([]byte(nil), data...)
+	}
+	return data
+}
+
+// evicted reports an entry evicted for room, an expired one is counted as expired
+func (b *listBase) evicted(key uint64, data []byte, expire uint64) {
+	expired := b.isExpired(expire)
+	reason := EvictCapacity
+	if expired {
+		reason = EvictExpired
+		b.expirations++
+	} else {
+		b.evictions++
+	}
+	data = b.out(data, b.onEvict != nil || expired && b.onExpire != nil || b.onRemove != nil)
+	if b.onEvict != nil {
+		b.onEvict(key, data, reason)
+	}
+	if expired && b.onExpire != nil {
+		b.onExpire(key, data)
+	}
+	b.report(key, data, reason)
+}
+
+// expired reports an entry removed by a read or DeleteExpired
+func (b *listBase) expired(key uint64, data []byte) {
+	b.expirations++
+	data = b.out(data, b.onExpire != nil || b.onRemove != nil)
+	if b.onExpire != nil {
+		b.onExpire(key, data)
+	}
+	b.report(key, data, EvictExpired)
+}
+
+// removed reports an entry deleted or replaced
+func (b *listBase) removed(key uint64, data []byte, reason EvictReason) {
+	b.report(key, b.out(data, b.onRemove != nil), reason)
+}
+
+func (b *listBase) report(key uint64, data []byte, reason EvictReason) {
+	switch reason {
+	case EvictDeleted:
+		b.deleted++
+	case EvictReplaced:
+		b.replaced++
+	}
+	if b.onRemove != nil {
+		b.onRemove(key, data, reason)
+	}
+	if b.events != nil && reason != EvictReplaced {
+		b.events.emit(CacheEvent{Type: removalEvents[reason], KeyHash: key, Size: len(data)})
+	}
+}
+
+func (b *listBase) written(key uint64, size int) {
+	if b.events != nil {
+		b.events.emit(CacheEvent{Type: EventSet, KeyHash: key, Size: size})
+	}
+}
+
+// DeleteExpired removes expired entries, returns their number
+func (b *listBase) DeleteExpired() int {
+	b.entries.Lock()
+	defer b.entries.Unlock()
+	var keys []uint64
+	b.entries.each(func(key uint64, expire uint64, _ []byte) {
+		if b.isExpired(expire) {
+			keys = append(keys, key)
+		}
+	})
+	for _, key := range keys {
+		b.entries.expire(key)
+	}
+	return len(keys)
+}
+
+// snapshot adds resident entries of the shard to enc in the order of each
+func (b *listBase) snapshot(enc *snapshotEncoder) {
+	l := sync.Locker(b.entries)
+	if rw, ok := b.entries.(interface{ RLocker() sync.Locker }); ok {
+		l = rw.RLocker()
+	}
+	l.Lock()
+	defer l.Unlock()
+	b.entries.each(func(key uint64, expire uint64, data []byte) {
+		enc.entry(snapshotEntry{hash: key, expire: expire, data: data})
+	})
+}
+
+func (b *listBase) Stats() ShardStats {
+	b.entries.Lock()
+	defer b.entries.Unlock()
+	return ShardStats{
+		Size:        b.size,
+		Len:         b.entries.count(),
+		Hits:        atomic.LoadUint64(&b.hits),
+		Misses:      atomic.LoadUint64(&b.misses),
+		Evictions:   b.evictions,
+		Expirations: b.expirations,
+		Deleted:     b.deleted,
+		Replaced:    b.replaced,
+	}
+}
+
+// listStorage is the IStorage over shards of a storage with its own eviction engine:
+// key hashing, entry limits, ttl units, expiration janitor, stats and snapshots
+type listStorage[S listShard] struct {
+	NumShards  int
+	MaxMemSize int
+	MaxEntries int
+
+	shards       []S
+	shardMask    uint64
+	hash         keyHasher
+	window       *rollingStats
+	defaultTTL   uint64
+	maxEntrySize int
+	copyOnGet    bool
+	workers      *workerPool
+	janitor      *janitor
+	cleanNext    int // shard the next janitor pass starts at
+	closed       int32
+	autoSnap     *autoSnapshot
+	events       *eventStream
+}
+
+// listLimits splits the storage limits between shards: capacity is bytes, or entries
+// without MaxMemSize, maxLen caps entries on top of bytes. Rounded up, so small limits
+// don't turn into 0 (unbounded) per shard with many shards
+func listLimits(cfg Config) (capacity int, byBytes bool, maxLen int) {
+	n := cfg.NumShards
+	if cfg.MaxMemSize == 0 {
+		return (cfg.MaxEntries + n - 1) / n, false, 0
+	}
+	if cfg.MaxEntries > 0 {
+		maxLen = (cfg.MaxEntries + n - 1) / n
+	}
+	return (cfg.MaxMemSize + n - 1) / n, true, maxLen
+}
+
+// init takes cfg.NumShards shards with keys hashed by hash, applies cfg to them and starts
+// background work
+func (s *listStorage[S]) init(cfg Config, hash keyHasher, shards []S) {
+	s.NumShards = cfg.NumShards
+	s.MaxMemSize = cfg.MaxMemSize
+	s.MaxEntries = cfg.MaxEntries
+	s.shards = shards
+	s.shardMask = uint64(len(shards) - 1)
+	s.hash = hash
+	s.window = &rollingStats{}
+	s.defaultTTL = cfg.defaultTTL()
+	s.maxEntrySize = cfg.MaxEntrySize
+	s.copyOnGet = cfg.CopyOnGet
+	if cfg.EventBuffer > 0 {
+		s.events = newEventStream(cfg.EventBuffer, cfg.EventSample)
+	}
+	_, _, maxLen := listLimits(cfg)
+	for _, shard := range shards {
+		b := shard.base()
+		b.maxLen = maxLen
+		b.copyOnSet = cfg.CopyOnSet
+		b.keepExpired = cfg.ExpirationMode == ExpireActive
+		b.onEvict = cfg.OnEvict
+		b.onExpire = cfg.OnExpire
+		b.onRemove = cfg.OnRemove
+		b.events = s.events
+	}
+	s.workers = newWorkerPool(cfg.MaxWorkers)
+	s.janitor = startJanitor(s.workers, cfg.expirePeriod(0), priorityNormal, func(ctx context.Context) {
+		ctx, cancel := withTimeout(ctx, cfg.CleanTimeout)
+		defer cancel()
+		s.deleteExpired(ctx)
+	})
+	s.autoSnap = startAutoSnapshot(cfg, s, s.workers, nil)
+}
+
+// Close stops the cleaner, further operations return ErrClosed
+func (s *listStorage[S]) Close() {
+	if !s.isClosed() {
+		s.autoSnap.stop()
+	}
+	atomic.StoreInt32(&s.closed, 1)
+	s.workers.close()
+	s.janitor.stop()
+}
+
+// Snapshot writes live entries to w, see Snapshotter
+func (s *listStorage[S]) Snapshot(w io.Writer) error {
+	if s.isClosed() {
+		return ErrClosed
+	}
+	return writeSnapshot(w, snapshotHeader{hash: snapshotHash(s.hash)}, len(s.shards), func(i int, enc *snapshotEncoder) {
+		s.shards[i].snapshot(enc)
+	})
+}
+
+// Restore sets entries of a snapshot, see Snapshotter, entries too large for a shard are skipped
+func (s *listStorage[S]) Restore(r io.Reader) error {
+	if s.isClosed() {
+		return ErrClosed
+	}
+	return readSnapshot(r, snapshotHeader{hash: snapshotHash(s.hash)}, s.hash.pair, func(e *snapshotEntry) {
+		s.getShard(e.hash).put(e.hash, e.data, e.ttl())
+	})
+}
+
+// Events returns the event stream enabled by WithEvents, nil otherwise.
+// The channel is never closed
+func (s *listStorage[S]) Events() <-chan CacheEvent {
+	if s.events == nil {
+		return nil
+	}
+	return s.events.ch
+}
+
+// DroppedEvents is number of events lost to a full event buffer
+func (s *listStorage[S]) DroppedEvents() uint64 {
+	return s.events.droppedCount()
+}
+
+// KeyHash is the hash events and callbacks identify key by
+func (s *listStorage[S]) KeyHash(key string) uint64 {
+	return s.hash.sum(key)
+}
+
+func (s *listStorage[S]) isClosed() bool {
+	return atomic.LoadInt32(&s.closed) == 1
+}
+
+func (s *listStorage[S]) getKey(key string) uint64 {
+	return s.hash.sum(key)
+}
+
+func (s *listStorage[S]) getShard(key uint64) S {
+	return s.shards[shardOf(key, s.shardMask)]
+}
+
+// ShardIndex is the shard key belongs to, its index in Stats().Shards
+func (s *listStorage[S]) ShardIndex(key string) int {
+	return int(shardOf(s.getKey(key), s.shardMask))
+}
+
+func (s *listStorage[S]) Get(key string) ([]byte, error) {
+	data, _, err := s.getTTL(key)
+	return data, err
+}
+
+func (s *listStorage[S]) GetWithTTL(key string) ([]byte, uint64, error) {
+	data, ttl, err := s.getTTL(key)
+	return data, ttlToSeconds(ttl), err
+}
+
+func (s *listStorage[S]) GetWithDuration(key string) ([]byte, time.Duration, error) {
+	data, ttl, err := s.getTTL(key)
+	return data, time.Duration(ttl) * time.Millisecond, err
+}
+
+// getTTL is GetWithTTL with ttl in milliseconds
+func (s *listStorage[S]) getTTL(key string) ([]byte, uint64, error) {
+	if s.isClosed() {
+		return nil, 0, ErrClosed
+	}
+	h := s.getKey(key)
+	data, ttl, err := s.getShard(h).GetWithTTL(h)
+	s.window.record(err)
+	if err != nil {
+		return nil, 0, err
+	}
+	return valueOut(data, s.copyOnGet), ttl, nil
+}
+
+func (s *listStorage[S]) Set(key string, data []byte, ttl uint64) error {
+	return s.setTTL(key, data, secondsToTTL(ttl))
+}
+
+func (s *listStorage[S]) SetWithDuration(key string, data []byte, ttl time.Duration) error {
+	return s.setTTL(key, data, durationToTTL(ttl))
+}
+
+// setTTL is Set with ttl in milliseconds
+func (s *listStorage[S]) setTTL(key string, data []byte, ttl uint64) error {
+	if s.isClosed() {
+		return ErrClosed
+	}
+	if s.maxEntrySize > 0 && len(data) > s.maxEntrySize {
+		return ErrTooLarge
+	}
+	ttl = applyDefaultTTL(ttl, s.defaultTTL)
+	h := s.getKey(key)
+	if err := s.getShard(h).put(h, data, ttl); err != nil {
+		return err
+	}
+	s.window.written(len(data))
+	return nil
+}
+
+func (s *listStorage[S]) Del(key string) error {
+	if s.isClosed() {
+		return ErrClosed
+	}
+	h := s.getKey(key)
+	if s.getShard(h).Del(h) {
+		s.window.deleted()
+	}
+	return nil
+}
+
+// WindowStats returns counters for the last window (up to 15 minutes, minute granularity)
+func (s *listStorage[S]) WindowStats(window time.Duration) WindowStats {
+	return s.window.get(window)
+}
+
+func (s *listStorage[S]) GetSize() int {
+	return s.Stats().Size
+}
+
+func (s *listStorage[S]) Len() int {
+	return s.Stats().Len
+}
+
+// DeleteExpired removes all expired entries and returns their number,
+// ExpireActive/ExpireHybrid cleaner does it every CleanPeriod
+func (s *listStorage[S]) DeleteExpired() int {
+	n := 0
+	for _, shard := range s.shards {
+		n += shard.DeleteExpired()
+	}
+	return n
+}
+
+// deleteExpired is the janitor pass, it stops between shards once ctx is done
+// and the next pass goes on from there
+func (s *listStorage[S]) deleteExpired(ctx context.Context) {
+	for range s.shards {
+		if ctx.Err() != nil {
+			return
+		}
+		s.shards[s.cleanNext].DeleteExpired()
+		s.cleanNext = (s.cleanNext + 1) % len(s.shards)
+	}
+}
+
+func (s *listStorage[S]) Clear() {
+	for _, shard := range s.shards {
+		shard.Clear()
+	}
+}
+
+func (s *listStorage[S]) Stats() Stats {
+	st := Stats{Shards: make([]ShardStats, len(s.shards))}
+	for i, shard := range s.shards {
+		st.Shards[i] = shard.Stats()
+		st.add(st.Shards[i])
+	}
+	return s.window.since(st)
+}
+
+// ResetStats starts counters of Stats over, Size and Len are not affected
+func (s *listStorage[S]) ResetStats() {
+	s.window.reset(s.Stats())
+}
+
+func (s *listStorage[S]) PrintInfo() {
+	s.WriteInfo(os.Stdout)
+}
+
+func (s *listStorage[S]) WriteInfo(w io.Writer) {
+	st := s.Stats()
+	fmt.Fprintf(w, "Cache size: %dkb / %dkb, len: %d / %d\n", st.Size/1024, s.MaxMemSize/1024, st.Len, s.MaxEntries)
+	fmt.Fprintf(w, "Hits: %d, misses: %d, evictions: %d, expirations: %d, hitrate: %f\n", st.Hits, st.Misses, st.Evictions, st.Expirations, st.HitRate())
+}
+
+func (s *listStorage[S]) String() string {
+	var b strings.Builder
+	s.WriteInfo(&b)
+	return b.String()
+}
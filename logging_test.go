@@ -0,0 +1,36 @@
+package probecache
+
+import (
+	"bytes"
+	"log/slog"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	s, err := NewLFUStorage(WithShards(1), WithMaxEntries(4), WithCleanDepth(1), WithLogger(logger), WithJanitor(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		s.Set(strconv.Itoa(i), []byte("x"), 0)
+		// uneven worth, so probing may find no victim
+		for j := 0; j < i%5; j++ {
+			s.Get(strconv.Itoa(i))
+		}
+	}
+	s.Close()
+	out := buf.String()
+	for _, msg := range []string{"janitor started", "emergency clean", "shard=0", "janitor stopped"} {
+		if !strings.Contains(out, msg) {
+			t.Fatalf("%q not logged:\n%s", msg, out)
+		}
+	}
+	if n := strings.Count(out, "emergency clean"); n != 1 {
+		t.Fatalf("emergency clean logged %d times, want once a second", n)
+	}
+}
@@ -0,0 +1,64 @@
+package probecache
+
+import (
+	"math"
+	"sync/atomic"
+)
+
+// lrfuPolicy: every reference adds to entry's combined recency-frequency value
+// CRF = sum of 2^(-lambda * age) over past references, age in storage references.
+// Lambda 0 makes CRF a plain hit count (LFU), lambda 1 lets the latest reference
+// outweigh all older ones (LRU). Decay is the same for all entries, so worth is
+// log2(CRF) + lambda*last, which doesn't change between references. Halving it
+// would mean nothing, aging is off
+type lrfuPolicy struct {
+	lambda float64
+	clock  *uint64 // references of all shards
+}
+
+func newLRFUPolicy(lambda float64) lrfuPolicy {
+	return lrfuPolicy{lambda: lambda, clock: new(uint64)}
+}
+
+func (p lrfuPolicy) OnInsert(old float64, existed bool) float64 {
+	if !existed {
+		old = math.Inf(-1)
+	}
+	return p.OnHit(old)
+}
+
+func (p lrfuPolicy) OnHit(worth float64) float64 {
+	now := p.lambda * float64(atomic.AddUint64(p.clock, 1))
+	return math.Log2(1+math.Exp2(worth-now)) + now
+}
+
+func (p lrfuPolicy) Victim(worth float64, mean float64) bool {
+	return worth <= mean
+}
+
+type LRFUShard = PolicyShard
+
+// NewLRFUShard makes a shard of capacity bytes, or entries if byBytes is false
+func NewLRFUShard(capacity int, byBytes bool, lambda float64) *LRFUShard {
+	if byBytes {
+		return NewPolicyShard(newLRFUPolicy(lambda), capacity, 0, DefaultConfig().MaxCleanDepth)
+	}
+	s := NewPolicyShard(newLRFUPolicy(lambda), 0, 0, DefaultConfig().MaxCleanDepth)
+	s.maxLen = capacity
+	return s
+}
+
+// ================================================================================================
+
+type LRFUStorage struct {
+	*PolicyStorage
+}
+
+func NewLRFUStorage(opts ...Option) (*LRFUStorage, error) {
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	cfg.AgingPeriod, cfg.AgingHits = 0, 0
+	return &LRFUStorage{newPolicyStorage(cfg, newLRFUPolicy(cfg.LRFULambda))}, nil
+}
@@ -0,0 +1,72 @@
+package probecache
+
+import "math/bits"
+
+const (
+	murmurC1 = 0x87c37b91114253d5
+	murmurC2 = 0x4cf5ad432745937f
+)
+
+// murmur3 is 128-bit MurmurHash3 (x64 variant) with seed 0, returns h1 and h2
+func murmur3(key string) (uint64, uint64) {
+	var h1, h2 uint64
+	n := len(key)
+	i := 0
+	for ; i+16 <= n; i += 16 {
+		k1 := le64(key[i:])
+		k2 := le64(key[i+8:])
+		h1 ^= murmurK1(k1)
+		h1 = bits.RotateLeft64(h1, 27) + h2
+		h1 = h1*5 + 0x52dce729
+		h2 ^= murmurK2(k2)
+		h2 = bits.RotateLeft64(h2, 31) + h1
+		h2 = h2*5 + 0x38495ab5
+	}
+	var k1, k2 uint64
+	for j := n - 1; j >= i; j-- {
+		if j-i >= 8 {
+			k2 ^= uint64(key[j]) << uint(8*(j-i-8))
+		} else {
+			k1 ^= uint64(key[j]) << uint(8*(j-i))
+		}
+	}
+	if n-i > 8 {
+		h2 ^= murmurK2(k2)
+	}
+	if n-i > 0 {
+		h1 ^= murmurK1(k1)
+	}
+	h1 ^= uint64(n)
+	h2 ^= uint64(n)
+	h1 += h2
+	h2 += h1
+	h1 = fmix64(h1)
+	h2 = fmix64(h2)
+	h1 += h2
+	h2 += h1
+	return h1, h2
+}
+
+func murmurK1(k uint64) uint64 {
+	return bits.RotateLeft64(k*murmurC1, 31) * murmurC2
+}
+
+func murmurK2(k uint64) uint64 {
+	return bits.RotateLeft64(k*murmurC2, 33) * murmurC1
+}
+
+func fmix64(k uint64) uint64 {
+	k ^= k >> 33
+	k *= 0xff51afd7ed558ccd
+	k ^= k >> 33
+	k *= 0xc4ceb9fe1a85ec53
+	k ^= k >> 33
+	return k
+}
+
+// le64 reads 8 bytes little endian, the compiler merges it into one load
+func le64(b string) uint64 {
+	_ = b[7]
+	return uint64(b[0]) | uint64(b[1])<<8 | uint64(b[2])<<16 | uint64(b[3])<<24 |
+		uint64(b[4])<<32 | uint64(b[5])<<40 | uint64(b[6])<<48 | uint64(b[7])<<56
+}
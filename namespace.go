@@ -0,0 +1,208 @@
+package probecache
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+type nsBackend interface {
+	IStorage
+	claim(key string, fn func(h uint64))
+	watch(fn removalHook) func()
+}
+
+// Namespace is a view over a storage with every key prefixed. It remembers
+// own keys, so it can be cleared and size-accounted independently from the
+// rest of the storage. Entries leaving the parent are forgotten by a removal hook.
+type Namespace struct {
+	prefix  string
+	parent  nsBackend
+	closed  int32
+	unwatch func()
+
+	// ops is read-held by writes, Clear holds it so no Set lands in the middle
+	ops sync.RWMutex
+
+	// mu guards keys, it's taken under the parent shard lock and never held calling the parent
+	mu   sync.Mutex
+	keys map[uint64]nsKey // by key hash in the root storage
+	size int              // payload of keys
+
+	hits   uint64
+	misses uint64
+}
+
+type nsKey struct {
+	key  string // without prefix
+	size int    // payload
+}
+
+func newNamespace(prefix string, parent nsBackend) *Namespace {
+	n := &Namespace{
+		prefix: prefix,
+		parent: parent,
+		keys:   make(map[uint64]nsKey),
+	}
+	n.unwatch = parent.watch(n.removed)
+	return n
+}
+
+func (s *LRUStorage) Namespace(prefix string) *Namespace {
+	return newNamespace(prefix, s)
+}
+
+func (s *LFUStorage) Namespace(prefix string) *Namespace {
+	return newNamespace(prefix, s)
+}
+
+func (s *TTLStorage) Namespace(prefix string) *Namespace {
+	return newNamespace(prefix, s)
+}
+
+// Namespace nests prefixes, Clear of the outer namespace clears the inner one too
+func (n *Namespace) Namespace(prefix string) *Namespace {
+	return newNamespace(prefix, n)
+}
+
+func (n *Namespace) Prefix() string {
+	return n.prefix
+}
+
+func (n *Namespace) isClosed() bool {
+	return atomic.LoadInt32(&n.closed) == 1
+}
+
+func (n *Namespace) claim(key string, fn func(h uint64)) {
+	n.parent.claim(n.prefix+key, fn)
+}
+
+func (n *Namespace) watch(fn removalHook) func() {
+	return n.parent.watch(fn)
+}
+
+// removed is the removal hook, overwritten keys stay
+func (n *Namespace) removed(h uint64, reason EvictReason) {
+	if reason == EvictReplaced {
+		return
+	}
+	n.mu.Lock()
+	n.size -= n.keys[h].size
+	delete(n.keys, h)
+	n.mu.Unlock()
+}
+
+func (n *Namespace) Set(key string, data []byte, ttl uint64) error {
+	if n.isClosed() {
+		return ErrClosed
+	}
+	n.ops.RLock()
+	defer n.ops.RUnlock()
+	if err := n.parent.Set(n.prefix+key, data, ttl); err != nil {
+		return err
+	}
+	// the entry may be gone already, then there's nothing to remember
+	n.parent.claim(n.prefix+key, func(h uint64) {
+		n.mu.Lock()
+		n.size += len(data) - n.keys[h].size
+		n.keys[h] = nsKey{key: key, size: len(data)}
+		n.mu.Unlock()
+	})
+	return nil
+}
+
+func (n *Namespace) Get(key string) ([]byte, error) {
+	d, _, err := n.GetWithTTL(key)
+	return d, err
+}
+
+func (n *Namespace) GetWithTTL(key string) ([]byte, uint64, error) {
+	if n.isClosed() {
+		return nil, 0, ErrClosed
+	}
+	d, ttl, err := n.parent.GetWithTTL(n.prefix + key)
+	if err != nil {
+		atomic.AddUint64(&n.misses, 1)
+		return nil, 0, err
+	}
+	atomic.AddUint64(&n.hits, 1)
+	return d, ttl, nil
+}
+
+func (n *Namespace) Del(key string) error {
+	if n.isClosed() {
+		return ErrClosed
+	}
+	n.ops.RLock()
+	defer n.ops.RUnlock()
+	return n.parent.Del(n.prefix + key)
+}
+
+// Clear removes only keys of the namespace from the parent storage
+func (n *Namespace) Clear() {
+	n.ops.Lock()
+	defer n.ops.Unlock()
+	n.mu.Lock()
+	keys := make([]string, 0, len(n.keys))
+	for _, k := range n.keys {
+		keys = append(keys, k.key)
+	}
+	n.mu.Unlock()
+	// removal hooks forget the keys
+	for _, key := range keys {
+		n.parent.Del(n.prefix + key)
+	}
+}
+
+// usage returns payload size and number of namespace entries
+func (n *Namespace) usage() (int, int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.size, len(n.keys)
+}
+
+// GetSize is payload size of namespace entries, without storage overhead
+func (n *Namespace) GetSize() int {
+	size, _ := n.usage()
+	return size
+}
+
+func (n *Namespace) Len() int {
+	_, l := n.usage()
+	return l
+}
+
+// Stats of a namespace carry only Size, Len, Hits and Misses
+func (n *Namespace) Stats() Stats {
+	size, l := n.usage()
+	return Stats{
+		Size:   size,
+		Len:    l,
+		Hits:   atomic.LoadUint64(&n.hits),
+		Misses: atomic.LoadUint64(&n.misses),
+	}
+}
+
+func (n *Namespace) ResetStats() {
+	atomic.StoreUint64(&n.hits, 0)
+	atomic.StoreUint64(&n.misses, 0)
+}
+
+func (n *Namespace) PrintInfo() {
+	n.WriteInfo(os.Stdout)
+}
+
+func (n *Namespace) WriteInfo(w io.Writer) {
+	st := n.Stats()
+	fmt.Fprintf(w, "Namespace %q size: %dkb, len: %d\n", n.prefix, st.Size/1024, st.Len)
+	fmt.Fprintf(w, "Hits: %d, misses: %d, hitrate: %.2f\n", st.Hits, st.Misses, st.HitRate())
+}
+
+// Close detaches the view, parent storage stays open and keeps the entries
+func (n *Namespace) Close() {
+	if atomic.SwapInt32(&n.closed, 1) == 0 {
+		n.unwatch()
+	}
+}
@@ -0,0 +1,62 @@
+package probecache
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestNamespaceForgetsRemoved(t *testing.T) {
+	s, err := NewLRUStorage(WithShards(1), WithMaxEntries(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ns := s.Namespace("ns:")
+	inner := ns.Namespace("in:")
+	for i := 0; i < 100; i++ {
+		ns.Set(strconv.Itoa(i), []byte("v"), 0)
+		inner.Set(strconv.Itoa(i), []byte("vv"), 0)
+	}
+	if ns.Len() != s.Len() {
+		t.Errorf("namespace len %d, storage %d after eviction", ns.Len(), s.Len())
+	}
+	if l := inner.Len(); l == 0 || inner.GetSize() != 2*l {
+		t.Errorf("inner len %d size %d", l, inner.GetSize())
+	}
+	s.Del("ns:in:99")
+	s.Clear()
+	if ns.Len() != 0 || ns.GetSize() != 0 || inner.Len() != 0 {
+		t.Errorf("namespace len %d size %d, inner %d after storage Clear", ns.Len(), ns.GetSize(), inner.Len())
+	}
+}
+
+func TestNamespaceClearRace(t *testing.T) {
+	s, err := NewTTLStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ns := s.Namespace("ns:")
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				ns.Set(strconv.Itoa(w*1000+i), []byte("v"), 0)
+				if i%100 == 0 {
+					ns.Clear()
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	if ns.Len() != s.Len() {
+		t.Errorf("namespace len %d, storage %d", ns.Len(), s.Len())
+	}
+	ns.Clear()
+	if s.Len() != 0 || ns.Len() != 0 {
+		t.Errorf("storage len %d, namespace %d after Clear", s.Len(), ns.Len())
+	}
+}
@@ -0,0 +1,29 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+// +build linux darwin freebsd netbsd openbsd dragonfly
+
+package probecache
+
+import (
+	"os"
+	"syscall"
+)
+
+// mapRegion reserves n bytes of anonymous memory outside the Go heap,
+// pages are committed by the OS on first touch
+func mapRegion(n int) ([]byte, error) {
+	return syscall.Mmap(-1, 0, n, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_ANON|syscall.MAP_PRIVATE)
+}
+
+// mapFile maps n bytes of f shared, writes reach the file through the page cache
+func mapFile(f *os.File, n int) ([]byte, error) {
+	return syscall.Mmap(int(f.Fd()), 0, n, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+}
+
+// lockFile keeps other processes off f until it's closed
+func lockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+}
+
+func unmapRegion(b []byte) error {
+	return syscall.Munmap(b)
+}
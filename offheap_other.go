@@ -0,0 +1,26 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package probecache
+
+import (
+	"fmt"
+	"os"
+)
+
+// no mmap here: the region is a plain pointer-free slice, still not scanned by GC
+func mapRegion(n int) ([]byte, error) {
+	return make([]byte, n), nil
+}
+
+func mapFile(f *os.File, n int) ([]byte, error) {
+	return nil, fmt.Errorf("%w: MmapPath needs mmap", ErrInvalidConfig)
+}
+
+func lockFile(f *os.File) error {
+	return nil
+}
+
+func unmapRegion(b []byte) error {
+	return nil
+}
@@ -0,0 +1,247 @@
+package probecache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"sort"
+)
+
+// File backed OffHeapStorage (MmapPath): a header page with the layout, then shard regions.
+// Every block of a region, used or free, starts with a header, so opening the file walks
+// the blocks and rebuilds indexes and free lists. An entry header is written after its
+// payload, a process dying in the middle of Set leaves the block free.
+
+const (
+	offHeapFileHeader  = 4096
+	offHeapFileVersion = 1
+	offHeapHeader      = 32 // magic, crc of the rest, gen, payload bytes (order of free blocks), key, expire
+
+	offHeapUsed uint32 = 0x44455355 // "USED"
+	offHeapFree uint32 = 0x45455246 // "FREE"
+)
+
+// offHeapBlock is a parsed block header
+type offHeapBlock struct {
+	used   bool
+	order  int
+	gen    uint32
+	n      uint32
+	key    uint64
+	expire uint64
+}
+
+// Run in lock only
+func (a *offHeapArena) markBlock(off uint32, order int) {
+	if a.hdr > 0 {
+		a.writeHeader(off, offHeapFree, 0, uint32(order), 0, 0)
+	}
+}
+
+// Run in lock only. Writes headers of all free blocks
+func (a *offHeapArena) markFree() {
+	if a.hdr == 0 {
+		return
+	}
+	for k, blocks := range a.free {
+		for off := range blocks {
+			a.markBlock(off, k)
+		}
+	}
+}
+
+// Run in lock only, after the payload is written
+func (a *offHeapArena) markEntry(key uint64, e offHeapEntry) {
+	if a.hdr > 0 {
+		a.writeHeader(e.off, offHeapUsed, e.gen, e.n, key, e.expire)
+	}
+}
+
+func (a *offHeapArena) writeHeader(off uint32, magic uint32, gen uint32, n uint32, key uint64, expire uint64) {
+	h := a.mem[off : off+offHeapHeader]
+	binary.LittleEndian.PutUint32(h[8:], gen)
+	binary.LittleEndian.PutUint32(h[12:], n)
+	binary.LittleEndian.PutUint64(h[16:], key)
+	binary.LittleEndian.PutUint64(h[24:], expire)
+	binary.LittleEndian.PutUint32(h[4:], crc32.ChecksumIEEE(h[8:]))
+	binary.LittleEndian.PutUint32(h, magic)
+}
+
+// block parses the header at off, false if it's broken or doesn't fit the arena
+func (a *offHeapArena) block(off int) (offHeapBlock, bool) {
+	if off+offHeapHeader > len(a.mem) {
+		return offHeapBlock{}, false
+	}
+	h := a.mem[off : off+offHeapHeader]
+	magic := binary.LittleEndian.Uint32(h)
+	if magic != offHeapUsed && magic != offHeapFree || binary.LittleEndian.Uint32(h[4:]) != crc32.ChecksumIEEE(h[8:]) {
+		return offHeapBlock{}, false
+	}
+	b := offHeapBlock{
+		used:   magic == offHeapUsed,
+		gen:    binary.LittleEndian.Uint32(h[8:]),
+		n:      binary.LittleEndian.Uint32(h[12:]),
+		key:    binary.LittleEndian.Uint64(h[16:]),
+		expire: binary.LittleEndian.Uint64(h[24:]),
+	}
+	if b.used {
+		b.order = a.order(int(b.n) + a.hdr)
+	} else if b.n <= uint32(a.topOrder) {
+		b.order = int(b.n)
+	} else {
+		return b, false
+	}
+	if b.order > a.topOrder {
+		return b, false
+	}
+	size := 1 << uint(offHeapMinShift+b.order)
+	return b, off%size == 0 && off+size <= len(a.mem)
+}
+
+// take allocates the block of order at off, false if it's not free
+func (a *offHeapArena) take(off uint32, order int) bool {
+	for k := order; k <= a.topOrder; k++ {
+		base := off &^ (1<<uint(offHeapMinShift+k) - 1)
+		if _, ok := a.free[k][base]; !ok {
+			continue
+		}
+		delete(a.free[k], base)
+		// split down, halves without off stay free
+		for k > order {
+			k--
+			size := uint32(1) << uint(offHeapMinShift+k)
+			a.free[k][off&^(size-1)^size] = struct{}{}
+		}
+		return true
+	}
+	return false
+}
+
+// newMappedOffHeapShard makes a shard over a region of the storage file, loading its entries
+// unless the file is fresh
+func newMappedOffHeapShard(mem []byte, topShift int, fresh bool) *OffHeapShard {
+	s := &OffHeapShard{
+		arena:  &offHeapArena{mem: mem, topOrder: topShift - offHeapMinShift, hdr: offHeapHeader},
+		mapped: true,
+	}
+	s.init(s, len(mem), true)
+	s.copyOut = true
+	if fresh {
+		s.reset()
+	} else {
+		s.load()
+	}
+	return s
+}
+
+// load rebuilds the shard from block headers. Expired entries are dropped, a broken header
+// frees the rest of its top block
+func (s *OffHeapShard) load() {
+	a := s.arena
+	s.index = make(map[uint64]offHeapEntry)
+	top := 1 << uint(offHeapMinShift+a.topOrder)
+	for off := 0; off < len(a.mem); {
+		b, ok := a.block(off)
+		if !ok {
+			off = (off/top + 1) * top
+			continue
+		}
+		if b.used && !s.isExpired(b.expire) {
+			// an interrupted overwrite may leave the key twice
+			if e, dup := s.index[b.key]; !dup || e.gen < b.gen {
+				s.index[b.key] = offHeapEntry{expire: b.expire, off: uint32(off), n: b.n, gen: b.gen}
+			}
+		}
+		off += 1 << uint(offHeapMinShift+b.order)
+	}
+	a.freeAll()
+	for key, e := range s.index {
+		order := a.order(int(e.n) + a.hdr)
+		if !a.take(e.off, order) {
+			delete(s.index, key)
+			continue
+		}
+		s.size += 1 << uint(offHeapMinShift+order)
+		s.queue = append(s.queue, offHeapSlot{key, e.gen})
+		if e.gen > s.gen {
+			s.gen = e.gen
+		}
+	}
+	sort.Slice(s.queue, func(i, j int) bool { return s.queue[i].gen < s.queue[j].gen })
+	a.markFree()
+}
+
+// offHeapFile is the mapped MmapPath of an OffHeapStorage
+type offHeapFile struct {
+	f   *os.File
+	mem []byte
+}
+
+// offHeapLayout is the file header, a file is reused only by a storage of the same layout
+func offHeapLayout(hash byte, topShift int, numShards int, region int) []byte {
+	b := append([]byte("PCMMAP"), offHeapFileVersion, hash, byte(topShift))
+	b = binary.LittleEndian.AppendUint32(b, uint32(numShards))
+	return binary.LittleEndian.AppendUint64(b, uint64(region))
+}
+
+// openOffHeapFile locks and maps path of size bytes, fresh if it has no entries yet.
+// The layout is written by the caller once fresh regions are formatted
+func openOffHeapFile(path string, layout []byte, size int) (*offHeapFile, bool, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, false, fmt.Errorf("lock %s: %w", path, err)
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, false, err
+	}
+	mismatch := fmt.Errorf("%w: %s holds a cache of other NumShards, MaxMemSize, MaxEntrySize or KeyHash", ErrInvalidConfig, path)
+	fresh := st.Size() == 0
+	if fresh {
+		err = f.Truncate(int64(size))
+	} else if st.Size() != int64(size) {
+		err = mismatch
+	}
+	if err != nil {
+		f.Close()
+		return nil, false, err
+	}
+	mem, err := mapFile(f, size)
+	if err != nil {
+		f.Close()
+		return nil, false, err
+	}
+	m := &offHeapFile{f: f, mem: mem}
+	if !fresh && !bytes.Equal(mem[:len(layout)], layout) {
+		// no layout is a file whose formatting was interrupted
+		if !bytes.Equal(mem[:len(layout)], make([]byte, len(layout))) {
+			m.close()
+			return nil, false, mismatch
+		}
+		fresh = true
+	}
+	return m, fresh, nil
+}
+
+// close unmaps and syncs the file, entries stay in it
+func (m *offHeapFile) close() error {
+	if m.mem == nil {
+		return nil
+	}
+	err := unmapRegion(m.mem)
+	m.mem = nil
+	if serr := m.f.Sync(); err == nil {
+		err = serr
+	}
+	if cerr := m.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
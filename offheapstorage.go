@@ -0,0 +1,430 @@
+package probecache
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"sync"
+)
+
+// OffHeap: entry payloads live in an anonymous mmap region per shard, outside the Go heap,
+// carved by a buddy allocator and freed explicitly on eviction, overwrite and delete.
+// The index holds no pointers, so GC neither scans the cache nor counts it into the heap
+// goal. Eviction is FIFO by insertion, values are always copied. Close unmaps the memory.
+// With MmapPath the regions are parts of a shared file mapping, see offheapfile.go.
+
+const (
+	offHeapMinShift = 6  // smallest block, 64 bytes
+	offHeapTopShift = 24 // largest block by default, 16mb
+	offHeapQueueGC  = 1024
+)
+
+// offHeapArena is a buddy allocator over mem, split into equal top blocks.
+// A block of order k is 1<<(minShift+k) bytes, free blocks are kept per order
+// and merged with their free buddy on release
+type offHeapArena struct {
+	mem      []byte
+	topOrder int
+	free     []map[uint32]struct{}
+	hdr      int // block header bytes of file backed arenas, 0 otherwise
+}
+
+func newOffHeapArena(mem []byte, topOrder int, hdr int) *offHeapArena {
+	a := &offHeapArena{mem: mem, topOrder: topOrder, hdr: hdr}
+	a.reset()
+	return a
+}
+
+func (a *offHeapArena) reset() {
+	a.freeAll()
+	a.markFree()
+}
+
+// freeAll makes all top blocks free
+func (a *offHeapArena) freeAll() {
+	a.free = make([]map[uint32]struct{}, a.topOrder+1)
+	for k := range a.free {
+		a.free[k] = make(map[uint32]struct{})
+	}
+	top := 1 << uint(offHeapMinShift+a.topOrder)
+	for off := 0; off+top <= len(a.mem); off += top {
+		a.free[a.topOrder][uint32(off)] = struct{}{}
+	}
+}
+
+// order returns the smallest block order holding n bytes
+func (a *offHeapArena) order(n int) int {
+	if n <= 1<<offHeapMinShift {
+		return 0
+	}
+	return bits.Len(uint(n-1)) - offHeapMinShift
+}
+
+func (a *offHeapArena) alloc(order int) (uint32, bool) {
+	for k := order; k <= a.topOrder; k++ {
+		for off := range a.free[k] {
+			delete(a.free[k], off)
+			// split down, upper halves stay free
+			for k > order {
+				k--
+				a.free[k][off+1<<uint(offHeapMinShift+k)] = struct{}{}
+				a.markBlock(off+1<<uint(offHeapMinShift+k), k)
+			}
+			return off, true
+		}
+	}
+	return 0, false
+}
+
+func (a *offHeapArena) release(off uint32, order int) {
+	for order < a.topOrder {
+		buddy := off ^ 1<<uint(offHeapMinShift+order)
+		if _, ok := a.free[order][buddy]; !ok {
+			break
+		}
+		delete(a.free[order], buddy)
+		if buddy < off {
+			off = buddy
+		}
+		order++
+	}
+	a.free[order][off] = struct{}{}
+	a.markBlock(off, order)
+}
+
+type offHeapEntry struct {
+	expire uint64
+	off    uint32
+	n      uint32
+	gen    uint32
+}
+
+// offHeapSlot is an insertion record, stale once gen no longer matches the index
+type offHeapSlot struct {
+	key uint64
+	gen uint32
+}
+
+type OffHeapShard struct {
+	sync.RWMutex
+	listBase
+	index  map[uint64]offHeapEntry
+	arena  *offHeapArena
+	queue  []offHeapSlot
+	head   int
+	gen    uint32
+	mapped bool // arena is a part of the storage file mapping, unmapped by the storage
+}
+
+// NewOffHeapShard maps capacity bytes, blocks are up to 1<<topShift bytes and no larger than capacity
+func NewOffHeapShard(capacity int, topShift int) (*OffHeapShard, error) {
+	if capacity < 1<<offHeapMinShift {
+		return nil, ErrInvalidConfig
+	}
+	topShift = offHeapShift(capacity, topShift)
+	mem, err := mapRegion(offHeapRegion(capacity, topShift))
+	if err != nil {
+		return nil, err
+	}
+	s := &OffHeapShard{
+		arena: newOffHeapArena(mem, topShift-offHeapMinShift, 0),
+	}
+	s.init(s, len(mem), true)
+	s.copyOut = true
+	s.reset()
+	return s, nil
+}
+
+// offHeapShift limits topShift to blocks no larger than capacity
+func offHeapShift(capacity int, topShift int) int {
+	if max := bits.Len(uint(capacity)) - 1; max < topShift {
+		return max
+	}
+	return topShift
+}
+
+// offHeapRegion returns bytes of a shard region, whole top blocks of capacity
+func offHeapRegion(capacity int, topShift int) int {
+	top := 1 << uint(topShift)
+	return capacity / top * top
+}
+
+func (s *OffHeapShard) reset() {
+	s.index = make(map[uint64]offHeapEntry)
+	s.queue = nil
+	s.head = 0
+	s.size = 0
+	s.arena.reset()
+}
+
+// release unmaps the region, the shard is unusable afterwards
+func (s *OffHeapShard) release() error {
+	s.Lock()
+	defer s.Unlock()
+	mem := s.arena.mem
+	if mem == nil {
+		return nil
+	}
+	s.index = make(map[uint64]offHeapEntry)
+	s.queue = nil
+	s.arena.mem = nil
+	if s.mapped {
+		return nil
+	}
+	return unmapRegion(mem)
+}
+
+// Run in lock only
+func (s *OffHeapShard) data(e offHeapEntry) []byte {
+	off := e.off + uint32(s.arena.hdr)
+	return s.arena.mem[off : off+e.n]
+}
+
+// Run in lock only. Frees entry memory
+func (s *OffHeapShard) remove(key uint64, e offHeapEntry) {
+	order := s.arena.order(int(e.n) + s.arena.hdr)
+	delete(s.index, key)
+	s.arena.release(e.off, order)
+	s.size -= 1 << uint(offHeapMinShift+order)
+}
+
+// Run in lock only. Evicts the oldest live entry, false if there is none
+func (s *OffHeapShard) evictOne() bool {
+	for s.head < len(s.queue) {
+		slot := s.queue[s.head]
+		s.head++
+		if e, ok := s.index[slot.key]; ok && e.gen == slot.gen {
+			s.evicted(slot.key, s.data(e), e.expire)
+			s.remove(slot.key, e)
+			return true
+		}
+	}
+	return false
+}
+
+// Run in lock only. Drops consumed and stale insertion records
+func (s *OffHeapShard) compactQueue() {
+	if s.head < offHeapQueueGC && len(s.queue) < 2*len(s.index)+offHeapQueueGC {
+		return
+	}
+	live := s.queue[:0]
+	for _, slot := range s.queue[s.head:] {
+		if e, ok := s.index[slot.key]; ok && e.gen == slot.gen {
+			live = append(live, slot)
+		}
+	}
+	s.queue = live
+	s.head = 0
+}
+
+func (s *OffHeapShard) Set(key uint64, data []byte, ttl uint64) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.arena.mem == nil {
+		return ErrClosed
+	}
+	order := s.arena.order(len(data) + s.arena.hdr)
+	if order > s.arena.topOrder {
+		return ErrTooLarge
+	}
+	if e, ok := s.index[key]; ok {
+		s.removed(key, s.data(e), EvictReplaced)
+		s.remove(key, e)
+	}
+	for s.maxLen > 0 && len(s.index) >= s.maxLen && s.evictOne() {
+	}
+	off, ok := s.arena.alloc(order)
+	// freeing everything merges back into top blocks, so this ends
+	for !ok && s.evictOne() {
+		off, ok = s.arena.alloc(order)
+	}
+	if !ok {
+		return ErrTooLarge
+	}
+	s.gen++
+	e := offHeapEntry{expire: expireAt(ttl), off: off, n: uint32(len(data)), gen: s.gen}
+	copy(s.data(e), data)
+	s.arena.markEntry(key, e)
+	s.index[key] = e
+	s.size += 1 << uint(offHeapMinShift+order)
+	s.compactQueue()
+	s.queue = append(s.queue, offHeapSlot{key, e.gen})
+	s.written(key, len(data))
+	return nil
+}
+
+func (s *OffHeapShard) put(key uint64, data []byte, ttl uint64) error {
+	return s.Set(key, data, ttl)
+}
+
+func (s *OffHeapShard) get(key uint64) ([]byte, uint64, error) {
+	s.RLock()
+	if s.arena.mem == nil {
+		s.RUnlock()
+		return nil, 0, ErrClosed
+	}
+	e, ok := s.index[key]
+	if !ok {
+		s.RUnlock()
+		s.miss()
+		return nil, 0, ErrMissing
+	}
+	if !s.isExpired(e.expire) {
+		data := append([]byte(nil), s.data(e)...)
+		s.RUnlock()
+		s.hit()
+		return data, ttlLeft(e.expire), nil
+	}
+	s.RUnlock()
+
+	s.miss()
+	if s.keepExpired {
+		return nil, 0, ErrExpired
+	}
+	s.Lock()
+	defer s.Unlock()
+	// may have been replaced while unlocked
+	if e, ok := s.index[key]; ok && s.isExpired(e.expire) {
+		s.expire(key)
+	}
+	return nil, 0, ErrExpired
+}
+
+func (s *OffHeapShard) Get(key uint64) ([]byte, error) {
+	d, _, err := s.get(key)
+	return d, err
+}
+
+func (s *OffHeapShard) GetWithTTL(key uint64) ([]byte, uint64, error) {
+	return s.get(key)
+}
+
+// Del removes entry, reports whether a live entry was removed
+func (s *OffHeapShard) Del(key uint64) bool {
+	s.Lock()
+	defer s.Unlock()
+	e, ok := s.index[key]
+	if !ok {
+		return false
+	}
+	s.removed(key, s.data(e), EvictDeleted)
+	s.remove(key, e)
+	return !s.isExpired(e.expire)
+}
+
+// Clear keeps the mapping, all blocks become free
+func (s *OffHeapShard) Clear() {
+	s.Lock()
+	defer s.Unlock()
+	if s.arena.mem != nil {
+		s.reset()
+	}
+}
+
+// each walks insertion records oldest first, so Restore keeps the order
+func (s *OffHeapShard) each(fn func(key uint64, expire uint64, data []byte)) {
+	for _, slot := range s.queue[s.head:] {
+		if e, ok := s.index[slot.key]; ok && e.gen == slot.gen {
+			fn(slot.key, e.expire, s.data(e))
+		}
+	}
+}
+
+// Run in lock only
+func (s *OffHeapShard) expire(key uint64) {
+	e := s.index[key]
+	s.expired(key, s.data(e))
+	s.remove(key, e)
+}
+
+func (s *OffHeapShard) count() int {
+	return len(s.index)
+}
+
+// ----------------------------------------------
+
+// OffHeapStorage supports the IStorage subset of Config: NumShards, MaxMemSize (required,
+// mapped upfront, committed by the OS on use), MaxEntries, MaxEntrySize (also raises the
+// 16mb block limit), DefaultTTL, OnEvict, OnExpire, OnRemove, EventBuffer, ExpirationMode, CleanPeriod.
+// Sizes are rounded up to a power of two, 64 bytes min. Values are always copied,
+// CopyOnGet/CopyOnSet are ignored. Close must be called to return the memory.
+//
+// With MmapPath the regions are a shared mapping of that file, locked against other
+// processes, and a storage of the same NumShards, MaxMemSize, MaxEntrySize and KeyHash
+// opened on it later starts with its entries. Each block then carries a 32 byte header.
+// Writes reach the file through the page cache: they survive a crash of the process,
+// but only those before Close or a background writeback survive a crash of the OS
+type OffHeapStorage struct {
+	listStorage[*OffHeapShard]
+	file *offHeapFile // MmapPath
+}
+
+func NewOffHeapStorage(opts ...Option) (*OffHeapStorage, error) {
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	numShards := cfg.NumShards
+	capacity := cfg.MaxMemSize / numShards
+	if capacity < 1<<offHeapMinShift || uint64(capacity) > math.MaxUint32 {
+		return nil, fmt.Errorf("%w: OffHeapStorage needs MaxMemSize of %d to %d bytes per shard, got %d", ErrInvalidConfig, 1<<offHeapMinShift, uint32(math.MaxUint32), capacity)
+	}
+	hdr := 0
+	if cfg.MmapPath != "" {
+		hdr = offHeapHeader
+	}
+	topShift := offHeapTopShift
+	if cfg.MaxEntrySize+hdr > 1<<offHeapTopShift {
+		topShift = bits.Len(uint(cfg.MaxEntrySize + hdr - 1))
+	}
+	topShift = offHeapShift(capacity, topShift)
+	region := offHeapRegion(capacity, topShift)
+	hash := newKeyHasher(cfg.KeyHash, cfg.Hasher)
+	s := &OffHeapStorage{}
+	var layout []byte
+	fresh := false
+	if cfg.MmapPath != "" {
+		if snapshotHash(hash) == hashSeeded {
+			return nil, fmt.Errorf("%w: MmapPath needs a KeyHash without random seed", ErrInvalidConfig)
+		}
+		layout = offHeapLayout(snapshotHash(hash), topShift, numShards, region)
+		s.file, fresh, err = openOffHeapFile(cfg.MmapPath, layout, offHeapFileHeader+numShards*region)
+		if err != nil {
+			return nil, fmt.Errorf("OffHeapStorage: map %s: %w", cfg.MmapPath, err)
+		}
+	}
+	s.shards = make([]*OffHeapShard, 0, numShards)
+	for i := 0; i < numShards; i++ {
+		var shard *OffHeapShard
+		if s.file != nil {
+			off := offHeapFileHeader + i*region
+			shard = newMappedOffHeapShard(s.file.mem[off:off+region:off+region], topShift, fresh)
+		} else if shard, err = NewOffHeapShard(capacity, topShift); err != nil {
+			s.release()
+			return nil, fmt.Errorf("OffHeapStorage: map %d bytes: %w", capacity, err)
+		}
+		s.shards = append(s.shards, shard)
+	}
+	if fresh {
+		copy(s.file.mem, layout)
+	}
+	cfg.CopyOnGet = false
+	s.init(cfg, hash, s.shards)
+	return s, nil
+}
+
+// Close stops the cleaner and unmaps shard memory, further operations return ErrClosed.
+// Entries of MmapPath stay in the file
+func (s *OffHeapStorage) Close() {
+	s.listStorage.Close()
+	s.release()
+}
+
+func (s *OffHeapStorage) release() {
+	for _, shard := range s.shards {
+		shard.release()
+	}
+	if s.file != nil {
+		s.file.close()
+	}
+}
@@ -0,0 +1,636 @@
+package probecache
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAppend(t *testing.T) {
+	lru, _ := NewLRUStorage(WithShards(1), WithMaxBytes(4<<10), WithMaxEntrySize(1<<10))
+	defer lru.Close()
+	ttl, _ := NewTTLStorage(WithShards(1), WithMaxEntrySize(1<<10))
+	defer ttl.Close()
+	for name, s := range map[string]interface {
+		IStorage
+		Append(key string, data []byte) error
+	}{"LRU": lru, "TTL": ttl} {
+		if err := s.Append("a", []byte("x")); !errors.Is(err, ErrMissing) {
+			t.Fatalf("%s: append to missing key: %v", name, err)
+		}
+		s.Set("a", []byte("ab"), 0)
+		before := s.GetSize()
+		if err := s.Append("a", []byte("cd")); err != nil {
+			t.Fatal(name, err)
+		}
+		if data, _ := s.Get("a"); string(data) != "abcd" {
+			t.Fatalf("%s: appended value %q", name, data)
+		}
+		if d := s.GetSize() - before; d != 2 {
+			t.Fatalf("%s: size grew by %d", name, d)
+		}
+		if err := s.Append("a", make([]byte, 1<<10)); !errors.Is(err, ErrTooLarge) {
+			t.Fatalf("%s: oversized append: %v", name, err)
+		}
+	}
+
+	// appends evict like sets do
+	for i := 0; i < 8; i++ {
+		lru.Set("k"+strconv.Itoa(i), make([]byte, 400), 0)
+	}
+	for i := 0; i < 8; i++ {
+		lru.Append("k"+strconv.Itoa(i), bytes.Repeat([]byte("x"), 500))
+	}
+	if size := lru.GetSize(); size > 4<<10 {
+		t.Fatalf("size %d over MaxMemSize after appends", size)
+	}
+}
+
+func TestPersist(t *testing.T) {
+	lru, _ := NewLRUStorage(WithShards(1), WithExpiryIndex(ExpiryHeap))
+	defer lru.Close()
+	ttl, _ := NewTTLStorage(WithShards(1), WithExpiryIndex(ExpiryHeap))
+	defer ttl.Close()
+	for name, s := range map[string]interface {
+		IStorage
+		SetWithDuration(key string, data []byte, ttl time.Duration) error
+		Persist(key string) error
+		DeleteExpired() int
+	}{"LRU": lru, "TTL": ttl} {
+		if err := s.Persist("a"); !errors.Is(err, ErrMissing) {
+			t.Fatalf("%s: persist missing key: %v", name, err)
+		}
+		s.SetWithDuration("a", []byte("1"), 10*time.Millisecond)
+		s.SetWithDuration("b", []byte("2"), 10*time.Millisecond)
+		if err := s.Persist("a"); err != nil {
+			t.Fatal(name, err)
+		}
+		if _, left, _ := s.GetWithTTL("a"); left != 0 {
+			t.Fatalf("%s: persisted entry has ttl %d", name, left)
+		}
+		time.Sleep(20 * time.Millisecond)
+		if n := s.DeleteExpired(); n != 1 {
+			t.Fatalf("%s: %d expired, want the other entry", name, n)
+		}
+		if data, err := s.Get("a"); string(data) != "1" {
+			t.Fatalf("%s: persisted entry %q, %v", name, data, err)
+		}
+		if err := s.Persist("b"); !errors.Is(err, ErrMissing) {
+			t.Fatalf("%s: persist expired key: %v", name, err)
+		}
+	}
+}
+
+func TestGetAndDelete(t *testing.T) {
+	s, _ := NewLRUStorage(WithShards(1), WithBufferPool(1<<10))
+	defer s.Close()
+	if _, err := s.GetAndDelete("a"); !errors.Is(err, ErrMissing) {
+		t.Fatalf("pop of missing key: %v", err)
+	}
+
+	// concurrent pops of one entry, exactly one gets it
+	for round := 0; round < 100; round++ {
+		s.Set("a", []byte("payload"), 0)
+		var wg sync.WaitGroup
+		var got int32
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if data, err := s.GetAndDelete("a"); err == nil {
+					if string(data) != "payload" {
+						t.Errorf("popped %q", data)
+					}
+					atomic.AddInt32(&got, 1)
+				}
+			}()
+		}
+		wg.Wait()
+		if got != 1 {
+			t.Fatalf("round %d: entry popped %d times", round, got)
+		}
+	}
+	if s.Len() != 0 || s.GetSize() != 0 {
+		t.Fatalf("len %d, size %d after pops", s.Len(), s.GetSize())
+	}
+
+	// popped value stays intact when its buffer is reused
+	s.Set("a", []byte("first"), 0)
+	data, _ := s.GetAndDelete("a")
+	s.Set("b", []byte("other"), 0)
+	if string(data) != "first" {
+		t.Fatalf("popped value changed to %q", data)
+	}
+}
+
+func TestSetCAS(t *testing.T) {
+	s, _ := NewLRUStorage(WithShards(1))
+	defer s.Close()
+	v, err := s.SetCAS("a", []byte("1"), 0, 0)
+	if err != nil || v == 0 {
+		t.Fatalf("create with version 0: %d, %v", v, err)
+	}
+	if _, err := s.SetCAS("a", []byte("2"), 0, 0); !errors.Is(err, ErrVersionMismatch) {
+		t.Fatalf("create over existing: %v", err)
+	}
+	s.Set("a", []byte("3"), 0)
+	current, err := s.SetCAS("a", []byte("4"), 0, v)
+	if !errors.Is(err, ErrVersionMismatch) || current == v {
+		t.Fatalf("stale version after Set: %d, %v", current, err)
+	}
+	if data, got, _ := s.GetWithVersion("a"); string(data) != "3" || got != current {
+		t.Fatalf("entry %q version %d, want %d", data, got, current)
+	}
+
+	// read-modify-write loops lose no updates
+	s.Set("n", []byte("0"), 0)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; {
+				data, version, _ := s.GetWithVersion("n")
+				n, _ := strconv.Atoi(string(data))
+				if _, err := s.SetCAS("n", []byte(strconv.Itoa(n+1)), 0, version); err == nil {
+					j++
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if data, _ := s.Get("n"); string(data) != "800" {
+		t.Fatalf("counter %s after 800 CAS increments", data)
+	}
+}
+
+func TestIncr(t *testing.T) {
+	s, _ := NewLRUStorage(WithShards(1))
+	defer s.Close()
+	if n, err := s.Incr("n", 5, 60); n != 5 || err != nil {
+		t.Fatalf("incr of missing key: %d, %v", n, err)
+	}
+	if n, _ := s.Decr("n", 7, 0); n != -2 {
+		t.Fatalf("decr to %d", n)
+	}
+	// the existing entry keeps its expiry
+	if _, left, _ := s.GetWithTTL("n"); left == 0 || left > 60 {
+		t.Fatalf("ttl %d after incr", left)
+	}
+	s.Set("s", []byte("abc"), 0)
+	if _, err := s.Incr("s", 1, 0); !errors.Is(err, ErrNotInteger) {
+		t.Fatalf("incr of a string: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				s.Incr("c", 1, 0)
+			}
+		}()
+	}
+	wg.Wait()
+	if data, _ := s.Get("c"); string(data) != "800" {
+		t.Fatalf("counter %s after 800 increments", data)
+	}
+}
+
+func TestSetIf(t *testing.T) {
+	s, _ := NewLRUStorage(WithShards(1))
+	defer s.Close()
+	if ok, _ := s.SetIfPresent("a", []byte("1"), 0); ok {
+		t.Fatal("replace of a missing key")
+	}
+	if ok, _ := s.SetIfAbsent("a", []byte("1"), 0); !ok {
+		t.Fatal("add of a missing key failed")
+	}
+	if ok, _ := s.SetIfAbsent("a", []byte("2"), 0); ok {
+		t.Fatal("add over a live entry")
+	}
+	if ok, _ := s.SetIfPresent("a", []byte("3"), 0); !ok {
+		t.Fatal("replace of a live entry failed")
+	}
+	if data, _ := s.Get("a"); string(data) != "3" {
+		t.Fatalf("value %q", data)
+	}
+
+	// an expired entry is absent
+	s.SetWithDuration("e", []byte("old"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if ok, _ := s.SetIfPresent("e", []byte("new"), 0); ok {
+		t.Fatal("replace of an expired entry")
+	}
+	if ok, _ := s.SetIfAbsent("e", []byte("new"), 0); !ok {
+		t.Fatal("add over an expired entry failed")
+	}
+
+	var wg sync.WaitGroup
+	var added int32
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ok, _ := s.SetIfAbsent("race", []byte("v"), 0); ok {
+				atomic.AddInt32(&added, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if added != 1 {
+		t.Fatalf("key added %d times", added)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	s, _ := NewLRUStorage(WithShards(1), WithMaxEntrySize(4))
+	s.SetWithDuration("a", []byte("1"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if _, err := s.Get("a"); !errors.Is(err, ErrExpired) || !errors.Is(err, ErrMissing) {
+		t.Fatalf("expired entry: %v", err)
+	}
+	if _, err := s.Get("a"); errors.Is(err, ErrExpired) || !errors.Is(err, ErrMissing) {
+		t.Fatalf("entry removed on expiry: %v", err)
+	}
+	if err := s.Set("b", []byte("12345"), 0); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("oversized set: %v", err)
+	}
+	s.Close()
+	if _, err := s.Get("a"); !errors.Is(err, ErrClosed) {
+		t.Fatalf("get after close: %v", err)
+	}
+	if err := s.Set("a", nil, 0); !errors.Is(err, ErrClosed) {
+		t.Fatalf("set after close: %v", err)
+	}
+}
+
+func TestDelExisted(t *testing.T) {
+	s, _ := NewLRUStorage(WithShards(1))
+	defer s.Close()
+	s.Set("a", []byte("1"), 0)
+	if !s.DelExisted("a") {
+		t.Fatal("live entry not reported")
+	}
+	if s.DelExisted("a") {
+		t.Fatal("deleted entry reported twice")
+	}
+	s.SetWithDuration("e", []byte("1"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if s.DelExisted("e") {
+		t.Fatal("expired entry reported")
+	}
+	if s.Len() != 0 {
+		t.Fatalf("expired entry left, len %d", s.Len())
+	}
+
+	s.Set("race", []byte("1"), 0)
+	var wg sync.WaitGroup
+	var existed int32
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if s.DelExisted("race") {
+				atomic.AddInt32(&existed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if existed != 1 {
+		t.Fatalf("entry reported deleted %d times", existed)
+	}
+}
+
+func TestClearConcurrent(t *testing.T) {
+	s, _ := NewLRUStorage(WithShards(2), WithMaxBytes(1<<20))
+	defer s.Close()
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; ; j++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				key := strconv.Itoa(i*1000 + j%1000)
+				s.Set(key, []byte("value"), 0)
+				s.Get(key)
+			}
+		}(i)
+	}
+	for i := 0; i < 50; i++ {
+		s.Clear()
+	}
+	<-s.ClearAsync()
+	close(stop)
+	wg.Wait()
+
+	<-s.ClearAsync()
+	if s.Len() != 0 || s.GetSize() != 0 {
+		t.Fatalf("len %d, size %d after Clear", s.Len(), s.GetSize())
+	}
+	s.Set("a", []byte("value"), 0)
+	if size := s.GetSize(); size != 5+entryOverhead {
+		t.Fatalf("size %d of one entry after Clear", size)
+	}
+}
+
+func TestMaxEntrySize(t *testing.T) {
+	makers := map[string]func(opts ...Option) (IStorage, error){
+		"LRU": func(o ...Option) (IStorage, error) { return NewLRUStorage(o...) },
+		"TTL": func(o ...Option) (IStorage, error) { return NewTTLStorage(o...) },
+	}
+	for name, make := range listStorages {
+		makers[name] = make
+	}
+	for name, make := range makers {
+		s, _ := make(WithShards(1), WithMaxEntrySize(4))
+		s.Set("a", []byte("1234"), 0)
+		if err := s.Set("a", []byte("12345"), 0); !errors.Is(err, ErrTooLarge) {
+			t.Errorf("%s: oversized set: %v", name, err)
+		}
+		if data, _ := s.Get("a"); string(data) != "1234" {
+			t.Errorf("%s: value %q after a rejected set", name, data)
+		}
+		s.Close()
+	}
+
+	s, _ := NewLRUStorage(WithShards(1), WithMaxEntrySize(4))
+	defer s.Close()
+	if _, err := s.SetIfAbsent("a", []byte("12345"), 0); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("oversized SetIfAbsent: %v", err)
+	}
+	if _, err := s.SetCAS("a", []byte("12345"), 0, 0); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("oversized SetCAS: %v", err)
+	}
+	if s.Len() != 0 {
+		t.Fatalf("rejected writes stored %d entries", s.Len())
+	}
+}
+
+func TestByteKeys(t *testing.T) {
+	s, _ := NewLRUStorage(WithShards(4), WithTrackKeys(), WithCollisionSafe(), WithZeroCopy())
+	defer s.Close()
+	key := []byte("user:1")
+	s.SetB(key, []byte("1"), 0)
+	if data, err := s.Get("user:1"); string(data) != "1" || err != nil {
+		t.Fatalf("string get of a byte key: %q, %v", data, err)
+	}
+	s.Set("user:2", []byte("2"), 0)
+	if data, err := s.GetB([]byte("user:2")); string(data) != "2" || err != nil {
+		t.Fatalf("byte get of a string key: %q, %v", data, err)
+	}
+	// the buffer is reused by the caller, the tracked key is a copy
+	copy(key, "temp:1")
+	if n, _ := s.DeleteByPrefix("user:"); n != 2 {
+		t.Fatalf("%d keys deleted by prefix", n)
+	}
+
+	s.SetB(key, []byte("1"), 0)
+	if allocs := testing.AllocsPerRun(100, func() {
+		s.GetB(key)
+	}); allocs != 0 {
+		t.Fatalf("GetB allocates %v times", allocs)
+	}
+	s.DelB(key)
+	if _, err := s.Get("temp:1"); !errors.Is(err, ErrMissing) {
+		t.Fatalf("get after DelB: %v", err)
+	}
+}
+
+func TestGetInto(t *testing.T) {
+	s, _ := NewLRUStorage(WithShards(1))
+	defer s.Close()
+	s.Set("a", []byte("hello"), 60)
+	dst := make([]byte, 3)
+	if n, _, err := s.GetInto("a", dst); !errors.Is(err, ErrShortBuffer) || n != 5 {
+		t.Fatalf("short buffer: %d, %v", n, err)
+	}
+	dst = make([]byte, 8)
+	n, ttl, err := s.GetInto("a", dst)
+	if err != nil || string(dst[:n]) != "hello" || ttl != 60 {
+		t.Fatalf("got %q, ttl %d, %v", dst[:n], ttl, err)
+	}
+	if _, _, err := s.GetInto("b", dst); !errors.Is(err, ErrMissing) {
+		t.Fatalf("missing key: %v", err)
+	}
+	if allocs := testing.AllocsPerRun(100, func() {
+		s.GetInto("a", dst)
+	}); allocs != 0 {
+		t.Fatalf("GetInto allocates %v times", allocs)
+	}
+}
+
+func TestCopyOptions(t *testing.T) {
+	for name, make := range map[string]func(opts ...Option) (IStorage, error){
+		"LRU":  func(o ...Option) (IStorage, error) { return NewLRUStorage(o...) },
+		"FIFO": func(o ...Option) (IStorage, error) { return NewFIFOStorage(o...) },
+	} {
+		s, _ := make(WithShards(1))
+		in := []byte("abc")
+		s.Set("a", in, 0)
+		in[0] = 'x'
+		out, _ := s.Get("a")
+		out[1] = 'y'
+		if data, _ := s.Get("a"); string(data) != "abc" {
+			t.Errorf("%s: copying storage changed to %q", name, data)
+		}
+		s.Close()
+
+		s, _ = make(WithShards(1), WithZeroCopy())
+		in = []byte("abc")
+		s.Set("a", in, 0)
+		in[0] = 'x'
+		out, _ = s.Get("a")
+		if string(out) != "xbc" || cap(out) != len(out) {
+			t.Errorf("%s: zero-copy storage doesn't share values: %q, cap %d", name, out, cap(out))
+		}
+		// appends to a returned value don't run into storage memory
+		_ = append(out, 'z')
+		if data, _ := s.Get("a"); string(data) != "xbc" {
+			t.Errorf("%s: append changed value to %q", name, data)
+		}
+		s.Close()
+	}
+}
+
+func TestDeleteByPrefix(t *testing.T) {
+	s, _ := NewLRUStorage(WithShards(4), WithMaxEntries(64), WithTrackKeys())
+	defer s.Close()
+	for i := 0; i < 10; i++ {
+		s.Set("user:"+strconv.Itoa(i), []byte("1"), 0)
+		s.Set("post:"+strconv.Itoa(i), []byte("1"), 0)
+	}
+	s.Set("user:1:avatar", []byte("1"), 0)
+	if n, err := s.DeleteMatch("user:?:*"); n != 1 || err != nil {
+		t.Fatalf("deleted %d by match, %v", n, err)
+	}
+	if n, err := s.DeleteByPrefix("user:"); n != 10 || err != nil {
+		t.Fatalf("deleted %d by prefix, %v", n, err)
+	}
+	if s.Len() != 10 {
+		t.Fatalf("%d entries left", s.Len())
+	}
+	if _, err := s.DeleteMatch("["); err == nil {
+		t.Fatal("bad pattern accepted")
+	}
+
+	// keys of evicted and deleted entries are not kept
+	for i := 0; i < 1000; i++ {
+		s.Set("tmp:"+strconv.Itoa(i), []byte("1"), 0)
+	}
+	s.Del("post:1")
+	tracked := 0
+	for _, shard := range s.shards {
+		tracked += len(shard.keys)
+	}
+	if tracked != s.Len() {
+		t.Fatalf("%d keys tracked for %d entries", tracked, s.Len())
+	}
+
+	untracked, _ := NewLRUStorage()
+	defer untracked.Close()
+	if _, err := untracked.DeleteByPrefix("user:"); !errors.Is(err, ErrKeysNotTracked) {
+		t.Fatalf("prefix delete without TrackKeys: %v", err)
+	}
+}
+
+func TestKeyFingerprints(t *testing.T) {
+	if _, err := NewLRUStorage(WithTrackKeys(), WithKeyFingerprints("")); !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("both key trackings accepted: %v", err)
+	}
+	s, _ := NewLRUStorage(WithShards(4), WithMaxEntries(64), WithKeyFingerprints(""))
+	defer s.Close()
+	for i := 0; i < 10; i++ {
+		s.Set("user:"+strconv.Itoa(i), []byte("1"), 0)
+		s.Set("post:"+strconv.Itoa(i), []byte("1"), 0)
+	}
+	s.Set("user:1/avatar", []byte("1"), 0)
+	if n, err := s.DeleteByPrefix("user:1/"); n != 1 || err != nil {
+		t.Fatalf("deleted %d by nested prefix, %v", n, err)
+	}
+	for _, prefix := range []string{"user", "user:1", ""} {
+		if _, err := s.DeleteByPrefix(prefix); !errors.Is(err, ErrKeysNotTracked) {
+			t.Fatalf("prefix %q without a delimiter at the end: %v", prefix, err)
+		}
+	}
+	if _, err := s.DeleteMatch("user:*"); !errors.Is(err, ErrKeysNotTracked) {
+		t.Fatalf("DeleteMatch by fingerprints: %v", err)
+	}
+	if err := s.Reshard(8); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := s.DeleteByPrefix("user:"); n != 10 || err != nil || s.Len() != 10 {
+		t.Fatalf("deleted %d by prefix after Reshard, %v, %d left", n, err, s.Len())
+	}
+
+	// keys of evicted and deleted entries are not kept, nor their prefixes
+	for i := 0; i < 1000; i++ {
+		s.Set("tmp:"+strconv.Itoa(i)+":", []byte("1"), 0)
+	}
+	s.Del("post:1")
+	tracked, prefixes := 0, 0
+	for _, shard := range s.shards {
+		tracked += len(shard.prints.byKey)
+		prefixes += len(shard.prints.prefixes)
+	}
+	if tracked != s.Len() || prefixes > 2*s.Len() {
+		t.Fatalf("%d keys and %d prefixes tracked for %d entries", tracked, prefixes, s.Len())
+	}
+
+	// two prefixes with the same fingerprint
+	seen := make(map[uint32]string)
+	var a, b string
+	for i := 0; a == ""; i++ {
+		p := "p" + strconv.Itoa(i) + ":"
+		if other, ok := seen[fingerprint(p)]; ok {
+			a, b = other, p
+		}
+		seen[fingerprint(p)] = p
+	}
+	c, _ := NewLRUStorage(WithShards(1), WithKeyFingerprints(":"))
+	defer c.Close()
+	c.Set(a+"1", []byte("1"), 0)
+	c.Set(b+"1", []byte("1"), 0)
+	c.Set(b+"2", []byte("1"), 0)
+	if len(c.shards[0].prints.spill) != 2 {
+		t.Fatalf("%d keys spilled over, want the 2 of the later prefix", len(c.shards[0].prints.spill))
+	}
+	if n, _ := c.DeleteByPrefix(b); n != 2 {
+		t.Fatalf("deleted %d by the later prefix", n)
+	}
+	if n, _ := c.DeleteByPrefix(a); n != 1 || c.Len() != 0 {
+		t.Fatalf("deleted %d by the first prefix, %d left", n, c.Len())
+	}
+}
+
+func TestSetNegative(t *testing.T) {
+	s, _ := NewLRUStorage(WithShards(1))
+	defer s.Close()
+	s.SetNegative("gone", 60)
+	if data, err := s.Get("gone"); !errors.Is(err, ErrNegativeCached) || data != nil {
+		t.Fatalf("negative entry: %q, %v", data, err)
+	}
+	if st := s.Stats(); st.Hits != 1 || st.Misses != 0 {
+		t.Fatalf("negative hit counted as %+v", st)
+	}
+	s.Set("gone", []byte("back"), 0)
+	if data, err := s.Get("gone"); string(data) != "back" || err != nil {
+		t.Fatalf("overwritten negative entry: %q, %v", data, err)
+	}
+
+	s.SetNegative("brief", 1)
+	s.shards[0].data[s.KeyHash("brief")].expire = nowMs() - 1
+	if _, err := s.Get("brief"); !errors.Is(err, ErrExpired) {
+		t.Fatalf("expired negative entry: %v", err)
+	}
+}
+
+func TestConcurrentGet(t *testing.T) {
+	s, _ := NewLFUStorage(WithShards(1))
+	defer s.Close()
+	shard := s.shards[0]
+	if !shard.readMostly {
+		t.Fatal("plain LFU Gets take the write lock")
+	}
+	s.Set("a", []byte("1"), 0)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				s.Get("a")
+				if g == 0 && i%10 == 0 {
+					s.Set(strconv.Itoa(i), []byte("1"), 0)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	// hits taken under the read lock all reach worth
+	shard.Lock()
+	e := shard.data[s.KeyHash("a")]
+	shard.fold(e)
+	worth := e.worth
+	shard.Unlock()
+	if worth != 8000 || s.Stats().Hits != 8000 {
+		t.Fatalf("worth %f, %d hits of 8000", worth, s.Stats().Hits)
+	}
+
+	onGet, _ := NewLFUStorage(WithShards(1), WithIncrementalClean(2, true))
+	defer onGet.Close()
+	if onGet.shards[0].readMostly {
+		t.Fatal("Gets cleaning shards under the read lock")
+	}
+}
@@ -0,0 +1,150 @@
+package otelprobecache
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	pcache "github.com/n1ord/probecache"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const scope = "github.com/n1ord/probecache/otelprobecache"
+
+type config struct {
+	tracers trace.TracerProvider
+	meters  metric.MeterProvider
+	name    string
+}
+
+type Option func(*config)
+
+// WithTracerProvider replaces the global otel.GetTracerProvider()
+func WithTracerProvider(p trace.TracerProvider) Option {
+	return func(c *config) { c.tracers = p }
+}
+
+// WithMeterProvider replaces the global otel.GetMeterProvider()
+func WithMeterProvider(p metric.MeterProvider) Option {
+	return func(c *config) { c.meters = p }
+}
+
+// WithName sets the "cache.name" attribute, telling storages of one service apart
+func WithName(name string) Option {
+	return func(c *config) { c.name = name }
+}
+
+// Storage is IStorage recording a span and a latency histogram point for Get, GetWithTTL,
+// Set and Del, with the operation, hit or miss, value size and shard as attributes. The
+// Context variants start spans under ctx, so they join the caller's trace
+type Storage struct {
+	pcache.IStorage
+	tracer   trace.Tracer
+	duration metric.Float64Histogram
+	name     []attribute.KeyValue
+	shardOf  func(key string) int // nil if the storage doesn't tell shards
+}
+
+func New(s pcache.IStorage, opts ...Option) (*Storage, error) {
+	cfg := config{tracers: otel.GetTracerProvider(), meters: otel.GetMeterProvider()}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	duration, err := cfg.meters.Meter(scope).Float64Histogram("probecache.operation.duration",
+		metric.WithUnit("s"), metric.WithDescription("Latency of storage operations"))
+	if err != nil {
+		return nil, err
+	}
+	st := &Storage{IStorage: s, tracer: cfg.tracers.Tracer(scope), duration: duration}
+	if cfg.name != "" {
+		st.name = []attribute.KeyValue{attribute.String("cache.name", cfg.name)}
+	}
+	if sh, ok := s.(interface{ ShardIndex(key string) int }); ok {
+		st.shardOf = sh.ShardIndex
+	}
+	return st, nil
+}
+
+// start opens span of op, attributes known before the call
+func (s *Storage) start(ctx context.Context, op, key string) (context.Context, trace.Span, []attribute.KeyValue) {
+	attrs := append(make([]attribute.KeyValue, 0, 5), s.name...)
+	attrs = append(attrs, attribute.String("cache.operation", op))
+	if s.shardOf != nil {
+		attrs = append(attrs, attribute.Int("cache.shard", s.shardOf(key)))
+	}
+	ctx, span := s.tracer.Start(ctx, "probecache."+op, trace.WithSpanKind(trace.SpanKindInternal), trace.WithAttributes(attrs...))
+	return ctx, span, attrs
+}
+
+// end records latency and error of the operation
+func (s *Storage) end(ctx context.Context, span trace.Span, attrs []attribute.KeyValue, begin time.Time, err error) {
+	d := time.Since(begin)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		attrs = append(attrs, attribute.Bool("cache.error", true))
+	}
+	s.duration.Record(ctx, d.Seconds(), metric.WithAttributes(attrs...))
+	span.End()
+}
+
+// isMiss tells a Get miss, which is not an error, from a failure
+func isMiss(err error) bool {
+	return errors.Is(err, pcache.ErrMissing) || errors.Is(err, pcache.ErrExpired) || errors.Is(err, pcache.ErrNegativeCached)
+}
+
+func (s *Storage) Get(key string) ([]byte, error) {
+	return s.GetContext(context.Background(), key)
+}
+
+func (s *Storage) GetContext(ctx context.Context, key string) ([]byte, error) {
+	data, _, err := s.GetWithTTLContext(ctx, key)
+	return data, err
+}
+
+func (s *Storage) GetWithTTL(key string) ([]byte, uint64, error) {
+	return s.GetWithTTLContext(context.Background(), key)
+}
+
+func (s *Storage) GetWithTTLContext(ctx context.Context, key string) ([]byte, uint64, error) {
+	ctx, span, attrs := s.start(ctx, "get", key)
+	begin := time.Now()
+	data, ttl, err := s.IStorage.GetWithTTL(key)
+	hit := attribute.Bool("cache.hit", err == nil)
+	span.SetAttributes(hit, attribute.Int("cache.size", len(data)))
+	failed := err
+	if isMiss(err) {
+		failed = nil
+	}
+	s.end(ctx, span, append(attrs, hit), begin, failed)
+	return data, ttl, err
+}
+
+func (s *Storage) Set(key string, data []byte, ttl uint64) error {
+	return s.SetContext(context.Background(), key, data, ttl)
+}
+
+func (s *Storage) SetContext(ctx context.Context, key string, data []byte, ttl uint64) error {
+	ctx, span, attrs := s.start(ctx, "set", key)
+	span.SetAttributes(attribute.Int("cache.size", len(data)))
+	begin := time.Now()
+	err := s.IStorage.Set(key, data, ttl)
+	s.end(ctx, span, attrs, begin, err)
+	return err
+}
+
+func (s *Storage) Del(key string) error {
+	return s.DelContext(context.Background(), key)
+}
+
+func (s *Storage) DelContext(ctx context.Context, key string) error {
+	ctx, span, attrs := s.start(ctx, "del", key)
+	begin := time.Now()
+	err := s.IStorage.Del(key)
+	s.end(ctx, span, attrs, begin, err)
+	return err
+}
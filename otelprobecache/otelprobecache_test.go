@@ -0,0 +1,90 @@
+package otelprobecache
+
+import (
+	"context"
+	"testing"
+
+	pcache "github.com/n1ord/probecache"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestStorage(t *testing.T) {
+	lru, _ := pcache.NewLRUStorage(pcache.WithShards(4))
+	defer lru.Close()
+	spans := tracetest.NewSpanRecorder()
+	reader := sdkmetric.NewManualReader()
+	s, err := New(lru, WithName("users"),
+		WithTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans))),
+		WithMeterProvider(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, parent := sdktrace.NewTracerProvider().Tracer("test").Start(context.Background(), "request")
+	s.SetContext(ctx, "a", []byte("12"), 0)
+	s.GetContext(ctx, "a")
+	s.Get("b")
+	lru.SetNegative("gone", 60)
+	s.Get("gone")
+	s.Del("a")
+	s.Close()
+	s.Get("a")
+	parent.End()
+
+	ended := spans.Ended()
+	if len(ended) != 6 {
+		t.Fatalf("%d spans", len(ended))
+	}
+	want := []struct {
+		name, key string
+		hit       attribute.Value
+		status    codes.Code
+	}{
+		{"probecache.set", "a", attribute.Value{}, codes.Unset},
+		{"probecache.get", "a", attribute.BoolValue(true), codes.Unset},
+		{"probecache.get", "b", attribute.BoolValue(false), codes.Unset},
+		{"probecache.get", "gone", attribute.BoolValue(false), codes.Unset}, // negative cache hit is a miss
+		{"probecache.del", "a", attribute.Value{}, codes.Unset},
+		{"probecache.get", "a", attribute.BoolValue(false), codes.Error},
+	}
+	for i, w := range want {
+		sp := ended[i]
+		attrs := map[attribute.Key]attribute.Value{}
+		for _, kv := range sp.Attributes() {
+			attrs[kv.Key] = kv.Value
+		}
+		if sp.Name() != w.name || attrs["cache.hit"] != w.hit || sp.Status().Code != w.status {
+			t.Errorf("span %d: %s %v %v", i, sp.Name(), attrs, sp.Status())
+		}
+		if attrs["cache.shard"].AsInt64() != int64(lru.ShardIndex(w.key)) {
+			t.Errorf("span %d: shard %v", i, attrs["cache.shard"])
+		}
+		if attrs["cache.name"].AsString() != "users" {
+			t.Errorf("span %d: name %v", i, attrs["cache.name"])
+		}
+	}
+	if ended[0].Parent().SpanID() != parent.SpanContext().SpanID() || ended[2].Parent().IsValid() {
+		t.Fatal("context variants don't join the caller's trace")
+	}
+	if st := ended[5].Status(); st.Description != pcache.ErrClosed.Error() {
+		t.Fatalf("status %v", st)
+	}
+
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatal(err)
+	}
+	h := rm.ScopeMetrics[0].Metrics[0].Data.(metricdata.Histogram[float64])
+	var count uint64
+	for _, p := range h.DataPoints {
+		count += p.Count
+	}
+	if count != 6 {
+		t.Fatalf("%d operations recorded", count)
+	}
+}
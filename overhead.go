@@ -0,0 +1,28 @@
+package probecache
+
+import "runtime"
+
+// entries the calibration shard is filled with, enough to average out map growth steps
+const calibrationEntries = 1 << 16
+
+// CalibrateEntryOverhead measures heap bytes an LRU/LFU entry with valueSize bytes of
+// payload takes beyond the payload: entry header, map slot and allocation rounding.
+// Feed the result to WithEntryOverhead, so MaxMemSize approximates real memory for small
+// values. It fills a throwaway shard and runs GC twice, call it once at startup
+func CalibrateEntryOverhead(valueSize int) int {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	shard := NewPolicyShard(lfuPolicy{}, 0, 0, 0)
+	for i := uint64(0); i < calibrationEntries; i++ {
+		shard.Set(i, make([]byte, valueSize), 0)
+	}
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	runtime.KeepAlive(shard)
+	overhead := int(int64(after.HeapAlloc)-int64(before.HeapAlloc))/calibrationEntries - valueSize
+	if overhead < entryOverhead {
+		return entryOverhead
+	}
+	return overhead
+}
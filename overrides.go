@@ -0,0 +1,182 @@
+package probecache
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type OverrideStat struct {
+	Pattern string
+	Extend  time.Duration
+	Until   time.Time
+	// Number of expired entries kept alive by the rule
+	Saved uint64
+}
+
+type overrideRule struct {
+	pattern string
+	hash    uint64 // key hash of a pattern without wildcards
+	literal bool
+	extend  time.Duration
+	until   time.Time
+	saved   uint64
+}
+
+// ttlOverrides is a tiny rule engine consulted when an entry is found expired
+// on access. Background cleaning keeps expired entries matching a rule for Get:
+// a literal rule by key hash, a wildcard one by tracked key.
+type ttlOverrides struct {
+	sync.RWMutex
+	rules []*overrideRule
+	n     int32 // len(rules)
+	until int64 // max rules until, unix nano
+	hash  func(key string) uint64
+	keyed bool // keys are tracked, wildcard rules are allowed
+}
+
+func newTTLOverrides(hash func(key string) uint64, keyed bool) *ttlOverrides {
+	return &ttlOverrides{hash: hash, keyed: keyed}
+}
+
+func (o *ttlOverrides) add(pattern string, extend time.Duration, until time.Time) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return err
+	}
+	literal := !strings.ContainsAny(pattern, `*?[\`)
+	if !literal && !o.keyed {
+		return fmt.Errorf("%w: pattern %q needs TrackKeys", ErrInvalidConfig, pattern)
+	}
+	r := &overrideRule{
+		pattern: pattern,
+		literal: literal,
+		extend:  extend,
+		until:   until,
+	}
+	if literal {
+		r.hash = o.hash(pattern)
+	}
+	o.Lock()
+	o.rules = append(o.rules, r)
+	o.pruneLocked()
+	o.Unlock()
+	return nil
+}
+
+// active reports whether any rule is, dropping rules once all of them expired
+func (o *ttlOverrides) active() bool {
+	if o == nil || atomic.LoadInt32(&o.n) == 0 {
+		return false
+	}
+	if time.Now().UnixNano() < atomic.LoadInt64(&o.until) {
+		return true
+	}
+	o.Lock()
+	o.pruneLocked()
+	o.Unlock()
+	return false
+}
+
+// Run in lock only. Drops expired rules
+func (o *ttlOverrides) pruneLocked() {
+	now := time.Now()
+	live := o.rules[:0]
+	until := int64(0)
+	for _, r := range o.rules {
+		if !now.Before(r.until) {
+			continue
+		}
+		live = append(live, r)
+		if r.until.UnixNano() > until {
+			until = r.until.UnixNano()
+		}
+	}
+	for i := len(live); i < len(o.rules); i++ {
+		o.rules[i] = nil
+	}
+	o.rules = live
+	atomic.StoreInt64(&o.until, until)
+	atomic.StoreInt32(&o.n, int32(len(live)))
+}
+
+// pins reports whether an active rule matches the entry of hash, keys are the
+// tracked ones of its shard
+func (o *ttlOverrides) pins(hash uint64, keys map[uint64]string) bool {
+	if !o.active() {
+		return false
+	}
+	now := time.Now()
+	o.RLock()
+	defer o.RUnlock()
+	for _, r := range o.rules {
+		if now.After(r.until) {
+			continue
+		}
+		if r.literal {
+			if r.hash == hash {
+				return true
+			}
+			continue
+		}
+		if key, ok := keys[hash]; ok {
+			if ok, _ := path.Match(r.pattern, key); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// match returns ttl extension in ms for key, 0 if no active rule matches
+func (o *ttlOverrides) match(key string) uint64 {
+	now := time.Now()
+	o.RLock()
+	defer o.RUnlock()
+	for _, r := range o.rules {
+		if now.After(r.until) {
+			continue
+		}
+		if ok, _ := path.Match(r.pattern, key); ok {
+			atomic.AddUint64(&r.saved, 1)
+			return durationToTTL(r.extend)
+		}
+	}
+	return 0
+}
+
+// rescuer returns callback for shards, nil when no rule is active to keep Get cheap
+func (o *ttlOverrides) rescuer(key string) func() uint64 {
+	if !o.active() {
+		return nil
+	}
+	return func() uint64 {
+		return o.match(key)
+	}
+}
+
+// rescuerB converts key to string only when some rule is active
+func (o *ttlOverrides) rescuerB(key []byte) func() uint64 {
+	if !o.active() {
+		return nil
+	}
+	return o.rescuer(string(key))
+}
+
+func (o *ttlOverrides) stats() []OverrideStat {
+	o.Lock()
+	defer o.Unlock()
+	o.pruneLocked()
+	out := make([]OverrideStat, len(o.rules))
+	for i, r := range o.rules {
+		out[i] = OverrideStat{
+			Pattern: r.pattern,
+			Extend:  r.extend,
+			Until:   r.until,
+			Saved:   atomic.LoadUint64(&r.saved),
+		}
+	}
+	return out
+}
@@ -0,0 +1,132 @@
+package pipeline
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	pcache "github.com/n1ord/probecache"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	offset64 = 14695981039346656037
+	prime64  = 1099511628211
+)
+
+type Item struct {
+	Key   string
+	Value []byte
+	TTL   uint64
+}
+
+// ScanFunc converts current row of sql.Rows into cache item
+type ScanFunc func(rows *sql.Rows) (Item, error)
+
+// FillFromChan reads items until in is closed and sets them into storage with
+// at most workers parallel writers. Keys are routed to writers by the same FNV
+// hash and bit folding storages use by default, so with a power of two workers up
+// to NumShards every shard is fed by a single goroutine and writers never contend
+// on shard locks (other KeyHash choices only lose that property).
+// First failed Set cancels the pipeline and is returned.
+func FillFromChan(ctx context.Context, storage pcache.IStorage, in <-chan Item, workers int) error {
+	if workers <= 0 {
+		workers = 1
+	}
+	g, ctx := errgroup.WithContext(ctx)
+	queues := make([]chan Item, workers)
+	for i := range queues {
+		q := make(chan Item, 64)
+		queues[i] = q
+		g.Go(func() error {
+			for item := range q {
+				if err := storage.Set(item.Key, item.Value, item.TTL); err != nil {
+					return fmt.Errorf("pipeline: set %q: %w", item.Key, err)
+				}
+			}
+			return nil
+		})
+	}
+
+	g.Go(func() error {
+		defer func() {
+			for _, q := range queues {
+				close(q)
+			}
+		}()
+		for {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case item, ok := <-in:
+				if !ok {
+					return nil
+				}
+				h := hash(item.Key)
+				q := queues[(h^h>>32)%uint64(workers)]
+				select {
+				case q <- item:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		}
+	})
+
+	err := g.Wait()
+	if err != nil {
+		// let the producer finish without blocking on a dead pipeline
+		go func() {
+			for range in {
+			}
+		}()
+	}
+	return err
+}
+
+// FillFromSQLRows scans every row with scan and sets it into storage, see FillFromChan.
+// Rows are closed on return; scan and rows errors abort the pipeline.
+func FillFromSQLRows(ctx context.Context, storage pcache.IStorage, rows *sql.Rows, scan ScanFunc, workers int) error {
+	defer rows.Close()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	in := make(chan Item)
+	errCh := make(chan error, 1)
+	go func() {
+		defer close(in)
+		for rows.Next() {
+			item, err := scan(rows)
+			if err != nil {
+				errCh <- fmt.Errorf("pipeline: scan: %w", err)
+				cancel()
+				return
+			}
+			select {
+			case in <- item:
+			case <-ctx.Done():
+				errCh <- nil
+				return
+			}
+		}
+		errCh <- rows.Err()
+	}()
+
+	err := FillFromChan(ctx, storage, in, workers)
+	if err != nil {
+		cancel()
+	}
+	if scanErr := <-errCh; scanErr != nil {
+		return scanErr
+	}
+	return err
+}
+
+func hash(key string) uint64 {
+	var h uint64 = offset64
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= prime64
+	}
+	return h
+}
@@ -0,0 +1,47 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+
+	pcache "github.com/n1ord/probecache"
+)
+
+func TestFillFromChan(t *testing.T) {
+	s, _ := pcache.NewLRUStorage(pcache.WithShards(4), pcache.WithMaxEntrySize(8))
+	defer s.Close()
+	in := make(chan Item)
+	go func() {
+		for i := 0; i < 1000; i++ {
+			in <- Item{Key: strconv.Itoa(i), Value: []byte(strconv.Itoa(i))}
+		}
+		close(in)
+	}()
+	if err := FillFromChan(context.Background(), s, in, 4); err != nil {
+		t.Fatal(err)
+	}
+	if s.Len() != 1000 {
+		t.Fatalf("%d entries filled", s.Len())
+	}
+	if data, _ := s.Get("999"); string(data) != "999" {
+		t.Fatalf("filled value %q", data)
+	}
+
+	// a failed Set stops the pipeline, the producer doesn't block on it
+	in = make(chan Item)
+	done := make(chan struct{})
+	go func() {
+		in <- Item{Key: "big", Value: make([]byte, 16)}
+		for i := 0; i < 1000; i++ {
+			in <- Item{Key: strconv.Itoa(i), Value: []byte("v")}
+		}
+		close(in)
+		close(done)
+	}()
+	if err := FillFromChan(context.Background(), s, in, 2); !errors.Is(err, pcache.ErrTooLarge) {
+		t.Fatalf("failed set: %v", err)
+	}
+	<-done
+}
@@ -0,0 +1,2513 @@
+package probecache
+
+import (
+	"context"
+	"fmt"
+	"hash/maphash"
+	"io"
+	"log/slog"
+	"math"
+	"math/bits"
+	"math/rand"
+	"os"
+	"path"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// Policy decides worth of entries in map based shards: the mean threshold eviction
+// and sampled eviction remove entries of lower worth first. Worth lives in the entry
+// metadata, shards keep its sum. One Policy value is shared by all shards of a storage,
+// methods are called under shard locks, concurrently for different shards.
+type Policy interface {
+	// OnInsert returns worth of a set entry, existed means overwrite of an entry of old worth
+	OnInsert(old float64, existed bool) float64
+	// OnHit returns worth of an entry after a hit
+	OnHit(worth float64) float64
+	// Victim reports whether an entry of given (weight adjusted) worth is evicted
+	// during threshold probing, mean is the shard mean worth
+	Victim(worth float64, mean float64) bool
+}
+
+// keys taken from the map per refill of the incremental clean cursor
+const cleanCursorSize = 64
+
+// policyEntry keeps metadata next to the payload instead of encoding it into
+// the stored bytes, so hits update worth without rewriting the entry
+type policyEntry struct {
+	data    []byte
+	expire  uint64
+	worth   float64
+	version uint64 // negativeFlag marks SetNegative entries
+	hits    uint32 // hits taken under the read lock, not yet folded into worth
+	check   uint64 // second key hash, CollisionSafe only
+}
+
+type PolicyShard struct {
+	sync.RWMutex
+	data      map[uint64]*policyEntry
+	keys      map[uint64]string // original keys, TrackKeys only
+	trackKeys bool
+	prints    *keyPrints // KeyFingerprints only
+
+	maxSize       int
+	critSize      int
+	size          int
+	maxCleanDepth int
+	policy        Policy
+	samples       int // sampled eviction size, 0 uses mean threshold probing
+	cleanSteps    int // incremental clean probes per Set, 0 cleans up to maxCleanDepth at once
+	cleanOnGet    bool
+	cursor        []uint64 // keys the incremental clean probes next
+	watermarks    bool
+	highSize      int
+	highLen       int
+	lowSize       int
+	lowLen        int
+	lowAsync      func(s *PolicyShard) bool // submits async eviction down to the low watermark, nil if sync
+	lowPending    int32
+	maxLen        int
+	window        *rollingStats
+	weigher       Weigher
+	overhead      int         // per entry bytes on top of payload without weigher
+	copyOnSet     bool        // false: Set takes ownership of caller's data
+	pool          *bufferPool // buffers of removed entries, values leave the lock as copies if set
+	onEvict       EvictFunc
+	onExpire      ExpireFunc
+	onRemove      EvictFunc
+	hooks         *removalHooks // nil on a standalone shard
+	events        *eventStream  // nil if disabled
+	log           *slog.Logger
+	emergencies   int    // emergency cleans not logged yet
+	loggedAt      uint64 // ms of the last emergency clean log
+	overrides     *ttlOverrides
+	expiry        expiryIndex // expire index, nil means expired entries are found by probing
+	expiration    ExpirationMode
+	staleWindow   uint64 // ms expired entries are kept for GetStale before they are due
+	rnd           *rand.Rand
+	jitter        float64
+	admission     *tinyLFU // TinyLFU filter, nil if disabled
+	xfetch        float64  // beta * delta in ms, 0 disables early expiration
+	agingHits     uint64   // halve all worth values after that many hits, 0 disables
+	sinceAging    uint64
+	readMostly    bool          // Get hits take the read lock, worth catches up in fold or drain
+	access        *accessBuffer // buffered access recording, nil if disabled
+	stripes       *sync.Pool
+
+	totalWorth float64
+	version    uint64
+
+	hits        uint64
+	misses      uint64
+	evictions   uint64
+	expirations uint64
+	cleans      uint64
+	cleaned     uint64
+	deleted     uint64
+	replaced    uint64
+	cleanDepth  uint64 // entries probed by clean runs
+	maxDepth    int    // most entries probed by one run
+	profile     bool
+	cleanTime   uint64 // ns spent cleaning, profile only
+}
+
+func NewPolicyShard(policy Policy, maxSize int, maxCritSize int, maxCleanDepth int) *PolicyShard {
+	if maxCritSize == 0 {
+		maxCritSize = maxSize
+	}
+	s := &PolicyShard{
+		policy:        policy,
+		maxSize:       maxSize,
+		critSize:      maxCritSize,
+		maxCleanDepth: maxCleanDepth,
+		overhead:      entryOverhead,
+	}
+	s.data = make(map[uint64]*policyEntry)
+	return s
+}
+
+// Run in lock only
+func (s *PolicyShard) clean() {
+	if !s.overLimit() {
+		return
+	}
+	// drop due entries first, so live ones are not evicted in their place
+	if s.expiry != nil && !s.overrides.active() {
+		s.expiry.advance(nowMs(), s.expireIndexed)
+		if !s.overLimit() {
+			return
+		}
+	}
+	if s.profile {
+		defer s.timed(time.Now())
+	}
+	if s.samples > 0 {
+		s.cleanSampled()
+		return
+	}
+	s.cleans++
+	iter := s.maxCleanDepth
+	evicted := 0
+	forced := 0
+	threshold := s.totalWorth / float64(len(s.data))
+	avgWeight := float64(s.size) / float64(len(s.data))
+	depth := 0
+	for k, e := range s.data {
+		if !s.overLimit() || iter == -2 || (iter <= 0 && !s.overCrit()) {
+			break
+		}
+		s.fold(e)
+		// expired entries matching TTL overrides wait for Get, which may rescue them
+		expired := s.isExpired(e.expire) && !s.pinned(k)
+		adjusted := e.worth
+		if s.weigher != nil {
+			// heavy entries have to be proportionally more valuable to survive
+			adjusted = e.worth * avgWeight / float64(s.weight(k, e))
+		}
+		victim := s.policy.Victim(adjusted, threshold) || expired
+		if victim || iter <= 0 {
+			if !victim {
+				forced++
+			}
+			s.evict(k, e, expired)
+			evicted++
+		}
+		iter--
+		depth++
+	}
+	s.window.evict(evicted)
+	s.probed(depth)
+	if forced > 0 && s.log != nil {
+		s.logEmergency(forced)
+	}
+}
+
+// Run in lock only. Logs a clean that hit critSize or maxLen and evicted entries regardless
+// of worth, at most once a second, with number of such cleans since the last log
+func (s *PolicyShard) logEmergency(forced int) {
+	s.emergencies++
+	now := nowMs()
+	if now-s.loggedAt < 1000 {
+		return
+	}
+	s.log.Warn("probecache: shard over critical size, emergency clean", "cleans", s.emergencies,
+		"forced", forced, "size", s.size, "critSize", s.critSize, "len", len(s.data))
+	s.emergencies, s.loggedAt = 0, now
+}
+
+// Run in lock only. Adds time since start to the clean time, profile only
+func (s *PolicyShard) timed(start time.Time) {
+	s.cleanTime += uint64(time.Since(start))
+}
+
+// Run in lock only. Records depth of a clean run
+func (s *PolicyShard) probed(depth int) {
+	s.cleanDepth += uint64(depth)
+	if depth > s.maxDepth {
+		s.maxDepth = depth
+	}
+}
+
+// Run in lock only
+func (s *PolicyShard) overHigh() bool {
+	return (s.maxSize > 0 && s.size > s.highSize) || (s.maxLen > 0 && len(s.data) >= s.highLen)
+}
+
+// Run in lock only
+func (s *PolicyShard) overLow() bool {
+	return (s.maxSize > 0 && s.size > s.lowSize) || (s.maxLen > 0 && len(s.data) > s.lowLen)
+}
+
+// Run in lock only. Evicts down to the low watermark in place, or submits
+// the shard to async eviction
+func (s *PolicyShard) lower() {
+	if s.lowAsync == nil {
+		s.evictDown(0)
+		return
+	}
+	if atomic.CompareAndSwapInt32(&s.lowPending, 0, 1) && !s.lowAsync(s) {
+		// storage closed
+		s.evictDown(0)
+		atomic.StoreInt32(&s.lowPending, 0)
+	}
+}
+
+// Run in lock only. Evicts up to limit entries (0 means no limit) while over the low
+// watermark: entries under the mean worth go first, a pass evicting none of them falls
+// back to any entries. Returns number of evicted entries
+func (s *PolicyShard) evictDown(limit int) int {
+	if s.profile {
+		defer s.timed(time.Now())
+	}
+	evicted := 0
+	defer func() {
+		s.window.evict(evicted)
+	}()
+	for s.overLow() && len(s.data) > 0 {
+		threshold := s.totalWorth / float64(len(s.data))
+		avgWeight := float64(s.size) / float64(len(s.data))
+		pass := 0
+		for k, e := range s.data {
+			if !s.overLow() || (limit > 0 && evicted >= limit) {
+				return evicted
+			}
+			s.fold(e)
+			expired := s.isExpired(e.expire) && !s.pinned(k)
+			adjusted := e.worth
+			if s.weigher != nil {
+				adjusted = e.worth * avgWeight / float64(s.weight(k, e))
+			}
+			if s.policy.Victim(adjusted, threshold) || expired {
+				s.evict(k, e, expired)
+				evicted++
+				pass++
+			}
+		}
+		if pass > 0 {
+			continue
+		}
+		for k, e := range s.data {
+			if !s.overLow() || (limit > 0 && evicted >= limit) {
+				return evicted
+			}
+			s.evict(k, e, s.isExpired(e.expire) && !s.pinned(k))
+			evicted++
+		}
+	}
+	return evicted
+}
+
+// Run in lock only. Incremental clean: probes s.cleanSteps entries at the cursor and evicts
+// the ones under the mean worth. Only hard limits (critSize, maxLen) force eviction on the spot
+func (s *PolicyShard) cleanStep() {
+	if !s.overLimit() {
+		return
+	}
+	if s.profile {
+		defer s.timed(time.Now())
+	}
+	if s.expiry != nil && !s.overrides.active() {
+		s.expiry.advance(nowMs(), s.expireIndexed)
+	}
+	evicted := 0
+	threshold := s.totalWorth / float64(len(s.data))
+	avgWeight := float64(s.size) / float64(len(s.data))
+	for i := 0; i < s.cleanSteps && s.overLimit(); i++ {
+		k, e, ok := s.next()
+		if !ok {
+			break
+		}
+		s.fold(e)
+		expired := s.isExpired(e.expire) && !s.pinned(k)
+		adjusted := e.worth
+		if s.weigher != nil {
+			adjusted = e.worth * avgWeight / float64(s.weight(k, e))
+		}
+		if s.policy.Victim(adjusted, threshold) || expired {
+			s.evict(k, e, expired)
+			evicted++
+		}
+	}
+	forced := 0
+	for s.overCrit() {
+		k, e, ok := s.next()
+		if !ok {
+			break
+		}
+		expired := s.isExpired(e.expire) && !s.pinned(k)
+		s.evict(k, e, expired)
+		evicted++
+		if !expired {
+			forced++
+		}
+	}
+	s.window.evict(evicted)
+	if forced > 0 && s.log != nil {
+		s.logEmergency(forced)
+	}
+}
+
+// Run in lock only. Returns entry at the clean cursor, which is refilled with keys
+// of a short map range, it starts at a random position
+func (s *PolicyShard) next() (uint64, *policyEntry, bool) {
+	for {
+		for len(s.cursor) > 0 {
+			k := s.cursor[len(s.cursor)-1]
+			s.cursor = s.cursor[:len(s.cursor)-1]
+			if e, ok := s.data[k]; ok {
+				return k, e, true
+			}
+		}
+		if len(s.data) == 0 {
+			return 0, nil, false
+		}
+		for k := range s.data {
+			s.cursor = append(s.cursor, k)
+			if len(s.cursor) == cleanCursorSize {
+				break
+			}
+		}
+	}
+}
+
+// Run in lock only. Redis-style eviction: every round samples s.samples entries
+// and evicts the one with the lowest worth, until under limit. Each sample starts
+// a new map iteration, which begins at a random position
+func (s *PolicyShard) cleanSampled() {
+	s.cleans++
+	evicted := 0
+	avgWeight := float64(s.size) / float64(len(s.data))
+	for s.overLimit() && len(s.data) > 0 {
+		var victim uint64
+		var victimEntry *policyEntry
+		victimExpired := false
+		lowest := 0.
+		for i := 0; i < s.samples; i++ {
+			for k, e := range s.data {
+				s.fold(e)
+				adjusted := e.worth
+				if s.weigher != nil {
+					adjusted = adjusted * avgWeight / float64(s.weight(k, e))
+				}
+				expired := s.isExpired(e.expire) && !s.pinned(k)
+				if expired {
+					adjusted = math.Inf(-1)
+				}
+				if victimEntry == nil || adjusted < lowest {
+					victim, victimEntry, victimExpired, lowest = k, e, expired, adjusted
+				}
+				break
+			}
+		}
+		s.evict(victim, victimEntry, victimExpired)
+		evicted++
+	}
+	s.window.evict(evicted)
+	s.probed(evicted * s.samples)
+}
+
+// Run in lock only
+func (s *PolicyShard) evict(k uint64, e *policyEntry, expired bool) {
+	s.cleaned++
+	if expired {
+		s.expirations++
+	} else {
+		s.evictions++
+	}
+	s.totalWorth -= e.worth
+	s.size -= s.weight(k, e)
+	delete(s.data, k)
+	s.forget(k)
+	if s.onEvict != nil {
+		reason := EvictCapacity
+		if expired {
+			reason = EvictExpired
+		}
+		s.onEvict(k, e.data, reason)
+	}
+	if expired && s.onExpire != nil {
+		s.onExpire(k, e.data)
+	}
+	if expired {
+		s.removed(k, e.data, EvictExpired)
+	} else {
+		s.removed(k, e.data, EvictCapacity)
+	}
+	s.pool.put(e.data)
+}
+
+func (s *PolicyShard) DeleteExpired() int {
+	s.Lock()
+	defer s.Unlock()
+	// the index is left alone while TTL overrides are active, its records are due once
+	if s.expiry != nil && !s.overrides.active() {
+		return s.expiry.advance(nowMs(), s.expireIndexed)
+	}
+	n := 0
+	for k, e := range s.data {
+		if !s.isDue(e.expire) || s.pinned(k) {
+			continue
+		}
+		s.removeExpired(k, e)
+		n++
+	}
+	return n
+}
+
+// Run in lock only. Removes entry of an expiry index record unless the record is stale
+func (s *PolicyShard) expireIndexed(key uint64, expire uint64) bool {
+	e, ok := s.data[key]
+	if !ok || e.expire != expire || !s.isDue(expire) {
+		return false
+	}
+	s.removeExpired(key, e)
+	return true
+}
+
+// Run in lock only. Reports whether a TTL override keeps the expired entry of key for Get
+func (s *PolicyShard) pinned(key uint64) bool {
+	return s.overrides.pins(key, s.keys)
+}
+
+// Run in lock only
+func (s *PolicyShard) removeExpired(key uint64, e *policyEntry) {
+	s.totalWorth -= e.worth
+	s.size -= s.weight(key, e)
+	delete(s.data, key)
+	s.forget(key)
+	s.expirations++
+	if s.onExpire != nil {
+		s.onExpire(key, e.data)
+	}
+	s.removed(key, e.data, EvictExpired)
+	s.pool.put(e.data)
+}
+
+// Run in lock only
+func (s *PolicyShard) schedule(key uint64, expire uint64) {
+	if s.expiry == nil || expire == noExpire {
+		return
+	}
+	s.expiry.add(key, expire)
+	// overwritten and deleted entries leave stale records, rebuild when they dominate
+	if s.expiry.len() > 2*len(s.data)+expiryRebuildSlack {
+		s.expiry.reset()
+		for k, e := range s.data {
+			if e.expire != noExpire {
+				s.expiry.add(k, e.expire)
+			}
+		}
+	}
+}
+
+// Run in lock only. When eviction is needed, a new key has to be seen more often
+// than a random resident one
+func (s *PolicyShard) admit(key uint64) bool {
+	s.admission.record(key)
+	if !s.overLimit() {
+		return true
+	}
+	for victim := range s.data {
+		return s.admission.admit(key, victim)
+	}
+	return true
+}
+
+// Run in lock only. Cost of the entry, payload and header length without weigher
+func (s *PolicyShard) weight(key uint64, e *policyEntry) int {
+	if s.weigher == nil {
+		return len(e.data) + s.overhead
+	}
+	if w := s.weigher(key, e.data); w > 0 {
+		return w
+	}
+	return 1
+}
+
+// Run in lock only. New key won't fit without eviction
+func (s *PolicyShard) overLimit() bool {
+	return (s.maxSize > 0 && s.size > s.maxSize) || (s.maxLen > 0 && len(s.data) >= s.maxLen)
+}
+
+// Run in lock only. Over the hard limit, random eviction is allowed
+func (s *PolicyShard) overCrit() bool {
+	return (s.maxSize > 0 && s.size >= s.critSize) || (s.maxLen > 0 && len(s.data) >= s.maxLen)
+}
+
+// rescue, if set, is asked for ttl extension of an expired entry
+func (s *PolicyShard) get(key uint64, check uint64, rescue func() uint64) ([]byte, uint64, uint64, error) {
+	if s.readMostly {
+		s.RLock()
+		e, ok := s.lookup(key, check)
+		if !ok {
+			s.RUnlock()
+			atomic.AddUint64(&s.misses, 1)
+			if s.access != nil && s.admission != nil {
+				s.access.record(s, key)
+			}
+			return nil, 0, 0, ErrMissing
+		}
+		if !s.isExpired(e.expire) {
+			if s.access == nil {
+				atomic.AddUint32(&e.hits, 1)
+			}
+			atomic.AddUint64(&s.hits, 1)
+			d, expire, version := s.valueOut(e.data), e.expire, e.version
+			s.RUnlock()
+			if s.access != nil {
+				s.access.record(s, key)
+			}
+			return hitResult(d, expire, version)
+		}
+		// rescue and removal of expired entries need the exclusive lock
+		s.RUnlock()
+	}
+	s.Lock()
+	if s.cleanOnGet {
+		s.cleanStep()
+	}
+	if s.admission != nil {
+		s.admission.record(key)
+	}
+	e, ok := s.lookup(key, check)
+	if ok {
+		if rescue != nil && s.isExpired(e.expire) {
+			if ext := rescue(); ext > 0 {
+				e.expire = expireAt(ext)
+				s.schedule(key, e.expire)
+			}
+		}
+		expire := e.expire
+		if s.isExpired(expire) {
+			// ExpireActive leaves them to the janitor
+			if s.expiration != ExpireActive {
+				s.removeExpired(key, e)
+			}
+			atomic.AddUint64(&s.misses, 1)
+			s.Unlock()
+			return nil, 0, 0, ErrExpired
+		}
+		if s.xfetch > 0 && expire != noExpire && xfetchEarly(ttlLeft(expire), s.xfetch, s.rnd) {
+			atomic.AddUint64(&s.misses, 1)
+			s.Unlock()
+			return nil, 0, 0, ErrMissing
+		}
+		s.touch(e)
+		atomic.AddUint64(&s.hits, 1)
+		d, version := s.valueOut(e.data), e.version
+		s.Unlock()
+		return hitResult(d, expire, version)
+	}
+	atomic.AddUint64(&s.misses, 1)
+	s.Unlock()
+	return nil, 0, 0, ErrMissing
+}
+
+// drain applies Gets recorded by the access buffer
+func (s *PolicyShard) drain(keys []uint64) {
+	s.Lock()
+	for _, k := range keys {
+		if s.admission != nil {
+			s.admission.record(k)
+		}
+		if e, ok := s.data[k]; ok {
+			s.touch(e)
+		}
+	}
+	s.Unlock()
+}
+
+func hitResult(d []byte, expire uint64, version uint64) ([]byte, uint64, uint64, error) {
+	ttl := ttlLeft(expire)
+	if version&negativeFlag != 0 {
+		return nil, ttl, version &^ negativeFlag, ErrNegativeCached
+	}
+	return d, ttl, version, nil
+}
+
+// GetStale returns entries expired less than window ms ago flagged stale, instead of removing them
+func (s *PolicyShard) GetStale(key uint64, window uint64) ([]byte, bool, error) {
+	return s.getStale(key, 0, window)
+}
+
+func (s *PolicyShard) getStale(key uint64, check uint64, window uint64) ([]byte, bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	e, ok := s.lookup(key, check)
+	if !ok {
+		atomic.AddUint64(&s.misses, 1)
+		return nil, false, ErrMissing
+	}
+	if !s.isExpired(e.expire) || e.expire+window > nowMs() {
+		s.touch(e)
+		atomic.AddUint64(&s.hits, 1)
+		if e.version&negativeFlag != 0 {
+			return nil, false, ErrNegativeCached
+		}
+		return s.valueOut(e.data), s.isExpired(e.expire), nil
+	}
+	if s.expiration != ExpireActive {
+		s.removeExpired(key, e)
+	}
+	atomic.AddUint64(&s.misses, 1)
+	return nil, false, ErrExpired
+}
+
+func (s *PolicyShard) GetWithTTL(key uint64) ([]byte, uint64, error) {
+	d, ttl, _, err := s.get(key, 0, nil)
+	return d, ttl, err
+}
+
+func (s *PolicyShard) GetWithVersion(key uint64) ([]byte, uint64, error) {
+	d, _, version, err := s.get(key, 0, nil)
+	return d, version, err
+}
+
+func (s *PolicyShard) Get(key uint64) ([]byte, error) {
+	d, _, err := s.GetWithTTL(key)
+	return d, err
+}
+
+func (s *PolicyShard) Set(key uint64, data []byte, ttl uint64) error {
+	s.SetVersioned(key, data, ttl)
+	return nil
+}
+
+// SetNegative stores an empty entry marked as known missing
+func (s *PolicyShard) SetNegative(key uint64, ttl uint64) {
+	s.setNegative(key, 0, ttl)
+}
+
+func (s *PolicyShard) setNegative(key uint64, check uint64, ttl uint64) {
+	s.Lock()
+	defer s.Unlock()
+	version := s.set(key, check, nil, ttl)
+	if version == 0 {
+		return
+	}
+	s.data[key].version = version | negativeFlag
+}
+
+// SetVersioned is Set returning version of the new entry
+func (s *PolicyShard) SetVersioned(key uint64, data []byte, ttl uint64) uint64 {
+	return s.setVersioned(key, 0, data, ttl)
+}
+
+func (s *PolicyShard) setVersioned(key uint64, check uint64, data []byte, ttl uint64) uint64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.set(key, check, data, ttl)
+}
+
+func (s *PolicyShard) SetCAS(key uint64, data []byte, ttl uint64, version uint64) (uint64, error) {
+	return s.setCAS(key, 0, data, ttl, version)
+}
+
+func (s *PolicyShard) setCAS(key uint64, check uint64, data []byte, ttl uint64, version uint64) (uint64, error) {
+	s.Lock()
+	defer s.Unlock()
+	current := uint64(0)
+	if e, ok := s.lookup(key, check); ok && !s.isExpired(e.expire) {
+		current = e.version &^ negativeFlag
+	}
+	if current != version {
+		return current, ErrVersionMismatch
+	}
+	return s.set(key, check, data, ttl), nil
+}
+
+func (s *PolicyShard) SetIfAbsent(key uint64, data []byte, ttl uint64) bool {
+	return s.setIf(key, 0, data, ttl, false)
+}
+
+func (s *PolicyShard) SetIfPresent(key uint64, data []byte, ttl uint64) bool {
+	return s.setIf(key, 0, data, ttl, true)
+}
+
+// setIf writes only if a live entry of the key exists as required by present
+func (s *PolicyShard) setIf(key uint64, check uint64, data []byte, ttl uint64, present bool) bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.exists(key, check) != present {
+		return false
+	}
+	s.set(key, check, data, ttl)
+	return true
+}
+
+// Run in lock only
+func (s *PolicyShard) exists(key uint64, check uint64) bool {
+	e, ok := s.lookup(key, check)
+	return ok && !s.isExpired(e.expire)
+}
+
+// Run in lock only. Entry of the key, an entry of another key with the same hash
+// (check mismatch, CollisionSafe only) is reported missing
+func (s *PolicyShard) lookup(key uint64, check uint64) (*policyEntry, bool) {
+	e, ok := s.data[key]
+	if !ok || e.check != check {
+		return nil, false
+	}
+	return e, true
+}
+
+// Run in lock only. Returns 0 if the new key was not admitted by TinyLFU
+func (s *PolicyShard) set(key uint64, check uint64, data []byte, ttl uint64) uint64 {
+	e, ok := s.data[key]
+	old := 0.0
+	if ok {
+		s.fold(e)
+		old = e.worth
+		s.size -= s.weight(key, e)
+		s.replaced++
+		s.removed(key, e.data, EvictReplaced)
+		s.pool.put(e.data)
+	} else {
+		if s.admission != nil && !s.admit(key) {
+			return 0
+		}
+		s.makeRoom()
+	}
+	if !ok {
+		e = &policyEntry{}
+		s.data[key] = e
+	}
+	// an entry of another key with the same hash is replaced, not overwritten
+	existed := ok && e.check == check
+	inherited := old
+	if !existed {
+		inherited = 0
+	}
+	e.worth = s.policy.OnInsert(inherited, existed)
+	e.check = check
+	s.totalWorth += e.worth - old
+	s.version++
+	e.version = s.version
+	e.data = s.valueIn(data)
+	e.expire = expireAt(jitterTTL(ttl, s.jitter, s.rnd))
+	s.size += s.weight(key, e)
+	s.schedule(key, e.expire)
+	if s.events != nil {
+		s.events.emit(CacheEvent{Type: EventSet, KeyHash: key, Size: len(e.data)})
+	}
+	return s.version
+}
+
+// Run in lock only. Evicts over the limits before an insert or after an entry grew
+func (s *PolicyShard) makeRoom() {
+	if s.watermarks && s.overHigh() {
+		s.lower()
+	}
+	if s.cleanSteps > 0 {
+		s.cleanStep()
+	} else {
+		s.clean()
+	}
+}
+
+func (s *PolicyShard) Del(key uint64) error {
+	s.DelExisted(key)
+	return nil
+}
+
+// DelExisted reports whether a live (not expired) entry was removed
+func (s *PolicyShard) DelExisted(key uint64) bool {
+	return s.delExisted(key, 0)
+}
+
+func (s *PolicyShard) delExisted(key uint64, check uint64) bool {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.lookup(key, check); !ok && s.data[key] != nil {
+		// entry of another key with the same hash
+		return false
+	}
+	return s.delLocked(key)
+}
+
+// Run in lock only
+func (s *PolicyShard) delLocked(key uint64) bool {
+	e, ok := s.data[key]
+	if !ok {
+		s.forget(key)
+		return false
+	}
+	s.remove(key, e)
+	return !s.isExpired(e.expire)
+}
+
+// DelVersion removes entry only if it still has given version
+func (s *PolicyShard) DelVersion(key uint64, version uint64) bool {
+	return s.delVersion(key, 0, version)
+}
+
+func (s *PolicyShard) delVersion(key uint64, check uint64, version uint64) bool {
+	s.Lock()
+	defer s.Unlock()
+	e, ok := s.lookup(key, check)
+	if !ok || e.version&^negativeFlag != version {
+		return false
+	}
+	s.remove(key, e)
+	return !s.isExpired(e.expire)
+}
+
+// Run in lock only. Reports an entry leaving the shard to OnRemove and the event stream
+func (s *PolicyShard) removed(key uint64, data []byte, reason EvictReason) {
+	if s.onRemove != nil {
+		s.onRemove(key, data, reason)
+	}
+	if s.events != nil && reason != EvictReplaced {
+		s.events.emit(CacheEvent{Type: removalEvents[reason], KeyHash: key, Size: len(data)})
+	}
+	if s.hooks != nil {
+		s.hooks.fire(key, reason)
+	}
+}
+
+// removalHook learns of an entry leaving the storage, under the shard lock,
+// so it must not call the storage
+type removalHook func(key uint64, reason EvictReason)
+
+// removalHooks let namespaces and the tag index forget keys as entries leave
+type removalHooks struct {
+	sync.RWMutex
+	fns map[*removalHook]struct{}
+}
+
+func newRemovalHooks() *removalHooks {
+	return &removalHooks{fns: make(map[*removalHook]struct{})}
+}
+
+// add registers fn until the returned func is called
+func (h *removalHooks) add(fn removalHook) func() {
+	p := &fn
+	h.Lock()
+	h.fns[p] = struct{}{}
+	h.Unlock()
+	return func() {
+		h.Lock()
+		delete(h.fns, p)
+		h.Unlock()
+	}
+}
+
+func (h *removalHooks) fire(key uint64, reason EvictReason) {
+	h.RLock()
+	for fn := range h.fns {
+		(*fn)(key, reason)
+	}
+	h.RUnlock()
+}
+
+// Run in lock only. Drops a deleted entry, it's not counted as evicted or expired
+func (s *PolicyShard) remove(key uint64, e *policyEntry) {
+	delete(s.data, key)
+	s.forget(key)
+	s.totalWorth -= e.worth
+	s.size -= s.weight(key, e)
+	s.deleted++
+	s.removed(key, e.data, EvictDeleted)
+	s.pool.put(e.data)
+}
+
+func (s *PolicyShard) track(key uint64, name string) {
+	s.Lock()
+	if _, ok := s.data[key]; ok {
+		if s.prints != nil {
+			s.prints.track(key, s.prints.deepest(name))
+		} else {
+			s.keys[key] = name
+		}
+	}
+	s.Unlock()
+}
+
+// Run in lock only
+func (s *PolicyShard) forget(key uint64) {
+	if s.trackKeys {
+		delete(s.keys, key)
+	}
+	if s.prints != nil {
+		s.prints.forget(key)
+	}
+}
+
+// moveTo hands all entries over to shards of the new layout and counters to heir, which
+// is one of them, and leaves the shard empty. The shards are locked all at once, no other
+// code holds two shard locks
+func (s *PolicyShard) moveTo(shards []*PolicyShard, mask uint64, heir *PolicyShard) {
+	s.Lock()
+	defer s.Unlock()
+	for _, dst := range shards {
+		dst.Lock()
+	}
+	for k, e := range s.data {
+		s.fold(e)
+		dst := shards[shardOf(k, mask)]
+		dst.data[k] = e
+		dst.size += dst.weight(k, e)
+		dst.totalWorth += e.worth
+		// later writes of the key must get higher versions, CAS and tags rely on it
+		if v := e.version &^ negativeFlag; v > dst.version {
+			dst.version = v
+		}
+		dst.schedule(k, e.expire)
+		if name, ok := s.keys[k]; ok && dst.trackKeys {
+			dst.keys[k] = name
+		}
+		if s.prints != nil {
+			if deepest, ok := s.prints.deepestOf(k); ok {
+				dst.prints.track(k, deepest)
+			}
+		}
+	}
+	atomic.AddUint64(&heir.hits, atomic.SwapUint64(&s.hits, 0))
+	atomic.AddUint64(&heir.misses, atomic.SwapUint64(&s.misses, 0))
+	heir.evictions += s.evictions
+	heir.expirations += s.expirations
+	heir.cleans += s.cleans
+	heir.cleaned += s.cleaned
+	heir.deleted += s.deleted
+	heir.replaced += s.replaced
+	heir.cleanDepth += s.cleanDepth
+	heir.cleanTime += s.cleanTime
+	if s.maxDepth > heir.maxDepth {
+		heir.maxDepth = s.maxDepth
+	}
+	s.evictions, s.expirations, s.cleans, s.cleaned, s.cleanDepth, s.cleanTime = 0, 0, 0, 0, 0, 0
+	s.deleted, s.replaced = 0, 0
+	for _, dst := range shards {
+		dst.Unlock()
+	}
+	s.data = make(map[uint64]*policyEntry)
+	if s.trackKeys {
+		s.keys = make(map[uint64]string)
+	}
+	if s.prints != nil {
+		s.prints.reset()
+	}
+	if s.expiry != nil {
+		s.expiry.reset()
+	}
+	s.cursor = nil
+	s.totalWorth = 0
+	s.size = 0
+}
+
+// deletePrefix removes entries with keys starting with prefix by their fingerprints,
+// KeyFingerprints only. Returns number of live ones
+func (s *PolicyShard) deletePrefix(prefix string) int {
+	s.Lock()
+	defer s.Unlock()
+	n := 0
+	for _, h := range s.prints.match(prefix) {
+		if s.delLocked(h) {
+			n++
+		}
+	}
+	return n
+}
+
+// DeleteKeys removes entries whose original key matches, returns number of live ones
+func (s *PolicyShard) DeleteKeys(match func(key string) bool) int {
+	s.Lock()
+	defer s.Unlock()
+	n := 0
+	for h, name := range s.keys {
+		if !match(name) {
+			continue
+		}
+		if s.delLocked(h) {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *PolicyShard) Incr(key uint64, delta int64, ttl uint64) (int64, error) {
+	return s.incr(key, 0, delta, ttl)
+}
+
+func (s *PolicyShard) incr(key uint64, check uint64, delta int64, ttl uint64) (int64, error) {
+	s.Lock()
+	defer s.Unlock()
+	if e, ok := s.lookup(key, check); ok && !s.isExpired(e.expire) {
+		n, err := strconv.ParseInt(string(e.data), 10, 64)
+		if err != nil {
+			return 0, ErrNotInteger
+		}
+		n += delta
+		s.version++
+		s.size -= s.weight(key, e)
+		s.pool.put(e.data)
+		e.data = strconv.AppendInt(nil, n, 10)
+		e.version = s.version
+		s.size += s.weight(key, e)
+		return n, nil
+	}
+	s.set(key, check, strconv.AppendInt(nil, delta, 10), ttl)
+	return delta, nil
+}
+
+// Append grows payload in place when the stored slice has spare capacity,
+// maxEntrySize 0 means unlimited
+func (s *PolicyShard) Append(key uint64, data []byte, maxEntrySize int) error {
+	return s.appendData(key, 0, data, maxEntrySize)
+}
+
+func (s *PolicyShard) appendData(key uint64, check uint64, data []byte, maxEntrySize int) error {
+	s.Lock()
+	defer s.Unlock()
+	e, ok := s.lookup(key, check)
+	if !ok {
+		return ErrMissing
+	}
+	if s.isExpired(e.expire) {
+		return ErrExpired
+	}
+	if maxEntrySize > 0 && len(e.data)+len(data) > maxEntrySize {
+		return ErrTooLarge
+	}
+	s.size -= s.weight(key, e)
+	if s.pool == nil || len(e.data)+len(data) <= cap(e.data) {
+		e.data = append(e.data, data...)
+	} else {
+		// keep buffers of pool classes, append would grow to arbitrary capacity
+		out := s.pool.get(len(e.data) + len(data))
+		copy(out, e.data)
+		copy(out[len(e.data):], data)
+		s.pool.put(e.data)
+		e.data = out
+	}
+	s.version++
+	e.version = s.version
+	s.size += s.weight(key, e)
+	if s.maxSize > 0 && s.size > s.maxSize {
+		s.makeRoom()
+	}
+	return nil
+}
+
+func (s *PolicyShard) GetAndDelete(key uint64) ([]byte, error) {
+	return s.getAndDelete(key, 0)
+}
+
+func (s *PolicyShard) getAndDelete(key uint64, check uint64) ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+	e, ok := s.lookup(key, check)
+	if !ok {
+		return nil, ErrMissing
+	}
+	delete(s.data, key)
+	s.forget(key)
+	s.totalWorth -= e.worth
+	s.size -= s.weight(key, e)
+	defer s.pool.put(e.data)
+	if s.isExpired(e.expire) {
+		s.expirations++
+		if s.onExpire != nil {
+			s.onExpire(key, e.data)
+		}
+		s.removed(key, e.data, EvictExpired)
+		return nil, ErrExpired
+	}
+	s.deleted++
+	s.removed(key, e.data, EvictDeleted)
+	return s.valueOut(e.data), nil
+}
+
+func (s *PolicyShard) Persist(key uint64) error {
+	return s.persist(key, 0)
+}
+
+func (s *PolicyShard) persist(key uint64, check uint64) error {
+	s.Lock()
+	defer s.Unlock()
+	e, ok := s.lookup(key, check)
+	if !ok {
+		return ErrMissing
+	}
+	if s.isExpired(e.expire) {
+		return ErrExpired
+	}
+	e.expire = noExpire
+	return nil
+}
+
+// Clear swaps the map under the lock, old one is left to GC
+func (s *PolicyShard) Clear() {
+	s.Lock()
+	defer s.Unlock()
+	if s.hooks != nil {
+		for key := range s.data {
+			s.hooks.fire(key, EvictDeleted)
+		}
+	}
+	s.data = make(map[uint64]*policyEntry)
+	if s.trackKeys {
+		s.keys = make(map[uint64]string)
+	}
+	if s.prints != nil {
+		s.prints.reset()
+	}
+	if s.expiry != nil {
+		s.expiry.reset()
+	}
+	s.cursor = nil
+	s.totalWorth = 0
+	s.size = 0
+}
+
+// ----------------------------------------------
+
+// Run in lock only. Applies hits taken under the read lock to worth, before
+// it is compared or replaced
+func (s *PolicyShard) fold(e *policyEntry) {
+	for n := atomic.SwapUint32(&e.hits, 0); n > 0; n-- {
+		s.touch(e)
+	}
+}
+
+// Run in lock only. Applies policy to a hit entry
+func (s *PolicyShard) touch(e *policyEntry) {
+	w := s.policy.OnHit(e.worth)
+	s.totalWorth += w - e.worth
+	e.worth = w
+	if s.agingHits > 0 {
+		s.sinceAging++
+		if s.sinceAging >= s.agingHits {
+			s.age()
+		}
+	}
+}
+
+// Run in lock only. Halves worth of every entry, so past popularity fades
+// and new hot entries are not starved by old ones
+func (s *PolicyShard) age() {
+	for _, e := range s.data {
+		s.fold(e)
+		s.totalWorth -= e.worth / 2
+		e.worth /= 2
+	}
+	s.sinceAging = 0
+}
+
+// Shrink removes due expired entries (not with ExpireLazy) and evicts down to the limits,
+// one clean round per lock, so readers are not blocked for long. Returns number of removed entries
+func (s *PolicyShard) Shrink() int {
+	removed := 0
+	if s.expiration != ExpireLazy {
+		removed += s.DeleteExpired()
+	}
+	for {
+		s.Lock()
+		n := len(s.data)
+		over := (s.maxSize > 0 && s.size > s.maxSize) || (s.maxLen > 0 && len(s.data) > s.maxLen)
+		if over {
+			s.clean()
+		}
+		left := len(s.data)
+		s.Unlock()
+		removed += n - left
+		if !over || left == n {
+			return removed
+		}
+	}
+}
+
+// Age halves worth of every entry of the shard
+func (s *PolicyShard) Age() {
+	s.Lock()
+	s.age()
+	s.Unlock()
+}
+
+// valueIn is payload stored by Set: a copy in a pool buffer, or data itself when Set
+// doesn't copy, the caller must not touch data afterwards
+func (s *PolicyShard) valueIn(d []byte) []byte {
+	if !s.copyOnSet {
+		return d
+	}
+	out := s.pool.get(len(d))
+	copy(out, d)
+	return out
+}
+
+// Run in lock only. Payload handed out of the lock, a copy when its buffer may be recycled
+func (s *PolicyShard) valueOut(d []byte) []byte {
+	if s.pool == nil {
+		return d
+	}
+	return append([]byte(nil), d...)
+}
+
+func (s *PolicyShard) isExpired(ts uint64) bool {
+	if ts == noExpire {
+		return false
+	}
+	return ts <= nowMs()
+}
+
+// isDue reports whether background expiration removes an entry, past its stale window
+func (s *PolicyShard) isDue(ts uint64) bool {
+	return s.isExpired(ts) && ts+s.staleWindow <= nowMs()
+}
+
+func (s *PolicyShard) Stats() ShardStats {
+	s.RLock()
+	defer s.RUnlock()
+	return ShardStats{
+		Size:        s.size,
+		Len:         len(s.data),
+		Hits:        atomic.LoadUint64(&s.hits),
+		Misses:      atomic.LoadUint64(&s.misses),
+		Evictions:   s.evictions,
+		Expirations: s.expirations,
+		Cleans:      s.cleans,
+		Cleaned:     s.cleaned,
+		Deleted:     s.deleted,
+		Replaced:    s.replaced,
+		CleanDepth:  s.cleanDepth,
+		MaxDepth:    s.maxDepth,
+		CleanTime:   time.Duration(s.cleanTime),
+	}
+}
+
+// MemoryStats walks entries of the shard under the read lock
+func (s *PolicyShard) MemoryStats() ShardMemoryStats {
+	s.RLock()
+	defer s.RUnlock()
+	m := ShardMemoryStats{Len: len(s.data)}
+	for _, e := range s.data {
+		m.Payload += len(e.data)
+		m.Slack += cap(e.data) - len(e.data)
+	}
+	m.Headers = len(s.data) * int(unsafe.Sizeof(policyEntry{}))
+	m.Map = mapBytes(len(s.data), 16)
+	if s.trackKeys {
+		m.Map += mapBytes(len(s.keys), 8+int(unsafe.Sizeof("")))
+		for _, name := range s.keys {
+			m.Payload += len(name)
+		}
+	}
+	if s.prints != nil {
+		maps, strs := s.prints.memory()
+		m.Map += maps
+		m.Payload += strs
+	}
+	return m
+}
+
+// largest adds entries of the shard to top, which stays sorted and at most n long
+func (s *PolicyShard) largest(n int, top []EntryInfo) []EntryInfo {
+	s.RLock()
+	defer s.RUnlock()
+	for k, e := range s.data {
+		if len(top) == n && len(e.data) <= top[n-1].Size || s.isExpired(e.expire) {
+			continue
+		}
+		top = pushLargest(top, EntryInfo{KeyHash: k, Key: s.keys[k], Size: len(e.data), TTL: ttlLeft(e.expire)}, n)
+	}
+	return top
+}
+
+// snapshot adds live entries of the shard to enc, negative ones are left out.
+// Takes the write lock to fold pending hits into the saved worth
+func (s *PolicyShard) snapshot(enc *snapshotEncoder) {
+	s.Lock()
+	defer s.Unlock()
+	for k, e := range s.data {
+		if e.version&negativeFlag != 0 {
+			continue
+		}
+		s.fold(e)
+		key, keyed := s.keys[k]
+		enc.entry(snapshotEntry{hash: k, check: e.check, key: key, keyed: keyed, expire: e.expire, worth: e.worth, data: e.data})
+	}
+}
+
+// restore sets a snapshot entry with its saved worth, unless it's NaN
+func (s *PolicyShard) restore(e *snapshotEntry) {
+	s.Lock()
+	defer s.Unlock()
+	if s.set(e.hash, e.check, e.data, e.ttl()) == 0 {
+		return
+	}
+	if s.trackKeys && e.keyed {
+		s.keys[e.hash] = e.key
+	}
+	if entry := s.data[e.hash]; !math.IsNaN(e.worth) {
+		s.totalWorth += e.worth - entry.worth
+		entry.worth = e.worth
+	}
+}
+
+func (s *PolicyShard) GetSize() int {
+	s.RLock()
+	size := s.size
+	s.RUnlock()
+	return size
+}
+
+func (s *PolicyShard) GetLen() int {
+	s.RLock()
+	size := len(s.data)
+	s.RUnlock()
+	return size
+}
+
+func (s *PolicyShard) GetTotalWorth() float64 {
+	s.RLock()
+	worth := s.totalWorth
+	s.RUnlock()
+	return worth
+}
+
+// ================================================================================================
+
+type PolicyStorage struct {
+	NumShards     int
+	MaxMemSize    int
+	MaxCritSize   int
+	MaxCleanDepth int
+	MaxEntries    int
+
+	// layout is read-held by operations on shards, Reshard holds it while moving a shard.
+	// Keys of old[moved:] shards are not moved yet and served from there
+	layout       sync.RWMutex
+	shards       []*PolicyShard
+	shardMask    uint64
+	old          []*PolicyShard
+	oldMask      uint64
+	moved        int
+	reshardMu    sync.Mutex
+	cfg          Config // makes shards for Reshard
+	policy       Policy
+	randSource   RandSourceFunc
+	hash         keyHasher
+	window       *rollingStats
+	overrides    *ttlOverrides
+	tags         *tagIndex
+	hooks        *removalHooks
+	trackKeys    bool
+	staleWindow  uint64
+	refresher    *refresher
+	defaultTTL   uint64
+	maxEntrySize int
+	copyOnGet    bool
+	agingPeriod  time.Duration
+	aging        *janitor
+	stopCh       chan struct{}
+	workers      *workerPool
+	access       *accessBuffer
+	events       *eventStream
+	janitorMu    sync.Mutex
+	janitor      *janitor
+	cleanNext    int // shard the next janitor pass starts at
+	closed       int32
+	autoSnap     *autoSnapshot
+	// second key hash seed, CollisionSafe only
+	collisionSafe bool
+	checkSeed     maphash.Seed
+}
+
+// NewPolicyStorage makes a storage with LRU/LFU shard engine and custom eviction policy
+func NewPolicyStorage(policy Policy, opts ...Option) (*PolicyStorage, error) {
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	return newPolicyStorage(cfg, policy), nil
+}
+
+func newPolicyStorage(cfg Config, policy Policy) *PolicyStorage {
+	s := &PolicyStorage{
+		NumShards:     cfg.NumShards,
+		MaxMemSize:    cfg.MaxMemSize,
+		MaxCritSize:   cfg.MaxCritSize,
+		MaxCleanDepth: cfg.MaxCleanDepth,
+		MaxEntries:    cfg.MaxEntries,
+		defaultTTL:    cfg.defaultTTL(),
+		maxEntrySize:  cfg.MaxEntrySize,
+		copyOnGet:     cfg.CopyOnGet && cfg.BufferPoolSize == 0, // pooled shards copy values out themselves
+		trackKeys:     cfg.TrackKeys,
+		collisionSafe: cfg.CollisionSafe,
+		cfg:           cfg,
+		policy:        policy,
+	}
+	if s.collisionSafe {
+		s.checkSeed = maphash.MakeSeed()
+	}
+	s.hash = newKeyHasher(cfg.KeyHash, cfg.Hasher)
+	s.window = &rollingStats{}
+	s.overrides = newTTLOverrides(s.KeyHash, s.trackKeys)
+	s.tags = newTagIndex()
+	s.hooks = newRemovalHooks()
+	s.hooks.add(s.tags.removed)
+	s.staleWindow = durationToTTL(cfg.StaleWindow)
+	s.workers = newWorkerPool(cfg.MaxWorkers)
+	s.refresher = newRefresher(cfg.Refresher, s.workers, cfg.MaxRefreshes, cfg.RefreshTimeout)
+	s.stopCh = make(chan struct{})
+	if cfg.EventBuffer > 0 {
+		s.events = newEventStream(cfg.EventBuffer, cfg.EventSample)
+	}
+	if cfg.AccessBufferSize > 0 {
+		batches := cfg.AccessBufferBatches
+		if batches == 0 {
+			batches = cfg.NumShards
+		}
+		s.access = newAccessBuffer(cfg.AccessBufferSize, batches, cfg.AccessDropPolicy, s.workers, s.stopCh)
+		s.access.profile = cfg.Profile
+	}
+	s.shards = s.newShards(cfg.NumShards)
+	s.shardMask = uint64(cfg.NumShards - 1)
+	s.Seed(cfg.Seed)
+	s.agingPeriod = cfg.AgingPeriod
+	s.aging = startJanitor(s.workers, s.agingPeriod, priorityNormal, func(context.Context) {
+		s.maintain("aging", s.Age)
+	})
+	period := cfg.JanitorPeriod
+	if period == 0 {
+		period = cfg.expirePeriod(0)
+	}
+	s.StartJanitor(period)
+	s.autoSnap = startAutoSnapshot(cfg, s, s.workers, func(err error) {
+		if cfg.Logger != nil {
+			cfg.Logger.Warn("probecache: auto snapshot failed", "path", cfg.SnapshotPath, "err", err)
+		}
+	})
+	return s
+}
+
+// newShards makes numShards shards splitting the storage limits
+func (s *PolicyStorage) newShards(numShards int) []*PolicyShard {
+	cfg := s.cfg
+	// round up, so small limits don't turn into 0 (unbounded) per shard with many shards
+	maxShardSize := (cfg.MaxMemSize + numShards - 1) / numShards
+	critShardSize := (cfg.MaxCritSize + numShards - 1) / numShards
+	maxShardLen := (cfg.MaxEntries + numShards - 1) / numShards
+	shards := make([]*PolicyShard, numShards)
+	for i := range shards {
+		shard := NewPolicyShard(s.policy, maxShardSize, critShardSize, cfg.MaxCleanDepth)
+		shard.window = s.window
+		shard.overrides = s.overrides
+		shard.maxLen = maxShardLen
+		shard.weigher = cfg.Weigher
+		if cfg.EntryOverhead > 0 {
+			shard.overhead = cfg.EntryOverhead
+		}
+		shard.onEvict = cfg.OnEvict
+		shard.onExpire = cfg.OnExpire
+		shard.onRemove = cfg.OnRemove
+		shard.hooks = s.hooks
+		shard.events = s.events
+		shard.profile = cfg.Profile
+		if cfg.Logger != nil {
+			shard.log = cfg.Logger.With("shard", i)
+		}
+		shard.copyOnSet = cfg.CopyOnSet
+		shard.pool = newBufferPool(cfg.BufferPoolSize / numShards)
+		shard.jitter = cfg.TTLJitter
+		if cfg.TinyLFUWidth > 0 {
+			shard.admission = newTinyLFU(cfg.TinyLFUWidth)
+		}
+		shard.xfetch = cfg.xfetchScale()
+		shard.samples = cfg.EvictionSamples
+		if cfg.HighWatermark > 0 {
+			shard.highSize = int(float64(maxShardSize) * cfg.HighWatermark)
+			shard.lowSize = int(float64(maxShardSize) * cfg.LowWatermark)
+			shard.highLen = int(float64(maxShardLen) * cfg.HighWatermark)
+			shard.lowLen = int(float64(maxShardLen) * cfg.LowWatermark)
+			shard.watermarks = true
+			if cfg.AsyncEviction {
+				shard.lowAsync = s.lowerAsync
+			}
+		}
+		shard.cleanSteps = cfg.CleanSteps
+		shard.cleanOnGet = cfg.CleanSteps > 0 && cfg.CleanOnGet
+		shard.agingHits = uint64(cfg.AgingHits)
+		if cfg.AccessBufferSize > 0 {
+			shard.access = s.access
+			shard.stripes = newStripePool(shard, cfg.AccessBufferSize)
+		}
+		// these update shard state on every Get, the access buffer takes over TinyLFU and AgingHits
+		shard.readMostly = !shard.cleanOnGet && shard.xfetch == 0 &&
+			(shard.access != nil || (shard.admission == nil && shard.agingHits == 0))
+		shard.expiration = cfg.ExpirationMode
+		shard.staleWindow = s.staleWindow
+		shard.expiry = cfg.newExpiryIndex(shard.staleWindow)
+		if cfg.TrackKeys {
+			shard.trackKeys = true
+			shard.keys = make(map[uint64]string)
+		}
+		if cfg.KeyFingerprints {
+			shard.prints = newKeyPrints(s.printDelims())
+		}
+		if s.randSource != nil {
+			shard.rnd = rand.New(s.randSource(i))
+		}
+		shards[i] = shard
+	}
+	return shards
+}
+
+// Reshard changes the number of shards of a live storage, rounded up to a power of two
+// like NumShards. Entries move to the new shards one old shard at a time, operations
+// wait only while a shard is moved and meanwhile find keys of the rest in the old ones.
+// Returns when all entries are moved, concurrent calls run one after another
+func (s *PolicyStorage) Reshard(numShards int) error {
+	if numShards < 1 {
+		return fmt.Errorf("%w: NumShards must be positive", ErrInvalidConfig)
+	}
+	numShards = 1 << uint(bits.Len(uint(numShards-1)))
+	s.reshardMu.Lock()
+	defer s.reshardMu.Unlock()
+	if s.isClosed() {
+		return ErrClosed
+	}
+	s.layout.Lock()
+	if numShards == len(s.shards) {
+		s.layout.Unlock()
+		return nil
+	}
+	s.old, s.oldMask, s.moved = s.shards, s.shardMask, 0
+	s.shards, s.shardMask = s.newShards(numShards), uint64(numShards-1)
+	if s.cfg.Logger != nil {
+		s.cfg.Logger.Info("probecache: resharding", "from", len(s.old), "to", numShards)
+	}
+	s.NumShards = numShards
+	s.cfg.NumShards = numShards
+	s.layout.Unlock()
+	for {
+		if s.isClosed() {
+			return ErrClosed
+		}
+		s.layout.Lock()
+		// counters go where keys of the shard go, or some of them when it splits
+		s.old[s.moved].moveTo(s.shards, s.shardMask, s.shards[uint64(s.moved)&s.shardMask])
+		s.moved++
+		done := s.moved == len(s.old)
+		if done {
+			s.old, s.oldMask, s.moved = nil, 0, 0
+		}
+		s.layout.Unlock()
+		if done {
+			if s.cfg.Logger != nil {
+				s.cfg.Logger.Info("probecache: resharded", "shards", numShards)
+			}
+			return nil
+		}
+	}
+}
+
+// lowerAsync submits a task evicting shard down to the low watermark, releasing
+// the shard lock every cleanCursorSize evictions. false if the storage is closed
+func (s *PolicyStorage) lowerAsync(shard *PolicyShard) bool {
+	return s.workers.submit(priorityHigh, func(ctx context.Context) {
+		if ctx.Err() != nil {
+			return
+		}
+		s.maintain("lowering", func() {
+			for {
+				shard.Lock()
+				n := shard.evictDown(cleanCursorSize)
+				over := shard.overLow()
+				shard.Unlock()
+				if !over || n == 0 {
+					break
+				}
+			}
+		})
+		atomic.StoreInt32(&shard.lowPending, 0)
+	})
+}
+
+// StartJanitor (re)starts background cleaner, which every period removes due expired
+// entries and evicts shards over their limits. Period 0 just stops it
+func (s *PolicyStorage) StartJanitor(period time.Duration) {
+	s.janitorMu.Lock()
+	defer s.janitorMu.Unlock()
+	s.stopJanitor()
+	if period <= 0 || s.isClosed() {
+		return
+	}
+	s.janitor = startJanitor(s.workers, period, priorityNormal, func(ctx context.Context) {
+		ctx, cancel := withTimeout(ctx, s.cfg.CleanTimeout)
+		defer cancel()
+		s.maintain("janitor", func() { s.shrink(ctx) })
+	})
+	if s.cfg.Logger != nil {
+		s.cfg.Logger.Debug("probecache: janitor started", "period", period)
+	}
+}
+
+func (s *PolicyStorage) StopJanitor() {
+	s.janitorMu.Lock()
+	s.stopJanitor()
+	s.janitorMu.Unlock()
+}
+
+// Run in janitorMu lock only
+func (s *PolicyStorage) stopJanitor() {
+	if s.janitor != nil && s.cfg.Logger != nil {
+		s.cfg.Logger.Debug("probecache: janitor stopped")
+	}
+	s.janitor.stop()
+	s.janitor = nil
+}
+
+// Shrink does a janitor pass right away, returns number of removed entries
+func (s *PolicyStorage) Shrink() int {
+	n := 0
+	s.layout.RLock()
+	defer s.layout.RUnlock()
+	for _, shard := range s.live() {
+		n += shard.Shrink()
+	}
+	return n
+}
+
+// shrink is the janitor pass, it stops between shards once ctx is done
+// and the next pass goes on from there
+func (s *PolicyStorage) shrink(ctx context.Context) {
+	s.layout.RLock()
+	defer s.layout.RUnlock()
+	shards := s.live()
+	for range shards {
+		if ctx.Err() != nil {
+			return
+		}
+		s.cleanNext %= len(shards)
+		shards[s.cleanNext].Shrink()
+		s.cleanNext++
+	}
+}
+
+// maintain runs background work fn, labeled probecache=work for pprof in Profile mode.
+// Cleans inline in Set are not labeled, that would reset the caller's labels
+func (s *PolicyStorage) maintain(work string, fn func()) {
+	if !s.cfg.Profile {
+		fn()
+		return
+	}
+	pprof.Do(context.Background(), pprof.Labels("probecache", work), func(context.Context) {
+		fn()
+	})
+}
+
+// Age halves worth of all entries, AgingPeriod/AgingHits do it automatically
+func (s *PolicyStorage) Age() {
+	s.layout.RLock()
+	defer s.layout.RUnlock()
+	for _, shard := range s.live() {
+		shard.Age()
+	}
+}
+
+// SetOnEvict sets callback called for every entry removed by eviction.
+// It runs under the shard lock and must not call back into the storage.
+// Expired entries removed by eviction are reported to both OnEvict and OnExpire.
+func (s *PolicyStorage) SetOnEvict(fn EvictFunc) {
+	s.layout.Lock()
+	defer s.layout.Unlock()
+	s.cfg.OnEvict = fn
+	for _, shard := range s.live() {
+		shard.Lock()
+		shard.onEvict = fn
+		shard.Unlock()
+	}
+}
+
+// Close stops aging and the janitor, cancels background tasks and refreshes and waits
+// for them, further operations return ErrClosed
+func (s *PolicyStorage) Close() {
+	if s.isClosed() {
+		return
+	}
+	s.autoSnap.stop()
+	if !atomic.CompareAndSwapInt32(&s.closed, 0, 1) {
+		return
+	}
+	close(s.stopCh)
+	s.refresher.close()
+	// cancels a janitor pass in progress
+	s.workers.close()
+	s.aging.stop()
+	s.StopJanitor()
+}
+
+func (s *PolicyStorage) snapshotHeader() snapshotHeader {
+	hdr := snapshotHeader{hash: snapshotHash(s.hash), policy: policyOf(s.policy), epoch: epochOf(s.policy)}
+	if hdr.policy != policyNone {
+		hdr.flags |= snapWorth
+	}
+	if s.hash.wide() {
+		hdr.flags |= snapChecked
+	} else if s.collisionSafe {
+		hdr.hash = hashSeeded
+	}
+	if s.trackKeys {
+		hdr.flags |= snapKeyed
+	}
+	return hdr
+}
+
+// Snapshot writes live entries with their worth to w, see Snapshotter.
+// Resharding waits for it to finish
+func (s *PolicyStorage) Snapshot(w io.Writer) error {
+	if s.isClosed() {
+		return ErrClosed
+	}
+	s.reshardMu.Lock()
+	defer s.reshardMu.Unlock()
+	s.layout.RLock()
+	shards := s.live()
+	s.layout.RUnlock()
+	return writeSnapshot(w, s.snapshotHeader(), len(shards), func(i int, enc *snapshotEncoder) {
+		shards[i].snapshot(enc)
+	})
+}
+
+// Restore sets entries of a snapshot, see Snapshotter. Entries keep their worth if the
+// snapshot is of the same policy, LRU ones stay older than entries set since
+func (s *PolicyStorage) Restore(r io.Reader) error {
+	if s.isClosed() {
+		return ErrClosed
+	}
+	err := readSnapshot(r, s.snapshotHeader(), s.hashKey, func(e *snapshotEntry) {
+		s.layout.RLock()
+		s.getShard(e.hash).restore(e)
+		s.layout.RUnlock()
+	})
+	if err != nil && s.cfg.Logger != nil {
+		s.cfg.Logger.Warn("probecache: snapshot restore failed", "err", err, "len", s.Len())
+	}
+	return err
+}
+
+func (s *PolicyStorage) isClosed() bool {
+	return atomic.LoadInt32(&s.closed) == 1
+}
+
+// SetRandSource replaces per-shard random sources used by probabilistic features
+func (s *PolicyStorage) SetRandSource(fn RandSourceFunc) {
+	s.layout.Lock()
+	defer s.layout.Unlock()
+	s.randSource = fn
+	for i, shard := range s.live() {
+		shard.Lock()
+		shard.rnd = rand.New(fn(i))
+		shard.Unlock()
+	}
+}
+
+// Seed makes probabilistic features reproducible
+func (s *PolicyStorage) Seed(seed int64) {
+	s.SetRandSource(defaultRandSource(seed))
+}
+
+// SetOnExpire sets callback called for every entry removed because its TTL passed,
+// either lazily on access or by eviction. Same locking rules as SetOnEvict.
+func (s *PolicyStorage) SetOnExpire(fn ExpireFunc) {
+	s.layout.Lock()
+	defer s.layout.Unlock()
+	s.cfg.OnExpire = fn
+	for _, shard := range s.live() {
+		shard.Lock()
+		shard.onExpire = fn
+		shard.Unlock()
+	}
+}
+
+// SetOnRemove sets callback called for every entry leaving the storage, with the reason.
+// Same locking rules as SetOnEvict.
+func (s *PolicyStorage) SetOnRemove(fn EvictFunc) {
+	s.layout.Lock()
+	defer s.layout.Unlock()
+	s.cfg.OnRemove = fn
+	for _, shard := range s.live() {
+		shard.Lock()
+		shard.onRemove = fn
+		shard.Unlock()
+	}
+}
+
+// Events returns the event stream enabled by WithEvents, nil otherwise.
+// The channel is never closed
+func (s *PolicyStorage) Events() <-chan CacheEvent {
+	if s.events == nil {
+		return nil
+	}
+	return s.events.ch
+}
+
+// DroppedEvents is number of events lost to a full event buffer
+func (s *PolicyStorage) DroppedEvents() uint64 {
+	return s.events.droppedCount()
+}
+
+// KeyHash is the hash events and callbacks identify key by
+func (s *PolicyStorage) KeyHash(key string) uint64 {
+	h, _ := s.hashKey(key)
+	return h
+}
+
+// OverrideTTL keeps expired entries with keys matching pattern (path.Match syntax)
+// alive for extend more on access, until the rule itself expires. Meant for pinning
+// stale data during origin incidents. Patterns with wildcards need TrackKeys.
+func (s *PolicyStorage) OverrideTTL(pattern string, extend time.Duration, until time.Time) error {
+	return s.overrides.add(pattern, extend, until)
+}
+
+func (s *PolicyStorage) OverrideStats() []OverrideStat {
+	return s.overrides.stats()
+}
+
+// hashKey returns key hash and the check entries keep: second half of a 128-bit
+// KeyHash, the second hash with CollisionSafe, 0 otherwise
+func (s *PolicyStorage) hashKey(key string) (uint64, uint64) {
+	if s.hash.wide() {
+		return s.hash.sum128(key)
+	}
+	if !s.collisionSafe {
+		return s.hash.sum(key), 0
+	}
+	return s.hash.sum(key), keyCheck(s.checkSeed, key)
+}
+
+func (s *PolicyStorage) hashKeyB(key []byte) (uint64, uint64) {
+	if s.hash.wide() {
+		return s.hash.sum128(string(key))
+	}
+	if !s.collisionSafe {
+		return s.hash.sumB(key), 0
+	}
+	return s.hash.sumB(key), keyCheckB(s.checkSeed, key)
+}
+
+// Run in layout read lock only
+func (s *PolicyStorage) getShard(key uint64) *PolicyShard {
+	if s.old != nil {
+		if i := shardOf(key, s.oldMask); int(i) >= s.moved {
+			return s.old[i]
+		}
+	}
+	return s.shards[shardOf(key, s.shardMask)]
+}
+
+// ShardIndex is the shard key belongs to, its index in Stats().Shards. During Reshard
+// it's the shard of the new layout
+func (s *PolicyStorage) ShardIndex(key string) int {
+	h, _ := s.hashKey(key)
+	s.layout.RLock()
+	defer s.layout.RUnlock()
+	return int(shardOf(h, s.shardMask))
+}
+
+// Run in layout read lock only. Shards holding entries, the old ones too during Reshard
+func (s *PolicyStorage) live() []*PolicyShard {
+	if s.old == nil {
+		return s.shards
+	}
+	return append(s.shards[:len(s.shards):len(s.shards)], s.old[s.moved:]...)
+}
+
+func (s *PolicyStorage) Get(key string) ([]byte, error) {
+	if s.isClosed() {
+		return nil, ErrClosed
+	}
+	h, check := s.hashKey(key)
+	s.layout.RLock()
+	defer s.layout.RUnlock()
+	shard := s.getShard(h)
+	data, _, _, err := shard.get(h, check, s.overrides.rescuer(key))
+	s.window.record(err)
+	if err != nil {
+		return nil, err
+	}
+	return valueOut(data, s.copyOnGet), nil
+}
+
+func (s *PolicyStorage) GetWithTTL(key string) ([]byte, uint64, error) {
+	data, ttl, err := s.getTTL(key)
+	return data, ttlToSeconds(ttl), err
+}
+
+// getTTL is GetWithTTL with ttl in milliseconds
+func (s *PolicyStorage) getTTL(key string) ([]byte, uint64, error) {
+	if s.isClosed() {
+		return nil, 0, ErrClosed
+	}
+	h, check := s.hashKey(key)
+	s.layout.RLock()
+	defer s.layout.RUnlock()
+	shard := s.getShard(h)
+	data, ttl, _, err := shard.get(h, check, s.overrides.rescuer(key))
+	s.window.record(err)
+	if err != nil {
+		return nil, 0, err
+	}
+	return valueOut(data, s.copyOnGet), ttl, nil
+}
+
+// GetInto copies value into dst, so hot read loops don't allocate. On ErrShortBuffer
+// n is the length required
+func (s *PolicyStorage) GetInto(key string, dst []byte) (n int, ttl uint64, err error) {
+	if s.isClosed() {
+		return 0, 0, ErrClosed
+	}
+	h, check := s.hashKey(key)
+	s.layout.RLock()
+	defer s.layout.RUnlock()
+	shard := s.getShard(h)
+	data, ttl, _, err := shard.get(h, check, s.overrides.rescuer(key))
+	s.window.record(err)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(dst) < len(data) {
+		return len(data), ttlToSeconds(ttl), ErrShortBuffer
+	}
+	return copy(dst, data), ttlToSeconds(ttl), nil
+}
+
+// GetStale is Get that serves entries expired less than StaleWindow ago, flagged stale.
+// A stale hit starts background Refresher call for the key, if one is set
+func (s *PolicyStorage) GetStale(key string) ([]byte, bool, error) {
+	if s.isClosed() {
+		return nil, false, ErrClosed
+	}
+	h, check := s.hashKey(key)
+	s.layout.RLock()
+	defer s.layout.RUnlock()
+	shard := s.getShard(h)
+	data, stale, err := shard.getStale(h, check, s.staleWindow)
+	s.window.record(err)
+	if err != nil {
+		return nil, false, err
+	}
+	if stale {
+		s.refresher.run(key, s.Set)
+	}
+	return valueOut(data, s.copyOnGet), stale, nil
+}
+
+func (s *PolicyStorage) GetWithDuration(key string) ([]byte, time.Duration, error) {
+	data, ttl, err := s.getTTL(key)
+	return data, time.Duration(ttl) * time.Millisecond, err
+}
+
+func (s *PolicyStorage) SetWithDuration(key string, data []byte, ttl time.Duration) error {
+	return s.setTTL(key, data, durationToTTL(ttl))
+}
+
+func (s *PolicyStorage) GetWithVersion(key string) ([]byte, uint64, error) {
+	if s.isClosed() {
+		return nil, 0, ErrClosed
+	}
+	h, check := s.hashKey(key)
+	s.layout.RLock()
+	defer s.layout.RUnlock()
+	shard := s.getShard(h)
+	data, _, version, err := shard.get(h, check, s.overrides.rescuer(key))
+	s.window.record(err)
+	return valueOut(data, s.copyOnGet), version, err
+}
+
+func (s *PolicyStorage) SetCAS(key string, data []byte, ttl uint64, version uint64) (uint64, error) {
+	if s.isClosed() {
+		return 0, ErrClosed
+	}
+	if s.maxEntrySize > 0 && len(data) > s.maxEntrySize {
+		return 0, ErrTooLarge
+	}
+	ttl = applyDefaultTTL(secondsToTTL(ttl), s.defaultTTL)
+	h, check := s.hashKey(key)
+	s.layout.RLock()
+	defer s.layout.RUnlock()
+	shard := s.getShard(h)
+	version, err := shard.setCAS(h, check, data, ttl, version)
+	if err == nil {
+		s.window.written(len(data))
+		s.track(shard, h, key)
+	}
+	return version, err
+}
+
+func (s *PolicyStorage) Set(key string, data []byte, ttl uint64) error {
+	return s.setTTL(key, data, secondsToTTL(ttl))
+}
+
+// setTTL is Set with ttl in milliseconds
+func (s *PolicyStorage) setTTL(key string, data []byte, ttl uint64) error {
+	if s.isClosed() {
+		return ErrClosed
+	}
+	if s.maxEntrySize > 0 && len(data) > s.maxEntrySize {
+		return ErrTooLarge
+	}
+	ttl = applyDefaultTTL(ttl, s.defaultTTL)
+	h, check := s.hashKey(key)
+	s.layout.RLock()
+	defer s.layout.RUnlock()
+	shard := s.getShard(h)
+	// 0 is a new key turned away by admission
+	if shard.setVersioned(h, check, data, ttl) == 0 {
+		return nil
+	}
+	s.window.written(len(data))
+	s.track(shard, h, key)
+	return nil
+}
+
+func (s *PolicyStorage) track(shard *PolicyShard, h uint64, key string) {
+	if s.trackKeys || s.cfg.KeyFingerprints {
+		shard.track(h, key)
+	}
+}
+
+func (s *PolicyStorage) printDelims() string {
+	if s.cfg.FingerprintDelims == "" {
+		return ":/"
+	}
+	return s.cfg.FingerprintDelims
+}
+
+// DeleteByPrefix removes entries with keys starting with prefix, needs TrackKeys, or
+// KeyFingerprints and a prefix ending with a delimiter. Returns number of live entries removed
+func (s *PolicyStorage) DeleteByPrefix(prefix string) (int, error) {
+	if !s.trackKeys && s.cfg.KeyFingerprints && !s.isClosed() {
+		if err := printedPrefixOf(s.printDelims(), prefix); err != nil {
+			return 0, err
+		}
+		n := 0
+		s.layout.RLock()
+		defer s.layout.RUnlock()
+		for _, shard := range s.live() {
+			n += shard.deletePrefix(prefix)
+		}
+		return n, nil
+	}
+	return s.deleteKeys(func(key string) bool {
+		return strings.HasPrefix(key, prefix)
+	})
+}
+
+// DeleteMatch removes entries with keys matching pattern (path.Match syntax), needs TrackKeys
+func (s *PolicyStorage) DeleteMatch(pattern string) (int, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return 0, err
+	}
+	return s.deleteKeys(func(key string) bool {
+		ok, _ := path.Match(pattern, key)
+		return ok
+	})
+}
+
+func (s *PolicyStorage) deleteKeys(match func(key string) bool) (int, error) {
+	if s.isClosed() {
+		return 0, ErrClosed
+	}
+	if !s.trackKeys {
+		return 0, ErrKeysNotTracked
+	}
+	n := 0
+	s.layout.RLock()
+	defer s.layout.RUnlock()
+	for _, shard := range s.live() {
+		n += shard.DeleteKeys(match)
+	}
+	return n, nil
+}
+
+// SetNegative caches key as missing upstream, Get returns ErrNegativeCached for it until ttl passes
+func (s *PolicyStorage) SetNegative(key string, ttl uint64) error {
+	if s.isClosed() {
+		return ErrClosed
+	}
+	ttl = applyDefaultTTL(secondsToTTL(ttl), s.defaultTTL)
+	h, check := s.hashKey(key)
+	s.layout.RLock()
+	defer s.layout.RUnlock()
+	shard := s.getShard(h)
+	shard.setNegative(h, check, ttl)
+	s.track(shard, h, key)
+	return nil
+}
+
+// SetTagged is Set remembering key under every tag for InvalidateTag
+func (s *PolicyStorage) SetTagged(key string, data []byte, ttl uint64, tags ...string) error {
+	if s.isClosed() {
+		return ErrClosed
+	}
+	if s.maxEntrySize > 0 && len(data) > s.maxEntrySize {
+		return ErrTooLarge
+	}
+	ttl = applyDefaultTTL(secondsToTTL(ttl), s.defaultTTL)
+	h, check := s.hashKey(key)
+	s.layout.RLock()
+	defer s.layout.RUnlock()
+	shard := s.getShard(h)
+	version := shard.setVersioned(h, check, data, ttl)
+	if version == 0 {
+		return nil
+	}
+	s.window.written(len(data))
+	// indexed under the shard lock, so the removal hook of the entry comes after
+	shard.RLock()
+	if e, ok := shard.lookup(h, check); ok && e.version&^negativeFlag == version {
+		s.tags.add(h, check, version, tags)
+	}
+	shard.RUnlock()
+	s.track(shard, h, key)
+	return nil
+}
+
+// InvalidateTag removes entries set with the tag and not overwritten since,
+// returns number of live entries removed
+func (s *PolicyStorage) InvalidateTag(tag string) int {
+	if s.isClosed() {
+		return 0
+	}
+	n := 0
+	s.layout.RLock()
+	defer s.layout.RUnlock()
+	for h, ref := range s.tags.take(tag) {
+		if s.getShard(h).delVersion(h, ref.check, ref.version) {
+			n++
+		}
+	}
+	return n
+}
+
+// SetIfAbsent (memcached add) writes only if key is missing or expired
+func (s *PolicyStorage) SetIfAbsent(key string, data []byte, ttl uint64) (bool, error) {
+	if s.isClosed() {
+		return false, ErrClosed
+	}
+	if s.maxEntrySize > 0 && len(data) > s.maxEntrySize {
+		return false, ErrTooLarge
+	}
+	ttl = applyDefaultTTL(secondsToTTL(ttl), s.defaultTTL)
+	h, check := s.hashKey(key)
+	s.layout.RLock()
+	defer s.layout.RUnlock()
+	shard := s.getShard(h)
+	ok := shard.setIf(h, check, data, ttl, false)
+	if ok {
+		s.window.written(len(data))
+		s.track(shard, h, key)
+	}
+	return ok, nil
+}
+
+// SetIfPresent (memcached replace) writes only over a live entry
+func (s *PolicyStorage) SetIfPresent(key string, data []byte, ttl uint64) (bool, error) {
+	if s.isClosed() {
+		return false, ErrClosed
+	}
+	if s.maxEntrySize > 0 && len(data) > s.maxEntrySize {
+		return false, ErrTooLarge
+	}
+	ttl = applyDefaultTTL(secondsToTTL(ttl), s.defaultTTL)
+	h, check := s.hashKey(key)
+	s.layout.RLock()
+	defer s.layout.RUnlock()
+	shard := s.getShard(h)
+	ok := shard.setIf(h, check, data, ttl, true)
+	if ok {
+		s.window.written(len(data))
+		s.track(shard, h, key)
+	}
+	return ok, nil
+}
+
+// claim calls fn with the hash of key if it's stored, under the shard lock,
+// so a removal hook for the entry runs after fn
+func (s *PolicyStorage) claim(key string, fn func(h uint64)) {
+	h, check := s.hashKey(key)
+	s.layout.RLock()
+	defer s.layout.RUnlock()
+	shard := s.getShard(h)
+	shard.RLock()
+	defer shard.RUnlock()
+	if _, ok := shard.lookup(h, check); ok {
+		fn(h)
+	}
+}
+
+// watch adds a removal hook, the returned func removes it
+func (s *PolicyStorage) watch(fn removalHook) func() {
+	return s.hooks.add(fn)
+}
+
+func (s *PolicyStorage) Del(key string) error {
+	if s.isClosed() {
+		return ErrClosed
+	}
+	h, check := s.hashKey(key)
+	s.layout.RLock()
+	defer s.layout.RUnlock()
+	shard := s.getShard(h)
+	if shard.delExisted(h, check) {
+		s.window.deleted()
+	}
+	return nil
+}
+
+// GetB is Get for []byte keys, e.g. taken from network buffers
+func (s *PolicyStorage) GetB(key []byte) ([]byte, error) {
+	if s.isClosed() {
+		return nil, ErrClosed
+	}
+	h, check := s.hashKeyB(key)
+	s.layout.RLock()
+	defer s.layout.RUnlock()
+	shard := s.getShard(h)
+	data, _, _, err := shard.get(h, check, s.overrides.rescuerB(key))
+	s.window.record(err)
+	if err != nil {
+		return nil, err
+	}
+	return valueOut(data, s.copyOnGet), nil
+}
+
+func (s *PolicyStorage) SetB(key []byte, data []byte, ttl uint64) error {
+	if s.isClosed() {
+		return ErrClosed
+	}
+	if s.maxEntrySize > 0 && len(data) > s.maxEntrySize {
+		return ErrTooLarge
+	}
+	ttl = applyDefaultTTL(secondsToTTL(ttl), s.defaultTTL)
+	h, check := s.hashKeyB(key)
+	s.layout.RLock()
+	defer s.layout.RUnlock()
+	shard := s.getShard(h)
+	if shard.setVersioned(h, check, data, ttl) == 0 {
+		return nil
+	}
+	s.window.written(len(data))
+	if s.trackKeys || s.cfg.KeyFingerprints {
+		shard.track(h, string(key))
+	}
+	return nil
+}
+
+func (s *PolicyStorage) DelB(key []byte) error {
+	if s.isClosed() {
+		return ErrClosed
+	}
+	h, check := s.hashKeyB(key)
+	s.layout.RLock()
+	defer s.layout.RUnlock()
+	shard := s.getShard(h)
+	if shard.delExisted(h, check) {
+		s.window.deleted()
+	}
+	return nil
+}
+
+func (s *PolicyStorage) DelExisted(key string) bool {
+	if s.isClosed() {
+		return false
+	}
+	h, check := s.hashKey(key)
+	s.layout.RLock()
+	defer s.layout.RUnlock()
+	shard := s.getShard(h)
+	if !shard.delExisted(h, check) {
+		return false
+	}
+	s.window.deleted()
+	return true
+}
+
+// Incr adds delta to the decimal integer stored at key and returns the new value.
+// Missing key is created with value delta and given ttl, existing one keeps its expiry.
+func (s *PolicyStorage) Incr(key string, delta int64, ttl uint64) (int64, error) {
+	if s.isClosed() {
+		return 0, ErrClosed
+	}
+	ttl = applyDefaultTTL(secondsToTTL(ttl), s.defaultTTL)
+	h, check := s.hashKey(key)
+	s.layout.RLock()
+	defer s.layout.RUnlock()
+	shard := s.getShard(h)
+	n, err := shard.incr(h, check, delta, ttl)
+	if err == nil {
+		s.track(shard, h, key)
+	}
+	return n, err
+}
+
+func (s *PolicyStorage) Decr(key string, delta int64, ttl uint64) (int64, error) {
+	return s.Incr(key, -delta, ttl)
+}
+
+func (s *PolicyStorage) Append(key string, data []byte) error {
+	if s.isClosed() {
+		return ErrClosed
+	}
+	h, check := s.hashKey(key)
+	s.layout.RLock()
+	defer s.layout.RUnlock()
+	shard := s.getShard(h)
+	if err := shard.appendData(h, check, data, s.maxEntrySize); err != nil {
+		return err
+	}
+	s.window.written(len(data))
+	return nil
+}
+
+func (s *PolicyStorage) GetAndDelete(key string) ([]byte, error) {
+	if s.isClosed() {
+		return nil, ErrClosed
+	}
+	h, check := s.hashKey(key)
+	s.layout.RLock()
+	defer s.layout.RUnlock()
+	shard := s.getShard(h)
+	data, err := shard.getAndDelete(h, check)
+	if err == nil {
+		s.window.deleted()
+	}
+	return data, err
+}
+
+func (s *PolicyStorage) Persist(key string) error {
+	if s.isClosed() {
+		return ErrClosed
+	}
+	h, check := s.hashKey(key)
+	s.layout.RLock()
+	defer s.layout.RUnlock()
+	shard := s.getShard(h)
+	return shard.persist(h, check)
+}
+
+// WindowStats returns counters for the last window (up to 15 minutes, minute granularity)
+func (s *PolicyStorage) WindowStats(window time.Duration) WindowStats {
+	return s.window.get(window)
+}
+
+func (s *PolicyStorage) GetSize() int {
+	size := 0
+	s.layout.RLock()
+	defer s.layout.RUnlock()
+	for _, shard := range s.live() {
+		size += shard.GetSize()
+	}
+	return size
+}
+
+func (s *PolicyStorage) Len() int {
+	n := 0
+	s.layout.RLock()
+	defer s.layout.RUnlock()
+	for _, shard := range s.live() {
+		n += shard.GetLen()
+	}
+	return n
+}
+
+func (s *PolicyStorage) Clear() {
+	s.layout.RLock()
+	defer s.layout.RUnlock()
+	for _, shard := range s.live() {
+		shard.Clear()
+	}
+	s.tags.reset()
+}
+
+// DeleteExpired removes all expired entries and returns their number.
+// Entries matching TTL overrides are kept, see OverrideTTL.
+func (s *PolicyStorage) DeleteExpired() int {
+	n := 0
+	s.layout.RLock()
+	defer s.layout.RUnlock()
+	for _, shard := range s.live() {
+		n += shard.DeleteExpired()
+	}
+	return n
+}
+
+// ClearAsync clears shards one by one in background and closes returned channel when done.
+// Readers may observe a partly cleared storage meanwhile. The channel of a closed storage
+// is closed right away
+func (s *PolicyStorage) ClearAsync() <-chan struct{} {
+	done := make(chan struct{})
+	if !s.workers.submit(priorityNormal, func(ctx context.Context) {
+		if ctx.Err() == nil {
+			s.Clear()
+		}
+		close(done)
+	}) {
+		close(done)
+	}
+	return done
+}
+
+func (s *PolicyStorage) Stats() Stats {
+	s.layout.RLock()
+	defer s.layout.RUnlock()
+	shards := s.live()
+	st := Stats{Shards: make([]ShardStats, len(shards))}
+	for i, shard := range shards {
+		st.Shards[i] = shard.Stats()
+		st.add(st.Shards[i])
+	}
+	return s.window.since(st)
+}
+
+// ResetStats starts counters of Stats over, Size and Len are not affected
+func (s *PolicyStorage) ResetStats() {
+	s.window.reset(s.Stats())
+}
+
+// MemoryStats is the memory breakdown per shard, for capacity planning without heap profiles.
+// Walks all entries, shard by shard
+func (s *PolicyStorage) MemoryStats() MemoryStats {
+	s.layout.RLock()
+	defer s.layout.RUnlock()
+	shards := s.live()
+	m := MemoryStats{Shards: make([]ShardMemoryStats, len(shards))}
+	for i, shard := range shards {
+		m.Shards[i] = shard.MemoryStats()
+		m.add(m.Shards[i])
+	}
+	return m
+}
+
+// Largest returns up to n biggest live entries by value size, largest first.
+// Key is known with TrackKeys only
+func (s *PolicyStorage) Largest(n int) []EntryInfo {
+	if n <= 0 {
+		return nil
+	}
+	s.layout.RLock()
+	defer s.layout.RUnlock()
+	var top []EntryInfo
+	for _, shard := range s.live() {
+		top = shard.largest(n, top)
+	}
+	return top
+}
+
+func (s *PolicyStorage) PrintInfo() {
+	s.WriteInfo(os.Stdout)
+}
+
+func (s *PolicyStorage) WriteInfo(w io.Writer) {
+	st := s.Stats()
+	fmt.Fprintf(w, "Cache size: %dkb / %dkb / %dkb\n", st.Size/1024, s.MaxMemSize/1024, s.MaxCritSize/1024)
+	fmt.Fprintf(w, "Hits: %d, misses: %d, evictions: %d, expirations: %d, cleans: %d, clean eff: %f\n", st.Hits, st.Misses, st.Evictions, st.Expirations, st.Cleans, st.CleanEfficiency())
+	m := s.MemoryStats()
+	largest := 0
+	for _, sh := range m.Shards {
+		if t := sh.Payload + sh.Slack + sh.Headers + sh.Map; t > largest {
+			largest = t
+		}
+	}
+	fmt.Fprintf(w, "Memory: payload %dkb, slack %dkb, headers %dkb, map ~%dkb, total ~%dkb, largest of %d shards ~%dkb\n", m.Payload/1024, m.Slack/1024, m.Headers/1024, m.Map/1024, m.Total()/1024, len(m.Shards), largest/1024)
+}
+
+// WriteShardInfo writes a line of stats per shard, to spot hot or skewed shards
+func (s *PolicyStorage) WriteShardInfo(w io.Writer) {
+	for i, sh := range s.Stats().Shards {
+		fmt.Fprintf(w, "Shard #%d size=%dkb, len=%d, hitrate=%f, cleans=%d, avg clean depth=%f, max depth=%d, clean eff=%f, clean time=%v\n", i, sh.Size/1024, sh.Len, sh.HitRate(), sh.Cleans, sh.AvgCleanDepth(), sh.MaxDepth, sh.CleanEfficiency(), sh.CleanTime)
+	}
+}
+
+func (s *PolicyStorage) String() string {
+	var b strings.Builder
+	s.WriteInfo(&b)
+	return b.String()
+}
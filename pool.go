@@ -0,0 +1,70 @@
+package probecache
+
+import "math/bits"
+
+// buffers above that are always allocated and left to GC
+const poolMaxBuffer = 1 << 20
+
+// bufferPool keeps buffers of removed entries for reuse by later Sets of a shard.
+// Capacities are rounded up to size classes, 4 per power of two (at most 25% spare),
+// so a freed buffer fits any request of its class. Kept bytes are bounded by limit.
+// Not safe for concurrent use, shards call it under their lock. nil pool allocates
+type bufferPool struct {
+	free  map[int][][]byte
+	bytes int
+	limit int
+}
+
+func newBufferPool(limit int) *bufferPool {
+	if limit <= 0 {
+		return nil
+	}
+	return &bufferPool{free: make(map[int][][]byte), limit: limit}
+}
+
+// poolClass rounds n up to its size class
+func poolClass(n int) int {
+	if n <= 64 {
+		return 64
+	}
+	step := 1 << uint(bits.Len(uint(n-1))-3)
+	return (n + step - 1) &^ (step - 1)
+}
+
+// get returns a buffer of length n, contents are not zeroed
+func (p *bufferPool) get(n int) []byte {
+	if p == nil || n > poolMaxBuffer {
+		return make([]byte, n)
+	}
+	class := poolClass(n)
+	if list := p.free[class]; len(list) > 0 {
+		b := list[len(list)-1]
+		list[len(list)-1] = nil
+		p.free[class] = list[:len(list)-1]
+		p.bytes -= class
+		return b[:n]
+	}
+	return make([]byte, n, class)
+}
+
+// put takes a buffer no longer referenced by the shard. Buffers of other origin
+// (not of a class capacity) and ones over the limit are dropped
+func (p *bufferPool) put(b []byte) {
+	if p == nil {
+		return
+	}
+	class := cap(b)
+	if class > poolMaxBuffer || class != poolClass(class) || p.bytes+class > p.limit {
+		return
+	}
+	p.free[class] = append(p.free[class], b[:0])
+	p.bytes += class
+}
+
+func (p *bufferPool) reset() {
+	if p == nil {
+		return
+	}
+	p.free = make(map[int][][]byte)
+	p.bytes = 0
+}
@@ -0,0 +1,62 @@
+package probecache
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+)
+
+func TestPoolClass(t *testing.T) {
+	for n, class := range map[int]int{1: 64, 64: 64, 65: 80, 100: 112, 1000: 1024, 1025: 1280} {
+		if c := poolClass(n); c != class {
+			t.Fatalf("class of %d is %d, want %d", n, c, class)
+		}
+	}
+}
+
+func TestBufferPool(t *testing.T) {
+	p := newBufferPool(200)
+	b := p.get(100)
+	if len(b) != 100 || cap(b) != 112 {
+		t.Fatalf("len %d, cap %d", len(b), cap(b))
+	}
+	p.put(b)
+	// any size of the class reuses it
+	if r := p.get(110); &r[0] != &b[0] {
+		t.Fatal("freed buffer not reused")
+	}
+	p.put(make([]byte, 100))
+	p.put(make([]byte, 0, 1024))
+	if p.bytes != 0 {
+		t.Fatalf("%d bytes kept of foreign and over limit buffers", p.bytes)
+	}
+	var none *bufferPool
+	if b := none.get(10); len(b) != 10 {
+		t.Fatal("nil pool doesn't allocate")
+	}
+	none.put(b)
+
+	if _, err := NewLRUStorage(WithBufferPool(1<<20), WithCopyOnGet(false)); !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("pool without CopyOnGet accepted: %v", err)
+	}
+	s, _ := NewLRUStorage(WithShards(1), WithBufferPool(1<<20))
+	defer s.Close()
+	value := make([]byte, 1000)
+	for i := 0; i < 100; i++ {
+		s.Set("a", value, 0)
+	}
+	// an overwrite takes the buffer it frees
+	if allocs := testing.AllocsPerRun(100, func() { s.Set("a", value, 0) }); allocs != 0 {
+		t.Fatalf("%f allocations per overwrite", allocs)
+	}
+	// recycled buffers carry nothing of old values
+	for i := 0; i < 100; i++ {
+		s.Set(strconv.Itoa(i), []byte("old value"), 0)
+		s.Set(strconv.Itoa(i), []byte(strconv.Itoa(i)), 0)
+	}
+	for i := 0; i < 100; i++ {
+		if got, _ := s.Get(strconv.Itoa(i)); string(got) != strconv.Itoa(i) {
+			t.Fatalf("got %q for %d", got, i)
+		}
+	}
+}
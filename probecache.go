@@ -1,7 +1,11 @@
 package probecache
 
 import (
-	"fmt"
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"time"
 )
 
 type IStorage interface {
@@ -12,14 +16,197 @@ type IStorage interface {
 	Clear()
 
 	GetSize() int
+	Len() int
+	Stats() Stats
+	// ResetStats starts Stats counters over
+	ResetStats()
 	PrintInfo()
+	WriteInfo(w io.Writer)
+
+	// Close releases storage, further operations return ErrClosed
+	Close()
 }
 
+var (
+	_ IStorage = (*LRUStorage)(nil)
+	_ IStorage = (*LFUStorage)(nil)
+	_ IStorage = (*PolicyStorage)(nil)
+	_ IStorage = (*TTLStorage)(nil)
+	_ IStorage = (*Namespace)(nil)
+	_ IStorage = (*ARCStorage)(nil)
+	_ IStorage = (*TwoQStorage)(nil)
+	_ IStorage = (*WTinyLFUStorage)(nil)
+	_ IStorage = (*ClockStorage)(nil)
+	_ IStorage = (*FIFOStorage)(nil)
+	_ IStorage = (*RandomStorage)(nil)
+	_ IStorage = (*SLRUStorage)(nil)
+	_ IStorage = (*GDSFStorage)(nil)
+	_ IStorage = (*LIRSStorage)(nil)
+	_ IStorage = (*S3FIFOStorage)(nil)
+	_ IStorage = (*LRFUStorage)(nil)
+	_ IStorage = (*ExactLRUStorage)(nil)
+	_ IStorage = (*ExactLFUStorage)(nil)
+	_ IStorage = (*RingStorage)(nil)
+	_ IStorage = (*OffHeapStorage)(nil)
+)
+
+type EvictReason int
+
+const (
+	EvictCapacity EvictReason = iota
+	EvictExpired
+	// Del and the like, reported to OnRemove only
+	EvictDeleted
+	// overwritten by Set, reported to OnRemove only
+	EvictReplaced
+)
+
+func (r EvictReason) String() string {
+	switch r {
+	case EvictCapacity:
+		return "capacity"
+	case EvictExpired:
+		return "expired"
+	case EvictDeleted:
+		return "deleted"
+	case EvictReplaced:
+		return "replaced"
+	}
+	return "unknown"
+}
+
+type EvictFunc func(keyHash uint64, value []byte, reason EvictReason)
+
+type ExpireFunc func(keyHash uint64, value []byte)
+
+// Weigher returns cost of an entry, counted against MaxMemSize/MaxCritSize
+// instead of its byte length. Must be stable for the same value, costs below 1 count as 1
+type Weigher func(keyHash uint64, value []byte) int
+
 const (
 	offset64 = 14695981039346656037
 	prime64  = 1099511628211
+
+	// expire value of entries that were made persistent
+	noExpire = 0
+	// internal ttl value for entries that never expire
+	ttlForever = math.MaxUint64
+	// per entry header size of LRU/LFU, list based storages count it too
+	// so that MaxMemSize means the same for all of them
+	entryOverhead = 24
+	// top bit of the stored version marks SetNegative entries
+	negativeFlag = 1 << 63
 )
 
+// shardOf picks one of mask+1 (a power of two) shards by key hash. Low bits of FNV-1a
+// depend only on low bits of key bytes, so high bits are folded in first
+func shardOf(key uint64, mask uint64) uint64 {
+	return (key ^ key>>32) & mask
+}
+
 var (
-	ErrMissing = fmt.Errorf("Entry not found in cache")
+	ErrMissing = errors.New("Entry not found in cache")
+	// ErrExpired is returned for an entry found expired (and removed) on access.
+	// errors.Is(ErrExpired, ErrMissing) holds, so miss checks keep working.
+	ErrExpired         error = expiredError{}
+	ErrTooLarge              = errors.New("Entry is too large")
+	ErrClosed                = errors.New("Storage is closed")
+	ErrInvalidConfig         = errors.New("Invalid storage config")
+	ErrVersionMismatch       = errors.New("Entry version mismatch")
+	ErrNotInteger            = errors.New("Entry value is not an integer")
+	ErrShortBuffer           = errors.New("Destination buffer is too short")
+	// ErrNegativeCached is returned for keys stored with SetNegative
+	ErrNegativeCached = errors.New("Entry is cached as missing")
+	ErrKeysNotTracked = errors.New("Original keys are not tracked, see TrackKeys")
+	ErrSnapshot       = errors.New("Invalid snapshot")
+	// ErrTruncated is wrapped with ErrSnapshot for a snapshot cut short
+	ErrTruncated = errors.New("Snapshot is truncated")
 )
+
+type expiredError struct{}
+
+func (expiredError) Error() string {
+	return "Entry expired"
+}
+
+func (expiredError) Is(target error) bool {
+	return target == ErrMissing
+}
+
+// expireAt returns unix milliseconds of expiration for ttl in milliseconds
+func expireAt(ttl uint64) uint64 {
+	if ttl == ttlForever {
+		return noExpire
+	}
+	return nowMs() + ttl
+}
+
+func nowMs() uint64 {
+	return uint64(time.Now().UnixNano() / int64(time.Millisecond))
+}
+
+// valueOut prepares stored payload for callers: a copy, or without copying
+// a slice capped at its length, so caller's appends don't run into storage memory
+func valueOut(d []byte, copyOnGet bool) []byte {
+	if !copyOnGet {
+		return d[:len(d):len(d)]
+	}
+	out := make([]byte, len(d))
+	copy(out, d)
+	return out
+}
+
+// applyDefaultTTL substitutes ttl 0, storages without DefaultTTL pass ttlForever
+func applyDefaultTTL(ttl uint64, defaultTTL uint64) uint64 {
+	if ttl == 0 {
+		return defaultTTL
+	}
+	return ttl
+}
+
+// ttlLeft returns milliseconds left until expire, 0 for persistent entries
+func ttlLeft(expire uint64) uint64 {
+	if expire == noExpire {
+		return 0
+	}
+	return expire - nowMs()
+}
+
+// jitterTTL spreads ttl by ±fraction, so entries written together don't expire together
+func jitterTTL(ttl uint64, fraction float64, rnd *rand.Rand) uint64 {
+	if fraction <= 0 || ttl == 0 || ttl == ttlForever {
+		return ttl
+	}
+	delta := float64(ttl) * fraction * (2*rnd.Float64() - 1)
+	return uint64(float64(ttl) + delta)
+}
+
+// xfetchEarly reports an entry with ttl ms left as expired ahead of time (XFetch),
+// probability rises as ttl approaches zero. scale is beta * expected recompute time, ms
+func xfetchEarly(ttl uint64, scale float64, rnd *rand.Rand) bool {
+	return -scale*math.Log(1-rnd.Float64()) >= float64(ttl)
+}
+
+// Public API takes and returns ttl in seconds, shards work in milliseconds.
+
+// secondsToTTL converts public ttl to milliseconds, huge values mean forever
+func secondsToTTL(ttl uint64) uint64 {
+	if ttl > ttlForever/1000 {
+		return ttlForever
+	}
+	return ttl * 1000
+}
+
+// ttlToSeconds rounds up, so an entry about to expire isn't reported as persistent
+func ttlToSeconds(ttl uint64) uint64 {
+	return (ttl + 999) / 1000
+}
+
+// durationToTTL converts d to milliseconds rounding up, so short positive
+// durations don't turn into an instantly expiring ttl
+func durationToTTL(d time.Duration) uint64 {
+	if d <= 0 {
+		return 0
+	}
+	return uint64((d + time.Millisecond - 1) / time.Millisecond)
+}
@@ -0,0 +1,138 @@
+package prometheus
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	pcache "github.com/n1ord/probecache"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// upper bounds of operation latency buckets, seconds
+var buckets = []float64{1e-6, 2.5e-6, 5e-6, 1e-5, 2.5e-5, 5e-5, 1e-4, 2.5e-4, 5e-4, 1e-3, 1e-2}
+
+// Collector is a prometheus.Collector of storage counters, register it with
+// prometheus.MustRegister or any registry. Operation latency is measured for calls
+// made through Storage() and the ones timed with Observe
+type Collector struct {
+	storage pcache.IStorage
+
+	hits        *prometheus.Desc
+	misses      *prometheus.Desc
+	evictions   *prometheus.Desc
+	expirations *prometheus.Desc
+	bytes       *prometheus.Desc
+	entries     *prometheus.Desc
+
+	mu           sync.Mutex // shard gauges are refilled on each Collect
+	shardBytes   *prometheus.GaugeVec
+	shardEntries *prometheus.GaugeVec
+	latency      *prometheus.HistogramVec
+}
+
+var _ prometheus.Collector = (*Collector)(nil)
+
+// NewCollector makes collector of storage s, name becomes the "cache" label
+func NewCollector(name string, s pcache.IStorage) *Collector {
+	labels := prometheus.Labels{"cache": name}
+	desc := func(metric, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName("probecache", "", metric), help, nil, labels)
+	}
+	return &Collector{
+		storage:     s,
+		hits:        desc("hits_total", "Get hits"),
+		misses:      desc("misses_total", "Get misses"),
+		evictions:   desc("evictions_total", "Entries evicted for capacity"),
+		expirations: desc("expirations_total", "Entries removed after their TTL"),
+		bytes:       desc("bytes", "Size counted against the memory limits"),
+		entries:     desc("entries", "Stored entries"),
+		shardBytes: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "probecache", Name: "shard_bytes", ConstLabels: labels,
+			Help: "Size counted against the memory limits per shard",
+		}, []string{"shard"}),
+		shardEntries: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "probecache", Name: "shard_entries", ConstLabels: labels,
+			Help: "Stored entries per shard",
+		}, []string{"shard"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "probecache", Name: "operation_duration_seconds", ConstLabels: labels,
+			Help: "Latency of storage operations", Buckets: buckets,
+		}, []string{"op"}),
+	}
+}
+
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.hits
+	ch <- c.misses
+	ch <- c.evictions
+	ch <- c.expirations
+	ch <- c.bytes
+	ch <- c.entries
+	c.shardBytes.Describe(ch)
+	c.shardEntries.Describe(ch)
+	c.latency.Describe(ch)
+}
+
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	st := c.storage.Stats()
+	ch <- prometheus.MustNewConstMetric(c.hits, prometheus.CounterValue, float64(st.Hits))
+	ch <- prometheus.MustNewConstMetric(c.misses, prometheus.CounterValue, float64(st.Misses))
+	ch <- prometheus.MustNewConstMetric(c.evictions, prometheus.CounterValue, float64(st.Evictions))
+	ch <- prometheus.MustNewConstMetric(c.expirations, prometheus.CounterValue, float64(st.Expirations))
+	ch <- prometheus.MustNewConstMetric(c.bytes, prometheus.GaugeValue, float64(st.Size))
+	ch <- prometheus.MustNewConstMetric(c.entries, prometheus.GaugeValue, float64(st.Len))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, sh := range st.Shards {
+		shard := strconv.Itoa(i)
+		c.shardBytes.WithLabelValues(shard).Set(float64(sh.Size))
+		c.shardEntries.WithLabelValues(shard).Set(float64(sh.Len))
+	}
+	c.shardBytes.Collect(ch)
+	c.shardEntries.Collect(ch)
+	c.latency.Collect(ch)
+}
+
+// Observe records latency of op started at start, for calls Storage() doesn't cover:
+//
+//	defer c.Observe("get_or_load", time.Now())
+func (c *Collector) Observe(op string, start time.Time) {
+	c.latency.WithLabelValues(op).Observe(time.Since(start).Seconds())
+}
+
+// Storage returns s wrapped to time Get, GetWithTTL, Set, Del and Clear
+func (c *Collector) Storage() pcache.IStorage {
+	return instrumented{c.storage, c}
+}
+
+type instrumented struct {
+	pcache.IStorage
+	c *Collector
+}
+
+func (s instrumented) Get(key string) ([]byte, error) {
+	defer s.c.Observe("get", time.Now())
+	return s.IStorage.Get(key)
+}
+
+func (s instrumented) GetWithTTL(key string) ([]byte, uint64, error) {
+	defer s.c.Observe("get_with_ttl", time.Now())
+	return s.IStorage.GetWithTTL(key)
+}
+
+func (s instrumented) Set(key string, data []byte, ttl uint64) error {
+	defer s.c.Observe("set", time.Now())
+	return s.IStorage.Set(key, data, ttl)
+}
+
+func (s instrumented) Del(key string) error {
+	defer s.c.Observe("del", time.Now())
+	return s.IStorage.Del(key)
+}
+
+func (s instrumented) Clear() {
+	defer s.c.Observe("clear", time.Now())
+	s.IStorage.Clear()
+}
@@ -0,0 +1,62 @@
+package prometheus
+
+import (
+	"strings"
+	"testing"
+
+	pcache "github.com/n1ord/probecache"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCollector(t *testing.T) {
+	users, _ := pcache.NewLRUStorage(pcache.WithShards(4), pcache.WithMaxEntries(100))
+	defer users.Close()
+	sessions, _ := pcache.NewFIFOStorage(pcache.WithShards(2))
+	defer sessions.Close()
+	uc, sc := NewCollector("users", users), NewCollector("sessions", sessions)
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(uc, sc)
+
+	cache := uc.Storage()
+	cache.Set("a", []byte("1"), 0)
+	cache.Set("b", []byte("2"), 0)
+	cache.Get("a")
+	cache.Get("c")
+	cache.GetWithTTL("b")
+	cache.Del("b")
+	sessions.Set("s", []byte("1"), 0)
+
+	expected := `
+# HELP probecache_entries Stored entries
+# TYPE probecache_entries gauge
+probecache_entries{cache="sessions"} 1
+probecache_entries{cache="users"} 1
+# HELP probecache_hits_total Get hits
+# TYPE probecache_hits_total counter
+probecache_hits_total{cache="sessions"} 0
+probecache_hits_total{cache="users"} 2
+# HELP probecache_misses_total Get misses
+# TYPE probecache_misses_total counter
+probecache_misses_total{cache="sessions"} 0
+probecache_misses_total{cache="users"} 1
+`
+	err := testutil.GatherAndCompare(reg, strings.NewReader(expected),
+		"probecache_entries", "probecache_hits_total", "probecache_misses_total")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := testutil.CollectAndCount(uc, "probecache_shard_entries"); n != 4 {
+		t.Fatalf("%d users shard gauges", n)
+	}
+	if n := testutil.CollectAndCount(sc, "probecache_shard_bytes"); n != 2 {
+		t.Fatalf("%d sessions shard gauges", n)
+	}
+	// get, get_with_ttl, set and del of users
+	if n := testutil.CollectAndCount(uc, "probecache_operation_duration_seconds"); n != 4 {
+		t.Fatalf("%d latency histograms", n)
+	}
+	if problems, err := testutil.CollectAndLint(uc); err != nil || len(problems) > 0 {
+		t.Fatal(problems, err)
+	}
+}
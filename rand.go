@@ -0,0 +1,73 @@
+package probecache
+
+import (
+	"math/bits"
+	"math/rand"
+)
+
+// PCGSource is a PCG-DXSM 128-bit generator (same as math/rand/v2 PCG).
+// It is not safe for concurrent use, storages keep one per shard under the shard lock.
+type PCGSource struct {
+	hi uint64
+	lo uint64
+}
+
+func NewPCGSource(seed int64) *PCGSource {
+	p := &PCGSource{}
+	p.Seed(seed)
+	return p
+}
+
+func (p *PCGSource) Seed(seed int64) {
+	// spread the seed over both halves of the state
+	x := uint64(seed)
+	p.hi = splitmix64(&x)
+	p.lo = splitmix64(&x)
+}
+
+func (p *PCGSource) next() (uint64, uint64) {
+	const (
+		mulHi = 2549297995355413924
+		mulLo = 4865540595714422341
+		incHi = 6364136223846793005
+		incLo = 1442695040888963407
+	)
+	hi, lo := bits.Mul64(p.lo, mulLo)
+	hi += p.hi*mulLo + p.lo*mulHi
+	lo, c := bits.Add64(lo, incLo, 0)
+	hi, _ = bits.Add64(hi, incHi, c)
+	p.lo = lo
+	p.hi = hi
+	return hi, lo
+}
+
+func (p *PCGSource) Uint64() uint64 {
+	hi, lo := p.next()
+	const cheapMul = 0xda942042e4dd58b5
+	hi ^= hi >> 32
+	hi *= cheapMul
+	hi ^= hi >> 48
+	hi *= lo | 1
+	return hi
+}
+
+func (p *PCGSource) Int63() int64 {
+	return int64(p.Uint64() >> 1)
+}
+
+func splitmix64(x *uint64) uint64 {
+	*x += 0x9e3779b97f4a7c15
+	z := *x
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+// RandSourceFunc creates random source for the shard with given index
+type RandSourceFunc func(shard int) rand.Source
+
+func defaultRandSource(seed int64) RandSourceFunc {
+	return func(shard int) rand.Source {
+		return NewPCGSource(seed + int64(shard))
+	}
+}
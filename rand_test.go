@@ -0,0 +1,57 @@
+package probecache
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+func TestPCGSource(t *testing.T) {
+	a, b, c := NewPCGSource(1), NewPCGSource(1), NewPCGSource(2)
+	same := 0
+	for i := 0; i < 100; i++ {
+		x := a.Uint64()
+		if x != b.Uint64() {
+			t.Fatal("sources of one seed diverged")
+		}
+		if x == c.Uint64() {
+			same++
+		}
+	}
+	if same > 1 {
+		t.Fatalf("sources of different seeds matched %d times", same)
+	}
+}
+
+func TestSeededEviction(t *testing.T) {
+	survivors := func(seed func(s *RandomStorage)) string {
+		s, _ := NewRandomStorage(WithShards(2), WithMaxEntries(16))
+		defer s.Close()
+		seed(s)
+		for i := 0; i < 200; i++ {
+			s.Set(strconv.Itoa(i), []byte("v"), 0)
+		}
+		kept := ""
+		for i := 0; i < 200; i++ {
+			if _, err := s.Get(strconv.Itoa(i)); err == nil {
+				kept += strconv.Itoa(i) + " "
+			}
+		}
+		return kept
+	}
+	seeded := func(seed int64) func(s *RandomStorage) {
+		return func(s *RandomStorage) { s.Seed(seed) }
+	}
+	if survivors(seeded(1)) != survivors(seeded(1)) {
+		t.Fatal("same seed evicted different entries")
+	}
+	if survivors(seeded(1)) == survivors(seeded(2)) {
+		t.Fatal("different seeds evicted the same entries")
+	}
+	source := func(s *RandomStorage) {
+		s.SetRandSource(func(shard int) rand.Source { return rand.NewSource(int64(shard)) })
+	}
+	if survivors(source) != survivors(source) {
+		t.Fatal("same sources evicted different entries")
+	}
+}
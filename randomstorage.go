@@ -0,0 +1,212 @@
+package probecache
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Random eviction: entries are kept in a dense slice, over budget a uniformly
+// random one is swapped with the last and dropped. No per-access bookkeeping,
+// reads take a read lock. Mostly a baseline for hit-rate comparisons.
+
+type randomEntry struct {
+	key    uint64
+	data   []byte
+	expire uint64
+}
+
+type RandomShard struct {
+	sync.RWMutex
+	listBase
+	items   map[uint64]int
+	entries []randomEntry
+	used    int
+	rnd     *rand.Rand
+}
+
+func NewRandomShard(capacity int, byBytes bool) *RandomShard {
+	s := &RandomShard{
+		rnd: rand.New(NewPCGSource(time.Now().UnixNano())),
+	}
+	s.init(s, capacity, byBytes)
+	s.reset()
+	return s
+}
+
+func (s *RandomShard) reset() {
+	s.items = make(map[uint64]int)
+	s.entries = nil
+	s.used = 0
+	s.size = 0
+}
+
+// overLimit reports whether one more entry of given cost doesn't fit
+func (s *RandomShard) overLimit(cost int) bool {
+	if s.capacity > 0 && s.used+cost > s.capacity {
+		return true
+	}
+	return s.maxLen > 0 && len(s.entries)+1 > s.maxLen
+}
+
+// Run in lock only
+func (s *RandomShard) remove(i int) randomEntry {
+	e := s.entries[i]
+	last := len(s.entries) - 1
+	if i != last {
+		s.entries[i] = s.entries[last]
+		s.items[s.entries[i].key] = i
+	}
+	s.entries[last] = randomEntry{}
+	s.entries = s.entries[:last]
+	s.used -= s.cost(e.data)
+	s.size -= len(e.data) + entryOverhead
+	delete(s.items, e.key)
+	return e
+}
+
+// Run in lock only
+func (s *RandomShard) evictOne() {
+	e := s.remove(s.rnd.Intn(len(s.entries)))
+	s.evicted(e.key, e.data, e.expire)
+}
+
+func (s *RandomShard) Set(key uint64, data []byte, ttl uint64) {
+	if s.copyOnSet {
+		data = append([]byte(nil), data...)
+	}
+	s.Lock()
+	defer s.Unlock()
+	if i, ok := s.items[key]; ok {
+		s.removed(key, s.remove(i).data, EvictReplaced)
+	}
+	cost := s.cost(data)
+	for len(s.entries) > 0 && s.overLimit(cost) {
+		s.evictOne()
+	}
+	s.items[key] = len(s.entries)
+	s.entries = append(s.entries, randomEntry{key: key, data: data, expire: expireAt(ttl)})
+	s.used += cost
+	s.size += len(data) + entryOverhead
+	s.written(key, len(data))
+}
+
+func (s *RandomShard) put(key uint64, data []byte, ttl uint64) error {
+	if s.tooLarge(data) {
+		return ErrTooLarge
+	}
+	s.Set(key, data, ttl)
+	return nil
+}
+
+func (s *RandomShard) get(key uint64) ([]byte, uint64, error) {
+	s.RLock()
+	i, ok := s.items[key]
+	if !ok {
+		s.RUnlock()
+		s.miss()
+		return nil, 0, ErrMissing
+	}
+	data, expire := s.entries[i].data, s.entries[i].expire
+	s.RUnlock()
+	if !s.isExpired(expire) {
+		s.hit()
+		return data, ttlLeft(expire), nil
+	}
+
+	s.miss()
+	if s.keepExpired {
+		return nil, 0, ErrExpired
+	}
+	s.Lock()
+	defer s.Unlock()
+	// may have been replaced while unlocked
+	if i, ok := s.items[key]; ok && s.isExpired(s.entries[i].expire) {
+		s.expire(key)
+	}
+	return nil, 0, ErrExpired
+}
+
+func (s *RandomShard) Get(key uint64) ([]byte, error) {
+	d, _, err := s.get(key)
+	return d, err
+}
+
+func (s *RandomShard) GetWithTTL(key uint64) ([]byte, uint64, error) {
+	return s.get(key)
+}
+
+// Del removes entry, reports whether a live entry was removed
+func (s *RandomShard) Del(key uint64) bool {
+	s.Lock()
+	defer s.Unlock()
+	i, ok := s.items[key]
+	if !ok {
+		return false
+	}
+	e := s.remove(i)
+	s.removed(key, e.data, EvictDeleted)
+	return !s.isExpired(e.expire)
+}
+
+func (s *RandomShard) Clear() {
+	s.Lock()
+	defer s.Unlock()
+	s.reset()
+}
+
+func (s *RandomShard) each(fn func(key uint64, expire uint64, data []byte)) {
+	for i := range s.entries {
+		e := &s.entries[i]
+		fn(e.key, e.expire, e.data)
+	}
+}
+
+// Run in lock only
+func (s *RandomShard) expire(key uint64) {
+	e := s.remove(s.items[key])
+	s.expired(e.key, e.data)
+}
+
+func (s *RandomShard) count() int {
+	return len(s.entries)
+}
+
+// ----------------------------------------------
+
+// RandomStorage supports the IStorage subset of Config: NumShards, MaxMemSize,
+// MaxEntries, MaxEntrySize, DefaultTTL, CopyOnGet/CopyOnSet, Seed, OnEvict, OnExpire, OnRemove, EventBuffer,
+// ExpirationMode, CleanPeriod
+type RandomStorage struct {
+	listStorage[*RandomShard]
+}
+
+func NewRandomStorage(opts ...Option) (*RandomStorage, error) {
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	capacity, byBytes, _ := listLimits(cfg)
+	shards := make([]*RandomShard, cfg.NumShards)
+	for i := range shards {
+		shards[i] = NewRandomShard(capacity, byBytes)
+	}
+	s := &RandomStorage{}
+	s.init(cfg, newKeyHasher(cfg.KeyHash, cfg.Hasher), shards)
+	s.Seed(cfg.Seed)
+	return s, nil
+}
+
+// SetRandSource replaces per-shard random sources used to pick eviction victims
+func (s *RandomStorage) SetRandSource(fn RandSourceFunc) {
+	for i, shard := range s.shards {
+		shard.Lock()
+		shard.rnd = rand.New(fn(i))
+		shard.Unlock()
+	}
+}
+
+// Seed makes eviction reproducible
+func (s *RandomStorage) Seed(seed int64) {
+	s.SetRandSource(defaultRandSource(seed))
+}
@@ -0,0 +1,245 @@
+package probecache
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sync"
+)
+
+// Ring (bigcache style): entries are written into one pre-allocated byte ring per shard
+// and the index map holds only their offsets, so there are no per-entry allocations and
+// nothing for GC to scan. Overwritten and deleted entries stay in the ring until its
+// oldest end reaches them, eviction is FIFO over the ring. Values are always copied.
+
+// record header: expire, key, payload length
+const ringHeader = 8 + 8 + 4
+
+type RingShard struct {
+	sync.RWMutex
+	listBase
+	index map[uint64]uint32
+	buf   []byte
+	head  int // oldest record
+	tail  int // next write
+	used  int // bytes from head to tail, garbage and padding included
+}
+
+func NewRingShard(capacity int) *RingShard {
+	s := &RingShard{
+		buf: make([]byte, capacity),
+	}
+	s.init(s, capacity, true)
+	s.copyOut = true
+	s.reset()
+	return s
+}
+
+func (s *RingShard) reset() {
+	s.index = make(map[uint64]uint32)
+	s.head, s.tail, s.used = 0, 0, 0
+	s.size = 0
+}
+
+func (s *RingShard) header(off int) (key uint64, expire uint64, n int) {
+	b := s.buf[off:]
+	return binary.BigEndian.Uint64(b[8:16]), binary.BigEndian.Uint64(b[0:8]), int(binary.BigEndian.Uint32(b[16:20]))
+}
+
+func (s *RingShard) putHeader(off int, key uint64, expire uint64, n int) {
+	b := s.buf[off:]
+	binary.BigEndian.PutUint64(b[0:8], expire)
+	binary.BigEndian.PutUint64(b[8:16], key)
+	binary.BigEndian.PutUint32(b[16:20], uint32(n))
+}
+
+// Run in lock only. Removes live record from the index
+func (s *RingShard) remove(key uint64, off int) []byte {
+	_, _, n := s.header(off)
+	delete(s.index, key)
+	s.size -= ringHeader + n
+	return s.buf[off+ringHeader : off+ringHeader+n]
+}
+
+// Run in lock only. Drops the oldest record, or padding at the ring end
+func (s *RingShard) evictOne() {
+	n := len(s.buf) - s.head
+	if n >= ringHeader {
+		key, expire, size := s.header(s.head)
+		n = ringHeader + size
+		if off, ok := s.index[key]; ok && int(off) == s.head {
+			s.evicted(key, s.remove(key, s.head), expire)
+		}
+	}
+	s.used -= n
+	s.head += n
+	if s.head == len(s.buf) {
+		s.head = 0
+	}
+}
+
+// Run in lock only. Frees n contiguous bytes at the tail and returns their offset,
+// a record that doesn't fit before the ring end goes to its start
+func (s *RingShard) reserve(n int) int {
+	for {
+		if s.used == 0 {
+			s.head, s.tail = 0, 0
+		}
+		if s.used == 0 || s.tail > s.head {
+			if len(s.buf)-s.tail >= n {
+				break
+			}
+			// pad the rest, ends shorter than a header are skipped implicitly
+			if rest := len(s.buf) - s.tail; rest >= ringHeader {
+				s.putHeader(s.tail, 0, 0, rest-ringHeader)
+			}
+			s.used += len(s.buf) - s.tail
+			s.tail = 0
+			continue
+		}
+		if s.head-s.tail >= n {
+			break
+		}
+		s.evictOne()
+	}
+	off := s.tail
+	s.tail += n
+	s.used += n
+	if s.tail == len(s.buf) {
+		s.tail = 0
+	}
+	return off
+}
+
+func (s *RingShard) Set(key uint64, data []byte, ttl uint64) error {
+	n := ringHeader + len(data)
+	if n > len(s.buf) {
+		return ErrTooLarge
+	}
+	s.Lock()
+	defer s.Unlock()
+	if off, ok := s.index[key]; ok {
+		s.removed(key, s.remove(key, int(off)), EvictReplaced)
+	}
+	for s.maxLen > 0 && len(s.index) >= s.maxLen && s.used > 0 {
+		s.evictOne()
+	}
+	off := s.reserve(n)
+	s.putHeader(off, key, expireAt(ttl), len(data))
+	copy(s.buf[off+ringHeader:], data)
+	s.index[key] = uint32(off)
+	s.size += n
+	s.written(key, len(data))
+	return nil
+}
+
+func (s *RingShard) put(key uint64, data []byte, ttl uint64) error {
+	return s.Set(key, data, ttl)
+}
+
+func (s *RingShard) get(key uint64) ([]byte, uint64, error) {
+	s.RLock()
+	off, ok := s.index[key]
+	if !ok {
+		s.RUnlock()
+		s.miss()
+		return nil, 0, ErrMissing
+	}
+	_, expire, n := s.header(int(off))
+	if !s.isExpired(expire) {
+		start := int(off) + ringHeader
+		data := append([]byte(nil), s.buf[start:start+n]...)
+		s.RUnlock()
+		s.hit()
+		return data, ttlLeft(expire), nil
+	}
+	s.RUnlock()
+
+	s.miss()
+	if s.keepExpired {
+		return nil, 0, ErrExpired
+	}
+	s.Lock()
+	defer s.Unlock()
+	// may have been replaced while unlocked
+	if off, ok := s.index[key]; ok {
+		if _, expire, _ := s.header(int(off)); s.isExpired(expire) {
+			s.expire(key)
+		}
+	}
+	return nil, 0, ErrExpired
+}
+
+func (s *RingShard) Get(key uint64) ([]byte, error) {
+	d, _, err := s.get(key)
+	return d, err
+}
+
+func (s *RingShard) GetWithTTL(key uint64) ([]byte, uint64, error) {
+	return s.get(key)
+}
+
+// Del removes entry, reports whether a live entry was removed
+func (s *RingShard) Del(key uint64) bool {
+	s.Lock()
+	defer s.Unlock()
+	off, ok := s.index[key]
+	if !ok {
+		return false
+	}
+	_, expire, _ := s.header(int(off))
+	s.removed(key, s.remove(key, int(off)), EvictDeleted)
+	return !s.isExpired(expire)
+}
+
+// Clear keeps the ring, only the index is dropped
+func (s *RingShard) Clear() {
+	s.Lock()
+	defer s.Unlock()
+	s.reset()
+}
+
+func (s *RingShard) each(fn func(key uint64, expire uint64, data []byte)) {
+	for key, off := range s.index {
+		_, expire, n := s.header(int(off))
+		fn(key, expire, s.buf[int(off)+ringHeader:int(off)+ringHeader+n])
+	}
+}
+
+// Run in lock only
+func (s *RingShard) expire(key uint64) {
+	s.expired(key, s.remove(key, int(s.index[key])))
+}
+
+func (s *RingShard) count() int {
+	return len(s.index)
+}
+
+// ----------------------------------------------
+
+// RingStorage supports the IStorage subset of Config: NumShards, MaxMemSize (required,
+// allocated upfront), MaxEntries, MaxEntrySize, DefaultTTL, OnEvict, OnExpire, OnRemove, EventBuffer,
+// ExpirationMode, CleanPeriod. Values are always copied, CopyOnGet/CopyOnSet are ignored
+type RingStorage struct {
+	listStorage[*RingShard]
+}
+
+func NewRingStorage(opts ...Option) (*RingStorage, error) {
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	numShards := cfg.NumShards
+	capacity := cfg.MaxMemSize / numShards
+	if capacity < ringHeader || uint64(capacity) > math.MaxUint32 {
+		return nil, fmt.Errorf("%w: RingStorage needs MaxMemSize of %d to %d bytes per shard, got %d", ErrInvalidConfig, ringHeader, uint32(math.MaxUint32), capacity)
+	}
+	shards := make([]*RingShard, numShards)
+	for i := range shards {
+		shards[i] = NewRingShard(capacity)
+	}
+	cfg.CopyOnGet = false
+	s := &RingStorage{}
+	s.init(cfg, newKeyHasher(cfg.KeyHash, cfg.Hasher), shards)
+	return s, nil
+}
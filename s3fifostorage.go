@@ -0,0 +1,267 @@
+package probecache
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// S3-FIFO: new entries go to small FIFO S (10% of capacity), main FIFO M holds
+// the rest, ghost FIFO G remembers keys recently dropped from S. A hit only
+// bumps a 2-bit counter, so Get takes a read lock and doesn't reorder anything.
+// Leaving S, an entry hit more than once moves to M, others are dropped and
+// remembered in G; a Set of a key found in G goes straight to M. Leaving M,
+// an entry with hits is reinserted with counter decremented.
+
+const s3MaxFreq = 3
+
+type s3Entry struct {
+	key    uint64
+	data   []byte
+	expire uint64
+	cost   int
+	freq   uint32
+	list   *list.List
+}
+
+type S3FIFOShard struct {
+	sync.RWMutex
+	listBase
+	items               map[uint64]*list.Element
+	small, main, ghost  *list.List
+	ghosts              map[uint64]*list.Element
+	smallSize, mainSize int
+	smallCap            int
+}
+
+func NewS3FIFOShard(capacity int, byBytes bool) *S3FIFOShard {
+	s := &S3FIFOShard{
+		smallCap: capacity / 10,
+	}
+	s.init(s, capacity, byBytes)
+	s.reset()
+	return s
+}
+
+func (s *S3FIFOShard) reset() {
+	s.items = make(map[uint64]*list.Element)
+	s.ghosts = make(map[uint64]*list.Element)
+	s.small, s.main, s.ghost = list.New(), list.New(), list.New()
+	s.smallSize, s.mainSize = 0, 0
+	s.size = 0
+}
+
+// overLimit reports whether one more entry of given cost doesn't fit
+func (s *S3FIFOShard) overLimit(cost int) bool {
+	if s.capacity > 0 && s.smallSize+s.mainSize+cost > s.capacity {
+		return true
+	}
+	return s.maxLen > 0 && len(s.items)+1 > s.maxLen
+}
+
+// Run in lock only
+func (s *S3FIFOShard) push(l *list.List, e *s3Entry) {
+	e.list = l
+	if l == s.small {
+		s.smallSize += e.cost
+	} else {
+		s.mainSize += e.cost
+	}
+	s.size += len(e.data) + entryOverhead
+	s.items[e.key] = l.PushFront(e)
+}
+
+// Run in lock only
+func (s *S3FIFOShard) unlink(el *list.Element) *s3Entry {
+	e := el.Value.(*s3Entry)
+	e.list.Remove(el)
+	if e.list == s.small {
+		s.smallSize -= e.cost
+	} else {
+		s.mainSize -= e.cost
+	}
+	s.size -= len(e.data) + entryOverhead
+	delete(s.items, e.key)
+	return e
+}
+
+// Run in lock only
+func (s *S3FIFOShard) remember(key uint64) {
+	s.ghosts[key] = s.ghost.PushFront(key)
+	for s.ghost.Len() > maxInt(len(s.items), 1) {
+		delete(s.ghosts, s.ghost.Remove(s.ghost.Back()).(uint64))
+	}
+}
+
+// Run in lock only
+func (s *S3FIFOShard) forgetGhost(key uint64) bool {
+	el, ok := s.ghosts[key]
+	if ok {
+		s.ghost.Remove(el)
+		delete(s.ghosts, key)
+	}
+	return ok
+}
+
+// Run in lock only. Removes exactly one resident entry
+func (s *S3FIFOShard) evictOne() {
+	for {
+		if s.small.Len() > 0 && (s.smallSize >= s.smallCap || s.main.Len() == 0) {
+			e := s.unlink(s.small.Back())
+			if atomic.LoadUint32(&e.freq) > 1 && !s.isExpired(e.expire) {
+				atomic.StoreUint32(&e.freq, 0)
+				s.push(s.main, e)
+				continue
+			}
+			s.evicted(e.key, e.data, e.expire)
+			s.remember(e.key)
+			return
+		}
+		e := s.unlink(s.main.Back())
+		if f := atomic.LoadUint32(&e.freq); f > 0 && !s.isExpired(e.expire) {
+			atomic.StoreUint32(&e.freq, f-1)
+			s.push(s.main, e)
+			continue
+		}
+		s.evicted(e.key, e.data, e.expire)
+		return
+	}
+}
+
+func (s *S3FIFOShard) Set(key uint64, data []byte, ttl uint64) {
+	if s.copyOnSet {
+		data = append([]byte(nil), data...)
+	}
+	s.Lock()
+	defer s.Unlock()
+	e := &s3Entry{key: key, data: data, expire: expireAt(ttl), cost: s.cost(data)}
+	to := s.small
+	if el, ok := s.items[key]; ok {
+		// overwrite keeps the queue and counts as a hit
+		old := s.unlink(el)
+		s.removed(key, old.data, EvictReplaced)
+		to = old.list
+		e.freq = old.freq
+		if e.freq < s3MaxFreq {
+			e.freq++
+		}
+	} else if s.forgetGhost(key) {
+		to = s.main
+	}
+	for len(s.items) > 0 && s.overLimit(e.cost) {
+		s.evictOne()
+	}
+	s.push(to, e)
+	s.written(key, len(data))
+}
+
+func (s *S3FIFOShard) put(key uint64, data []byte, ttl uint64) error {
+	if s.tooLarge(data) {
+		return ErrTooLarge
+	}
+	s.Set(key, data, ttl)
+	return nil
+}
+
+func (s *S3FIFOShard) get(key uint64) ([]byte, uint64, error) {
+	s.RLock()
+	el, ok := s.items[key]
+	if !ok {
+		s.RUnlock()
+		s.miss()
+		return nil, 0, ErrMissing
+	}
+	e := el.Value.(*s3Entry)
+	if !s.isExpired(e.expire) {
+		if f := atomic.LoadUint32(&e.freq); f < s3MaxFreq {
+			atomic.CompareAndSwapUint32(&e.freq, f, f+1)
+		}
+		data, expire := e.data, e.expire
+		s.RUnlock()
+		s.hit()
+		return data, ttlLeft(expire), nil
+	}
+	s.RUnlock()
+
+	s.miss()
+	if s.keepExpired {
+		return nil, 0, ErrExpired
+	}
+	s.Lock()
+	defer s.Unlock()
+	// may have been replaced while unlocked
+	if el, ok := s.items[key]; ok && s.isExpired(el.Value.(*s3Entry).expire) {
+		s.expire(key)
+	}
+	return nil, 0, ErrExpired
+}
+
+func (s *S3FIFOShard) Get(key uint64) ([]byte, error) {
+	d, _, err := s.get(key)
+	return d, err
+}
+
+func (s *S3FIFOShard) GetWithTTL(key uint64) ([]byte, uint64, error) {
+	return s.get(key)
+}
+
+// Del removes entry and its ghost, reports whether a live entry was removed
+func (s *S3FIFOShard) Del(key uint64) bool {
+	s.Lock()
+	defer s.Unlock()
+	s.forgetGhost(key)
+	el, ok := s.items[key]
+	if !ok {
+		return false
+	}
+	e := s.unlink(el)
+	s.removed(key, e.data, EvictDeleted)
+	return !s.isExpired(e.expire)
+}
+
+func (s *S3FIFOShard) Clear() {
+	s.Lock()
+	defer s.Unlock()
+	s.reset()
+}
+
+func (s *S3FIFOShard) each(fn func(key uint64, expire uint64, data []byte)) {
+	for _, el := range s.items {
+		e := el.Value.(*s3Entry)
+		fn(e.key, e.expire, e.data)
+	}
+}
+
+// Run in lock only
+func (s *S3FIFOShard) expire(key uint64) {
+	e := s.unlink(s.items[key])
+	s.expired(e.key, e.data)
+}
+
+func (s *S3FIFOShard) count() int {
+	return len(s.items)
+}
+
+// ----------------------------------------------
+
+// S3FIFOStorage supports the IStorage subset of Config: NumShards, MaxMemSize,
+// MaxEntries, MaxEntrySize, DefaultTTL, CopyOnGet/CopyOnSet, OnEvict, OnExpire, OnRemove, EventBuffer,
+// ExpirationMode, CleanPeriod
+type S3FIFOStorage struct {
+	listStorage[*S3FIFOShard]
+}
+
+func NewS3FIFOStorage(opts ...Option) (*S3FIFOStorage, error) {
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	capacity, byBytes, _ := listLimits(cfg)
+	shards := make([]*S3FIFOShard, cfg.NumShards)
+	for i := range shards {
+		shards[i] = NewS3FIFOShard(capacity, byBytes)
+	}
+	s := &S3FIFOStorage{}
+	s.init(cfg, newKeyHasher(cfg.KeyHash, cfg.Hasher), shards)
+	return s, nil
+}
@@ -0,0 +1,195 @@
+package probecache
+
+import (
+	"expvar"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestNumShardsRoundedUp(t *testing.T) {
+	for n, want := range map[int]int{1: 1, 2: 2, 3: 4, 16: 16, 50: 64, 1000: 1024} {
+		cfg, err := newConfig([]Option{WithShards(n)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.NumShards != want {
+			t.Errorf("NumShards %d: got %d, want %d", n, cfg.NumShards, want)
+		}
+	}
+}
+
+func TestShardDistribution(t *testing.T) {
+	keysets := map[string]func(i int) string{
+		"numeric": func(i int) string { return fmt.Sprintf("key%d", i) },
+		"url":     func(i int) string { return fmt.Sprintf("https://example.com/items/%d?page=1", i) },
+		// keys that differ only in high bits of their bytes
+		"highbits": func(i int) string {
+			b := make([]byte, 7)
+			for j := range b {
+				b[j] = '!' + byte(i%8)<<4
+				i /= 8
+			}
+			return string(b)
+		},
+	}
+	const perShard = 1000
+	for _, kind := range []KeyHash{HashFNV, HashXXHash, HashMaphash, HashMurmur3} {
+		h := newKeyHasher(kind, nil)
+		for name, key := range keysets {
+			for shards := 2; shards <= 256; shards *= 4 {
+				counts := make([]int, shards)
+				for i := 0; i < perShard*shards; i++ {
+					counts[shardOf(h.sum(key(i)), uint64(shards-1))]++
+				}
+				for i, n := range counts {
+					// ~5 standard deviations of the binomial count
+					if n < perShard*85/100 || n > perShard*115/100 {
+						t.Errorf("%s %s %d shards: shard %d has %d keys, want about %d", kind, name, shards, i, n, perShard)
+						break
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestReshard(t *testing.T) {
+	s, err := NewLRUStorage(WithShards(4), WithTrackKeys())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	const n = 10000
+	for i := 0; i < n; i++ {
+		s.Set(fmt.Sprintf("key%d", i), []byte(fmt.Sprint(i)), 0)
+	}
+	_, version, _ := s.GetWithVersion("key0")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < n; i++ {
+			if v, err := s.Get(fmt.Sprintf("key%d", i)); err != nil || string(v) != fmt.Sprint(i) {
+				t.Errorf("key%d during Reshard: got %q %v", i, v, err)
+				return
+			}
+		}
+	}()
+	for _, shards := range []int{50, 2} {
+		if err := s.Reshard(shards); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+	if s.NumShards != 2 || s.Len() != n {
+		t.Fatalf("got %d shards, %d entries", s.NumShards, s.Len())
+	}
+	if next, _ := s.SetCAS("key0", []byte("x"), 0, version); next <= version {
+		t.Fatalf("version %d after moved entry of version %d", next, version)
+	}
+	if removed, _ := s.DeleteByPrefix("key1"); removed != 1111 {
+		t.Fatalf("DeleteByPrefix removed %d of moved keys, want 1111", removed)
+	}
+}
+
+func TestAutoShards(t *testing.T) {
+	for _, c := range []struct{ maxBytes, procs, want int }{
+		{1 << 30, 8, 32},
+		{1 << 30, 6, 16},
+		{1 << 20, 8, 4},
+		{1 << 10, 8, 1},
+		{0, 2, 8},
+	} {
+		if got := autoShards(c.maxBytes, c.procs); got != c.want {
+			t.Errorf("autoShards(%d, %d) = %d, want %d", c.maxBytes, c.procs, got, c.want)
+		}
+	}
+}
+
+func TestEntryOverhead(t *testing.T) {
+	overhead := CalibrateEntryOverhead(16)
+	// entry struct and map slot at least, well under a kilobyte
+	if overhead < 64 || overhead > 1024 {
+		t.Fatalf("calibrated overhead %d", overhead)
+	}
+	s, err := NewLRUStorage(WithShards(1), WithEntryOverhead(overhead))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.Set("key", make([]byte, 16), 0)
+	if got := s.GetSize(); got != 16+overhead {
+		t.Fatalf("GetSize %d, want %d", got, 16+overhead)
+	}
+
+	ttl, _ := NewTTLStorage(WithShards(1), WithEntryOverhead(overhead))
+	defer ttl.Close()
+	for i := 0; i < 100; i++ {
+		ttl.SetTagged(fmt.Sprintf("key%d", i), make([]byte, 16), 60, "t")
+	}
+	if got := ttl.GetSize(); got != 100*(16+overhead) {
+		t.Fatalf("TTL GetSize %d, want %d", got, 100*(16+overhead))
+	}
+	for i := 0; i < 50; i++ {
+		if i%2 == 0 {
+			ttl.Del(fmt.Sprintf("key%d", i))
+		} else {
+			ttl.GetAndDelete(fmt.Sprintf("key%d", i))
+		}
+	}
+	ttl.InvalidateTag("t")
+	if got := ttl.GetSize(); got != 0 {
+		t.Fatalf("TTL GetSize %d after deleting all entries", got)
+	}
+}
+
+func TestMemoryStats(t *testing.T) {
+	s, err := NewLRUStorage(WithShards(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for i := 0; i < 1000; i++ {
+		s.Set(fmt.Sprintf("key%d", i), make([]byte, 10), 0)
+	}
+	m := s.MemoryStats()
+	if m.Len != 1000 || m.Payload != 10000 || len(m.Shards) != 4 {
+		t.Fatalf("got %+v", m)
+	}
+	if m.Headers == 0 || m.Map < 1000*16 {
+		t.Fatalf("headers %d, map %d", m.Headers, m.Map)
+	}
+}
+
+func TestPublishExpvar(t *testing.T) {
+	s, err := NewLRUStorage(WithShards(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	PublishExpvar("probecache_test", s)
+	s.Set("a", []byte("1"), 0)
+	s.Get("a")
+	got := expvar.Get("probecache_test").String()
+	if !strings.Contains(got, `"Hits":1`) || !strings.Contains(got, `"HitRate":1`) {
+		t.Fatalf("got %s", got)
+	}
+}
+
+func TestManyShards(t *testing.T) {
+	s, _ := NewLRUStorage(WithShards(1024), WithMaxEntries(100))
+	defer s.Close()
+	// idle shards allocate no wheel levels
+	for _, shard := range s.shards {
+		if w := shard.expiry.(*timingWheel); w.slots != [wheelLevels]*wheelLevel{} {
+			t.Fatal("wheel levels allocated upfront")
+		}
+	}
+	for i := 0; i < 10000; i++ {
+		s.Set(fmt.Sprint(i), []byte("1"), 60)
+	}
+	// 100 entries over 1024 shards round up to one per shard, not to unbounded
+	if n := s.Len(); n > 1024 {
+		t.Fatalf("%d entries", n)
+	}
+}
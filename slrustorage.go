@@ -0,0 +1,219 @@
+package probecache
+
+import (
+	"container/list"
+	"sync"
+)
+
+// SLRU: new entries land in the probation segment, a second hit promotes them
+// to the protected segment (80% of capacity). Protected overflow goes back to
+// probation head, eviction takes probation tail first, so single-touch entries
+// leave before anything that was hit twice.
+
+type slruEntry struct {
+	key    uint64
+	data   []byte
+	expire uint64
+	cost   int
+	list   *list.List
+}
+
+type SLRUShard struct {
+	sync.Mutex
+	listBase
+	items              map[uint64]*list.Element
+	probation          *list.List
+	protected          *list.List
+	probSize, protSize int
+	protCap            int
+}
+
+func NewSLRUShard(capacity int, byBytes bool) *SLRUShard {
+	s := &SLRUShard{
+		protCap: capacity * 8 / 10,
+	}
+	s.init(s, capacity, byBytes)
+	s.reset()
+	return s
+}
+
+func (s *SLRUShard) reset() {
+	s.items = make(map[uint64]*list.Element)
+	s.probation, s.protected = list.New(), list.New()
+	s.probSize, s.protSize = 0, 0
+	s.size = 0
+}
+
+func (s *SLRUShard) listSize(l *list.List) *int {
+	if l == s.probation {
+		return &s.probSize
+	}
+	return &s.protSize
+}
+
+// Run in lock only
+func (s *SLRUShard) push(l *list.List, e *slruEntry) {
+	e.list = l
+	*s.listSize(l) += e.cost
+	s.size += len(e.data) + entryOverhead
+	s.items[e.key] = l.PushFront(e)
+}
+
+// Run in lock only
+func (s *SLRUShard) unlink(el *list.Element) *slruEntry {
+	e := el.Value.(*slruEntry)
+	e.list.Remove(el)
+	*s.listSize(e.list) -= e.cost
+	s.size -= len(e.data) + entryOverhead
+	delete(s.items, e.key)
+	return e
+}
+
+// overLimit reports whether one more entry of given cost doesn't fit
+func (s *SLRUShard) overLimit(cost int) bool {
+	if s.capacity > 0 && s.probSize+s.protSize+cost > s.capacity {
+		return true
+	}
+	return s.maxLen > 0 && len(s.items)+1 > s.maxLen
+}
+
+// Run in lock only
+func (s *SLRUShard) evictOne() {
+	el := s.probation.Back()
+	if el == nil {
+		el = s.protected.Back()
+	}
+	e := s.unlink(el)
+	s.evicted(e.key, e.data, e.expire)
+}
+
+// Run in lock only
+func (s *SLRUShard) promote(el *list.Element) {
+	s.push(s.protected, s.unlink(el))
+	for s.capacity > 0 && s.protSize > s.protCap && s.protected.Len() > 1 {
+		s.push(s.probation, s.unlink(s.protected.Back()))
+	}
+}
+
+func (s *SLRUShard) Set(key uint64, data []byte, ttl uint64) {
+	if s.copyOnSet {
+		data = append([]byte(nil), data...)
+	}
+	s.Lock()
+	defer s.Unlock()
+	e := &slruEntry{key: key, data: data, expire: expireAt(ttl), cost: s.cost(data)}
+	// overwrite keeps the segment
+	to := s.probation
+	if el, ok := s.items[key]; ok {
+		old := s.unlink(el)
+		s.removed(key, old.data, EvictReplaced)
+		to = old.list
+	}
+	for len(s.items) > 0 && s.overLimit(e.cost) {
+		s.evictOne()
+	}
+	s.push(to, e)
+	s.written(key, len(data))
+}
+
+func (s *SLRUShard) put(key uint64, data []byte, ttl uint64) error {
+	if s.tooLarge(data) {
+		return ErrTooLarge
+	}
+	s.Set(key, data, ttl)
+	return nil
+}
+
+func (s *SLRUShard) get(key uint64) ([]byte, uint64, error) {
+	s.Lock()
+	defer s.Unlock()
+	el, ok := s.items[key]
+	if !ok {
+		s.miss()
+		return nil, 0, ErrMissing
+	}
+	e := el.Value.(*slruEntry)
+	if s.isExpired(e.expire) {
+		if !s.keepExpired {
+			s.expire(key)
+		}
+		s.miss()
+		return nil, 0, ErrExpired
+	}
+	if e.list == s.probation {
+		s.promote(el)
+	} else {
+		s.protected.MoveToFront(el)
+	}
+	s.hit()
+	return e.data, ttlLeft(e.expire), nil
+}
+
+func (s *SLRUShard) Get(key uint64) ([]byte, error) {
+	d, _, err := s.get(key)
+	return d, err
+}
+
+func (s *SLRUShard) GetWithTTL(key uint64) ([]byte, uint64, error) {
+	return s.get(key)
+}
+
+// Del removes entry, reports whether a live entry was removed
+func (s *SLRUShard) Del(key uint64) bool {
+	s.Lock()
+	defer s.Unlock()
+	el, ok := s.items[key]
+	if !ok {
+		return false
+	}
+	e := s.unlink(el)
+	s.removed(key, e.data, EvictDeleted)
+	return !s.isExpired(e.expire)
+}
+
+func (s *SLRUShard) Clear() {
+	s.Lock()
+	defer s.Unlock()
+	s.reset()
+}
+
+func (s *SLRUShard) each(fn func(key uint64, expire uint64, data []byte)) {
+	for _, el := range s.items {
+		e := el.Value.(*slruEntry)
+		fn(e.key, e.expire, e.data)
+	}
+}
+
+// Run in lock only
+func (s *SLRUShard) expire(key uint64) {
+	e := s.unlink(s.items[key])
+	s.expired(e.key, e.data)
+}
+
+func (s *SLRUShard) count() int {
+	return len(s.items)
+}
+
+// ----------------------------------------------
+
+// SLRUStorage supports the IStorage subset of Config: NumShards, MaxMemSize,
+// MaxEntries, MaxEntrySize, DefaultTTL, CopyOnGet/CopyOnSet, OnEvict, OnExpire, OnRemove, EventBuffer,
+// ExpirationMode, CleanPeriod
+type SLRUStorage struct {
+	listStorage[*SLRUShard]
+}
+
+func NewSLRUStorage(opts ...Option) (*SLRUStorage, error) {
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	capacity, byBytes, _ := listLimits(cfg)
+	shards := make([]*SLRUShard, cfg.NumShards)
+	for i := range shards {
+		shards[i] = NewSLRUShard(capacity, byBytes)
+	}
+	s := &SLRUStorage{}
+	s.init(cfg, newKeyHasher(cfg.KeyHash, cfg.Hasher), shards)
+	return s, nil
+}
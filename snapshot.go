@@ -0,0 +1,471 @@
+package probecache
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Snapshot stream, uvarints unless sized:
+//
+//	"PCSNAP" version(1) hash(1) flags(1) policy(1) epoch
+//	1 hash(8) check expire [worth(8)] [key] data   per entry, data length prefixed
+//	0 count                                       end, count of entries
+//
+// Key is its length + 1, 0 for an entry whose key isn't known. Version 1 had no policy
+// byte and keys prefixed with their length, it's still read
+const (
+	snapshotMagic   = "PCSNAP"
+	snapshotVersion = 2
+	// longest value Restore accepts, guards allocations on corrupt input
+	maxSnapshotValue = 1 << 30
+)
+
+// hash byte values past KeyHash kinds
+const (
+	hashCustom byte = 254 // user Hasher, assumed stable between runs
+	hashSeeded byte = 255 // random seed, hashes mean nothing to another storage
+)
+
+const (
+	snapKeyed   = 1 << iota // entries carry original keys, TrackKeys
+	snapWorth               // entries carry worth, LRU/LFU
+	snapChecked             // entries carry a second key hash, HashMurmur3 of LRU/LFU
+)
+
+// Snapshotter is a storage that can be saved by Snapshot and loaded by Restore. All
+// storages are, but Namespace: it's a view, save its parent
+type Snapshotter interface {
+	// Snapshot writes live entries to w, a shard at a time: a shard is locked only
+	// while its entries are copied to memory
+	Snapshot(w io.Writer) error
+	// Restore sets entries of a snapshot, expired ones are skipped. Entries of a storage
+	// with another key hash can be restored only if it tracked keys. Restore stops at the
+	// first error, entries read before it stay set
+	Restore(r io.Reader) error
+}
+
+var (
+	_ Snapshotter = (*PolicyStorage)(nil)
+	_ Snapshotter = (*TTLStorage)(nil)
+	_ Snapshotter = (*ARCStorage)(nil)
+	_ Snapshotter = (*TwoQStorage)(nil)
+	_ Snapshotter = (*WTinyLFUStorage)(nil)
+	_ Snapshotter = (*ClockStorage)(nil)
+	_ Snapshotter = (*FIFOStorage)(nil)
+	_ Snapshotter = (*RandomStorage)(nil)
+	_ Snapshotter = (*SLRUStorage)(nil)
+	_ Snapshotter = (*GDSFStorage)(nil)
+	_ Snapshotter = (*LIRSStorage)(nil)
+	_ Snapshotter = (*S3FIFOStorage)(nil)
+	_ Snapshotter = (*LRFUStorage)(nil)
+	_ Snapshotter = (*ExactLRUStorage)(nil)
+	_ Snapshotter = (*ExactLFUStorage)(nil)
+	_ Snapshotter = (*RingStorage)(nil)
+	_ Snapshotter = (*OffHeapStorage)(nil)
+)
+
+// policy byte values, worth is carried over only between storages of the same policy
+const (
+	policyNone byte = iota // no worth, or worth of a policy that can't be carried over
+	policyLRU
+	policyLFU
+)
+
+type snapshotHeader struct {
+	hash   byte
+	flags  byte
+	policy byte
+	epoch  uint64 // unix ms worth of a time based policy counts from, 0 if it's not
+}
+
+type snapshotEntry struct {
+	hash   uint64
+	check  uint64
+	key    string
+	keyed  bool // key is known
+	expire uint64
+	worth  float64
+	data   []byte
+}
+
+// ttl is the internal ttl an entry is set with to expire when it did
+func (e *snapshotEntry) ttl() uint64 {
+	if e.expire == noExpire {
+		return ttlForever
+	}
+	if now := nowMs(); e.expire > now {
+		return e.expire - now
+	}
+	return 1
+}
+
+// snapshotHash identifies key hashes of h in a snapshot header
+func snapshotHash(h keyHasher) byte {
+	if h.custom != nil {
+		return hashCustom
+	}
+	if h.kind == HashMaphash {
+		return hashSeeded
+	}
+	return byte(h.kind)
+}
+
+// pair is the hash and no check, as storages without checks rehash keys of a snapshot
+func (h keyHasher) pair(key string) (uint64, uint64) {
+	return h.sum(key), 0
+}
+
+// policyOf identifies p in a snapshot header, policyNone for custom policies
+func policyOf(p Policy) byte {
+	switch p.(type) {
+	case lruPolicy:
+		return policyLRU
+	case lfuPolicy:
+		return policyLFU
+	}
+	return policyNone
+}
+
+// epochOf returns start of the worth clock of time based policies, 0 for others
+func epochOf(p Policy) uint64 {
+	if c, ok := p.(interface{ epoch() time.Time }); ok {
+		return uint64(c.epoch().UnixNano() / int64(time.Millisecond))
+	}
+	return 0
+}
+
+type snapshotEncoder struct {
+	w     io.Writer
+	flags byte
+	buf   []byte // entries of the current shard
+	now   uint64
+	count uint64
+	err   error
+}
+
+// writeSnapshot encodes shards one at a time: shard(i, enc) adds entries of the i-th
+// in its lock, they are written to w once it's released
+func writeSnapshot(w io.Writer, hdr snapshotHeader, shards int, shard func(i int, enc *snapshotEncoder)) error {
+	if hdr.hash == hashSeeded && hdr.flags&snapKeyed == 0 {
+		return fmt.Errorf("%w: keys are hashed with random seed and not tracked", ErrSnapshot)
+	}
+	enc := &snapshotEncoder{w: w, flags: hdr.flags, now: nowMs()}
+	enc.buf = append(enc.buf, snapshotMagic...)
+	enc.buf = append(enc.buf, snapshotVersion, hdr.hash, hdr.flags, hdr.policy)
+	enc.buf = binary.AppendUvarint(enc.buf, hdr.epoch)
+	for i := 0; i < shards && enc.err == nil; i++ {
+		shard(i, enc)
+		enc.flush()
+	}
+	enc.buf = append(enc.buf, 0)
+	enc.buf = binary.AppendUvarint(enc.buf, enc.count)
+	enc.flush()
+	return enc.err
+}
+
+// entry adds an entry unless it's expired, data is copied
+func (enc *snapshotEncoder) entry(e snapshotEntry) {
+	if e.expire != noExpire && e.expire <= enc.now {
+		return
+	}
+	enc.buf = append(enc.buf, 1)
+	enc.buf = binary.LittleEndian.AppendUint64(enc.buf, e.hash)
+	enc.buf = binary.AppendUvarint(enc.buf, e.check)
+	enc.buf = binary.AppendUvarint(enc.buf, e.expire)
+	if enc.flags&snapWorth != 0 {
+		enc.buf = binary.LittleEndian.AppendUint64(enc.buf, math.Float64bits(e.worth))
+	}
+	if enc.flags&snapKeyed != 0 {
+		if e.keyed {
+			enc.buf = binary.AppendUvarint(enc.buf, uint64(len(e.key))+1)
+			enc.buf = append(enc.buf, e.key...)
+		} else {
+			enc.buf = append(enc.buf, 0)
+		}
+	}
+	enc.buf = binary.AppendUvarint(enc.buf, uint64(len(e.data)))
+	enc.buf = append(enc.buf, e.data...)
+	enc.count++
+}
+
+func (enc *snapshotEncoder) flush() {
+	if enc.err == nil && len(enc.buf) > 0 {
+		_, enc.err = enc.w.Write(enc.buf)
+	}
+	enc.buf = enc.buf[:0]
+}
+
+// readSnapshot calls fn for live entries of a snapshot made for a storage with header
+// local. Entries of another key hash are rehashed by their keys, ones without a key
+// are skipped then
+func readSnapshot(r io.Reader, local snapshotHeader, rehash func(key string) (uint64, uint64), fn func(e *snapshotEntry)) error {
+	br := bufio.NewReader(r)
+	head := make([]byte, len(snapshotMagic)+3)
+	if _, err := io.ReadFull(br, head); err != nil {
+		return snapshotErr(err)
+	}
+	if string(head[:len(snapshotMagic)]) != snapshotMagic {
+		return fmt.Errorf("%w: not a snapshot", ErrSnapshot)
+	}
+	version := head[len(snapshotMagic)]
+	if version != 1 && version != snapshotVersion {
+		return fmt.Errorf("%w: unknown version %d", ErrSnapshot, version)
+	}
+	hdr := snapshotHeader{hash: head[len(snapshotMagic)+1], flags: head[len(snapshotMagic)+2]}
+	if version > 1 {
+		b, err := br.ReadByte()
+		if err != nil {
+			return snapshotErr(err)
+		}
+		hdr.policy = b
+	}
+	epoch, err := binary.ReadUvarint(br)
+	if err != nil {
+		return snapshotErr(err)
+	}
+	rehashed := hdr.hash != local.hash || hdr.hash == hashSeeded || hdr.flags&snapChecked != local.flags&snapChecked
+	if rehashed && hdr.flags&snapKeyed == 0 {
+		return fmt.Errorf("%w: made with another key hash and without keys", ErrSnapshot)
+	}
+	// worth of the same policy is kept, of a time based one moved to the local clock.
+	// Version 1 didn't name policies, only time based ones were told apart
+	worth := hdr.flags&snapWorth != 0 && local.policy != policyNone && hdr.policy == local.policy
+	if version == 1 {
+		worth = hdr.flags&snapWorth != 0 && local.policy != policyNone && (epoch == 0) == (local.epoch == 0)
+	}
+	shift := (float64(epoch) - float64(local.epoch)) / 1000
+	now := nowMs()
+	count := uint64(0)
+	for {
+		tag, err := br.ReadByte()
+		if err != nil {
+			return snapshotErr(err)
+		}
+		if tag == 0 {
+			n, err := binary.ReadUvarint(br)
+			if err != nil {
+				return snapshotErr(err)
+			}
+			if n != count {
+				return fmt.Errorf("%w: %d entries read, %d written", ErrSnapshot, count, n)
+			}
+			return nil
+		}
+		if tag != 1 {
+			return fmt.Errorf("%w: bad entry tag %d", ErrSnapshot, tag)
+		}
+		e, err := readSnapshotEntry(br, version, hdr.flags)
+		if err != nil {
+			return err
+		}
+		count++
+		if e.expire != noExpire && e.expire <= now {
+			continue
+		}
+		if rehashed {
+			if !e.keyed {
+				continue
+			}
+			e.hash, e.check = rehash(e.key)
+		}
+		if !worth {
+			e.worth = math.NaN()
+		} else if epoch != 0 {
+			e.worth += shift
+		}
+		fn(&e)
+	}
+}
+
+// readSnapshotEntry reads an entry after its tag, NaN worth means none
+func readSnapshotEntry(br *bufio.Reader, version byte, flags byte) (snapshotEntry, error) {
+	var e snapshotEntry
+	var b [8]byte
+	if _, err := io.ReadFull(br, b[:]); err != nil {
+		return e, snapshotErr(err)
+	}
+	e.hash = binary.LittleEndian.Uint64(b[:])
+	var err error
+	if e.check, err = binary.ReadUvarint(br); err != nil {
+		return e, snapshotErr(err)
+	}
+	if e.expire, err = binary.ReadUvarint(br); err != nil {
+		return e, snapshotErr(err)
+	}
+	if flags&snapWorth != 0 {
+		if _, err := io.ReadFull(br, b[:]); err != nil {
+			return e, snapshotErr(err)
+		}
+		e.worth = math.Float64frombits(binary.LittleEndian.Uint64(b[:]))
+	}
+	if flags&snapKeyed != 0 {
+		if e.key, e.keyed, err = readSnapshotKey(br, version); err != nil {
+			return e, err
+		}
+	}
+	e.data, err = readSnapshotBytes(br)
+	return e, err
+}
+
+// readSnapshotKey reads a key, an empty one of version 1 is taken for unknown
+func readSnapshotKey(br *bufio.Reader, version byte) (string, bool, error) {
+	if version == 1 {
+		key, err := readSnapshotBytes(br)
+		return string(key), len(key) > 0, err
+	}
+	n, err := binary.ReadUvarint(br)
+	if err != nil {
+		return "", false, snapshotErr(err)
+	}
+	if n == 0 {
+		return "", false, nil
+	}
+	if n > maxSnapshotValue {
+		return "", false, fmt.Errorf("%w: key of %d bytes", ErrSnapshot, n-1)
+	}
+	key := make([]byte, n-1)
+	if _, err := io.ReadFull(br, key); err != nil {
+		return "", false, snapshotErr(err)
+	}
+	return string(key), true, nil
+}
+
+func readSnapshotBytes(br *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, snapshotErr(err)
+	}
+	if n > maxSnapshotValue {
+		return nil, fmt.Errorf("%w: entry of %d bytes", ErrSnapshot, n)
+	}
+	d := make([]byte, n)
+	if _, err := io.ReadFull(br, d); err != nil {
+		return nil, snapshotErr(err)
+	}
+	return d, nil
+}
+
+// snapshotErr reports a stream cut short as ErrSnapshot and ErrTruncated, other read errors as they are
+func snapshotErr(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: %w", ErrSnapshot, ErrTruncated)
+	}
+	return err
+}
+
+// autoSnapshot saves a storage to a file every interval and once more on stop
+type autoSnapshot struct {
+	mu      sync.Mutex // one save at a time, so an older snapshot never replaces a newer one
+	path    string
+	s       Snapshotter
+	onError func(err error)
+	timeout time.Duration
+	janitor *janitor
+}
+
+// startAutoSnapshot returns nil without SnapshotPath, which is safe to stop
+func startAutoSnapshot(cfg Config, s Snapshotter, pool *workerPool, onError func(err error)) *autoSnapshot {
+	if cfg.SnapshotPath == "" {
+		return nil
+	}
+	a := &autoSnapshot{path: cfg.SnapshotPath, s: s, onError: onError, timeout: cfg.SnapshotTimeout}
+	a.janitor = startJanitor(pool, cfg.SnapshotInterval, priorityLow, a.save)
+	return a
+}
+
+func (a *autoSnapshot) save(ctx context.Context) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	ctx, cancel := withTimeout(ctx, a.timeout)
+	defer cancel()
+	if err := SaveToFileContext(ctx, a.s, a.path); err != nil && a.onError != nil {
+		a.onError(err)
+	}
+}
+
+// stop saves the last snapshot, call it before the storage is closed
+func (a *autoSnapshot) stop() {
+	if a == nil {
+		return
+	}
+	a.janitor.stop()
+	a.save(context.Background())
+}
+
+// SaveToFile snapshots s to a temporary file next to path and renames it over path
+// once synced, so path holds either the previous snapshot or the new one in full
+func SaveToFile(s Snapshotter, path string) error {
+	return SaveToFileContext(context.Background(), s, path)
+}
+
+// SaveToFileContext is SaveToFile which gives up with ctx.Err() once ctx is done,
+// path keeps the previous snapshot then
+func SaveToFileContext(ctx context.Context, s Snapshotter, path string) error {
+	dir, name := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	f, err := os.CreateTemp(dir, name+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	err = s.Snapshot(ctxWriter{ctx: ctx, w: f})
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// make the rename durable, not every platform can sync a directory
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// ctxWriter fails writes once ctx is done
+type ctxWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (w ctxWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.w.Write(p)
+}
+
+// LoadFromFile restores the snapshot at path into s, entries expired meanwhile are
+// skipped. A truncated file is loaded up to the cut without error: a partly warm
+// cache beats a cold one. A missing file is reported as fs.ErrNotExist
+func LoadFromFile(s Snapshotter, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	err = s.Restore(f)
+	if errors.Is(err, ErrTruncated) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,371 @@
+package probecache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	opts := []Option{WithShards(4), WithMaxBytes(1 << 20)}
+	makers := map[string]func() (IStorage, error){
+		"LRU":      func() (IStorage, error) { return NewLRUStorage(opts...) },
+		"LFU":      func() (IStorage, error) { return NewLFUStorage(opts...) },
+		"TTL":      func() (IStorage, error) { return NewTTLStorage(opts...) },
+		"ARC":      func() (IStorage, error) { return NewARCStorage(opts...) },
+		"TwoQ":     func() (IStorage, error) { return NewTwoQStorage(opts...) },
+		"WTinyLFU": func() (IStorage, error) { return NewWTinyLFUStorage(opts...) },
+		"Clock":    func() (IStorage, error) { return NewClockStorage(opts...) },
+		"FIFO":     func() (IStorage, error) { return NewFIFOStorage(opts...) },
+		"Random":   func() (IStorage, error) { return NewRandomStorage(opts...) },
+		"SLRU":     func() (IStorage, error) { return NewSLRUStorage(opts...) },
+		"GDSF":     func() (IStorage, error) { return NewGDSFStorage(opts...) },
+		"LIRS":     func() (IStorage, error) { return NewLIRSStorage(opts...) },
+		"S3FIFO":   func() (IStorage, error) { return NewS3FIFOStorage(opts...) },
+		"LRFU":     func() (IStorage, error) { return NewLRFUStorage(opts...) },
+		"ExactLRU": func() (IStorage, error) { return NewExactLRUStorage(opts...) },
+		"ExactLFU": func() (IStorage, error) { return NewExactLFUStorage(opts...) },
+		"Ring":     func() (IStorage, error) { return NewRingStorage(opts...) },
+		"OffHeap":  func() (IStorage, error) { return NewOffHeapStorage(opts...) },
+	}
+	for name, make := range makers {
+		src, err := make()
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		for i := 0; i < 100; i++ {
+			src.Set("k"+strconv.Itoa(i), []byte("v"+strconv.Itoa(i)), uint64(i%3)*100)
+		}
+		src.Set("gone", []byte("x"), 0)
+		src.Del("gone")
+		var buf bytes.Buffer
+		if err := src.(Snapshotter).Snapshot(&buf); err != nil {
+			t.Fatal(name, err)
+		}
+		dst, _ := make()
+		if err := dst.(Snapshotter).Restore(&buf); err != nil {
+			t.Fatal(name, err)
+		}
+		if dst.Len() != 100 {
+			t.Errorf("%s: restored %d entries", name, dst.Len())
+		}
+		for i := 0; i < 100; i++ {
+			data, ttl, err := dst.GetWithTTL("k" + strconv.Itoa(i))
+			if err != nil || string(data) != "v"+strconv.Itoa(i) || (i%3 == 0) != (ttl == 0) {
+				t.Errorf("%s: k%d = %q, ttl %d, %v", name, i, data, ttl, err)
+				break
+			}
+		}
+		src.Close()
+		dst.Close()
+	}
+}
+
+func TestSnapshotWorth(t *testing.T) {
+	src, _ := NewLFUStorage(WithShards(1))
+	defer src.Close()
+	src.Set("hot", []byte("1"), 0)
+	for i := 0; i < 5; i++ {
+		src.Get("hot")
+	}
+	src.Set("cold", []byte("1"), 0)
+	var buf bytes.Buffer
+	src.Snapshot(&buf)
+	dst, _ := NewLFUStorage(WithShards(1))
+	defer dst.Close()
+	if err := dst.Restore(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := src.shards[0].GetTotalWorth()
+	if got := dst.shards[0].GetTotalWorth(); got != want {
+		t.Fatalf("total worth %v, want %v", got, want)
+	}
+
+	lru, _ := NewPolicyStorage(lruPolicy{start: time.Now().Add(-time.Hour)}, WithShards(1))
+	defer lru.Close()
+	lru.Set("a", []byte("1"), 0)
+	lru.Get("a")
+	buf.Reset()
+	lru.Snapshot(&buf)
+	fresh, _ := NewLRUStorage(WithShards(1))
+	defer fresh.Close()
+	fresh.Restore(&buf)
+	// hit an hour after the old start is about now for the fresh one
+	if w := fresh.shards[0].GetTotalWorth(); w < -1 || w > 1 {
+		t.Fatalf("restored LRU worth %v", w)
+	}
+}
+
+func TestSnapshotHashes(t *testing.T) {
+	src, _ := NewLRUStorage(WithKeyHash(HashMaphash))
+	defer src.Close()
+	src.Set("a", []byte("1"), 0)
+	var buf bytes.Buffer
+	if err := src.Snapshot(&buf); !errors.Is(err, ErrSnapshot) {
+		t.Fatalf("seeded hash without keys: %v", err)
+	}
+
+	keyed, _ := NewLRUStorage(WithKeyHash(HashMaphash), WithTrackKeys())
+	defer keyed.Close()
+	keyed.Set("a", []byte("1"), 0)
+	if err := keyed.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	snap := buf.Bytes()
+	dst, _ := NewFIFOStorage(WithKeyHash(HashMurmur3))
+	defer dst.Close()
+	if err := dst.Restore(bytes.NewReader(snap)); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := dst.Get("a"); string(data) != "1" {
+		t.Fatalf("rehashed entry %q, %v", data, err)
+	}
+
+	if err := dst.Restore(bytes.NewReader(snap[:len(snap)-3])); !errors.Is(err, ErrSnapshot) {
+		t.Fatalf("truncated: %v", err)
+	}
+	if err := dst.Restore(bytes.NewReader([]byte("PCSNAQ\x01\x00\x00\x00"))); !errors.Is(err, ErrSnapshot) {
+		t.Fatalf("bad magic: %v", err)
+	}
+}
+
+func TestSnapshotPolicies(t *testing.T) {
+	src, _ := NewLRUStorage(WithShards(2))
+	defer src.Close()
+	want, _ := NewLFUStorage(WithShards(2))
+	defer want.Close()
+	for i := 0; i < 50; i++ {
+		k := "k" + strconv.Itoa(i)
+		src.Set(k, []byte("v"), 0)
+		src.Get(k)
+		want.Set(k, []byte("v"), 0)
+	}
+	var buf bytes.Buffer
+	if err := src.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	dst, _ := NewLFUStorage(WithShards(2))
+	defer dst.Close()
+	if err := dst.Restore(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if dst.Len() != 50 {
+		t.Fatalf("restored %d entries", dst.Len())
+	}
+	// LRU worth is a timestamp, LFU entries start over as fresh ones
+	for i := range dst.shards {
+		if got, w := dst.shards[i].GetTotalWorth(), want.shards[i].GetTotalWorth(); got != w {
+			t.Fatalf("shard %d worth %v, want %v", i, got, w)
+		}
+	}
+}
+
+func TestSnapshotReshard(t *testing.T) {
+	src, _ := NewLFUStorage(WithShards(8))
+	defer src.Close()
+	for i := 0; i < 200; i++ {
+		src.Set("k"+strconv.Itoa(i), []byte(strconv.Itoa(i)), 0)
+	}
+	var buf bytes.Buffer
+	src.Snapshot(&buf)
+	snap := buf.Bytes()
+	for _, n := range []int{1, 3, 32} {
+		dst, _ := NewLFUStorage(WithShards(n))
+		if err := dst.Restore(bytes.NewReader(snap)); err != nil {
+			t.Fatal(n, err)
+		}
+		for i := 0; i < 200; i++ {
+			if data, err := dst.Get("k" + strconv.Itoa(i)); string(data) != strconv.Itoa(i) {
+				t.Fatalf("%d shards: k%d = %q, %v", n, i, data, err)
+			}
+		}
+		dst.Close()
+	}
+}
+
+func TestSnapshotEmptyKey(t *testing.T) {
+	src, _ := NewLRUStorage(WithKeyHash(HashMaphash), WithTrackKeys())
+	defer src.Close()
+	src.Set("", []byte("empty"), 0)
+	src.Set("a", []byte("1"), 0)
+	var buf bytes.Buffer
+	if err := src.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	dst, _ := NewLRUStorage(WithKeyHash(HashMurmur3), WithTrackKeys())
+	defer dst.Close()
+	if err := dst.Restore(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := dst.Get(""); string(data) != "empty" {
+		t.Fatalf("empty key %q, %v", data, err)
+	}
+
+	// an entry of unknown key can't be rehashed and is skipped
+	buf.Reset()
+	hdr := snapshotHeader{hash: hashSeeded, flags: snapKeyed}
+	writeSnapshot(&buf, hdr, 1, func(_ int, enc *snapshotEncoder) {
+		enc.entry(snapshotEntry{hash: 1, expire: noExpire, data: []byte("lost")})
+		enc.entry(snapshotEntry{hash: 2, key: "b", keyed: true, expire: noExpire, data: []byte("2")})
+	})
+	dst.Clear()
+	if err := dst.Restore(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if dst.Len() != 1 {
+		t.Fatalf("restored %d entries", dst.Len())
+	}
+	if _, err := dst.Get(""); err == nil {
+		t.Fatal("unknown key restored as empty one")
+	}
+}
+
+func TestSnapshotFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.snap")
+	src, _ := NewTTLStorage()
+	defer src.Close()
+	for i := 0; i < 100; i++ {
+		src.Set(strconv.Itoa(i), bytes.Repeat([]byte("x"), 100), 0)
+	}
+	src.SetWithDuration("short", []byte("x"), 20*time.Millisecond)
+	if err := SaveToFile(src, path); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := os.ReadDir(filepath.Dir(path)); len(files) != 1 {
+		t.Fatalf("temp file left: %v", files)
+	}
+	time.Sleep(30 * time.Millisecond)
+	dst, _ := NewTTLStorage()
+	defer dst.Close()
+	if err := LoadFromFile(dst, path); err != nil {
+		t.Fatal(err)
+	}
+	if dst.Len() != 100 {
+		t.Fatalf("loaded %d entries, expired one included?", dst.Len())
+	}
+
+	data, _ := os.ReadFile(path)
+	os.WriteFile(path, data[:len(data)/2], 0o644)
+	dst.Clear()
+	if err := LoadFromFile(dst, path); err != nil {
+		t.Fatal(err)
+	}
+	if n := dst.Len(); n == 0 || n >= 100 {
+		t.Fatalf("loaded %d entries of a truncated file", n)
+	}
+	if err := LoadFromFile(dst, path+".missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("missing file: %v", err)
+	}
+}
+
+func TestSnapshotFileCancel(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.snap")
+	src, _ := NewLRUStorage()
+	defer src.Close()
+	src.Set("a", []byte("1"), 0)
+	if err := SaveToFile(src, path); err != nil {
+		t.Fatal(err)
+	}
+	src.Set("b", []byte("2"), 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := SaveToFileContext(ctx, src, path); !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled save: %v", err)
+	}
+	if files, _ := os.ReadDir(filepath.Dir(path)); len(files) != 1 {
+		t.Fatalf("temp file left: %v", files)
+	}
+	dst, _ := NewLRUStorage()
+	defer dst.Close()
+	if err := LoadFromFile(dst, path); err != nil || dst.Len() != 1 {
+		t.Fatalf("previous snapshot not kept: %d entries, %v", dst.Len(), err)
+	}
+}
+
+func TestAutoSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.snap")
+	if _, err := NewLRUStorage(WithAutoSnapshot(time.Second, "")); !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("interval without path: %v", err)
+	}
+	for _, mk := range []func(...Option) (IStorage, error){
+		func(o ...Option) (IStorage, error) { return NewLRUStorage(o...) },
+		func(o ...Option) (IStorage, error) { return NewFIFOStorage(o...) },
+	} {
+		os.Remove(path)
+		s, err := mk(WithAutoSnapshot(10*time.Millisecond, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Set("a", []byte("1"), 0)
+		time.Sleep(50 * time.Millisecond)
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("no periodic snapshot: %v", err)
+		}
+		s.Set("b", []byte("2"), 0)
+		s.Close()
+
+		dst, _ := NewTTLStorage()
+		if err := LoadFromFile(dst, path); err != nil {
+			t.Fatal(err)
+		}
+		if v, _ := dst.Get("b"); string(v) != "2" || dst.Len() != 2 {
+			t.Fatalf("final snapshot on Close: b=%q, %d entries", v, dst.Len())
+		}
+		dst.Close()
+	}
+}
+
+func TestOffHeapMmap(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.mmap")
+	opts := []Option{WithShards(4), WithMaxBytes(1 << 20), WithMmapFile(path)}
+	s, err := NewOffHeapStorage(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		s.Set(strconv.Itoa(i), bytes.Repeat([]byte{byte(i)}, i*10), 0)
+	}
+	s.Set("5", []byte("overwritten"), 0)
+	s.Del("7")
+	s.SetWithDuration("short", []byte("x"), 20*time.Millisecond)
+	if _, err := NewOffHeapStorage(opts...); err == nil {
+		t.Fatal("file mapped twice")
+	}
+	s.Close()
+
+	time.Sleep(30 * time.Millisecond)
+	s, err = NewOffHeapStorage(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Len() != 99 {
+		t.Fatalf("reopened with %d entries", s.Len())
+	}
+	if v, _ := s.Get("5"); string(v) != "overwritten" {
+		t.Fatalf("5 = %q", v)
+	}
+	if v, _ := s.Get("42"); !bytes.Equal(v, bytes.Repeat([]byte{42}, 420)) {
+		t.Fatalf("42 = %v", v)
+	}
+	if _, err := s.Get("7"); err != ErrMissing {
+		t.Fatalf("deleted 7: %v", err)
+	}
+	// freed blocks are reused after reopening
+	for i := 0; i < 1000; i++ {
+		s.Set("new"+strconv.Itoa(i), bytes.Repeat([]byte("y"), 1000), 0)
+	}
+	if st := s.Stats(); st.Size > 1<<20 || st.Evictions == 0 {
+		t.Fatalf("size %d, evictions %d", st.Size, st.Evictions)
+	}
+	s.Close()
+
+	if _, err := NewOffHeapStorage(WithShards(4), WithMaxBytes(2<<20), WithMmapFile(path)); !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("other layout: %v", err)
+	}
+}
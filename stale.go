@@ -0,0 +1,99 @@
+package probecache
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RefreshFunc loads a fresh value for key, ttl in seconds as in Set. ctx is cancelled
+// after RefreshTimeout and by Close of the storage
+type RefreshFunc func(ctx context.Context, key string) (value []byte, ttl uint64, err error)
+
+// refreshes in flight when Config.MaxRefreshes is 0
+const defaultMaxRefreshes = 16
+
+// refresher runs RefreshFunc in worker tasks for stale hits, one call per key at a time
+// and at most cap(sem) at once. Stale hits over that and failed refreshes are dropped,
+// the stale entry is served until the stale window passes.
+type refresher struct {
+	fn      RefreshFunc
+	workers *workerPool
+	timeout time.Duration
+	sem     chan struct{}
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+
+	sync.Mutex
+	inflight map[string]struct{}
+	closed   bool
+}
+
+func newRefresher(fn RefreshFunc, workers *workerPool, max int, timeout time.Duration) *refresher {
+	if max <= 0 {
+		max = defaultMaxRefreshes
+	}
+	r := &refresher{
+		fn:       fn,
+		workers:  workers,
+		timeout:  timeout,
+		sem:      make(chan struct{}, max),
+		inflight: make(map[string]struct{}),
+	}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	return r
+}
+
+func (r *refresher) run(key string, set func(key string, data []byte, ttl uint64) error) {
+	if r.fn == nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	if _, ok := r.inflight[key]; ok || r.closed {
+		return
+	}
+	select {
+	case r.sem <- struct{}{}:
+	default:
+		return
+	}
+	r.inflight[key] = struct{}{}
+	r.wg.Add(1)
+	ok := r.workers.submit(priorityLow, func(ctx context.Context) {
+		defer r.done(key)
+		// a task queued until Close doesn't call fn
+		if ctx.Err() != nil || r.ctx.Err() != nil {
+			return
+		}
+		ctx, cancel := withTimeout(r.ctx, r.timeout)
+		defer cancel()
+		// a value loaded past the deadline or Close is not set
+		if data, ttl, err := r.fn(ctx, key); err == nil && ctx.Err() == nil {
+			set(key, data, ttl)
+		}
+	})
+	if !ok {
+		delete(r.inflight, key)
+		<-r.sem
+		r.wg.Done()
+	}
+}
+
+func (r *refresher) done(key string) {
+	r.Lock()
+	delete(r.inflight, key)
+	r.Unlock()
+	<-r.sem
+	r.wg.Done()
+}
+
+// close cancels refreshes in flight and waits for them to return
+func (r *refresher) close() {
+	r.Lock()
+	r.closed = true
+	r.Unlock()
+	r.cancel()
+	r.wg.Wait()
+}
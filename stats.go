@@ -0,0 +1,211 @@
+package probecache
+
+import "time"
+
+type ShardStats struct {
+	Size        int
+	Len         int
+	Hits        uint64
+	Misses      uint64
+	Evictions   uint64
+	Expirations uint64
+	// Number of clean() runs and entries removed by them
+	Cleans  uint64
+	Cleaned uint64
+	// Entries removed by deletes and overwritten by Set
+	Deleted  uint64
+	Replaced uint64
+	// Entries probed by clean() runs, and most probed by one run since creation
+	// (not reset by ResetStats). LRU/LFU only
+	CleanDepth uint64
+	MaxDepth   int
+	// Time spent cleaning and evicting, Profile mode only
+	CleanTime time.Duration
+}
+
+func (s ShardStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+func (s ShardStats) CleanEfficiency() float64 {
+	if s.Cleans == 0 {
+		return 0
+	}
+	return float64(s.Cleaned) / float64(s.Cleans)
+}
+
+// AvgCleanDepth is average number of entries probed per clean() run
+func (s ShardStats) AvgCleanDepth() float64 {
+	if s.Cleans == 0 {
+		return 0
+	}
+	return float64(s.CleanDepth) / float64(s.Cleans)
+}
+
+// Stats counters run from storage creation or the last ResetStats
+type Stats struct {
+	Size        int
+	Len         int
+	Hits        uint64
+	Misses      uint64
+	Evictions   uint64
+	Expirations uint64
+	Cleans      uint64
+	Cleaned     uint64
+	Deleted     uint64
+	Replaced    uint64
+	CleanDepth  uint64
+	MaxDepth    int
+	CleanTime   time.Duration
+	// Writes and Del calls, storage-wide only
+	Sets    uint64
+	Deletes uint64
+
+	Shards []ShardStats
+}
+
+func (s *Stats) add(sh ShardStats) {
+	s.Size += sh.Size
+	s.Len += sh.Len
+	s.Hits += sh.Hits
+	s.Misses += sh.Misses
+	s.Evictions += sh.Evictions
+	s.Expirations += sh.Expirations
+	s.Cleans += sh.Cleans
+	s.Cleaned += sh.Cleaned
+	s.Deleted += sh.Deleted
+	s.Replaced += sh.Replaced
+	s.CleanDepth += sh.CleanDepth
+	s.CleanTime += sh.CleanTime
+	if sh.MaxDepth > s.MaxDepth {
+		s.MaxDepth = sh.MaxDepth
+	}
+}
+
+func (s *ShardStats) addCounters(o ShardStats) {
+	s.Hits += o.Hits
+	s.Misses += o.Misses
+	s.Evictions += o.Evictions
+	s.Expirations += o.Expirations
+	s.Cleans += o.Cleans
+	s.Cleaned += o.Cleaned
+	s.Deleted += o.Deleted
+	s.Replaced += o.Replaced
+	s.CleanDepth += o.CleanDepth
+	s.CleanTime += o.CleanTime
+}
+
+func (s *ShardStats) subCounters(o ShardStats) {
+	s.Hits -= o.Hits
+	s.Misses -= o.Misses
+	s.Evictions -= o.Evictions
+	s.Expirations -= o.Expirations
+	s.Cleans -= o.Cleans
+	s.Cleaned -= o.Cleaned
+	s.Deleted -= o.Deleted
+	s.Replaced -= o.Replaced
+	s.CleanDepth -= o.CleanDepth
+	s.CleanTime -= o.CleanTime
+}
+
+func (s *Stats) addCounters(o Stats) {
+	s.Hits += o.Hits
+	s.Misses += o.Misses
+	s.Evictions += o.Evictions
+	s.Expirations += o.Expirations
+	s.Cleans += o.Cleans
+	s.Cleaned += o.Cleaned
+	s.Deleted += o.Deleted
+	s.Replaced += o.Replaced
+	s.CleanDepth += o.CleanDepth
+	s.CleanTime += o.CleanTime
+	s.Sets += o.Sets
+	s.Deletes += o.Deletes
+}
+
+// sub subtracts counters of base, per shard too while the shard list matches
+func (s *Stats) sub(base Stats) {
+	s.Hits -= base.Hits
+	s.Misses -= base.Misses
+	s.Evictions -= base.Evictions
+	s.Expirations -= base.Expirations
+	s.Cleans -= base.Cleans
+	s.Cleaned -= base.Cleaned
+	s.Deleted -= base.Deleted
+	s.Replaced -= base.Replaced
+	s.CleanDepth -= base.CleanDepth
+	s.CleanTime -= base.CleanTime
+	s.Sets -= base.Sets
+	s.Deletes -= base.Deletes
+	if len(base.Shards) != len(s.Shards) {
+		return
+	}
+	for i := range s.Shards {
+		s.Shards[i].subCounters(base.Shards[i])
+	}
+}
+
+func (s Stats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// CleanEfficiency is average number of entries removed per clean() run
+func (s Stats) CleanEfficiency() float64 {
+	if s.Cleans == 0 {
+		return 0
+	}
+	return float64(s.Cleaned) / float64(s.Cleans)
+}
+
+// MemoryStats breaks down memory held by LRU/LFU entries. Payload and headers are exact,
+// maps are estimated from entry counts (Go maps don't shrink, after mass deletes they hold
+// more). Expiry indexes and free pool buffers are not counted
+type MemoryStats struct {
+	Payload int // value bytes
+	Slack   int // allocated but unused capacity of value buffers
+	Headers int // entry metadata structs
+	Map     int // hash map slots and control bytes, TrackKeys key maps and KeyFingerprints included
+	Len     int
+
+	Shards []ShardMemoryStats
+}
+
+type ShardMemoryStats struct {
+	Payload int
+	Slack   int
+	Headers int
+	Map     int
+	Len     int
+}
+
+func (m *MemoryStats) add(sh ShardMemoryStats) {
+	m.Payload += sh.Payload
+	m.Slack += sh.Slack
+	m.Headers += sh.Headers
+	m.Map += sh.Map
+	m.Len += sh.Len
+}
+
+// Total is the estimated heap footprint of the entries
+func (m MemoryStats) Total() int {
+	return m.Payload + m.Slack + m.Headers + m.Map
+}
+
+// mapBytes estimates a Go map of n entries with slot bytes per key and value: capacity
+// doubles past 7/8 load, each slot also has a control byte
+func mapBytes(n int, slot int) int {
+	if n == 0 {
+		return 0
+	}
+	capacity := 8
+	for capacity*7/8 < n {
+		capacity *= 2
+	}
+	return capacity * (slot + 1)
+}
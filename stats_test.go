@@ -0,0 +1,258 @@
+package probecache
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsCounters(t *testing.T) {
+	lru, _ := NewLRUStorage(WithShards(2))
+	fifo, _ := NewFIFOStorage(WithShards(2))
+	ttl, _ := NewTTLStorage(WithShards(2))
+	for name, s := range map[string]IStorage{"lru": lru, "fifo": fifo, "ttl": ttl} {
+		s.Set("a", []byte("1"), 0)
+		s.Set("b", []byte("2"), 0)
+		s.Get("a")
+		s.Get("c")
+		s.Del("b")
+		st := s.Stats()
+		if st.Sets != 2 || st.Deletes != 1 || st.Hits != 1 || st.Misses != 1 {
+			t.Errorf("%s: got %+v", name, st)
+		}
+		s.ResetStats()
+		s.Get("a")
+		st = s.Stats()
+		if st.Sets != 0 || st.Deletes != 0 || st.Hits != 1 || st.Misses != 0 || st.Len != 1 {
+			t.Errorf("%s after reset: got %+v", name, st)
+		}
+		if st.Shards[0].Hits+st.Shards[1].Hits != 1 {
+			t.Errorf("%s after reset: shard hits %+v", name, st.Shards)
+		}
+		s.Close()
+	}
+}
+
+func TestStatsFailedWrites(t *testing.T) {
+	s, _ := NewLRUStorage(WithShards(1), WithMaxEntries(10), WithTinyLFU(64), WithMaxEntrySize(4))
+	defer s.Close()
+	for i := 0; i < 10; i++ {
+		s.Set(strconv.Itoa(i), []byte("1"), 0)
+		for j := 0; j < 5; j++ {
+			s.Get(strconv.Itoa(i))
+		}
+	}
+	s.ResetStats()
+	written := s.WindowStats(windowMinutes * time.Minute).BytesWritten
+	// admission turns away a key seen once, the rest fail on the entry
+	s.Set("new", []byte("1"), 0)
+	s.Append("missing", []byte("1"))
+	s.Append("0", []byte("1234"))
+	s.Del("missing")
+	s.DelExisted("missing")
+	s.GetAndDelete("missing")
+	if _, err := s.Get("new"); err == nil {
+		t.Fatal("admission let a new key in")
+	}
+	if st := s.Stats(); st.Sets != 0 || st.Deletes != 0 {
+		t.Fatalf("failed writes counted: %+v", st)
+	}
+	if w := s.WindowStats(windowMinutes * time.Minute); w.BytesWritten != written {
+		t.Fatalf("failed writes counted %d bytes", w.BytesWritten-written)
+	}
+	s.Append("0", []byte("2"))
+	s.Del("1")
+	s.GetAndDelete("2")
+	if st := s.Stats(); st.Sets != 1 || st.Deletes != 2 {
+		t.Fatalf("writes counted: %+v", st)
+	}
+}
+
+func TestShardCleanDepth(t *testing.T) {
+	s, _ := NewLRUStorage(WithShards(2), WithMaxBytes(4096), WithCleanDepth(5))
+	defer s.Close()
+	for i := 0; i < 1000; i++ {
+		s.Set(string(rune('a'+i%26))+string(rune(i)), make([]byte, 32), 0)
+	}
+	for i, sh := range s.Stats().Shards {
+		if sh.Cleans == 0 || sh.MaxDepth == 0 || sh.AvgCleanDepth() <= 0 || sh.AvgCleanDepth() > float64(sh.MaxDepth) {
+			t.Errorf("shard %d: %+v", i, sh)
+		}
+	}
+}
+
+func TestRemoveReasons(t *testing.T) {
+	reasons := map[EvictReason]int{}
+	s, _ := NewLRUStorage(WithShards(1), WithMaxEntries(3), WithOnRemove(func(key uint64, value []byte, reason EvictReason) {
+		reasons[reason]++
+	}))
+	defer s.Close()
+	s.Set("a", []byte("1"), 0)
+	s.Set("a", []byte("2"), 0)
+	s.Del("a")
+	for i := 0; i < 5; i++ {
+		s.Set(string(rune('b'+i)), []byte("x"), 0)
+	}
+	if reasons[EvictReplaced] != 1 || reasons[EvictDeleted] != 1 || reasons[EvictCapacity] == 0 {
+		t.Fatalf("got %v", reasons)
+	}
+	st := s.Stats()
+	if st.Replaced != 1 || st.Deleted != 1 || st.Evictions != uint64(reasons[EvictCapacity]) {
+		t.Fatalf("got %+v", st)
+	}
+}
+
+func TestProfileCleanTime(t *testing.T) {
+	s, _ := NewLRUStorage(WithShards(2), WithMaxBytes(4096), WithProfiling())
+	defer s.Close()
+	for i := 0; i < 1000; i++ {
+		s.Set(string(rune('a'+i%26))+string(rune(i)), make([]byte, 32), 0)
+	}
+	st := s.Stats()
+	if st.CleanTime <= 0 || st.CleanTime != st.Shards[0].CleanTime+st.Shards[1].CleanTime {
+		t.Fatalf("got %+v", st)
+	}
+	s.ResetStats()
+	if st := s.Stats(); st.CleanTime != 0 {
+		t.Fatalf("after reset %v", st.CleanTime)
+	}
+}
+
+func TestRemoveReasonsList(t *testing.T) {
+	makers := map[string]func(opts ...Option) (IStorage, error){
+		"Ring":    func(o ...Option) (IStorage, error) { return NewRingStorage(o...) },
+		"OffHeap": func(o ...Option) (IStorage, error) { return NewOffHeapStorage(o...) },
+	}
+	for name, make := range listStorages {
+		makers[name] = make
+	}
+	for name, make := range makers {
+		reasons := map[EvictReason]int{}
+		s, err := make(WithShards(1), WithMaxBytes(4096), WithMaxEntries(3), WithEvents(64, 1),
+			WithOnRemove(func(key uint64, value []byte, reason EvictReason) {
+				reasons[reason]++
+			}))
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		s.Set("a", []byte("1"), 0)
+		s.Set("a", []byte("2"), 0)
+		s.Del("a")
+		for i := 0; i < 5; i++ {
+			s.Set(string(rune('b'+i)), []byte("x"), 0)
+		}
+		if reasons[EvictReplaced] != 1 || reasons[EvictDeleted] != 1 || reasons[EvictCapacity] == 0 {
+			t.Errorf("%s: got %v", name, reasons)
+		}
+		st := s.Stats()
+		if st.Replaced != 1 || st.Deleted != 1 || st.Evictions != uint64(reasons[EvictCapacity]) {
+			t.Errorf("%s: got %+v", name, st)
+		}
+		events := s.(interface{ Events() <-chan CacheEvent }).Events()
+		types := map[EventType]int{}
+		for len(events) > 0 {
+			types[(<-events).Type]++
+		}
+		if types[EventSet] != 7 || types[EventDelete] != 1 || types[EventEvict] != reasons[EvictCapacity] {
+			t.Errorf("%s: events %v", name, types)
+		}
+		s.Close()
+	}
+}
+
+func TestWindowStats(t *testing.T) {
+	if time.Now().Second() == 59 {
+		time.Sleep(time.Second) // keep the test in one minute
+	}
+	s, _ := NewLRUStorage(WithShards(1), WithMaxEntries(2))
+	defer s.Close()
+	for i := 0; i < 4; i++ {
+		s.Set(strconv.Itoa(i), []byte("1234"), 0)
+	}
+	s.Get("3")
+	s.Get("missing")
+	w := s.WindowStats(time.Minute)
+	if w.Hits != 1 || w.Misses != 1 || w.Evictions != 2 || w.BytesWritten != 16 {
+		t.Fatalf("current minute %+v", w)
+	}
+	if w.Window <= 0 || w.Window > time.Minute {
+		t.Fatalf("current minute window %v", w.Window)
+	}
+
+	// minutes before the window and buckets left from a previous lap are not counted
+	minute := time.Now().Unix() / 60
+	s.window.buckets[(minute-3)%windowMinutes] = windowBucket{minute: minute - 3, hits: 10}
+	s.window.buckets[(minute-5)%windowMinutes] = windowBucket{minute: minute - 5 - windowMinutes, hits: 100}
+	if w := s.WindowStats(time.Minute); w.Hits != 1 {
+		t.Fatalf("1 minute window counted %d hits", w.Hits)
+	}
+	if w := s.WindowStats(10 * time.Minute); w.Hits != 11 {
+		t.Fatalf("10 minute window counted %d hits", w.Hits)
+	}
+	if w := s.WindowStats(time.Hour); w.Window > 15*time.Minute {
+		t.Fatalf("window %v over 15 minutes", w.Window)
+	}
+}
+
+func TestStatsShards(t *testing.T) {
+	s, _ := NewLRUStorage(WithShards(4), WithMaxEntries(40), WithExpiryIndex(ExpiryScan))
+	defer s.Close()
+	for i := 0; i < 100; i++ {
+		s.Set(strconv.Itoa(i), []byte("v"), 0)
+	}
+	s.SetWithDuration("x", []byte("v"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	for i := 0; i < 100; i++ {
+		s.Get(strconv.Itoa(i))
+	}
+	s.Get("x")
+	st := s.Stats()
+	var sum ShardStats
+	for _, sh := range st.Shards {
+		sum.Size += sh.Size
+		sum.Len += sh.Len
+		sum.Hits += sh.Hits
+		sum.Misses += sh.Misses
+		sum.Evictions += sh.Evictions
+		sum.Expirations += sh.Expirations
+	}
+	if len(st.Shards) != 4 || sum.Size != st.Size || sum.Len != st.Len || sum.Hits != st.Hits ||
+		sum.Misses != st.Misses || sum.Evictions != st.Evictions || sum.Expirations != st.Expirations {
+		t.Fatalf("totals %+v, shards sum %+v", st, sum)
+	}
+	if st.Len != s.Len() || st.Size != s.GetSize() || st.Hits+st.Misses != 101 || st.Expirations != 1 {
+		t.Fatalf("got %+v", st)
+	}
+	if st.Evictions+uint64(st.Len)+st.Expirations != 101 {
+		t.Fatalf("%d evicted, %d left of 101", st.Evictions, st.Len)
+	}
+	if r := st.HitRate(); r != float64(st.Hits)/101 {
+		t.Fatalf("hit rate %f", r)
+	}
+}
+
+func TestWriteInfo(t *testing.T) {
+	lru, _ := NewLRUStorage(WithShards(2), WithMaxBytes(1<<20))
+	defer lru.Close()
+	fifo, _ := NewFIFOStorage(WithShards(2), WithMaxBytes(1<<20))
+	defer fifo.Close()
+	for name, s := range map[string]interface {
+		IStorage
+		fmt.Stringer
+	}{"LRU": lru, "FIFO": fifo} {
+		s.Set("a", make([]byte, 4096), 0)
+		s.Get("a")
+		s.Get("b")
+		var b bytes.Buffer
+		s.WriteInfo(&b)
+		if b.String() != s.String() {
+			t.Fatalf("%s: WriteInfo %q, String %q", name, b.String(), s.String())
+		}
+		if !strings.Contains(b.String(), "Cache size: 4kb / 1024kb") || !strings.Contains(b.String(), "Hits: 1, misses: 1") {
+			t.Fatalf("%s: info %q", name, b.String())
+		}
+	}
+}
@@ -0,0 +1,574 @@
+package probecache
+
+import (
+	"errors"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// listStorages makes every storage over listStorage, with its own list or heap based engine
+var listStorages = map[string]func(opts ...Option) (IStorage, error){
+	"ARC":      func(o ...Option) (IStorage, error) { return NewARCStorage(o...) },
+	"TwoQ":     func(o ...Option) (IStorage, error) { return NewTwoQStorage(o...) },
+	"WTinyLFU": func(o ...Option) (IStorage, error) { return NewWTinyLFUStorage(o...) },
+	"Clock":    func(o ...Option) (IStorage, error) { return NewClockStorage(o...) },
+	"FIFO":     func(o ...Option) (IStorage, error) { return NewFIFOStorage(o...) },
+	"Random":   func(o ...Option) (IStorage, error) { return NewRandomStorage(o...) },
+	"SLRU":     func(o ...Option) (IStorage, error) { return NewSLRUStorage(o...) },
+	"GDSF":     func(o ...Option) (IStorage, error) { return NewGDSFStorage(o...) },
+	"LIRS":     func(o ...Option) (IStorage, error) { return NewLIRSStorage(o...) },
+	"S3FIFO":   func(o ...Option) (IStorage, error) { return NewS3FIFOStorage(o...) },
+	"ExactLRU": func(o ...Option) (IStorage, error) { return NewExactLRUStorage(o...) },
+	"ExactLFU": func(o ...Option) (IStorage, error) { return NewExactLFUStorage(o...) },
+}
+
+func TestSmallLimits(t *testing.T) {
+	for name, make := range listStorages {
+		// fewer bytes than shards still bounds every shard
+		s, err := make(WithShards(8), WithMaxBytes(4))
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		for i := 0; i < 1000; i++ {
+			s.Set(strconv.Itoa(i), []byte("v"), 0)
+		}
+		if n := s.Len(); n > 8 {
+			t.Errorf("%s: %d entries under MaxMemSize 4", name, n)
+		}
+		s.Close()
+	}
+}
+
+func TestOverCapacity(t *testing.T) {
+	for name, newStorage := range listStorages {
+		// no MaxEntrySize, the shard capacity alone rejects the value
+		s, err := newStorage(WithShards(1), WithMaxBytes(1<<10))
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		for i := 0; i < 10; i++ {
+			s.Set(strconv.Itoa(i), []byte("v"), 0)
+		}
+		if err := s.Set("big", make([]byte, 2<<10), 0); !errors.Is(err, ErrTooLarge) {
+			t.Errorf("%s: a value over the shard set: %v", name, err)
+		}
+		if st := s.Stats(); st.Len != 10 || st.Evictions != 0 {
+			t.Errorf("%s: %d entries left, %d evicted by a value over the shard", name, st.Len, st.Evictions)
+		}
+		s.Close()
+	}
+}
+
+func TestLen(t *testing.T) {
+	storages := map[string]func(opts ...Option) (IStorage, error){
+		"LRU":  func(o ...Option) (IStorage, error) { return NewLRUStorage(o...) },
+		"LFU":  func(o ...Option) (IStorage, error) { return NewLFUStorage(o...) },
+		"TTL":  func(o ...Option) (IStorage, error) { return NewTTLStorage(o...) },
+		"LRFU": func(o ...Option) (IStorage, error) { return NewLRFUStorage(o...) },
+		"Ring": func(o ...Option) (IStorage, error) { return NewRingStorage(o...) },
+	}
+	for name, make := range listStorages {
+		storages[name] = make
+	}
+	for name, make := range storages {
+		s, err := make(WithShards(4), WithMaxBytes(1<<20))
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		for i := 0; i < 100; i++ {
+			s.Set(strconv.Itoa(i), []byte("v"), 0)
+		}
+		s.Set("0", []byte("overwritten"), 0)
+		s.Del("1")
+		s.Del("missing")
+		if n := s.Len(); n != 99 {
+			t.Errorf("%s: len %d, want 99", name, n)
+		}
+		s.Clear()
+		if n := s.Len(); n != 0 {
+			t.Errorf("%s: len %d after Clear", name, n)
+		}
+		s.Close()
+	}
+}
+
+func TestClose(t *testing.T) {
+	storages := map[string]func(opts ...Option) (IStorage, error){
+		"LRU":  func(o ...Option) (IStorage, error) { return NewLRUStorage(o...) },
+		"LFU":  func(o ...Option) (IStorage, error) { return NewLFUStorage(o...) },
+		"TTL":  func(o ...Option) (IStorage, error) { return NewTTLStorage(o...) },
+		"Ring": func(o ...Option) (IStorage, error) { return NewRingStorage(o...) },
+	}
+	for name, make := range listStorages {
+		storages[name] = make
+	}
+	before := runtime.NumGoroutine()
+	for name, make := range storages {
+		s, err := make(WithShards(2), WithMaxBytes(1<<20), WithJanitor(time.Millisecond),
+			WithAgingPeriod(time.Millisecond), WithExpirationMode(ExpireActive), WithCleanPeriod(time.Millisecond))
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		s.Set("a", []byte("1"), 0)
+		s.Close()
+		s.Close()
+		if err := s.Set("a", []byte("1"), 0); !errors.Is(err, ErrClosed) {
+			t.Errorf("%s: set after close: %v", name, err)
+		}
+		if _, err := s.Get("a"); !errors.Is(err, ErrClosed) {
+			t.Errorf("%s: get after close: %v", name, err)
+		}
+		if err := s.Del("a"); !errors.Is(err, ErrClosed) {
+			t.Errorf("%s: del after close: %v", name, err)
+		}
+	}
+	// background goroutines are gone
+	for i := 0; runtime.NumGoroutine() > before; i++ {
+		if i == 100 {
+			t.Fatalf("%d goroutines left, %d before", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// survivors counts keys prefix0..prefix(n-1) still in s
+func survivors(s IStorage, prefix string, n int) int {
+	kept := 0
+	for i := 0; i < n; i++ {
+		if _, err := s.Get(prefix + strconv.Itoa(i)); err == nil {
+			kept++
+		}
+	}
+	return kept
+}
+
+func TestARC(t *testing.T) {
+	s, _ := NewARCStorage(WithShards(1), WithMaxEntries(100))
+	defer s.Close()
+	for i := 0; i < 50; i++ {
+		s.Set("hot"+strconv.Itoa(i), []byte("1"), 0)
+	}
+	survivors(s, "hot", 50)
+	// a scan passes through T1 and leaves the twice seen T2 alone
+	for i := 0; i < 200; i++ {
+		s.Set("cold"+strconv.Itoa(i), []byte("1"), 0)
+	}
+	if n := survivors(s, "hot", 50); n != 50 {
+		t.Fatalf("%d of 50 hot keys survived a scan", n)
+	}
+	// a key evicted from T1 comes back: recency gets more room
+	shard := s.shards[0]
+	s.Set("cold149", []byte("1"), 0)
+	if shard.p == 0 || shard.items[s.KeyHash("cold149")].Value.(*arcEntry).list != shard.t2 {
+		t.Fatalf("ghost hit left target %d", shard.p)
+	}
+	if st := s.Stats(); st.Len != 100 || st.Evictions != 151 {
+		t.Fatalf("got %+v", st)
+	}
+}
+
+func TestTwoQ(t *testing.T) {
+	s, _ := NewTwoQStorage(WithShards(1), WithMaxEntries(100))
+	defer s.Close()
+	for i := 0; i < 150; i++ {
+		s.Set("k"+strconv.Itoa(i), []byte("1"), 0)
+	}
+	// k0..k49 were pushed out of A1in and are remembered in A1out,
+	// set again they are admitted to Am
+	for i := 0; i < 20; i++ {
+		s.Set("k"+strconv.Itoa(i), []byte("1"), 0)
+	}
+	for i := 0; i < 300; i++ {
+		s.Set("scan"+strconv.Itoa(i), []byte("1"), 0)
+	}
+	if n := survivors(s, "k", 20); n != 20 {
+		t.Fatalf("%d of 20 Am keys survived a scan", n)
+	}
+	if n := survivors(s, "k", 150); n != 20 {
+		t.Fatalf("%d keys seen once survived a scan", n-20)
+	}
+}
+
+func TestWTinyLFU(t *testing.T) {
+	s, _ := NewWTinyLFUStorage(WithShards(1), WithMaxEntries(1000))
+	defer s.Close()
+	for i := 0; i < 500; i++ {
+		s.Set("hot"+strconv.Itoa(i), []byte("1"), 0)
+	}
+	for j := 0; j < 5; j++ {
+		survivors(s, "hot", 500)
+	}
+	// scanned keys leave the window and lose to the more frequent main area
+	for i := 0; i < 10000; i++ {
+		s.Set("scan"+strconv.Itoa(i), []byte("1"), 0)
+	}
+	if n := survivors(s, "hot", 500); n < 450 {
+		t.Fatalf("%d of 500 hot keys survived a scan", n)
+	}
+	if n := s.Len(); n > 1000 {
+		t.Fatalf("%d entries under MaxEntries 1000", n)
+	}
+}
+
+func TestClock(t *testing.T) {
+	s, _ := NewClockStorage(WithShards(1), WithMaxEntries(10))
+	defer s.Close()
+	for i := 0; i < 10; i++ {
+		s.Set("k"+strconv.Itoa(i), []byte("1"), 0)
+	}
+	// referenced entries get a second chance, the hand takes the others
+	survivors(s, "k", 5)
+	for i := 0; i < 5; i++ {
+		s.Set("n"+strconv.Itoa(i), []byte("1"), 0)
+	}
+	if n := survivors(s, "k", 5); n != 5 {
+		t.Fatalf("%d of 5 referenced entries kept", n)
+	}
+	if n := survivors(s, "k", 10); n != 5 {
+		t.Fatalf("%d unreferenced entries kept", n-5)
+	}
+}
+
+func TestFIFO(t *testing.T) {
+	s, _ := NewFIFOStorage(WithShards(1), WithMaxEntries(5))
+	defer s.Close()
+	for i := 0; i < 5; i++ {
+		s.Set("k"+strconv.Itoa(i), []byte("1"), 0)
+	}
+	// reads and overwrites don't move entries in the queue
+	survivors(s, "k", 2)
+	s.Set("k1", []byte("2"), 0)
+	s.Set("n0", []byte("1"), 0)
+	s.Set("n1", []byte("1"), 0)
+	for i, want := range []bool{false, false, true, true, true} {
+		if _, err := s.Get("k" + strconv.Itoa(i)); (err == nil) != want {
+			t.Fatalf("k%d kept %v, want %v", i, err == nil, want)
+		}
+	}
+}
+
+func TestRandom(t *testing.T) {
+	s, _ := NewRandomStorage(WithShards(1), WithMaxEntries(100), WithSeed(1))
+	defer s.Close()
+	for i := 0; i < 100; i++ {
+		s.Set("old"+strconv.Itoa(i), []byte("1"), 0)
+	}
+	for i := 0; i < 100; i++ {
+		s.Set("new"+strconv.Itoa(i), []byte("1"), 0)
+	}
+	// victims are picked at random among residents, about 100*0.99^100 old keys stay
+	old, young := survivors(s, "old", 100), survivors(s, "new", 100)
+	if old < 15 || old > 60 || old+young != 100 {
+		t.Fatalf("%d old and %d new keys kept", old, young)
+	}
+}
+
+func TestSLRU(t *testing.T) {
+	s, _ := NewSLRUStorage(WithShards(1), WithMaxEntries(10))
+	defer s.Close()
+	for i := 0; i < 10; i++ {
+		s.Set("k"+strconv.Itoa(i), []byte("1"), 0)
+	}
+	// hit entries are promoted to the protected segment, a scan churns probation only
+	survivors(s, "k", 5)
+	for i := 0; i < 20; i++ {
+		s.Set("scan"+strconv.Itoa(i), []byte("1"), 0)
+	}
+	if n := survivors(s, "k", 5); n != 5 {
+		t.Fatalf("%d of 5 protected entries kept", n)
+	}
+	if n := survivors(s, "k", 10); n != 5 {
+		t.Fatalf("%d probation entries kept", n-5)
+	}
+}
+
+func TestGDSF(t *testing.T) {
+	s, _ := NewGDSFStorage(WithShards(1), WithMaxBytes(8192))
+	defer s.Close()
+	s.Set("big", make([]byte, 4096), 0)
+	for i := 0; i < 20; i++ {
+		s.Set("small"+strconv.Itoa(i), make([]byte, 100), 0)
+	}
+	// priority is hits/size: the big entry goes before older small ones
+	for i := 0; i < 20; i++ {
+		s.Set("new"+strconv.Itoa(i), make([]byte, 100), 0)
+	}
+	if _, err := s.Get("big"); err == nil {
+		t.Fatal("big entry kept")
+	}
+	if n := survivors(s, "small", 20); n != 20 {
+		t.Fatalf("%d of 20 small entries kept", n)
+	}
+
+	// hits outweigh size
+	s.Clear()
+	evicted := s.Stats().Evictions
+	s.Set("big", make([]byte, 4096), 0)
+	for i := 0; i < 100; i++ {
+		s.Get("big")
+	}
+	for i := 0; i < 40; i++ {
+		s.Set("small"+strconv.Itoa(i), make([]byte, 100), 0)
+	}
+	if _, err := s.Get("big"); err != nil || s.Stats().Evictions == evicted {
+		t.Fatalf("frequently hit big entry: %v, %d evictions", err, s.Stats().Evictions-evicted)
+	}
+}
+
+func TestLIRS(t *testing.T) {
+	s, _ := NewLIRSStorage(WithShards(1), WithMaxEntries(100))
+	defer s.Close()
+	// the first 99 entries warm up the LIR set, a scan churns the single HIR slot
+	for i := 0; i < 99; i++ {
+		s.Set("k"+strconv.Itoa(i), []byte("1"), 0)
+	}
+	for i := 0; i < 1000; i++ {
+		s.Set("scan"+strconv.Itoa(i), []byte("1"), 0)
+	}
+	// a ghost still in the stack comes back with a short reuse distance
+	shard := s.shards[0]
+	ghost := shard.items[s.KeyHash("scan998")]
+	if ghost == nil || ghost.resident || ghost.s == nil {
+		t.Fatalf("scan998 is not a ghost: %+v", ghost)
+	}
+	s.Set("scan998", []byte("1"), 0)
+	if !ghost.lir || !ghost.resident || shard.lirSize > shard.lirCap {
+		t.Fatalf("reused ghost %+v, LIR size %d", ghost, shard.lirSize)
+	}
+	if n := survivors(s, "k", 99); n != 99 {
+		t.Fatalf("%d of 99 warm entries survived a scan", n)
+	}
+	lir := 0
+	for i := 0; i < 99; i++ {
+		if shard.items[s.KeyHash("k"+strconv.Itoa(i))].lir {
+			lir++
+		}
+	}
+	if lir != 98 {
+		t.Fatalf("%d warm entries are LIR, want one demoted", lir)
+	}
+}
+
+func TestS3FIFO(t *testing.T) {
+	s, _ := NewS3FIFOStorage(WithShards(1), WithMaxEntries(100))
+	defer s.Close()
+	for i := 0; i < 10; i++ {
+		s.Set("k"+strconv.Itoa(i), []byte("1"), 0)
+	}
+	survivors(s, "k", 10)
+	survivors(s, "k", 10)
+	// entries hit in S move to M, one-hit scanned entries are dropped from S
+	for i := 0; i < 1000; i++ {
+		s.Set("scan"+strconv.Itoa(i), []byte("1"), 0)
+	}
+	if n := survivors(s, "k", 10); n != 10 {
+		t.Fatalf("%d of 10 hit entries survived a scan", n)
+	}
+	// a key remembered in G goes straight to M
+	shard := s.shards[0]
+	if _, ok := shard.ghosts[s.KeyHash("scan850")]; !ok {
+		t.Fatal("scan850 is not remembered in G")
+	}
+	s.Set("scan850", []byte("1"), 0)
+	if e := shard.items[s.KeyHash("scan850")].Value.(*s3Entry); e.list != shard.main {
+		t.Fatal("ghost key set into S")
+	}
+}
+
+func TestLRFU(t *testing.T) {
+	worth := func(s *LRFUStorage, key string) float64 {
+		shard := s.shards[0]
+		shard.Lock()
+		defer shard.Unlock()
+		e := shard.data[s.KeyHash(key)]
+		shard.fold(e)
+		return e.worth
+	}
+	// "a" is referenced often but long ago, "b" once but last
+	order := func(lambda float64) (float64, float64) {
+		s, _ := NewLRFUStorage(WithShards(1), WithLRFULambda(lambda))
+		defer s.Close()
+		s.Set("a", []byte("1"), 0)
+		for i := 0; i < 3; i++ {
+			s.Get("a")
+		}
+		// Gets are folded into worth later, fold them before "b" comes
+		a := worth(s, "a")
+		s.Set("b", []byte("1"), 0)
+		return a, worth(s, "b")
+	}
+	if a, b := order(0); a != 2 || b != 0 {
+		t.Fatalf("lambda 0: worth %f and %f, want log2 of references", a, b)
+	}
+	if a, b := order(1); a >= b {
+		t.Fatalf("lambda 1: frequent worth %f over recent %f", a, b)
+	}
+	if _, err := NewLRFUStorage(WithLRFULambda(2)); !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("lambda 2 accepted: %v", err)
+	}
+}
+
+func TestExactLRU(t *testing.T) {
+	var evicted []uint64
+	s, _ := NewExactLRUStorage(WithShards(1), WithMaxEntries(3), WithOnEvict(func(key uint64, data []byte, reason EvictReason) {
+		evicted = append(evicted, key)
+	}))
+	defer s.Close()
+	for _, key := range []string{"a", "b", "c"} {
+		s.Set(key, []byte("1"), 0)
+	}
+	s.Get("a")
+	s.Set("b", []byte("2"), 0)
+	// least recently used first, a hit and an overwrite both count as use
+	for _, key := range []string{"d", "e", "f"} {
+		s.Set(key, []byte("1"), 0)
+	}
+	want := []uint64{s.KeyHash("c"), s.KeyHash("a"), s.KeyHash("b")}
+	if len(evicted) != len(want) {
+		t.Fatalf("%d evicted, want %d", len(evicted), len(want))
+	}
+	for i := range want {
+		if evicted[i] != want[i] {
+			t.Fatalf("eviction %d out of recency order", i)
+		}
+	}
+}
+
+func TestExactLFU(t *testing.T) {
+	var evicted []uint64
+	s, _ := NewExactLFUStorage(WithShards(1), WithMaxEntries(3), WithOnEvict(func(key uint64, data []byte, reason EvictReason) {
+		evicted = append(evicted, key)
+	}))
+	defer s.Close()
+	for _, key := range []string{"a", "b", "c"} {
+		s.Set(key, []byte("1"), 0)
+	}
+	s.Get("a")
+	s.Get("a")
+	s.Get("c")
+	s.Get("b")
+	// "d" and "b" have a hit each, "d" is more recent
+	s.Set("d", []byte("1"), 0)
+	s.Get("d")
+	s.Set("e", []byte("1"), 0)
+	s.Set("f", []byte("1"), 0)
+	want := []uint64{s.KeyHash("c"), s.KeyHash("b"), s.KeyHash("e")}
+	if len(evicted) != len(want) {
+		t.Fatalf("%d evicted, want %d", len(evicted), len(want))
+	}
+	for i := range want {
+		if evicted[i] != want[i] {
+			t.Fatalf("eviction %d out of frequency order", i)
+		}
+	}
+}
+
+func TestRing(t *testing.T) {
+	record := ringHeader + 4
+	s, _ := NewRingStorage(WithShards(1), WithMaxBytes(10*record))
+	defer s.Close()
+	for i := 0; i < 10; i++ {
+		s.Set(strconv.Itoa(i), []byte("v00"+strconv.Itoa(i)), 0)
+	}
+	// FIFO over the ring, a hit doesn't save the oldest record
+	s.Get("0")
+	s.Set("10", []byte("v010"), 0)
+	if n := survivors(s, "", 11); n != 10 {
+		t.Fatalf("%d of 11 kept in a ring of 10", n)
+	}
+	if _, err := s.Get("0"); err == nil {
+		t.Fatal("the oldest record survived a wrap")
+	}
+	// an overwrite takes new space, the old record stays until the ring reaches it
+	s.Set("5", []byte("v105"), 0)
+	if _, err := s.Get("1"); err == nil || s.Len() != 9 {
+		t.Fatalf("%d live after an overwrite", s.Len())
+	}
+
+	// values are copied in and out
+	value := []byte("abcd")
+	s.Set("a", value, 0)
+	value[0] = 'x'
+	got, _ := s.Get("a")
+	got[1] = 'x'
+	if got, _ := s.Get("a"); string(got) != "abcd" {
+		t.Fatalf("got %q", got)
+	}
+	if err := s.Set("big", make([]byte, 10*record), 0); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("a record over the ring set: %v", err)
+	}
+}
+
+func TestOffHeap(t *testing.T) {
+	// 4 byte values take the smallest block
+	s, err := NewOffHeapStorage(WithShards(1), WithMaxBytes(16<<offHeapMinShift))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 16; i++ {
+		s.Set(strconv.Itoa(i), []byte("abcd"), 0)
+	}
+	if size := s.GetSize(); size != 16<<offHeapMinShift {
+		t.Fatalf("size %d of 16 blocks", size)
+	}
+	// FIFO by insertion, a hit doesn't save the oldest entry
+	s.Get("0")
+	s.Set("16", []byte("abcd"), 0)
+	if _, err := s.Get("0"); err == nil || survivors(s, "", 17) != 16 {
+		t.Fatal("the oldest entry survived")
+	}
+
+	// values are copied in and out
+	value := []byte("abcd")
+	s.Set("a", value, 0)
+	value[0] = 'x'
+	got, _ := s.Get("a")
+	got[1] = 'x'
+	if got, _ := s.Get("a"); string(got) != "abcd" {
+		t.Fatalf("got %q", got)
+	}
+
+	// freed blocks merge with their buddies back into whole ones
+	s.Del("a")
+	for i := 0; i < 17; i++ {
+		s.Del(strconv.Itoa(i))
+	}
+	arena := s.shards[0].arena
+	for k := 0; k < arena.topOrder; k++ {
+		if len(arena.free[k]) != 0 {
+			t.Fatalf("%d free blocks of order %d left unmerged", len(arena.free[k]), k)
+		}
+	}
+	if s.GetSize() != 0 || len(arena.free[arena.topOrder]) == 0 {
+		t.Fatalf("size %d after deleting all", s.GetSize())
+	}
+	s.Close()
+	if err := s.Set("a", value, 0); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Set after Close: %v", err)
+	}
+}
+
+func TestPolicyEntry(t *testing.T) {
+	s, _ := NewLFUStorage(WithShards(1), WithZeroCopy())
+	defer s.Close()
+	in := []byte("abc")
+	s.Set("a", in, 60)
+	for i := 0; i < 10; i++ {
+		s.Get("a")
+	}
+	s.Age()
+	// worth lives next to the payload, hits and aging leave the value alone
+	out, ttl, _ := s.GetWithTTL("a")
+	if &out[0] != &in[0] || string(out) != "abc" || ttl != 60 {
+		t.Fatalf("value %q, ttl %d after hits", out, ttl)
+	}
+	if size := s.GetSize(); size != 3+entryOverhead {
+		t.Fatalf("size %d of a 3 byte value", size)
+	}
+	s.Set("a", []byte("abcdef"), 0)
+	if size := s.GetSize(); size != 6+entryOverhead {
+		t.Fatalf("size %d after overwrite", size)
+	}
+}
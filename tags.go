@@ -0,0 +1,98 @@
+package probecache
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// tagIndex maps tags to key hashes with entry versions they were tagged at, so
+// InvalidateTag never removes an entry overwritten later without the tag.
+// Keys leave the index with their entries, by the storage removal hook.
+type tagIndex struct {
+	sync.Mutex
+	tags map[string]map[uint64]tagRef
+	keys map[uint64][]string // reverse: tags of a key hash
+	n    int64               // len(keys), hook skips the lock while no key is tagged
+}
+
+// tagRef is a tagged entry, check is the CollisionSafe key check
+type tagRef struct {
+	version uint64
+	check   uint64
+}
+
+func newTagIndex() *tagIndex {
+	return &tagIndex{
+		tags: make(map[string]map[uint64]tagRef),
+		keys: make(map[uint64][]string),
+	}
+}
+
+// Run in the shard lock of key only, so removed can't run in between
+func (t *tagIndex) add(key uint64, check uint64, version uint64, tags []string) {
+	t.Lock()
+	defer t.Unlock()
+	for _, tag := range tags {
+		refs, ok := t.tags[tag]
+		if !ok {
+			refs = make(map[uint64]tagRef)
+			t.tags[tag] = refs
+		}
+		if _, ok := refs[key]; !ok {
+			t.keys[key] = append(t.keys[key], tag)
+		}
+		refs[key] = tagRef{version: version, check: check}
+	}
+	atomic.StoreInt64(&t.n, int64(len(t.keys)))
+}
+
+// removed is the removal hook, an overwritten entry loses its tags too
+func (t *tagIndex) removed(key uint64, reason EvictReason) {
+	if atomic.LoadInt64(&t.n) == 0 {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	for _, tag := range t.keys[key] {
+		if refs := t.tags[tag]; refs != nil {
+			delete(refs, key)
+			if len(refs) == 0 {
+				delete(t.tags, tag)
+			}
+		}
+	}
+	delete(t.keys, key)
+	atomic.StoreInt64(&t.n, int64(len(t.keys)))
+}
+
+// take removes tag from the index and returns its keys
+func (t *tagIndex) take(tag string) map[uint64]tagRef {
+	t.Lock()
+	defer t.Unlock()
+	refs := t.tags[tag]
+	delete(t.tags, tag)
+	for key := range refs {
+		tags := t.keys[key]
+		for i, name := range tags {
+			if name == tag {
+				tags = append(tags[:i], tags[i+1:]...)
+				break
+			}
+		}
+		if len(tags) == 0 {
+			delete(t.keys, key)
+		} else {
+			t.keys[key] = tags
+		}
+	}
+	atomic.StoreInt64(&t.n, int64(len(t.keys)))
+	return refs
+}
+
+func (t *tagIndex) reset() {
+	t.Lock()
+	t.tags = make(map[string]map[uint64]tagRef)
+	t.keys = make(map[uint64][]string)
+	atomic.StoreInt64(&t.n, 0)
+	t.Unlock()
+}
@@ -0,0 +1,74 @@
+package probecache
+
+import (
+	"strconv"
+	"testing"
+)
+
+func tagged(s *PolicyStorage) (int, int) {
+	s.tags.Lock()
+	defer s.tags.Unlock()
+	return len(s.tags.tags), len(s.tags.keys)
+}
+
+func TestTagIndexPrune(t *testing.T) {
+	s, err := NewLRUStorage(WithShards(1), WithMaxEntries(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for i := 0; i < 100; i++ {
+		s.SetTagged(strconv.Itoa(i), []byte("v"), 0, "all", "t"+strconv.Itoa(i))
+	}
+	if tags, keys := tagged(s.PolicyStorage); keys != s.Len() || tags != keys+1 {
+		t.Errorf("%d tags, %d keys indexed for %d entries", tags, keys, s.Len())
+	}
+	s.Set("99", []byte("v"), 0)
+	s.Del("98")
+	if n := s.InvalidateTag("t99") + s.InvalidateTag("t98"); n != 0 {
+		t.Errorf("removed %d overwritten or deleted entries", n)
+	}
+	// all but the overwritten one are tagged
+	l := s.Len()
+	if n := s.InvalidateTag("all"); n != l-1 || s.Len() != 1 {
+		t.Errorf("removed %d of %d tagged, %d left", n, l-1, s.Len())
+	}
+	if tags, keys := tagged(s.PolicyStorage); tags != 0 || keys != 0 {
+		t.Errorf("%d tags, %d keys left indexed", tags, keys)
+	}
+
+	ttl, err := NewTTLStorage(WithExpiryIndex(ExpiryScan))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ttl.Close()
+	ttl.SetTagged("x", []byte("v"), 1, "t")
+	for _, shard := range ttl.shards {
+		shard.Lock()
+		for _, e := range shard.data {
+			e.expire = nowMs() - 1
+		}
+		shard.Unlock()
+	}
+	ttl.DeleteExpired()
+	if tags, keys := tagged(ttl.PolicyStorage); tags != 0 || keys != 0 {
+		t.Errorf("%d tags, %d keys indexed after expiry", tags, keys)
+	}
+}
+
+func TestTagCollisionSafe(t *testing.T) {
+	same := HasherFunc(func(key string) uint64 { return 42 })
+	s, err := NewLRUStorage(WithHasher(same), WithCollisionSafe())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.SetTagged("a", []byte("1"), 0, "t")
+	s.Set("b", []byte("2"), 0)
+	if n := s.InvalidateTag("t"); n != 0 {
+		t.Fatalf("removed %d entries of a colliding key", n)
+	}
+	if v, err := s.Get("b"); err != nil || string(v) != "2" {
+		t.Fatalf("got %q %v", v, err)
+	}
+}
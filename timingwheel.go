@@ -0,0 +1,128 @@
+package probecache
+
+import "time"
+
+const (
+	wheelBits   = 6
+	wheelSlots  = 1 << wheelBits
+	wheelLevels = 4
+)
+
+type wheelLevel [wheelSlots][]expiryRecord
+
+// timingWheel is a hierarchical timing wheel indexing expire times of shard entries,
+// so expired ones are found in O(expired + elapsed ticks) instead of a full map scan.
+// Level l slots span 64^l ticks, entries further than 64^4 ticks wait in overflow.
+// Levels are allocated on first use, so idle shards of storages with many of them
+// stay small. See expiryIndex.
+type timingWheel struct {
+	tick     uint64 // ms
+	delay    uint64 // ms after expire an entry is due, e.g. stale window
+	current  uint64 // next tick to process
+	slots    [wheelLevels]*wheelLevel
+	overflow []expiryRecord
+	count    int
+}
+
+func newTimingWheel(tick time.Duration, delay uint64) *timingWheel {
+	w := &timingWheel{
+		tick:  uint64(tick / time.Millisecond),
+		delay: delay,
+	}
+	if w.tick == 0 {
+		w.tick = 1
+	}
+	w.current = nowMs() / w.tick
+	return w
+}
+
+func (w *timingWheel) add(key uint64, expire uint64) {
+	w.count++
+	w.place(expiryRecord{key, expire})
+}
+
+func (w *timingWheel) place(e expiryRecord) {
+	t := (e.expire + w.delay) / w.tick
+	if t < w.current {
+		t = w.current
+	}
+	// lowest level where t and current share all higher digits
+	for l := 0; l < wheelLevels; l++ {
+		shift := uint(wheelBits * (l + 1))
+		if t>>shift == w.current>>shift {
+			slot := (t >> uint(wheelBits*l)) & (wheelSlots - 1)
+			if w.slots[l] == nil {
+				w.slots[l] = new(wheelLevel)
+			}
+			w.slots[l][slot] = append(w.slots[l][slot], e)
+			return
+		}
+	}
+	w.overflow = append(w.overflow, e)
+}
+
+func (w *timingWheel) advance(now uint64, fn func(key uint64, expire uint64) bool) int {
+	n := 0
+	end := now / w.tick
+	if w.count == 0 && w.current < end {
+		w.current = end
+	}
+	// a tick is processed once it has fully passed
+	for w.current < end {
+		w.cascade()
+		if w.slots[0] != nil {
+			slot := w.current & (wheelSlots - 1)
+			due := w.slots[0][slot]
+			w.slots[0][slot] = nil
+			w.count -= len(due)
+			for _, e := range due {
+				if fn(e.key, e.expire) {
+					n++
+				}
+			}
+		}
+		w.current++
+	}
+	return n
+}
+
+// cascade moves records of higher level slots starting at current tick down
+func (w *timingWheel) cascade() {
+	if w.current&(wheelSlots-1) != 0 {
+		return
+	}
+	top := 1
+	for top < wheelLevels && (w.current>>uint(wheelBits*top))&(wheelSlots-1) == 0 {
+		top++
+	}
+	if top == wheelLevels {
+		overflow := w.overflow
+		w.overflow = nil
+		for _, e := range overflow {
+			w.place(e)
+		}
+		top--
+	}
+	for l := top; l >= 1; l-- {
+		if w.slots[l] == nil {
+			continue
+		}
+		slot := (w.current >> uint(wheelBits*l)) & (wheelSlots - 1)
+		entries := w.slots[l][slot]
+		w.slots[l][slot] = nil
+		for _, e := range entries {
+			w.place(e)
+		}
+	}
+}
+
+func (w *timingWheel) len() int {
+	return w.count
+}
+
+func (w *timingWheel) reset() {
+	w.slots = [wheelLevels]*wheelLevel{}
+	w.overflow = nil
+	w.count = 0
+	w.current = nowMs() / w.tick
+}
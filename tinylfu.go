@@ -0,0 +1,88 @@
+package probecache
+
+// tinyLFU is a TinyLFU admission filter: a doorkeeper bloom filter absorbs first
+// occurrences, repeated keys are counted in a 4-row count-min sketch. Every
+// 10*width events the sketch is halved and the doorkeeper cleared, so old
+// popularity fades. Not thread safe, shards use it in lock.
+type tinyLFU struct {
+	rows    [4][]uint8
+	door    []uint64
+	mask    uint64
+	events  int
+	resetAt int
+}
+
+func newTinyLFU(width int) *tinyLFU {
+	n := 64
+	for n < width {
+		n <<= 1
+	}
+	t := &tinyLFU{
+		mask:    uint64(n - 1),
+		door:    make([]uint64, n/64),
+		resetAt: 10 * n,
+	}
+	for i := range t.rows {
+		t.rows[i] = make([]uint8, n)
+	}
+	return t
+}
+
+func (t *tinyLFU) index(key uint64, i int) uint64 {
+	x := key + uint64(i)
+	return splitmix64(&x) & t.mask
+}
+
+// doorkeeper uses two of the sketch indexes as bloom filter bits
+func (t *tinyLFU) inDoor(key uint64) bool {
+	a, b := t.index(key, 0), t.index(key, 1)
+	return t.door[a/64]&(1<<(a%64)) != 0 && t.door[b/64]&(1<<(b%64)) != 0
+}
+
+func (t *tinyLFU) record(key uint64) {
+	if !t.inDoor(key) {
+		a, b := t.index(key, 0), t.index(key, 1)
+		t.door[a/64] |= 1 << (a % 64)
+		t.door[b/64] |= 1 << (b % 64)
+	} else {
+		for i := range t.rows {
+			if c := &t.rows[i][t.index(key, i)]; *c < 255 {
+				*c++
+			}
+		}
+	}
+	t.events++
+	if t.events >= t.resetAt {
+		t.reset()
+	}
+}
+
+func (t *tinyLFU) estimate(key uint64) int {
+	min := 255
+	for i := range t.rows {
+		if c := int(t.rows[i][t.index(key, i)]); c < min {
+			min = c
+		}
+	}
+	if t.inDoor(key) {
+		min++
+	}
+	return min
+}
+
+func (t *tinyLFU) reset() {
+	for i := range t.rows {
+		for j := range t.rows[i] {
+			t.rows[i][j] >>= 1
+		}
+	}
+	for i := range t.door {
+		t.door[i] = 0
+	}
+	t.events = 0
+}
+
+// admit lets a new key in only if it was seen more often than the victim
+func (t *tinyLFU) admit(key uint64, victim uint64) bool {
+	return t.estimate(key) > t.estimate(victim)
+}
@@ -0,0 +1,231 @@
+package probecache
+
+import (
+	"container/list"
+	"sync"
+)
+
+// 2Q: new keys go to FIFO A1in, keys pushed out of it are remembered in ghost
+// FIFO A1out. Only a key seen again while in A1out is admitted to LRU Am, so
+// one-time scans pass through A1in without touching the hot set. A1in takes
+// 25% of capacity, A1out remembers up to 50% of capacity worth of keys.
+
+type twoQEntry struct {
+	key    uint64
+	data   []byte // nil for ghosts
+	expire uint64
+	cost   int
+	list   *list.List
+}
+
+type TwoQShard struct {
+	sync.Mutex
+	listBase
+	items           map[uint64]*list.Element
+	a1in, a1out, am *list.List
+	inSize, outSize int
+	amSize          int
+}
+
+func NewTwoQShard(capacity int, byBytes bool) *TwoQShard {
+	s := &TwoQShard{}
+	s.init(s, capacity, byBytes)
+	s.reset()
+	return s
+}
+
+func (s *TwoQShard) reset() {
+	s.items = make(map[uint64]*list.Element)
+	s.a1in, s.a1out, s.am = list.New(), list.New(), list.New()
+	s.inSize, s.outSize, s.amSize = 0, 0, 0
+	s.size = 0
+}
+
+func (s *TwoQShard) listSize(l *list.List) *int {
+	switch l {
+	case s.a1in:
+		return &s.inSize
+	case s.a1out:
+		return &s.outSize
+	}
+	return &s.amSize
+}
+
+func (s *TwoQShard) resident(e *twoQEntry) bool {
+	return e.list != s.a1out
+}
+
+// Run in lock only
+func (s *TwoQShard) push(l *list.List, e *twoQEntry) {
+	e.list = l
+	*s.listSize(l) += e.cost
+	if s.resident(e) {
+		s.size += len(e.data) + entryOverhead
+	}
+	s.items[e.key] = l.PushFront(e)
+}
+
+// Run in lock only
+func (s *TwoQShard) unlink(el *list.Element) *twoQEntry {
+	e := el.Value.(*twoQEntry)
+	e.list.Remove(el)
+	*s.listSize(e.list) -= e.cost
+	if s.resident(e) {
+		s.size -= len(e.data) + entryOverhead
+	}
+	delete(s.items, e.key)
+	return e
+}
+
+// Run in lock only. Frees room for an entry of given cost: A1in over its share
+// is moved to A1out, otherwise Am loses its LRU entry
+func (s *TwoQShard) fit(cost int) {
+	for s.a1in.Len()+s.am.Len() > 0 {
+		overSize := s.capacity > 0 && s.inSize+s.amSize+cost > s.capacity
+		overLen := s.maxLen > 0 && s.a1in.Len()+s.am.Len() >= s.maxLen
+		if !overSize && !overLen {
+			return
+		}
+		if s.a1in.Len() > 0 && (s.inSize > s.capacity/4 || s.am.Len() == 0) {
+			e := s.unlink(s.a1in.Back())
+			s.evicted(e.key, e.data, e.expire)
+			e.data = nil
+			s.push(s.a1out, e)
+			for s.a1out.Len() > 0 && s.outSize > s.capacity/2 {
+				s.unlink(s.a1out.Back())
+			}
+			continue
+		}
+		e := s.unlink(s.am.Back())
+		s.evicted(e.key, e.data, e.expire)
+	}
+}
+
+func (s *TwoQShard) Set(key uint64, data []byte, ttl uint64) {
+	if s.copyOnSet {
+		data = append([]byte(nil), data...)
+	}
+	s.Lock()
+	defer s.Unlock()
+	e := &twoQEntry{key: key, data: data, expire: expireAt(ttl), cost: s.cost(data)}
+	to := s.a1in
+	if el, ok := s.items[key]; ok {
+		old := s.unlink(el)
+		if s.resident(old) {
+			s.removed(key, old.data, EvictReplaced)
+		}
+		switch old.list {
+		case s.a1out, s.am:
+			to = s.am
+		}
+	}
+	s.fit(e.cost)
+	s.push(to, e)
+	s.written(key, len(data))
+}
+
+func (s *TwoQShard) put(key uint64, data []byte, ttl uint64) error {
+	if s.tooLarge(data) {
+		return ErrTooLarge
+	}
+	s.Set(key, data, ttl)
+	return nil
+}
+
+func (s *TwoQShard) get(key uint64) ([]byte, uint64, error) {
+	s.Lock()
+	defer s.Unlock()
+	el, ok := s.items[key]
+	if !ok || !s.resident(el.Value.(*twoQEntry)) {
+		s.miss()
+		return nil, 0, ErrMissing
+	}
+	e := el.Value.(*twoQEntry)
+	if s.isExpired(e.expire) {
+		if !s.keepExpired {
+			s.expire(key)
+		}
+		s.miss()
+		return nil, 0, ErrExpired
+	}
+	// A1in is FIFO, hits there don't count
+	if e.list == s.am {
+		s.am.MoveToFront(el)
+	}
+	s.hit()
+	return e.data, ttlLeft(e.expire), nil
+}
+
+func (s *TwoQShard) Get(key uint64) ([]byte, error) {
+	d, _, err := s.get(key)
+	return d, err
+}
+
+func (s *TwoQShard) GetWithTTL(key uint64) ([]byte, uint64, error) {
+	return s.get(key)
+}
+
+// Del removes resident entry or ghost, reports whether a live entry was removed
+func (s *TwoQShard) Del(key uint64) bool {
+	s.Lock()
+	defer s.Unlock()
+	el, ok := s.items[key]
+	if !ok {
+		return false
+	}
+	e := s.unlink(el)
+	if !s.resident(e) {
+		return false
+	}
+	s.removed(key, e.data, EvictDeleted)
+	return !s.isExpired(e.expire)
+}
+
+func (s *TwoQShard) Clear() {
+	s.Lock()
+	defer s.Unlock()
+	s.reset()
+}
+
+// each skips ghosts
+func (s *TwoQShard) each(fn func(key uint64, expire uint64, data []byte)) {
+	for _, el := range s.items {
+		if e := el.Value.(*twoQEntry); s.resident(e) {
+			fn(e.key, e.expire, e.data)
+		}
+	}
+}
+
+// Run in lock only
+func (s *TwoQShard) expire(key uint64) {
+	e := s.unlink(s.items[key])
+	s.expired(e.key, e.data)
+}
+
+func (s *TwoQShard) count() int {
+	return s.a1in.Len() + s.am.Len()
+}
+
+// ----------------------------------------------
+
+// TwoQStorage supports the IStorage subset of Config: NumShards, MaxMemSize,
+// MaxEntries, MaxEntrySize, DefaultTTL, CopyOnGet/CopyOnSet, OnEvict, OnExpire, OnRemove, EventBuffer,
+// ExpirationMode, CleanPeriod
+type TwoQStorage struct {
+	listStorage[*TwoQShard]
+}
+
+func NewTwoQStorage(opts ...Option) (*TwoQStorage, error) {
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	capacity, byBytes, _ := listLimits(cfg)
+	shards := make([]*TwoQShard, cfg.NumShards)
+	for i := range shards {
+		shards[i] = NewTwoQShard(capacity, byBytes)
+	}
+	s := &TwoQStorage{}
+	s.init(cfg, newKeyHasher(cfg.KeyHash, cfg.Hasher), shards)
+	return s, nil
+}
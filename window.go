@@ -0,0 +1,174 @@
+package probecache
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const windowMinutes = 16 // 15 full minutes + current one
+
+type WindowStats struct {
+	Window       time.Duration
+	Hits         uint64
+	Misses       uint64
+	Evictions    uint64
+	BytesWritten uint64
+}
+
+func (w WindowStats) HitRate() float64 {
+	if w.Hits+w.Misses == 0 {
+		return 0
+	}
+	return float64(w.Hits) / float64(w.Hits+w.Misses)
+}
+
+// EvictionRate returns evictions per second
+func (w WindowStats) EvictionRate() float64 {
+	if w.Window <= 0 {
+		return 0
+	}
+	return float64(w.Evictions) / w.Window.Seconds()
+}
+
+type windowBucket struct {
+	minute       int64
+	hits         uint64
+	misses       uint64
+	evictions    uint64
+	bytesWritten uint64
+}
+
+// rollingStats keeps per-minute counters in a ring. Buckets are reset lazily by
+// the first writer of a new minute, so counts near the minute boundary are approximate.
+// It also counts storage lifetime Sets and Deletes and keeps the ResetStats baseline
+type rollingStats struct {
+	buckets [windowMinutes]windowBucket
+	sets    uint64
+	deletes uint64
+
+	baseMu sync.Mutex
+	base   Stats // subtracted by since, so counters start over on ResetStats
+}
+
+func (r *rollingStats) bucket() *windowBucket {
+	minute := time.Now().Unix() / 60
+	b := &r.buckets[minute%windowMinutes]
+	old := atomic.LoadInt64(&b.minute)
+	if old != minute && atomic.CompareAndSwapInt64(&b.minute, old, minute) {
+		atomic.StoreUint64(&b.hits, 0)
+		atomic.StoreUint64(&b.misses, 0)
+		atomic.StoreUint64(&b.evictions, 0)
+		atomic.StoreUint64(&b.bytesWritten, 0)
+	}
+	return b
+}
+
+func (r *rollingStats) hit() {
+	if r == nil {
+		return
+	}
+	atomic.AddUint64(&r.bucket().hits, 1)
+}
+
+func (r *rollingStats) miss() {
+	if r == nil {
+		return
+	}
+	atomic.AddUint64(&r.bucket().misses, 1)
+}
+
+func (r *rollingStats) evict(n int) {
+	if r == nil || n <= 0 {
+		return
+	}
+	atomic.AddUint64(&r.bucket().evictions, uint64(n))
+}
+
+// written counts a Set of n bytes
+func (r *rollingStats) written(n int) {
+	if r == nil {
+		return
+	}
+	atomic.AddUint64(&r.sets, 1)
+	atomic.AddUint64(&r.bucket().bytesWritten, uint64(n))
+}
+
+func (r *rollingStats) deleted() {
+	if r == nil {
+		return
+	}
+	atomic.AddUint64(&r.deletes, 1)
+}
+
+// since fills Sets and Deletes of shard stats st and subtracts counters
+// at the last reset. Size and Len are not counters and kept as they are
+func (r *rollingStats) since(st Stats) Stats {
+	if r == nil {
+		return st
+	}
+	st.Sets = atomic.LoadUint64(&r.sets)
+	st.Deletes = atomic.LoadUint64(&r.deletes)
+	r.baseMu.Lock()
+	defer r.baseMu.Unlock()
+	st.sub(r.base)
+	return st
+}
+
+// reset moves the baseline by st, counters reported by since at the moment
+func (r *rollingStats) reset(st Stats) {
+	if r == nil {
+		return
+	}
+	r.baseMu.Lock()
+	defer r.baseMu.Unlock()
+	shards := r.base.Shards
+	r.base.addCounters(st)
+	// Reshard changes the shard list, old baselines don't apply
+	if len(shards) != len(st.Shards) {
+		shards = make([]ShardStats, len(st.Shards))
+	}
+	for i := range shards {
+		shards[i].addCounters(st.Shards[i])
+	}
+	r.base.Shards = shards
+}
+
+func (r *rollingStats) record(err error) {
+	if err != nil && err != ErrNegativeCached {
+		r.miss()
+	} else {
+		r.hit()
+	}
+}
+
+// get sums last window (rounded up to minutes, max 15) including current minute
+func (r *rollingStats) get(window time.Duration) WindowStats {
+	minutes := int64((window + time.Minute - 1) / time.Minute)
+	if minutes < 1 {
+		minutes = 1
+	}
+	if minutes > windowMinutes-1 {
+		minutes = windowMinutes - 1
+	}
+	now := time.Now()
+	current := now.Unix() / 60
+	out := WindowStats{
+		// the current minute is incomplete
+		Window: time.Duration(minutes-1)*time.Minute + time.Duration(now.Unix()%60)*time.Second,
+	}
+	if out.Window <= 0 {
+		out.Window = time.Second
+	}
+	for m := current - minutes + 1; m <= current; m++ {
+		b := &r.buckets[m%windowMinutes]
+		if atomic.LoadInt64(&b.minute) != m {
+			continue
+		}
+		out.Hits += atomic.LoadUint64(&b.hits)
+		out.Misses += atomic.LoadUint64(&b.misses)
+		out.Evictions += atomic.LoadUint64(&b.evictions)
+		out.BytesWritten += atomic.LoadUint64(&b.bytesWritten)
+	}
+	return out
+}
@@ -0,0 +1,182 @@
+package probecache
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// goroutines of background tasks in the process by default, see SetMaxWorkers
+const defaultMaxWorkers = 64
+
+// priority orders queued background tasks, higher first, FIFO within one
+type priority int
+
+const (
+	// refreshes, snapshots
+	priorityLow priority = iota
+	// janitor and cleaners, aging, log sync and compaction, ClearAsync
+	priorityNormal
+	// eviction down to the low watermark, access buffer drain: memory and hit rate wait for them
+	priorityHigh
+	priorities
+)
+
+// workerPool runs background tasks on at most max goroutines (0 means no limit), tasks over
+// it are queued. Goroutines exit once the queue is empty. A pool with a parent spawns none
+// itself: it passes at most max tasks at a time on to the parent, so the storage pools of
+// Config.MaxWorkers share the process pool of SetMaxWorkers.
+type workerPool struct {
+	parent *workerPool
+
+	mu      sync.Mutex
+	max     int
+	running int
+	queue   [priorities][]func()
+
+	// storage pools only: ctx of tasks is cancelled by close, which waits for them
+	ctx    context.Context
+	cancel context.CancelFunc
+	tasks  sync.WaitGroup
+	closed bool
+}
+
+var processWorkers = &workerPool{max: defaultMaxWorkers}
+
+// withTimeout is context.WithTimeout, d 0 means no timeout
+func withTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+// SetMaxWorkers sets the goroutine budget of background work of all storages in the process:
+// janitors and cleaners, aging, async eviction, access buffer drains, refreshes, log compaction
+// and auto snapshots. Tasks over it wait in a queue, eviction first. 0 removes the limit.
+// Config.MaxWorkers limits a single storage on top of it
+func SetMaxWorkers(n int) error {
+	if n < 0 {
+		return fmt.Errorf("%w: negative MaxWorkers", ErrInvalidConfig)
+	}
+	processWorkers.mu.Lock()
+	processWorkers.max = n
+	processWorkers.mu.Unlock()
+	// a raised limit starts queued tasks right away
+	processWorkers.spawn()
+	return nil
+}
+
+// newWorkerPool is a storage pool of up to max tasks at a time in the process pool
+func newWorkerPool(max int) *workerPool {
+	p := &workerPool{parent: processWorkers, max: max}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	return p
+}
+
+// submit queues fn, reports false if the pool is closed. fn gets a context
+// cancelled by close and should return soon once it is
+func (p *workerPool) submit(prio priority, fn func(ctx context.Context)) bool {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return false
+	}
+	p.tasks.Add(1)
+	p.queue[prio] = append(p.queue[prio], func() {
+		defer p.tasks.Done()
+		fn(p.ctx)
+	})
+	p.mu.Unlock()
+	p.spawn()
+	return true
+}
+
+// spawn starts queued tasks while under max
+func (p *workerPool) spawn() {
+	for {
+		p.mu.Lock()
+		if p.max > 0 && p.running >= p.max {
+			p.mu.Unlock()
+			return
+		}
+		prio, task := p.next()
+		if task == nil {
+			p.mu.Unlock()
+			return
+		}
+		p.running++
+		p.mu.Unlock()
+		if p.parent == nil {
+			go p.work(task)
+		} else {
+			p.parent.enqueue(prio, func() {
+				task()
+				p.done()
+			})
+		}
+	}
+}
+
+// enqueue adds a task of a child pool
+func (p *workerPool) enqueue(prio priority, task func()) {
+	p.mu.Lock()
+	p.queue[prio] = append(p.queue[prio], task)
+	p.mu.Unlock()
+	p.spawn()
+}
+
+// Run in mu only. Takes the first task of the highest priority
+func (p *workerPool) next() (priority, func()) {
+	for prio := priorities - 1; prio >= 0; prio-- {
+		if q := p.queue[prio]; len(q) > 0 {
+			task := q[0]
+			q[0] = nil
+			p.queue[prio] = q[1:]
+			return prio, task
+		}
+	}
+	return 0, nil
+}
+
+// work runs task and queued ones after it until the queue is empty or over a lowered max
+func (p *workerPool) work(task func()) {
+	for task != nil {
+		task()
+		p.mu.Lock()
+		task = nil
+		if p.max == 0 || p.running <= p.max {
+			_, task = p.next()
+		}
+		if task == nil {
+			p.running--
+		}
+		p.mu.Unlock()
+	}
+}
+
+// done frees a slot of a child pool taken by spawn
+func (p *workerPool) done() {
+	p.mu.Lock()
+	p.running--
+	p.mu.Unlock()
+	p.spawn()
+}
+
+// close cancels the context of tasks and waits for them, tasks still queued run in place,
+// so they release their waiters. Later submits are refused
+func (p *workerPool) close() {
+	p.mu.Lock()
+	p.closed = true
+	queue := p.queue
+	p.queue = [priorities][]func(){}
+	p.mu.Unlock()
+	p.cancel()
+	for prio := priorities - 1; prio >= 0; prio-- {
+		for _, task := range queue[prio] {
+			task()
+		}
+	}
+	p.tasks.Wait()
+}
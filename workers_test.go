@@ -0,0 +1,111 @@
+package probecache
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWorkerPoolLimit(t *testing.T) {
+	p := newWorkerPool(3)
+	var running, peak int32
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		p.submit(priorityNormal, func(context.Context) {
+			defer wg.Done()
+			n := atomic.AddInt32(&running, 1)
+			for {
+				old := atomic.LoadInt32(&peak)
+				if n <= old || atomic.CompareAndSwapInt32(&peak, old, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			atomic.AddInt32(&running, -1)
+		})
+	}
+	wg.Wait()
+	p.close()
+	if peak > 3 {
+		t.Fatalf("%d tasks at once over MaxWorkers 3", peak)
+	}
+}
+
+func TestWorkerPoolPriority(t *testing.T) {
+	p := newWorkerPool(1)
+	defer p.close()
+	block := make(chan struct{})
+	p.submit(priorityNormal, func(context.Context) { <-block })
+	var mu sync.Mutex
+	var order []priority
+	var wg sync.WaitGroup
+	for _, prio := range []priority{priorityLow, priorityNormal, priorityHigh, priorityLow, priorityHigh} {
+		prio := prio
+		wg.Add(1)
+		p.submit(prio, func(context.Context) {
+			mu.Lock()
+			order = append(order, prio)
+			mu.Unlock()
+			wg.Done()
+		})
+	}
+	close(block)
+	wg.Wait()
+	want := []priority{priorityHigh, priorityHigh, priorityNormal, priorityLow, priorityLow}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("tasks ran in order %v, want %v", order, want)
+		}
+	}
+}
+
+func TestWorkerPoolClose(t *testing.T) {
+	p := newWorkerPool(1)
+	started := make(chan struct{})
+	var cancelled, queued int32
+	p.submit(priorityNormal, func(ctx context.Context) {
+		close(started)
+		<-ctx.Done()
+		atomic.StoreInt32(&cancelled, 1)
+	})
+	<-started
+	p.submit(priorityLow, func(ctx context.Context) {
+		if ctx.Err() != nil {
+			atomic.StoreInt32(&queued, 1)
+		}
+	})
+	p.close()
+	if atomic.LoadInt32(&cancelled) != 1 || atomic.LoadInt32(&queued) != 1 {
+		t.Fatalf("close returned before tasks saw the cancel: running %d, queued %d", cancelled, queued)
+	}
+	if p.submit(priorityHigh, func(context.Context) {}) {
+		t.Fatal("submit to a closed pool")
+	}
+}
+
+func TestMaxWorkers(t *testing.T) {
+	if _, err := NewLRUStorage(WithMaxWorkers(-1)); err == nil {
+		t.Fatal("negative MaxWorkers accepted")
+	}
+	if err := SetMaxWorkers(-1); err == nil {
+		t.Fatal("negative process budget accepted")
+	}
+	s, err := NewLRUStorage(WithMaxWorkers(1), WithJanitor(time.Millisecond), WithAgingPeriod(time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Set("a", []byte("1"), 0)
+	<-s.ClearAsync()
+	if _, err := s.Get("a"); err == nil {
+		t.Fatal("ClearAsync left the entry")
+	}
+	s.Close()
+	select {
+	case <-s.ClearAsync():
+	case <-time.After(time.Second):
+		t.Fatal("ClearAsync of a closed storage never done")
+	}
+}
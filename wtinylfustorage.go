@@ -0,0 +1,270 @@
+package probecache
+
+import (
+	"container/list"
+	"sync"
+)
+
+// W-TinyLFU: new entries land in a small LRU window (1% of capacity). Entries
+// pushed out of the window compete with the eviction victim of the main SLRU
+// area (probation + protected, 80% of main): the one seen more often according
+// to the TinyLFU sketch stays. Hits in probation promote to protected.
+
+type wtEntry struct {
+	key    uint64
+	data   []byte
+	expire uint64
+	cost   int
+	list   *list.List
+}
+
+type WTinyLFUShard struct {
+	sync.Mutex
+	listBase
+	items                        map[uint64]*list.Element
+	window, probation, protected *list.List
+	winSize, probSize, protSize  int
+	sketch                       *tinyLFU
+	winCap, protCap              int
+}
+
+func NewWTinyLFUShard(capacity int, byBytes bool, sketchWidth int) *WTinyLFUShard {
+	s := &WTinyLFUShard{
+		sketch: newTinyLFU(sketchWidth),
+	}
+	s.init(s, capacity, byBytes)
+	if capacity > 0 {
+		s.winCap = maxInt(capacity/100, 1)
+		s.protCap = (capacity - s.winCap) * 8 / 10
+	}
+	s.reset()
+	return s
+}
+
+func (s *WTinyLFUShard) reset() {
+	s.items = make(map[uint64]*list.Element)
+	s.window, s.probation, s.protected = list.New(), list.New(), list.New()
+	s.winSize, s.probSize, s.protSize = 0, 0, 0
+	s.size = 0
+}
+
+func (s *WTinyLFUShard) listSize(l *list.List) *int {
+	switch l {
+	case s.window:
+		return &s.winSize
+	case s.probation:
+		return &s.probSize
+	}
+	return &s.protSize
+}
+
+// Run in lock only
+func (s *WTinyLFUShard) push(l *list.List, e *wtEntry) {
+	e.list = l
+	*s.listSize(l) += e.cost
+	s.size += len(e.data) + entryOverhead
+	s.items[e.key] = l.PushFront(e)
+}
+
+// Run in lock only
+func (s *WTinyLFUShard) unlink(el *list.Element) *wtEntry {
+	e := el.Value.(*wtEntry)
+	e.list.Remove(el)
+	*s.listSize(e.list) -= e.cost
+	s.size -= len(e.data) + entryOverhead
+	delete(s.items, e.key)
+	return e
+}
+
+// overLimit reports whether one more entry of given cost doesn't fit
+func (s *WTinyLFUShard) overLimit(cost int) bool {
+	if s.capacity > 0 && s.winSize+s.probSize+s.protSize+cost > s.capacity {
+		return true
+	}
+	return s.maxLen > 0 && len(s.items)+1 > s.maxLen
+}
+
+// Run in lock only. victim is the main area entry to go first
+func (s *WTinyLFUShard) victim() *list.Element {
+	if el := s.probation.Back(); el != nil {
+		return el
+	}
+	return s.protected.Back()
+}
+
+// Run in lock only. Moves window overflow to main area through admission
+func (s *WTinyLFUShard) drainWindow() {
+	for s.capacity > 0 && s.winSize > s.winCap && s.window.Len() > 0 {
+		cand := s.unlink(s.window.Back())
+		admitted := true
+		for s.overLimit(cand.cost) {
+			v := s.victim()
+			if v == nil || !s.sketch.admit(cand.key, v.Value.(*wtEntry).key) {
+				admitted = false
+				break
+			}
+			e := s.unlink(v)
+			s.evicted(e.key, e.data, e.expire)
+		}
+		if admitted {
+			s.push(s.probation, cand)
+		} else {
+			s.evicted(cand.key, cand.data, cand.expire)
+		}
+	}
+}
+
+// Run in lock only. Enforces limits without admission, e.g. after maxLen hit
+// or an entry grown in place
+func (s *WTinyLFUShard) trim() {
+	for len(s.items) > 0 && (s.capacity > 0 && s.winSize+s.probSize+s.protSize > s.capacity ||
+		s.maxLen > 0 && len(s.items) > s.maxLen) {
+		el := s.victim()
+		if el == nil {
+			el = s.window.Back()
+		}
+		e := s.unlink(el)
+		s.evicted(e.key, e.data, e.expire)
+	}
+}
+
+// Run in lock only
+func (s *WTinyLFUShard) promote(el *list.Element) {
+	e := s.unlink(el)
+	s.push(s.protected, e)
+	for s.protSize > s.protCap && s.protected.Len() > 1 {
+		s.push(s.probation, s.unlink(s.protected.Back()))
+	}
+}
+
+func (s *WTinyLFUShard) Set(key uint64, data []byte, ttl uint64) {
+	if s.copyOnSet {
+		data = append([]byte(nil), data...)
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.sketch.record(key)
+	e := &wtEntry{key: key, data: data, expire: expireAt(ttl), cost: s.cost(data)}
+	to := s.window
+	if el, ok := s.items[key]; ok {
+		old := s.unlink(el)
+		s.removed(key, old.data, EvictReplaced)
+		to = old.list
+	}
+	s.push(to, e)
+	s.written(key, len(data))
+	s.drainWindow()
+	s.trim()
+}
+
+func (s *WTinyLFUShard) put(key uint64, data []byte, ttl uint64) error {
+	if s.tooLarge(data) {
+		return ErrTooLarge
+	}
+	s.Set(key, data, ttl)
+	return nil
+}
+
+func (s *WTinyLFUShard) get(key uint64) ([]byte, uint64, error) {
+	s.Lock()
+	defer s.Unlock()
+	s.sketch.record(key)
+	el, ok := s.items[key]
+	if !ok {
+		s.miss()
+		return nil, 0, ErrMissing
+	}
+	e := el.Value.(*wtEntry)
+	if s.isExpired(e.expire) {
+		if !s.keepExpired {
+			s.expire(key)
+		}
+		s.miss()
+		return nil, 0, ErrExpired
+	}
+	if e.list == s.probation {
+		s.promote(el)
+	} else {
+		e.list.MoveToFront(el)
+	}
+	s.hit()
+	return e.data, ttlLeft(e.expire), nil
+}
+
+func (s *WTinyLFUShard) Get(key uint64) ([]byte, error) {
+	d, _, err := s.get(key)
+	return d, err
+}
+
+func (s *WTinyLFUShard) GetWithTTL(key uint64) ([]byte, uint64, error) {
+	return s.get(key)
+}
+
+// Del removes entry, reports whether a live entry was removed
+func (s *WTinyLFUShard) Del(key uint64) bool {
+	s.Lock()
+	defer s.Unlock()
+	el, ok := s.items[key]
+	if !ok {
+		return false
+	}
+	e := s.unlink(el)
+	s.removed(key, e.data, EvictDeleted)
+	return !s.isExpired(e.expire)
+}
+
+func (s *WTinyLFUShard) Clear() {
+	s.Lock()
+	defer s.Unlock()
+	s.reset()
+}
+
+func (s *WTinyLFUShard) each(fn func(key uint64, expire uint64, data []byte)) {
+	for _, el := range s.items {
+		e := el.Value.(*wtEntry)
+		fn(e.key, e.expire, e.data)
+	}
+}
+
+// Run in lock only
+func (s *WTinyLFUShard) expire(key uint64) {
+	e := s.unlink(s.items[key])
+	s.expired(e.key, e.data)
+}
+
+func (s *WTinyLFUShard) count() int {
+	return len(s.items)
+}
+
+// ----------------------------------------------
+
+// WTinyLFUStorage supports the IStorage subset of Config: NumShards, MaxMemSize,
+// MaxEntries, MaxEntrySize, DefaultTTL, CopyOnGet/CopyOnSet, OnEvict, OnExpire, OnRemove, EventBuffer,
+// ExpirationMode, CleanPeriod.
+// TinyLFUWidth sets sketch width per shard, by default it follows shard capacity
+type WTinyLFUStorage struct {
+	listStorage[*WTinyLFUShard]
+}
+
+func NewWTinyLFUStorage(opts ...Option) (*WTinyLFUStorage, error) {
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	capacity, byBytes, maxLen := listLimits(cfg)
+	// sketch should count about as many keys as shard holds
+	sketchWidth := cfg.TinyLFUWidth
+	if sketchWidth == 0 {
+		sketchWidth = capacity
+		if byBytes {
+			sketchWidth = maxInt(maxLen, capacity/256)
+		}
+	}
+	shards := make([]*WTinyLFUShard, cfg.NumShards)
+	for i := range shards {
+		shards[i] = NewWTinyLFUShard(capacity, byBytes, sketchWidth)
+	}
+	s := &WTinyLFUStorage{}
+	s.init(cfg, newKeyHasher(cfg.KeyHash, cfg.Hasher), shards)
+	return s, nil
+}